@@ -1,3 +1,4 @@
+// Package clone clones a repo into the work dir, for the plan step to copy and change.
 package clone
 
 import (
@@ -11,8 +12,11 @@ type Input struct {
 	// WorkDir is where results will be stored:
 	//   - {WorkDir}/cloned: stores the result of `git clone`
 	WorkDir string
-	// GitURL to clone.
+	// GitURL to clone. If the repo is already cloned, its origin is pointed at it.
 	GitURL string
+	// RecurseSubmodules initializes and updates submodules after cloning.
+	// Repos without a .gitmodules file are left alone.
+	RecurseSubmodules bool
 }
 
 type Output struct {
@@ -28,7 +32,15 @@ type Error struct {
 func Clone(ctx context.Context, input Input) (Output, error) {
 	cloneIntoDir := path.Join(input.WorkDir, "cloned")
 	if _, err := os.Stat(cloneIntoDir); err == nil {
-		// already cloned
+		// already cloned, but the URL may have changed, e.g. with --clone-url-template
+		cmd := exec.CommandContext(ctx, "git", "remote", "set-url", "origin", input.GitURL)
+		cmd.Dir = cloneIntoDir
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return Output{Success: false}, Error{error: err, Details: string(output)}
+		}
+		if err := updateSubmodules(ctx, input, cloneIntoDir); err != nil {
+			return Output{Success: false}, err
+		}
 		return Output{Success: true, ClonedIntoDir: cloneIntoDir}, nil
 	}
 
@@ -37,5 +49,26 @@ func Clone(ctx context.Context, input Input) (Output, error) {
 	if output, err := cmd.CombinedOutput(); err != nil {
 		return Output{Success: false}, Error{error: err, Details: string(output)}
 	}
+	if err := updateSubmodules(ctx, input, cloneIntoDir); err != nil {
+		return Output{Success: false}, err
+	}
 	return Output{Success: true, ClonedIntoDir: cloneIntoDir}, nil
 }
+
+// updateSubmodules runs `git submodule update --init --recursive`, if requested
+// and if the repo has any submodules
+func updateSubmodules(ctx context.Context, input Input, repoDir string) error {
+	if !input.RecurseSubmodules {
+		return nil
+	}
+	if _, err := os.Stat(path.Join(repoDir, ".gitmodules")); os.IsNotExist(err) {
+		return nil
+	}
+
+	cmd := exec.CommandContext(ctx, "git", "submodule", "update", "--init", "--recursive")
+	cmd.Dir = repoDir
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return Error{error: err, Details: string(output)}
+	}
+	return nil
+}
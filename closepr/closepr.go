@@ -0,0 +1,160 @@
+// Package closepr closes the PRs of an abandoned change, optionally explaining why in a comment.
+package closepr
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Clever/microplane/lib"
+	"github.com/google/go-github/v35/github"
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+// Input to Close()
+type Input struct {
+	// Repo is the git Repo
+	Repo lib.Repo
+	// PRNumber of the PR opened by push. It's the IID for Gitlab.
+	PRNumber int
+	// Comment is posted on the PR before it's closed, unless the PR already has it. Empty means
+	// no comment.
+	Comment string
+}
+
+// Output from Close()
+type Output struct {
+	Success bool
+	// Closed is set if the PR was open, and so was closed
+	Closed bool
+	// NotOpen is set if the PR was already merged or closed, so was left alone
+	NotOpen bool
+}
+
+// Close comments on and closes a PR, if it's open.
+// A nil limiter means no rate limiting.
+func Close(ctx context.Context, input Input, repoLimiter *time.Ticker) (Output, error) {
+	switch {
+	case input.Repo.IsGithub():
+		return GithubClose(ctx, input, repoLimiter)
+	case input.Repo.IsGitlab():
+		return GitlabClose(ctx, input, repoLimiter)
+	}
+	return Output{}, fmt.Errorf("unsupported provider: %s", input.Repo.ProviderConfig.Backend)
+}
+
+// GithubClose comments on and closes a PR in Github
+func GithubClose(ctx context.Context, input Input, repoLimiter *time.Ticker) (Output, error) {
+	p := lib.NewProviderFromConfig(input.Repo.ProviderConfig)
+	client, err := p.GithubClient(ctx)
+	if err != nil {
+		return Output{}, err
+	}
+
+	lib.Wait(repoLimiter)
+	pr, _, err := client.PullRequests.Get(ctx, input.Repo.Owner, input.Repo.Name, input.PRNumber)
+	if err != nil {
+		return Output{Success: false}, err
+	}
+	if pr.GetState() != "open" {
+		return Output{Success: true, NotOpen: true}, nil
+	}
+
+	if input.Comment != "" {
+		if err := githubComment(ctx, client, input, repoLimiter); err != nil {
+			return Output{Success: false}, fmt.Errorf("failed to comment on PR: %w", err)
+		}
+	}
+
+	lib.Wait(repoLimiter)
+	if _, _, err := client.PullRequests.Edit(ctx, input.Repo.Owner, input.Repo.Name, input.PRNumber, &github.PullRequest{State: github.String("closed")}); err != nil {
+		return Output{Success: false}, fmt.Errorf("failed to close PR: %w", err)
+	}
+	return Output{Success: true, Closed: true}, nil
+}
+
+// githubComment posts the Comment on a PR, unless it already has the same comment, e.g. because
+// a previous run commented but failed to close the PR
+func githubComment(ctx context.Context, client *github.Client, input Input, repoLimiter *time.Ticker) error {
+	comment := strings.TrimSpace(input.Comment)
+	opts := &github.IssueListCommentsOptions{ListOptions: github.ListOptions{PerPage: 100}}
+	for {
+		lib.Wait(repoLimiter)
+		comments, resp, err := client.Issues.ListComments(ctx, input.Repo.Owner, input.Repo.Name, input.PRNumber, opts)
+		if err != nil {
+			return err
+		}
+		for _, c := range comments {
+			if strings.TrimSpace(c.GetBody()) == comment {
+				return nil
+			}
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+
+	lib.Wait(repoLimiter)
+	_, _, err := client.Issues.CreateComment(ctx, input.Repo.Owner, input.Repo.Name, input.PRNumber, &github.IssueComment{Body: &comment})
+	return err
+}
+
+// GitlabClose comments on and closes an MR in Gitlab
+func GitlabClose(ctx context.Context, input Input, repoLimiter *time.Ticker) (Output, error) {
+	p := lib.NewProviderFromConfig(input.Repo.ProviderConfig)
+	client, err := p.GitlabClient()
+	if err != nil {
+		return Output{}, err
+	}
+	ctxFunc := gitlab.WithContext(ctx)
+	pid := fmt.Sprintf("%s/%s", input.Repo.Owner, input.Repo.Name)
+
+	lib.Wait(repoLimiter)
+	mr, _, err := client.MergeRequests.GetMergeRequest(pid, input.PRNumber, &gitlab.GetMergeRequestsOptions{}, ctxFunc)
+	if err != nil {
+		return Output{Success: false}, err
+	}
+	if mr.State != "opened" {
+		return Output{Success: true, NotOpen: true}, nil
+	}
+
+	if input.Comment != "" {
+		if err := gitlabComment(client, pid, input, ctxFunc, repoLimiter); err != nil {
+			return Output{Success: false}, fmt.Errorf("failed to comment on MR: %w", err)
+		}
+	}
+
+	lib.Wait(repoLimiter)
+	if _, _, err := client.MergeRequests.UpdateMergeRequest(pid, input.PRNumber, &gitlab.UpdateMergeRequestOptions{StateEvent: gitlab.String("close")}, ctxFunc); err != nil {
+		return Output{Success: false}, fmt.Errorf("failed to close MR: %w", err)
+	}
+	return Output{Success: true, Closed: true}, nil
+}
+
+// gitlabComment posts the Comment on an MR, unless it already has the same comment
+func gitlabComment(client *gitlab.Client, pid string, input Input, ctxFunc gitlab.RequestOptionFunc, repoLimiter *time.Ticker) error {
+	comment := strings.TrimSpace(input.Comment)
+	opts := &gitlab.ListMergeRequestNotesOptions{ListOptions: gitlab.ListOptions{PerPage: 100}}
+	for {
+		lib.Wait(repoLimiter)
+		notes, resp, err := client.Notes.ListMergeRequestNotes(pid, input.PRNumber, opts, ctxFunc)
+		if err != nil {
+			return err
+		}
+		for _, note := range notes {
+			if !note.System && strings.TrimSpace(note.Body) == comment {
+				return nil
+			}
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+
+	lib.Wait(repoLimiter)
+	_, _, err := client.Notes.CreateMergeRequestNote(pid, input.PRNumber, &gitlab.CreateMergeRequestNoteOptions{Body: &comment}, ctxFunc)
+	return err
+}
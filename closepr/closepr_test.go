@@ -0,0 +1,59 @@
+package closepr
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Clever/microplane/lib"
+	"github.com/google/go-github/v35/github"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGithubClose(t *testing.T) {
+	t.Setenv("GITHUB_API_TOKEN", "test")
+	comments := []github.IssueComment{}
+	closed := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/api/v3/repos/clever/app/pulls/7":
+			json.NewEncoder(w).Encode(github.PullRequest{Number: github.Int(7), State: github.String("open")})
+		case r.Method == http.MethodGet && r.URL.Path == "/api/v3/repos/clever/app/issues/7/comments":
+			json.NewEncoder(w).Encode(comments)
+		case r.Method == http.MethodPost && r.URL.Path == "/api/v3/repos/clever/app/issues/7/comments":
+			var comment github.IssueComment
+			json.NewDecoder(r.Body).Decode(&comment)
+			comments = append(comments, comment)
+			json.NewEncoder(w).Encode(comment)
+		case r.Method == http.MethodPatch && r.URL.Path == "/api/v3/repos/clever/app/pulls/7":
+			var update map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&update)
+			assert.Equal(t, map[string]interface{}{"state": "closed"}, update)
+			closed++
+			json.NewEncoder(w).Encode(github.PullRequest{Number: github.Int(7), State: github.String("closed")})
+		default:
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	input := Input{
+		Repo:     lib.Repo{Owner: "clever", Name: "app", ProviderConfig: lib.ProviderConfig{Backend: "github", BackendURL: server.URL}},
+		PRNumber: 7,
+		Comment:  "Not rolling this out after all",
+	}
+
+	output, err := Close(context.Background(), input, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, Output{Success: true, Closed: true}, output)
+
+	// a re-run, e.g. after closing failed, doesn't comment again
+	output, err = Close(context.Background(), input, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, Output{Success: true, Closed: true}, output)
+	assert.Len(t, comments, 1)
+	assert.Equal(t, "Not rolling this out after all", comments[0].GetBody())
+	assert.Equal(t, 2, closed)
+}
@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/Clever/microplane/lib"
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+)
+
+// allowedReposFile is set by --allowed-repos-file, or $MICROPLANE_ALLOWED_REPOS_FILE
+var allowedReposFile string
+
+// addAllowedReposFlag adds --allowed-repos-file to a command that changes repos on the provider
+func addAllowedReposFlag(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&allowedReposFile, "allowed-repos-file", os.Getenv("MICROPLANE_ALLOWED_REPOS_FILE"), "file listing the only repos this may change, one owner/name or glob like 'clever/*' per line. repos not on it are skipped. defaults to $MICROPLANE_ALLOWED_REPOS_FILE")
+}
+
+// loadAllowedRepos reads an allowed repos file: one owner/name pattern per line, ignoring blank
+// lines and # comments
+func loadAllowedRepos(file string) ([]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	patterns := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if _, err := path.Match(line, ""); err != nil || !strings.Contains(line, "/") {
+			return nil, fmt.Errorf("invalid repo '%s', expected owner/name or a glob like 'clever/*'", line)
+		}
+		patterns = append(patterns, line)
+	}
+	return patterns, scanner.Err()
+}
+
+// repoAllowed determines if a repo's owner/name matches one of the allowed patterns
+func repoAllowed(patterns []string, r lib.Repo) bool {
+	fullName := fmt.Sprintf("%s/%s", r.Owner, r.Name)
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, fullName); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedRepos narrows repos to those in --allowed-repos-file, if it's set, reporting any that
+// are skipped. It exits if the file can't be read, rather than carrying on without it.
+func allowedRepos(repos []lib.Repo) []lib.Repo {
+	if allowedReposFile == "" {
+		return repos
+	}
+	patterns, err := loadAllowedRepos(allowedReposFile)
+	if err != nil {
+		log.Fatalf("error loading --allowed-repos-file, not continuing without it: %s", err.Error())
+	}
+
+	allowed := []lib.Repo{}
+	denied := []string{}
+	for _, r := range repos {
+		if repoAllowed(patterns, r) {
+			allowed = append(allowed, r)
+		} else {
+			denied = append(denied, fmt.Sprintf("%s/%s", r.Owner, r.Name))
+		}
+	}
+	if len(denied) > 0 {
+		log.Print(color.RedString("skipping %d repos that aren't in --allowed-repos-file %s: %s", len(denied), allowedReposFile, strings.Join(denied, ", ")))
+	}
+	if len(allowed) == 0 {
+		exitNoRepos(fmt.Sprintf("none of the %d targeted repos are in --allowed-repos-file %s", len(repos), allowedReposFile))
+	}
+	return allowed
+}
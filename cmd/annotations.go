@@ -0,0 +1,38 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Clever/microplane/lib"
+)
+
+// githubAnnotations is set by --github-annotations, and on by default in Github Actions
+var githubAnnotations bool
+
+// githubAnnotation is a Github Actions workflow command, e.g. "::error title=clever/app::push failed",
+// which the Actions UI shows as an annotation on the run. Secrets are redacted like in the logs.
+func githubAnnotation(level, title, message string) string {
+	if w, ok := logOutput.(*logWriter); ok {
+		message = w.redact(message)
+	}
+	data := strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A")
+	property := strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A", ":", "%3A", ",", "%2C")
+	return fmt.Sprintf("::%s title=%s::%s", level, property.Replace(title), data.Replace(message))
+}
+
+// annotateFailure annotates a repo that failed, with --github-annotations. It's in addition to
+// the usual logs, which go to stderr, since Actions only reads workflow commands from stdout.
+func annotateFailure(r lib.Repo, err error) {
+	if githubAnnotations {
+		fmt.Fprintln(os.Stdout, githubAnnotation("error", fmt.Sprintf("%s/%s", r.Owner, r.Name), err.Error()))
+	}
+}
+
+// annotateSkip annotates a repo that was skipped, with --github-annotations
+func annotateSkip(r lib.Repo, reason string) {
+	if githubAnnotations {
+		fmt.Fprintln(os.Stdout, githubAnnotation("warning", fmt.Sprintf("%s/%s", r.Owner, r.Name), "skipped: "+reason))
+	}
+}
@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Clever/microplane/plan"
+)
+
+// artifactsDir is set by --artifacts-dir, or $MICROPLANE_ARTIFACTS_DIR
+var artifactsDir string
+
+// Files saved for each repo in --artifacts-dir, beside its <step>.json outputs
+const (
+	artifactPlanDiff = "plan.diff"
+	artifactPlanLog  = "plan.log"
+)
+
+// setupArtifactsDir creates --artifacts-dir, if it's set
+func setupArtifactsDir() error {
+	if artifactsDir == "" {
+		return nil
+	}
+	return os.MkdirAll(artifactsDir, 0755)
+}
+
+// saveArtifacts copies an output written to the work dir into --artifacts-dir as it's written,
+// so it's complete even if the run stops part way. The layout is flat and predictable, for
+// uploading as CI artifacts: init.json, then <repo>/<step>.json for each repo, with the plan's
+// diff and what its change command printed as <repo>/plan.diff and <repo>/plan.log. Other
+// files in the work dir aren't copied.
+func saveArtifacts(path string, bs []byte) error {
+	rel, err := filepath.Rel(workDir, path)
+	if err != nil {
+		return nil
+	}
+	if rel == "init.json" {
+		return ioutil.WriteFile(filepath.Join(artifactsDir, rel), bs, 0644)
+	}
+	parts := strings.Split(rel, string(filepath.Separator))
+	if len(parts) != 3 || parts[0] == runsDir || parts[2] != parts[1]+".json" {
+		return nil
+	}
+	repoName, step := parts[0], parts[1]
+	repoDir := filepath.Join(artifactsDir, repoName)
+	if err := os.MkdirAll(repoDir, 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(repoDir, step+".json"), bs, 0644); err != nil {
+		return err
+	}
+	if step != "plan" {
+		return nil
+	}
+
+	var planOutput struct {
+		plan.Output
+		Error string
+	}
+	if err := json.Unmarshal(bs, &planOutput); err != nil {
+		return err
+	}
+	log := planOutput.ScriptOutput
+	if planOutput.Error != "" {
+		log = strings.TrimSpace(log + "\n" + planOutput.Error)
+	}
+	// a re-plan replaces the previous plan's files
+	for name, contents := range map[string]string{artifactPlanDiff: planOutput.GitDiff, artifactPlanLog: log} {
+		file := filepath.Join(repoDir, name)
+		if contents == "" {
+			if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+		if err := ioutil.WriteFile(file, []byte(contents), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
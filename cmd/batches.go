@@ -0,0 +1,124 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+
+	"github.com/Clever/microplane/lib"
+	"github.com/Clever/microplane/merge"
+	"github.com/Clever/microplane/plan"
+)
+
+// pushBatchesFile is where push --batch-size records how many batches it has pushed, so that a
+// resumed push continues with the next batch
+const pushBatchesFile = "push-batches.json"
+
+// pushBatchProgress is how far push --batch-size got through its batches
+type pushBatchProgress struct {
+	BatchSize int
+	// Repos are the repos being pushed, as owner/name, in the order they're batched
+	Repos []string
+	// Done is how many batches have been pushed
+	Done int
+}
+
+// pushInBatches pushes repos --batch-size at a time, pausing --batch-pause between batches, so
+// that reviewers get PRs in manageable waves. Progress is saved after each batch, and a push of
+// the same repos with the same batch size resumes after the last batch pushed.
+func pushInBatches(repos []lib.Repo) error {
+	repos, others := pushableRepos(repos)
+	// push reports why it skips the others
+	if err := parallelize(others, pushOneRepo); err != nil {
+		return err
+	}
+	batches := batchRepos(repos, pushFlagBatchSize)
+	progressPath := path.Join(workDir, pushBatchesFile)
+	progress := pushBatchProgress{BatchSize: pushFlagBatchSize, Repos: repoNames(repos)}
+	var saved pushBatchProgress
+	if loadJSON(progressPath, &saved) == nil && sameBatches(saved, progress) {
+		progress.Done = saved.Done
+		log.Printf("resuming push at batch %d of %d", progress.Done+1, len(batches))
+	}
+
+	for i := progress.Done; i < len(batches); i++ {
+		log.Printf("pushing batch %d of %d (%d repos)", i+1, len(batches), len(batches[i]))
+		if err := parallelize(batches[i], pushOneRepo); err != nil {
+			return fmt.Errorf("batch %d of %d: %s. Re-run push to retry it", i+1, len(batches), err.Error())
+		}
+		if dryRun {
+			if i+1 < len(batches) {
+				log.Printf("%swould pause %s before batch %d", dryRunPrefix, pushFlagBatchPause, i+2)
+			}
+			continue
+		}
+		progress.Done = i + 1
+		if err := writeJSON(progress, progressPath); err != nil {
+			return err
+		}
+		if i+1 < len(batches) && pushFlagBatchPause > 0 {
+			log.Printf("pausing %s before batch %d of %d", pushFlagBatchPause, i+2, len(batches))
+			sleepUntilDeadline(pushFlagBatchPause)
+		}
+	}
+	if dryRun {
+		return nil
+	}
+	// every batch is pushed, so the next push starts over
+	if err := os.Remove(progressPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// pushableRepos splits repos into those push would open a PR for, planned and not ignored or
+// already merged, and the others. Batches are made of the first, so each is a full batch of PRs.
+func pushableRepos(repos []lib.Repo) (pushable []lib.Repo, others []lib.Repo) {
+	for _, r := range repos {
+		var planOutput plan.Output
+		var mergeOutput merge.Output
+		if loadJSON(outputPath(r.Name, "plan"), &planOutput) != nil || !planOutput.Success || planOutput.Ignored ||
+			(loadJSON(outputPath(r.Name, "merge"), &mergeOutput) == nil && mergeOutput.Success) {
+			others = append(others, r)
+			continue
+		}
+		pushable = append(pushable, r)
+	}
+	return pushable, others
+}
+
+// batchRepos splits repos into batches of size, in order
+func batchRepos(repos []lib.Repo, size int) [][]lib.Repo {
+	batches := [][]lib.Repo{}
+	for start := 0; start < len(repos); start += size {
+		end := start + size
+		if end > len(repos) {
+			end = len(repos)
+		}
+		batches = append(batches, repos[start:end])
+	}
+	return batches
+}
+
+// sameBatches determines if saved progress is for the same batches
+func sameBatches(a, b pushBatchProgress) bool {
+	if a.BatchSize != b.BatchSize || len(a.Repos) != len(b.Repos) {
+		return false
+	}
+	for i := range a.Repos {
+		if a.Repos[i] != b.Repos[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// repoNames lists repos as owner/name
+func repoNames(repos []lib.Repo) []string {
+	names := []string{}
+	for _, r := range repos {
+		names = append(names, fmt.Sprintf("%s/%s", r.Owner, r.Name))
+	}
+	return names
+}
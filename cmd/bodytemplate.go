@@ -0,0 +1,47 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// bodyTemplateTokenEnv holds a token to fetch --body-template from a URL with, e.g. for a
+// template in a private repo
+const bodyTemplateTokenEnv = "MICROPLANE_BODY_TEMPLATE_TOKEN"
+
+// bodyTemplateTimeout bounds fetching --body-template from a URL
+const bodyTemplateTimeout = 30 * time.Second
+
+// loadBodyTemplate reads --body-template from a file, or fetches it from an http(s) URL, sending
+// the token in MICROPLANE_BODY_TEMPLATE_TOKEN if it's set. It's loaded once, before any repo is
+// pushed, so every repo in the run uses the same template.
+func loadBodyTemplate(location string) (string, error) {
+	if !strings.HasPrefix(location, "https://") && !strings.HasPrefix(location, "http://") {
+		return readFlagFile("body-template", location)
+	}
+	req, err := http.NewRequest(http.MethodGet, location, nil)
+	if err != nil {
+		return "", err
+	}
+	if token := os.Getenv(bodyTemplateTokenEnv); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	client := &http.Client{Timeout: bodyTemplateTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("fetching %s: %s", location, resp.Status)
+	}
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return string(content), nil
+}
@@ -0,0 +1,32 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/Clever/microplane/lib"
+)
+
+// ciStatusMapFile is set by --ci-status-map-file, or $MICROPLANE_CI_STATUS_MAP_FILE
+var ciStatusMapFile string
+
+// applyCIStatusMap reads --ci-status-map-file, a JSON object mapping raw CI statuses to the
+// success, pending, or failure that push and sync report, e.g. {"manual": "pending"}
+func applyCIStatusMap() error {
+	if ciStatusMapFile == "" {
+		return nil
+	}
+	bs, err := ioutil.ReadFile(ciStatusMapFile)
+	if err != nil {
+		return fmt.Errorf("cannot read --ci-status-map-file: %s", err.Error())
+	}
+	var m map[string]string
+	if err := json.Unmarshal(bs, &m); err != nil {
+		return fmt.Errorf("invalid --ci-status-map-file %s: %s", ciStatusMapFile, err.Error())
+	}
+	if err := lib.SetCIStatusMap(m); err != nil {
+		return fmt.Errorf("invalid --ci-status-map-file %s: %s", ciStatusMapFile, err.Error())
+	}
+	return nil
+}
@@ -2,15 +2,40 @@ package cmd
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/Clever/microplane/clone"
+	"github.com/Clever/microplane/initialize"
 	"github.com/Clever/microplane/lib"
 	"github.com/spf13/cobra"
 )
 
+var cloneFlagRecurseSubmodules bool
+var cloneFlagParallelism int64
+var cloneFlagThrottle string
+var cloneFlagPrintManifest bool
+var cloneFlagCloneURLTemplate string
+
+// cloneManifestVersion is the version of the clone manifest's schema. Fields may be added
+// without changing it, but not changed or removed.
+const cloneManifestVersion = 1
+
+// cloneManifest maps each cloned repo, by owner/name, to the absolute path of its checkout.
+// It's written to the work dir for scripts, so they don't depend on the work dir's layout.
+type cloneManifest struct {
+	Version int
+	Repos   map[string]string
+}
+
+// rate limits the # of git clones. used to prevent load on the git host
+var cloneThrottle *time.Ticker
+
 var cloneCmd = &cobra.Command{
 	Use:   "clone",
 	Short: "Clone all repos targeted by init",
@@ -21,14 +46,40 @@ var cloneCmd = &cobra.Command{
 			log.Fatal(err)
 		}
 
-		err = parallelize(repos, cloneOneRepo)
-		if err != nil {
+		if err := lib.CheckGit(); err != nil {
 			log.Fatal(err)
 		}
+
+		if cloneFlagCloneURLTemplate != "" {
+			if _, err := lib.ParseCloneURLTemplate(cloneFlagCloneURLTemplate); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		if cloneFlagThrottle != "" {
+			dur, err := time.ParseDuration(cloneFlagThrottle)
+			if err != nil {
+				log.Fatalf("Error parsing --throttle flag: %s", err.Error())
+			}
+			cloneThrottle = time.NewTicker(dur)
+		}
+
+		log.Printf("cloning %d repos with parallelism limit [%d]", len(repos), cloneFlagParallelism)
+		err = parallelizeLimited(repos, cloneOneRepo, cloneFlagParallelism)
+		if err := writeOutputFile(cmd, repos, "clone"); err != nil {
+			log.Printf("error writing --output-file: %s", err.Error())
+		}
+		if err := writeCloneManifest(cloneFlagPrintManifest); err != nil {
+			log.Printf("error writing clone manifest: %s", err.Error())
+		}
+		if err != nil {
+			log.Fatalf("%d errors:\n %+v\n", strings.Count(err.Error(), " | ")+1, err)
+		}
 	},
 }
 
 func cloneOneRepo(r lib.Repo, ctx context.Context) error {
+	lib.Wait(cloneThrottle)
 	log.Printf("cloning: %s/%s", r.Owner, r.Name)
 
 	// Prepare workdir for current step's output
@@ -39,14 +90,15 @@ func cloneOneRepo(r lib.Repo, ctx context.Context) error {
 	}
 
 	// Execute
-	cloneURL, err := r.ComputedCloneURL()
+	cloneURL, err := cloneURLFor(r, cloneFlagCloneURLTemplate)
 	if err != nil {
 		return err
 	}
 
 	input := clone.Input{
-		WorkDir: cloneWorkDir,
-		GitURL:  cloneURL,
+		WorkDir:           cloneWorkDir,
+		GitURL:            cloneURL,
+		RecurseSubmodules: cloneFlagRecurseSubmodules,
 	}
 	output, err := clone.Clone(ctx, input)
 	if err != nil {
@@ -55,8 +107,58 @@ func cloneOneRepo(r lib.Repo, ctx context.Context) error {
 			Error string
 		}{output, err.Error()}
 		writeJSON(o, cloneOutputPath)
-		return err
+		return fmt.Errorf("%s/%s error: %+v", r.Owner, r.Name, err)
 	}
 	writeJSON(output, cloneOutputPath)
 	return nil
 }
+
+// cloneURLFor is the URL to clone r from, and push it to: --clone-url-template rendered for r if
+// it's set, otherwise the provider's
+func cloneURLFor(r lib.Repo, cloneURLTemplate string) (string, error) {
+	if cloneURLTemplate != "" {
+		return r.TemplatedCloneURL(cloneURLTemplate)
+	}
+	return r.ComputedCloneURL()
+}
+
+// cloneManifestPath is where the clone manifest is written
+func cloneManifestPath() string {
+	return filepath.Join(workDir, "manifest.json")
+}
+
+// writeCloneManifest writes the manifest of every repo that's been cloned, not just those
+// targeted by this run, and optionally prints it
+func writeCloneManifest(print bool) error {
+	var initOutput initialize.Output
+	if err := loadJSON(outputPath("", "init"), &initOutput); err != nil {
+		return err
+	}
+	manifest := cloneManifest{Version: cloneManifestVersion, Repos: map[string]string{}}
+	for _, r := range initOutput.Repos {
+		var output clone.Output
+		if loadJSON(outputPath(r.Name, "clone"), &output) == nil && output.Success {
+			manifest.Repos[fmt.Sprintf("%s/%s", r.Owner, r.Name)] = output.ClonedIntoDir
+		}
+	}
+	if err := writeJSON(manifest, cloneManifestPath()); err != nil {
+		return err
+	}
+	if print {
+		b, err := json.MarshalIndent(manifest, "", "    ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+	}
+	return nil
+}
+
+func init() {
+	addOutputFileFlag(cloneCmd)
+	cloneCmd.Flags().BoolVar(&cloneFlagPrintManifest, "print-manifest", false, "print the manifest of where each repo is cloned, which is also written to mp/manifest.json")
+	cloneCmd.Flags().StringVar(&cloneFlagCloneURLTemplate, "clone-url-template", "", "Go template for the URL to clone each repo from, for hosts whose git URLs differ from the provider's, e.g. 'ssh://git@{{.Host}}:7999/{{.Owner}}/{{.Name}}.git'. Variables: .Owner .Name .Host")
+	cloneCmd.Flags().BoolVar(&cloneFlagRecurseSubmodules, "recurse-submodules", false, "Initialize and update git submodules after cloning")
+	cloneCmd.Flags().Int64VarP(&cloneFlagParallelism, "parallelism", "p", defaultParallelism, "Parallelism limit")
+	cloneCmd.Flags().StringVarP(&cloneFlagThrottle, "throttle", "t", "", "Throttle number of clones, e.g. '1s' means 1 clone per second")
+}
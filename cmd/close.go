@@ -0,0 +1,110 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+	"text/template"
+
+	"github.com/Clever/microplane/closepr"
+	"github.com/Clever/microplane/lib"
+	"github.com/Clever/microplane/merge"
+	"github.com/Clever/microplane/push"
+	"github.com/spf13/cobra"
+)
+
+// CLI flags
+var (
+	closeFlagFilter  string
+	closeFlagComment string
+)
+
+// closeComment is the parsed --comment template
+var closeComment *template.Template
+
+// count of PRs closed
+var closeCount int64
+
+var closeCmd = &cobra.Command{
+	Use:     "close",
+	Aliases: []string{"abort"},
+	Short:   "Close the PRs opened by microplane, to abandon a change",
+	Example: `mp close --comment 'We are no longer rolling out {{.Branch}}, sorry for the noise'
+mp close --filter 'app-*'`,
+	Args: cobra.ExactArgs(0),
+	Run: func(cmd *cobra.Command, args []string) {
+		var err error
+		closeComment, err = push.ParseCommentTemplate(closeFlagComment)
+		if err != nil {
+			log.Fatalf("Invalid --comment: %s", err.Error())
+		}
+
+		repos, err := whichRepos(cmd)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		repos, err = filterReposOrExit(repos, closeFlagFilter)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		err = parallelize(repos, closeOneRepo)
+		log.Printf("closed %d PRs", closeCount)
+		if err != nil {
+			log.Fatalf("%d errors:\n %+v\n", strings.Count(err.Error(), " | ")+1, err)
+		}
+	},
+}
+
+func closeOneRepo(r lib.Repo, ctx context.Context) error {
+	// Merged PRs can't be closed
+	var mergeOutput merge.Output
+	if loadJSON(outputPath(r.Name, "merge"), &mergeOutput) == nil && mergeOutput.Success {
+		return nil
+	}
+	var pushOutput push.Output
+	if loadJSON(outputPath(r.Name, "push"), &pushOutput) != nil || !pushOutput.Success {
+		return nil
+	}
+
+	comment, err := renderCloseComment(closeComment, r, pushOutput)
+	if err != nil {
+		return fmt.Errorf("%s/%s error: %+v", r.Owner, r.Name, err)
+	}
+	output, err := closepr.Close(ctx, closepr.Input{Repo: r, PRNumber: pushOutput.PullRequestNumber, Comment: comment}, repoLimiter(r))
+	if err != nil {
+		return fmt.Errorf("%s/%s error: %+v", r.Owner, r.Name, err)
+	}
+	switch {
+	case output.Closed:
+		atomic.AddInt64(&closeCount, 1)
+		log.Printf("%s/%s - closed: %s", r.Owner, r.Name, pushOutput.PullRequestURL)
+	case output.NotOpen:
+		log.Printf("%s/%s - skipping, PR isn't open", r.Owner, r.Name)
+	}
+	return nil
+}
+
+// renderCloseComment renders the --comment template for a repo's PR
+func renderCloseComment(tmpl *template.Template, r lib.Repo, pushOutput push.Output) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, push.CommentVars{
+		Owner:    r.Owner,
+		Name:     r.Name,
+		PRNumber: pushOutput.PullRequestNumber,
+		PRURL:    pushOutput.PullRequestURL,
+		Branch:   pushOutput.BranchName,
+	}); err != nil {
+		return "", fmt.Errorf("failed to render --comment: %w", err)
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
+
+func init() {
+	closeCmd.Flags().StringVar(&closeFlagFilter, "filter", "", "only close PRs in repos matching this glob, e.g. 'app-*' or 'clever/app-*'")
+	closeCmd.Flags().StringVar(&closeFlagComment, "comment", "", "Go template for a comment to post on each PR before it's closed, not repeated on re-runs. Variables: .Owner .Name .PRNumber .PRURL .Branch")
+}
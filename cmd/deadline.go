@@ -0,0 +1,41 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// maxDuration is set by --max-duration, to bound how long a command runs, e.g. a scheduled run
+var maxDuration time.Duration
+
+// runCtx is cancelled when the command's --max-duration is up, which kills in-flight git
+// commands and API calls. Repos not started by then are left for the next run.
+var runCtx = context.Background()
+
+// cancelRun releases runCtx's timer once the command is done
+var cancelRun = func() {}
+
+// setupDeadline starts the clock on --max-duration, if it's set
+func setupDeadline() error {
+	if maxDuration < 0 {
+		return errors.New("--max-duration must be positive, or 0 for no limit")
+	}
+	if maxDuration > 0 {
+		runCtx, cancelRun = context.WithTimeout(context.Background(), maxDuration)
+	}
+	return nil
+}
+
+// deadlinePassed is whether the command's --max-duration is up
+func deadlinePassed() bool {
+	return errors.Is(runCtx.Err(), context.DeadlineExceeded)
+}
+
+// sleepUntilDeadline sleeps for d, or until the command's --max-duration is up
+func sleepUntilDeadline(d time.Duration) {
+	select {
+	case <-time.After(d):
+	case <-runCtx.Done():
+	}
+}
@@ -0,0 +1,119 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Clever/microplane/lib"
+	"github.com/Clever/microplane/plan"
+	"github.com/spf13/cobra"
+)
+
+// CLI flags
+var diffFlagFilter string
+
+// previousPlanFile is where plan keeps a repo's previous plan output, next to plan.json, so
+// that mp diff can tell what a re-plan changed
+const previousPlanFile = "previous.json"
+
+// Ways a repo's planned diff can differ from its previous plan, from planChange
+const (
+	planAdded   = "added"
+	planRemoved = "removed"
+	planChanged = "changed"
+)
+
+var diffCmd = &cobra.Command{
+	Use:   "diff",
+	Short: "Compare each repo's planned diff with its previous plan",
+	Long: `Compare each repo's planned diff with its previous plan.
+
+Each time plan runs, it keeps the repo's previous plan. This lists the repos whose
+diff was added, removed, or changed by the latest plan, e.g. to check that a change
+to the script only affects the repos you expect before pushing again.`,
+	Example: `mp diff
+mp diff --filter 'app-*'`,
+	Args: cobra.ExactArgs(0),
+	Run: func(cmd *cobra.Command, args []string) {
+		repos, err := whichRepos(cmd)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		repos, err = filterReposOrExit(repos, diffFlagFilter)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		changes := map[string][]string{}
+		unchanged := 0
+		for _, r := range repos {
+			previous, hadPrevious := loadPlannedDiff(previousPlanPath(r.Name))
+			current, hasCurrent := loadPlannedDiff(outputPath(r.Name, "plan"))
+			change := planChange(previous, hadPrevious, current, hasCurrent)
+			if change == "" {
+				if hasCurrent {
+					unchanged++
+				}
+				continue
+			}
+			changes[change] = append(changes[change], fmt.Sprintf("%s/%s", r.Owner, r.Name))
+		}
+
+		for _, change := range []string{planAdded, planRemoved, planChanged} {
+			if len(changes[change]) == 0 {
+				continue
+			}
+			fmt.Printf("%s (%d):\n", change, len(changes[change]))
+			fmt.Printf("  %s\n", strings.Join(changes[change], "\n  "))
+		}
+		fmt.Printf("%d added, %d removed, %d changed, %d unchanged\n", len(changes[planAdded]), len(changes[planRemoved]), len(changes[planChanged]), unchanged)
+	},
+}
+
+// previousPlanPath is where a repo's previous plan output is kept
+func previousPlanPath(repoName string) string {
+	return filepath.Join(filepath.Dir(outputPath(repoName, "plan")), previousPlanFile)
+}
+
+// keepPreviousPlan copies a repo's plan output, if any, to previousPlanPath before it's re-planned
+func keepPreviousPlan(r lib.Repo) error {
+	bs, err := ioutil.ReadFile(outputPath(r.Name, "plan"))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(previousPlanPath(r.Name), bs, 0644)
+}
+
+// loadPlannedDiff loads the diff from a plan output, if it was planned successfully
+func loadPlannedDiff(path string) (string, bool) {
+	var planOutput plan.Output
+	if loadJSON(path, &planOutput) != nil || !planOutput.Success {
+		return "", false
+	}
+	return planOutput.GitDiff, true
+}
+
+// planChange describes how a repo's planned diff differs from its previous plan, where either
+// plan may not have succeeded. It returns "" if nothing changed.
+func planChange(previous string, hadPrevious bool, current string, hasCurrent bool) string {
+	switch {
+	case hasCurrent && !hadPrevious:
+		return planAdded
+	case hadPrevious && !hasCurrent:
+		return planRemoved
+	case hasCurrent && previous != current:
+		return planChanged
+	}
+	return ""
+}
+
+func init() {
+	diffCmd.Flags().StringVar(&diffFlagFilter, "filter", "", "only compare repos matching this glob, e.g. 'app-*' or 'clever/app-*'")
+}
@@ -0,0 +1,93 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+
+	"github.com/Clever/microplane/dismiss"
+	"github.com/Clever/microplane/lib"
+	"github.com/Clever/microplane/merge"
+	"github.com/Clever/microplane/push"
+	"github.com/spf13/cobra"
+)
+
+// CLI flags
+var (
+	dismissFlagFilter string
+	dismissFlagReason string
+)
+
+// count of reviews dismissed, and of PRs they were on
+var dismissCount int64
+var dismissPRCount int64
+
+var dismissCmd = &cobra.Command{
+	Use:   "dismiss",
+	Short: "Dismiss the reviews on the PRs opened by microplane, so reviewers look at them again",
+	Long: `Dismiss the approving and changes requested reviews on each open PR opened by microplane, e.g.
+after the change was reworked, so reviewers look at it again.
+
+In Github, the reason is the dismissal message. In Gitlab, the MR's approvals are reset, and the
+reason is left as a comment. Resetting others' approvals in Gitlab needs a project or group
+access token, otherwise only the token's own approval is removed.`,
+	Example: `mp dismiss --reason 'The approach changed, please review again'
+mp dismiss --reason 'Rebased onto the new API' --filter 'app-*'`,
+	Args: cobra.ExactArgs(0),
+	Run: func(cmd *cobra.Command, args []string) {
+		if strings.TrimSpace(dismissFlagReason) == "" {
+			log.Fatal("--reason is required")
+		}
+
+		repos, err := whichRepos(cmd)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		repos, err = filterReposOrExit(repos, dismissFlagFilter)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		err = parallelize(repos, dismissOneRepo)
+		log.Printf("dismissed %d reviews on %d PRs", dismissCount, dismissPRCount)
+		if err != nil {
+			log.Fatalf("%d errors:\n %+v\n", strings.Count(err.Error(), " | ")+1, err)
+		}
+	},
+}
+
+func dismissOneRepo(r lib.Repo, ctx context.Context) error {
+	// Only open PRs have reviews to dismiss
+	var mergeOutput merge.Output
+	if loadJSON(outputPath(r.Name, "merge"), &mergeOutput) == nil && mergeOutput.Success {
+		return nil
+	}
+	var pushOutput push.Output
+	if loadJSON(outputPath(r.Name, "push"), &pushOutput) != nil || !pushOutput.Success || pushOutput.PullRequestNumber == 0 {
+		return nil
+	}
+
+	output, err := dismiss.Dismiss(ctx, dismiss.Input{Repo: r, PRNumber: pushOutput.PullRequestNumber, Reason: dismissFlagReason}, repoLimiter(r))
+	atomic.AddInt64(&dismissCount, int64(output.Dismissed))
+	if output.Dismissed > 0 {
+		atomic.AddInt64(&dismissPRCount, 1)
+	}
+	if err != nil {
+		return fmt.Errorf("%s/%s error: %+v", r.Owner, r.Name, err)
+	}
+	switch {
+	case output.NotOpen:
+		log.Printf("%s/%s - skipping, PR isn't open", r.Owner, r.Name)
+	case output.Dismissed > 0:
+		log.Printf("%s/%s - dismissed %d reviews: %s", r.Owner, r.Name, output.Dismissed, pushOutput.PullRequestURL)
+	}
+	return nil
+}
+
+func init() {
+	dismissCmd.Flags().StringVar(&dismissFlagReason, "reason", "", "why the reviews are dismissed, shown to reviewers. required")
+	dismissCmd.Flags().StringVar(&dismissFlagFilter, "filter", "", "only dismiss reviews on repos matching this glob, e.g. 'app-*' or 'clever/app-*'")
+}
@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/Clever/microplane/lib"
+	"github.com/spf13/cobra"
+)
+
+var doctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "Check that microplane is ready to run",
+	Long: `Check that microplane is ready to run, without changing any repos.
+
+This verifies that git is installed and, for each provider targeted by init,
+that its API token is set and valid and its API is reachable.
+
+"mp push" and "mp merge" run these checks before doing any work.`,
+	Args: cobra.ExactArgs(0),
+	Run: func(cmd *cobra.Command, args []string) {
+		repos, err := whichRepos(cmd)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if err := preflight(context.Background(), repos); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("all checks passed")
+	},
+}
+
+// preflight checks everything needed to operate on the given repos, so that we
+// can fail before any repo has been modified
+func preflight(ctx context.Context, repos []lib.Repo) error {
+	if err := lib.CheckGit(); err != nil {
+		return err
+	}
+
+	checked := map[lib.ProviderConfig]bool{}
+	for _, r := range repos {
+		if checked[r.ProviderConfig] {
+			continue
+		}
+		checked[r.ProviderConfig] = true
+
+		if err := lib.NewProviderFromConfig(r.ProviderConfig).Check(ctx); err != nil {
+			return fmt.Errorf("preflight check failed: %s", err.Error())
+		}
+	}
+	return nil
+}
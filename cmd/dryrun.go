@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// dryRun is set by --dry-run, to rehearse a change without side effects. Each of dryRunCommands
+// checks what it would do, and reports it with dryRunPrefix instead of doing it.
+var dryRun bool
+
+// dryRunCommands are the commands that support --dry-run
+var dryRunCommands = []string{"plan", "push", "merge"}
+
+// dryRunPrefix labels the output of a dry run
+const dryRunPrefix = "[dry run] "
+
+// checkDryRun fails commands that don't support --dry-run, rather than letting them run for real
+func checkDryRun(cmd *cobra.Command) error {
+	if !dryRun {
+		return nil
+	}
+	if !contains(dryRunCommands, cmd.Name()) {
+		return fmt.Errorf("mp %s doesn't support --dry-run, only mp %s do", cmd.Name(), strings.Join(dryRunCommands, ", mp "))
+	}
+	log.Printf("%snothing will be committed, pushed, or merged, and the work dir won't be updated", dryRunPrefix)
+	return nil
+}
+
+// dryRunLabel is dryRunPrefix in a dry run, and nothing otherwise
+func dryRunLabel() string {
+	if dryRun {
+		return dryRunPrefix
+	}
+	return ""
+}
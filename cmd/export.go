@@ -0,0 +1,129 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/Clever/microplane/lib"
+	"github.com/spf13/cobra"
+)
+
+// CLI flags
+var exportFlagOutput string
+
+// exportSteps are the steps whose per-repo outputs are exported
+var exportSteps = []string{"clone", "plan", "push", "merge"}
+
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export a workflow's state as SQL, for querying with SQLite",
+	Long: `Export a workflow's state as SQL, for querying with SQLite.
+
+The work dir stays the source of truth. Re-run export to refresh the database,
+it drops and recreates its tables each time.
+
+## Tables
+
+repos: one row per repo
+  owner, name  the repo
+  status       how far the repo has gotten, as shown by "mp status"
+  failed       1 if the repo's latest step failed, 0 otherwise
+
+outputs: one row per repo and step that has run
+  owner, name  the repo
+  step         clone, plan, push, or merge
+  success      1 if the step succeeded, 0 otherwise
+  error        the step's error, if it failed
+  output       the step's output JSON, as written to the work dir. Query it
+               with SQLite's JSON functions, e.g. json_extract(output, '$.PullRequestURL')`,
+	Example: `mp export -o mp.sql && sqlite3 mp.db < mp.sql
+
+# repos that are still open with a failing pipeline
+sqlite3 mp.db "SELECT r.owner, r.name, json_extract(o.output, '$.PullRequestURL')
+  FROM repos r JOIN outputs o ON o.owner = r.owner AND o.name = r.name AND o.step = 'push'
+  WHERE r.status = 'pushed' AND json_extract(o.output, '$.PullRequestCombinedStatus') = 'failure'"`,
+	Args: cobra.ExactArgs(0),
+	Run: func(cmd *cobra.Command, args []string) {
+		repos, err := whichRepos(cmd)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		out := os.Stdout
+		if exportFlagOutput != "" {
+			out, err = os.Create(exportFlagOutput)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer out.Close()
+		}
+
+		if err := exportSQL(out, repos); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+// exportSQL writes SQL that (re)creates the export tables and fills them in from the work dir
+func exportSQL(w io.Writer, repos []lib.Repo) error {
+	statements := []string{
+		"BEGIN TRANSACTION",
+		"DROP TABLE IF EXISTS repos",
+		"DROP TABLE IF EXISTS outputs",
+		"CREATE TABLE repos (owner TEXT NOT NULL, name TEXT NOT NULL, status TEXT NOT NULL, failed INTEGER NOT NULL, PRIMARY KEY (owner, name))",
+		"CREATE TABLE outputs (owner TEXT NOT NULL, name TEXT NOT NULL, step TEXT NOT NULL, success INTEGER NOT NULL, error TEXT, output TEXT NOT NULL, PRIMARY KEY (owner, name, step))",
+	}
+	for _, r := range repos {
+		status, _, failed := getRepoStatus(r)
+		statusFailed := 0
+		if failed {
+			statusFailed = 1
+		}
+		statements = append(statements, fmt.Sprintf("INSERT INTO repos VALUES (%s, %s, %s, %d)", sqlQuote(r.Owner), sqlQuote(r.Name), sqlQuote(status), statusFailed))
+
+		for _, step := range exportSteps {
+			var raw json.RawMessage
+			if loadJSON(outputPath(r.Name, step), &raw) != nil {
+				continue
+			}
+			var result struct {
+				Success bool
+				Error   string
+			}
+			if err := json.Unmarshal(raw, &result); err != nil {
+				return fmt.Errorf("%s/%s %s output: %s", r.Owner, r.Name, step, err.Error())
+			}
+			success := 0
+			if result.Success {
+				success = 1
+			}
+			errorValue := "NULL"
+			if result.Error != "" {
+				errorValue = sqlQuote(result.Error)
+			}
+			statements = append(statements, fmt.Sprintf("INSERT INTO outputs VALUES (%s, %s, %s, %d, %s, %s)",
+				sqlQuote(r.Owner), sqlQuote(r.Name), sqlQuote(step), success, errorValue, sqlQuote(string(raw))))
+		}
+	}
+	statements = append(statements, "COMMIT")
+
+	for _, statement := range statements {
+		if _, err := fmt.Fprintf(w, "%s;\n", statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sqlQuote quotes a string as a SQL literal
+func sqlQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+func init() {
+	exportCmd.Flags().StringVarP(&exportFlagOutput, "output", "o", "", "file to write the SQL to, instead of stdout")
+}
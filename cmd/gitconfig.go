@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// gitConfigFlags are the --git-config values, each key=value
+var gitConfigFlags []string
+
+// gitConfigKey is a git config key: a section, optional subsection, and variable name, e.g.
+// core.autocrlf or http.https://example.com/.extraHeader
+var gitConfigKey = regexp.MustCompile(`^[A-Za-z0-9-]+(\..+)?\.[A-Za-z][A-Za-z0-9-]*$`)
+
+// parseGitConfig parses --git-config values, each key=value
+func parseGitConfig(values []string) ([][2]string, error) {
+	config := [][2]string{}
+	for _, v := range values {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 || !gitConfigKey.MatchString(parts[0]) {
+			return nil, fmt.Errorf("invalid --git-config '%s', expected key=value, e.g. core.autocrlf=input", v)
+		}
+		config = append(config, [2]string{parts[0], parts[1]})
+	}
+	return config, nil
+}
+
+// applyGitConfig applies --git-config to every git subprocess, as if each was run with -c
+func applyGitConfig() error {
+	config, err := parseGitConfig(gitConfigFlags)
+	if err != nil {
+		return err
+	}
+	return addGitConfigEnv(config)
+}
+
+// addGitConfigEnv adds config for every git subprocess with GIT_CONFIG_COUNT (git 2.31 or later),
+// including those run by hooks and plan scripts, without touching the user's git config. It
+// keeps any config already set that way in the environment.
+func addGitConfigEnv(config [][2]string) error {
+	if len(config) == 0 {
+		return nil
+	}
+	count := 0
+	if existing := os.Getenv("GIT_CONFIG_COUNT"); existing != "" {
+		var err error
+		if count, err = strconv.Atoi(existing); err != nil {
+			return fmt.Errorf("invalid GIT_CONFIG_COUNT in the environment: %s", existing)
+		}
+	}
+	for _, kv := range config {
+		os.Setenv(fmt.Sprintf("GIT_CONFIG_KEY_%d", count), kv[0])
+		os.Setenv(fmt.Sprintf("GIT_CONFIG_VALUE_%d", count), kv[1])
+		count++
+	}
+	return os.Setenv("GIT_CONFIG_COUNT", strconv.Itoa(count))
+}
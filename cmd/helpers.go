@@ -1,10 +1,16 @@
 package cmd
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
 
 	"github.com/Clever/microplane/initialize"
 	"github.com/Clever/microplane/lib"
@@ -26,7 +32,61 @@ func writeJSON(obj interface{}, path string) error {
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(path, b, 0644)
+	if err := ioutil.WriteFile(path, b, 0644); err != nil {
+		return err
+	}
+	if artifactsDir != "" {
+		if err := saveArtifacts(path, b); err != nil {
+			return err
+		}
+	}
+	if runID != "" {
+		return saveToRun(runID, path, b)
+	}
+	return nil
+}
+
+// consolidatedOutput is what --output-file writes: every repo's output for a step, in one document
+type consolidatedOutput struct {
+	Step  string
+	Repos []consolidatedRepoOutput
+}
+
+// consolidatedRepoOutput is a repo's output for a step, exactly as it was written to the
+// work dir. Output is null if the step didn't run for the repo.
+type consolidatedRepoOutput struct {
+	Owner  string
+	Name   string
+	Output json.RawMessage
+}
+
+// addOutputFileFlag adds the --output-file flag to a step's command
+func addOutputFileFlag(cmd *cobra.Command) {
+	cmd.Flags().String("output-file", "", "also write all repos' outputs for this step to a single JSON file, e.g. results.json")
+}
+
+// writeOutputFile writes the consolidated output of a step, if --output-file was given
+func writeOutputFile(cmd *cobra.Command, repos []lib.Repo, step string) error {
+	outputFile, err := cmd.Flags().GetString("output-file")
+	if err != nil || outputFile == "" {
+		return err
+	}
+	if dryRun {
+		// the work dir isn't updated by a dry run, so there's nothing new to consolidate
+		log.Printf("%snot writing --output-file", dryRunPrefix)
+		return nil
+	}
+
+	output := consolidatedOutput{Step: step, Repos: []consolidatedRepoOutput{}}
+	for _, r := range repos {
+		repoOutput := consolidatedRepoOutput{Owner: r.Owner, Name: r.Name}
+		var raw json.RawMessage
+		if err := loadJSON(outputPath(r.Name, step), &raw); err == nil {
+			repoOutput.Output = raw
+		}
+		output.Repos = append(output.Repos, repoOutput)
+	}
+	return writeJSON(output, outputFile)
 }
 
 func parallelize(repos []lib.Repo, f func(lib.Repo, context.Context) error) error {
@@ -35,32 +95,69 @@ func parallelize(repos []lib.Repo, f func(lib.Repo, context.Context) error) erro
 
 // parallelize take a list of repos and applies a function (clone, plan, ...) to them
 func parallelizeLimited(repos []lib.Repo, f func(lib.Repo, context.Context) error, parallelismLimit int64) error {
-	ctx := context.Background()
+	ctx := runCtx
 	var eg errgroup.Group
+	var notStarted, timedOut int64
 	parallelLimit := semaphore.NewWeighted(parallelismLimit)
 	for _, r := range repos {
 		eg.Add(1)
 		go func(repo lib.Repo) {
-			parallelLimit.Acquire(ctx, 1)
-			defer parallelLimit.Release(1)
 			defer eg.Done()
+			if err := parallelLimit.Acquire(ctx, 1); err != nil {
+				// --max-duration is up
+				atomic.AddInt64(&timedOut, 1)
+				return
+			}
+			defer parallelLimit.Release(1)
+			// a bug that panics for one repo shouldn't stop the rest
+			defer func() {
+				if p := recover(); p != nil {
+					err := fmt.Errorf("%s/%s error: unexpected panic: %v", repo.Owner, repo.Name, p)
+					annotateFailure(repo, err)
+					eg.Error(err)
+				}
+			}()
 
+			if lib.APIBudgetExhausted() {
+				atomic.AddInt64(&notStarted, 1)
+				return
+			}
+			if ctx.Err() != nil {
+				atomic.AddInt64(&timedOut, 1)
+				return
+			}
 			err := f(repo, ctx)
 			if err != nil {
+				if deadlinePassed() {
+					err = fmt.Errorf("%s (timed out: --max-duration of %s passed)", err.Error(), maxDuration)
+				}
+				annotateFailure(repo, err)
 				eg.Error(err)
 				return
 			}
 		}(r)
 	}
 
-	return eg.Wait()
+	err := eg.Wait()
+	// commands exit on errors, which skips saving the rate limits when the command finishes
+	saveRateLimits()
+	if lib.APIBudgetExhausted() {
+		log.Printf("stopped: made %d API calls, the limit set by --max-api-calls. %d of %d repos weren't started, and repos that failed with \"API call budget\" errors weren't finished. Re-run to continue", lib.APICalls(), notStarted, len(repos))
+	}
+	if deadlinePassed() {
+		log.Printf("stopped: --max-duration of %s passed. %d of %d repos weren't started, and repos that failed with \"timed out\" errors weren't finished. Re-run to continue", maxDuration, timedOut, len(repos))
+		if err == nil && timedOut > 0 {
+			err = fmt.Errorf("%d repos timed out before starting", timedOut)
+		}
+	}
+	return err
 }
 
 // whichRepos determines which repos are relevant to the current command.
-// It also handles the `singleRepo` flag, allowing a user to target just one repo.
+// It also handles the `singleRepo` and `repos` flags, allowing a user to target just some repos.
 func whichRepos(cmd *cobra.Command) ([]lib.Repo, error) {
 	var initOutput initialize.Output
-	if err := loadJSON(outputPath("", "init"), &initOutput); err != nil {
+	if err := loadJSON(savedOutputPath("", "init"), &initOutput); err != nil {
 		return []lib.Repo{}, err
 	}
 
@@ -68,18 +165,194 @@ func whichRepos(cmd *cobra.Command) ([]lib.Repo, error) {
 	if err != nil {
 		return []lib.Repo{}, err
 	}
+	names, err := cmd.Flags().GetStringSlice("repos")
+	if err != nil {
+		return []lib.Repo{}, err
+	}
 
 	// All repos
-	if singleRepo == "" {
+	if singleRepo == "" && len(names) == 0 {
+		if len(initOutput.Repos) == 0 {
+			exitNoRepos(fmt.Sprintf("init didn't find any repos for %s. Re-run init with a different query or filters", initTarget(initOutput)))
+		}
 		return initOutput.Repos, nil
 	}
 
 	// Single repo
-	for _, r := range initOutput.Repos {
-		if r.Name == singleRepo {
-			return []lib.Repo{r}, nil
+	if singleRepo != "" {
+		for _, r := range initOutput.Repos {
+			if r.Name == singleRepo {
+				return []lib.Repo{r}, nil
+			}
+		}
+		// TODO: showing valid repo names would be helpful
+		return []lib.Repo{}, fmt.Errorf("%s not a targeted repo name", singleRepo)
+	}
+
+	return selectRepos(initOutput.Repos, names)
+}
+
+// selectRepos narrows a list of repos to the named ones, each given as "owner/name" or just
+// "name". It errors if any of the names aren't in the list.
+func selectRepos(repos []lib.Repo, names []string) ([]lib.Repo, error) {
+	found := map[string]bool{}
+	selected := []lib.Repo{}
+	for _, r := range repos {
+		fullName := fmt.Sprintf("%s/%s", r.Owner, r.Name)
+		matched := false
+		for _, name := range names {
+			if name == r.Name || name == fullName {
+				found[name] = true
+				matched = true
+			}
+		}
+		if matched {
+			selected = append(selected, r)
+		}
+	}
+
+	missing := []string{}
+	for _, name := range names {
+		if !found[name] {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return []lib.Repo{}, fmt.Errorf("not targeted repos: %s", strings.Join(missing, ", "))
+	}
+	return selected, nil
+}
+
+// exitCodeNoRepos is the exit status when there are no repos to operate on, so scripts can tell
+// it apart from a failure
+const exitCodeNoRepos = 3
+
+// exitNoRepos explains why there are no repos to operate on, and exits with exitCodeNoRepos
+func exitNoRepos(reason string) {
+	log.Printf("no repos to operate on: %s", reason)
+	os.Exit(exitCodeNoRepos)
+}
+
+// initTarget describes how init found its repos, for work dirs from before it was recorded too
+func initTarget(initOutput initialize.Output) string {
+	if initOutput.Target == "" {
+		return "the init query"
+	}
+	return initOutput.Target
+}
+
+// filterReposOrExit is filterRepos for a command's --filter, exiting if nothing matches it
+func filterReposOrExit(repos []lib.Repo, pattern string) ([]lib.Repo, error) {
+	filtered, err := filterRepos(repos, pattern)
+	if err == nil && len(filtered) == 0 {
+		exitNoRepos(fmt.Sprintf("none of the %d targeted repos match --filter %q", len(repos), pattern))
+	}
+	return filtered, err
+}
+
+// filterRepos narrows a list of repos to those matching a glob pattern.
+// The pattern is matched against both the repo name and "owner/name". An empty pattern matches everything.
+func filterRepos(repos []lib.Repo, pattern string) ([]lib.Repo, error) {
+	if pattern == "" {
+		return repos, nil
+	}
+
+	filtered := []lib.Repo{}
+	for _, r := range repos {
+		matchName, err := path.Match(pattern, r.Name)
+		if err != nil {
+			return []lib.Repo{}, fmt.Errorf("invalid filter %q: %s", pattern, err.Error())
+		}
+		matchFullName, _ := path.Match(pattern, fmt.Sprintf("%s/%s", r.Owner, r.Name))
+		if matchName || matchFullName {
+			filtered = append(filtered, r)
+		}
+	}
+	return filtered, nil
+}
+
+// parsePipelineVariables parses --pipeline-variable values, each KEY=VALUE
+func parsePipelineVariables(values []string) (map[string]string, error) {
+	variables := map[string]string{}
+	for _, v := range values {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid pipeline variable '%s', expected KEY=VALUE", v)
+		}
+		variables[parts[0]] = parts[1]
+	}
+	return variables, nil
+}
+
+// repoMetadata looks up a repo's metadata from a --metadata-file, by owner/name or name
+func repoMetadata(metadata map[string]map[string]string, r lib.Repo) map[string]string {
+	if m, ok := metadata[fmt.Sprintf("%s/%s", r.Owner, r.Name)]; ok {
+		return m
+	}
+	return metadata[r.Name]
+}
+
+// firstLine is the first non-blank line of a message, e.g. to summarize an error in a log line
+func firstLine(message string) string {
+	for _, line := range strings.Split(message, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			return line
+		}
+	}
+	return ""
+}
+
+// stdinReadBy is the flag that read stdin, since it can only be read once
+var stdinReadBy string
+
+// readFlagFile reads the file given to a flag, or stdin if the file is "-"
+func readFlagFile(flag string, path string) (string, error) {
+	if path != "-" {
+		content, err := ioutil.ReadFile(path)
+		return string(content), err
+	}
+	if stdinReadBy != "" {
+		return "", fmt.Errorf("--%s and --%s can't both read stdin", stdinReadBy, flag)
+	}
+	stdinReadBy = flag
+	content, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return "", fmt.Errorf("error reading --%s from stdin: %s", flag, err.Error())
+	}
+	return string(content), nil
+}
+
+// maxConfirmSample is how many example lines to show when asking for confirmation
+const maxConfirmSample = 5
+
+// confirm asks the user to confirm an action before it's taken, showing a sample of what will happen.
+// It requires skipConfirm when stdin isn't a terminal, since there's no one to ask.
+func confirm(action string, sample []string, skipConfirm bool) error {
+	if skipConfirm {
+		return nil
+	}
+	if stat, err := os.Stdin.Stat(); err != nil || stat.Mode()&os.ModeCharDevice == 0 {
+		return fmt.Errorf("not running in a terminal, pass --yes to %s without confirmation", action)
+	}
+
+	// the prompt goes to stderr, so it doesn't end up in output piped elsewhere, e.g. --print-urls
+	fmt.Fprintf(os.Stderr, "About to %s:\n", action)
+	for i, line := range sample {
+		if i == maxConfirmSample {
+			fmt.Fprintf(os.Stderr, "  ...and %d more\n", len(sample)-maxConfirmSample)
+			break
 		}
+		fmt.Fprintf(os.Stderr, "  %s\n", line)
+	}
+	fmt.Fprint(os.Stderr, "Continue? [y/N] ")
+
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return err
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	if answer != "y" && answer != "yes" {
+		return fmt.Errorf("aborted, did not %s", action)
 	}
-	// TODO: showing valid repo names would be helpful
-	return []lib.Repo{}, fmt.Errorf("%s not a targeted repo name", singleRepo)
+	return nil
 }
@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Clever/microplane/lib"
+	"github.com/Clever/microplane/merge"
+)
+
+// Hooks are user commands run for each repo at defined points of a step, e.g. to update an
+// external tracker. A failing hook fails the repo, unless it's listed in --best-effort-hooks.
+const (
+	hookPrePlan   = "pre-plan"
+	hookPrePush   = "pre-push"
+	hookPostPush  = "post-push"
+	hookPostMerge = "post-merge"
+)
+
+// CLI flags, shared by the commands with hooks
+var hookFlagBestEffort []string
+
+// runHook runs a hook's command with sh in dir, if it's set. Besides the MICROPLANE_REPO and
+// MICROPLANE_OWNER of the repo, env sets more MICROPLANE_<X> vars for the hook to use.
+func runHook(ctx context.Context, name string, command string, r lib.Repo, dir string, env ...string) error {
+	if command == "" {
+		return nil
+	}
+	output, err := hookCommand(ctx, name, command, r, dir, env...).CombinedOutput()
+	if err == nil {
+		return nil
+	}
+
+	err = fmt.Errorf("%s hook failed: [%s] %s", name, err, output)
+	if contains(hookFlagBestEffort, name) {
+		log.Printf("%s/%s - %s (best effort, continuing)", r.Owner, r.Name, err.Error())
+		return nil
+	}
+	return err
+}
+
+// hookCommand is the command to run a hook, or another per-repo user command, with sh in dir
+func hookCommand(ctx context.Context, name string, command string, r lib.Repo, dir string, env ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("MICROPLANE_HOOK=%s", name),
+		fmt.Sprintf("MICROPLANE_REPO=%s", r.Name),
+		fmt.Sprintf("MICROPLANE_OWNER=%s", r.Owner),
+	)
+	cmd.Env = append(cmd.Env, env...)
+	return cmd
+}
+
+// postMergeScriptOutputLimit is the most of the post-merge script's output kept in the merge output
+const postMergeScriptOutputLimit = 4 * 1024
+
+// runPostMergeScript runs the --post-merge-script for a merged repo, and records its result.
+// Unlike a hook, its failure doesn't fail the merge.
+func runPostMergeScript(ctx context.Context, command string, r lib.Repo, dir string, env ...string) *merge.PostMergeResult {
+	result := &merge.PostMergeResult{RanAt: time.Now()}
+	output, err := hookCommand(ctx, "post-merge-script", command, r, dir, env...).CombinedOutput()
+	result.Output = strings.TrimSpace(string(output))
+	if len(result.Output) > postMergeScriptOutputLimit {
+		// keep the end, where the reason it failed usually is
+		start := len(result.Output) - postMergeScriptOutputLimit
+		for start < len(result.Output) && !utf8.RuneStart(result.Output[start]) {
+			start++
+		}
+		result.Output = result.Output[start:]
+	}
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		result.Success = true
+	case errors.As(err, &exitErr):
+		result.ExitCode = exitErr.ExitCode()
+	default:
+		result.ExitCode = -1
+		result.Output = err.Error()
+	}
+	return result
+}
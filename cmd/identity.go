@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/mail"
+	"os"
+	"strings"
+
+	"github.com/Clever/microplane/lib"
+)
+
+// The commits microplane makes and the PRs it opens can be by different identities: commits are
+// authored by git's user, or plan's --commit-author, and PRs are opened by whoever the API token
+// authenticates as.
+
+// parseCommitAuthor parses a --commit-author, e.g. "Jane Doe <jane@example.com>"
+func parseCommitAuthor(author string) (*mail.Address, error) {
+	addr, err := mail.ParseAddress(author)
+	if err != nil || addr.Name == "" {
+		return nil, fmt.Errorf("invalid --commit-author '%s', expected a name and email like 'Jane Doe <jane@example.com>'", author)
+	}
+	return addr, nil
+}
+
+// applyCommitAuthor makes the author of every commit plan makes, including those by plan
+// scripts, the --commit-author. The committer is still git's user.
+func applyCommitAuthor(author string) error {
+	if author == "" {
+		return nil
+	}
+	addr, err := parseCommitAuthor(author)
+	if err != nil {
+		return err
+	}
+	if err := os.Setenv("GIT_AUTHOR_NAME", addr.Name); err != nil {
+		return err
+	}
+	return os.Setenv("GIT_AUTHOR_EMAIL", addr.Address)
+}
+
+// checkPROpener checks that each provider's API token authenticates as --pr-opener, if given, so
+// that PRs aren't opened by a personal token by mistake. With --verbose it logs who'll open them.
+func checkPROpener(ctx context.Context, repos []lib.Repo, opener string) error {
+	if opener == "" && !verbose {
+		return nil
+	}
+	opener = strings.TrimPrefix(opener, "@")
+	checked := map[lib.ProviderConfig]bool{}
+	for _, r := range repos {
+		if checked[r.ProviderConfig] {
+			continue
+		}
+		checked[r.ProviderConfig] = true
+
+		user, err := lib.NewProviderFromConfig(r.ProviderConfig).TokenUser(ctx)
+		if err != nil {
+			return err
+		}
+		if opener != "" && !strings.EqualFold(user, opener) {
+			return fmt.Errorf("%s authenticates as %s on %s, not --pr-opener %s. Set it to %s's token", r.ProviderConfig.APITokenEnv(), user, r.ProviderConfig.Host(), opener, opener)
+		}
+		if verbose {
+			log.Printf("PRs on %s will be opened by %s, from %s", r.ProviderConfig.Host(), user, r.ProviderConfig.APITokenEnv())
+		}
+	}
+	return nil
+}
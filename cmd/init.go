@@ -3,8 +3,10 @@ package cmd
 import (
 	"fmt"
 	"log"
+	"path/filepath"
 
 	"github.com/Clever/microplane/initialize"
+	"github.com/Clever/microplane/lib"
 
 	"github.com/spf13/cobra"
 )
@@ -25,6 +27,10 @@ where repos.txt has lines like:
 	clever/repo2
 	clever/repo2
 
+Pass - instead of a file, or as the query, to read the repos from stdin, e.g.
+
+$ gh repo list clever --limit 1000 | mp init -
+
 ## (2) Init via Search
 
 ### GitHub Code Search
@@ -47,7 +53,7 @@ To init all repos belonging to a specific org use --all-repos flag.
 
 $ mp init "clever" --all-repos
 
-would target all repos in clever org.
+would target all repos in clever org. With --provider=gitlab, this targets all projects in a group, including its subgroups.
 
 To init repos with additional parameters use --repo-search flag
 
@@ -59,6 +65,28 @@ would target all Clever repos written in Go
 
 See https://help.github.com/articles/searching-repositories/ for more details about the search syntax on Github.
 
+### Github Topic Search
+
+- Search target repos in an org based on their Github topics.
+
+For example:
+
+$ mp init "clever" --topics team-payments,tier-1
+
+would target all repos in the clever org with either the team-payments or tier-1 topic.
+Pass --topics-match-all to only target repos with all of the given topics.
+
+### Search URL
+
+- Search target repos with the URL of a search from the web UI, e.g. one bookmarked by your team.
+
+For example:
+
+$ mp init --search-url 'https://github.com/search?q=org%3AClever+language%3AGo&type=repositories'
+
+Repository and code searches are supported, and on GitLab project and code (blobs) searches,
+optionally within a group.
+
 ### GitLab
 
 Search target repos based on a GitLab search.
@@ -74,7 +102,16 @@ If you are using an *enterprise* GitLab instance, we assume you have an ElasticS
 See https://docs.gitlab.com/ee/user/search/advanced_search_syntax.html for more details about the search syntax on Gitlab.`,
 	Args: cobra.RangeArgs(0, 1),
 	Run: func(cmd *cobra.Command, args []string) {
-		if len(args) == 0 && initFlagReposFile == "" {
+		if len(args) == 1 && args[0] == "-" && initFlagReposFile == "" {
+			initFlagReposFile = "-"
+			args = nil
+		}
+
+		if initSearchURL != "" {
+			if len(args) > 0 || initFlagReposFile != "" {
+				log.Fatal("--search-url is the search, so don't also pass a search query or -f")
+			}
+		} else if len(args) == 0 && initFlagReposFile == "" {
 			log.Fatal("to init via code search (default), you must pass a search query. If init from a repo file, specify a repos file with -f." +
 				"If init with a github repo search, include --repo-search flag.")
 		}
@@ -89,15 +126,47 @@ See https://docs.gitlab.com/ee/user/search/advanced_search_syntax.html for more
 			query = args[0]
 		}
 
+		// later steps read the TLS files too, so don't depend on the current directory
+		for _, file := range []*string{&initCACertFile, &initClientCertFile, &initClientKeyFile} {
+			if *file == "" {
+				continue
+			}
+			abs, err := filepath.Abs(*file)
+			if err != nil {
+				log.Fatal(err)
+			}
+			*file = abs
+		}
+		tlsFiles := lib.ProviderConfig{CACertFile: initCACertFile, ClientCertFile: initClientCertFile, ClientKeyFile: initClientKeyFile}
+		if err := tlsFiles.CheckTLSFiles(); err != nil {
+			log.Fatalf("invalid TLS options: %s", err.Error())
+		}
+
 		output, err := initialize.Initialize(initialize.Input{
-			AllRepos:      initAllrepos,
-			Query:         query,
-			WorkDir:       workDir,
-			Version:       cliVersion,
-			Provider:      initProvider,
-			ProviderURL:   initProviderURL,
-			ReposFromFile: initFlagReposFile,
-			RepoSearch:    initRepoSearch,
+			AllRepos:              initAllrepos,
+			Query:                 query,
+			WorkDir:               workDir,
+			Version:               cliVersion,
+			Provider:              initProvider,
+			ProviderURL:           initProviderURL,
+			ReposFromFile:         initFlagReposFile,
+			RepoSearch:            initRepoSearch,
+			SearchURL:             initSearchURL,
+			Topics:                initTopics,
+			TopicsMatchAll:        initTopicsMatchAll,
+			CACertFile:            initCACertFile,
+			InsecureSkipTLSVerify: initInsecureSkipTLSVerify,
+			ClientCertFile:        initClientCertFile,
+			ClientKeyFile:         initClientKeyFile,
+			TokenEnv:              initTokenEnv,
+			Filter: initialize.Filter{
+				SkipArchived: initSkipArchived,
+				SkipForks:    initSkipForks,
+				MinStars:     initMinStars,
+				MinForks:     initMinForks,
+				Languages:    initLanguages,
+				Limit:        initLimit,
+			},
 		})
 		if err != nil {
 			log.Fatal(err)
@@ -111,19 +180,53 @@ See https://docs.gitlab.com/ee/user/search/advanced_search_syntax.html for more
 		for _, repo := range output.Repos {
 			fmt.Println(repo.Name)
 		}
+		if initSearchURL != "" {
+			log.Printf("found %d repos for %s", len(output.Repos), output.Target)
+		}
+		if len(output.Repos) == 0 {
+			exitNoRepos(fmt.Sprintf("didn't find any repos for %s", output.Target))
+		}
 	},
 }
 
 var initFlagReposFile string
 var initRepoSearch bool
+var initSearchURL string
 var initAllrepos bool
 var initProvider string
 var initProviderURL string
+var initTopics []string
+var initTopicsMatchAll bool
+var initSkipArchived bool
+var initSkipForks bool
+var initLimit int
+var initMinStars int
+var initMinForks int
+var initLanguages []string
+var initCACertFile string
+var initInsecureSkipTLSVerify bool
+var initClientCertFile string
+var initClientKeyFile string
+var initTokenEnv string
 
 func init() {
-	initCmd.Flags().StringVarP(&initFlagReposFile, "file", "f", "", "get repos from a file instead of searching")
+	initCmd.Flags().StringVarP(&initFlagReposFile, "file", "f", "", "get repos from a file instead of searching, or from stdin with -")
 	initCmd.Flags().BoolVar(&initRepoSearch, "repo-search", false, "get repos from a github repo search")
+	initCmd.Flags().StringVar(&initSearchURL, "search-url", "", "get repos from the URL of a search in the provider's web UI, e.g. a saved search")
 	initCmd.Flags().BoolVar(&initAllrepos, "all-repos", false, "get all repos for a given org")
 	initCmd.Flags().StringVar(&initProvider, "provider", "github", "'github' or 'gitlab'")
 	initCmd.Flags().StringVar(&initProviderURL, "provider-url", "", "custom URL for enterprise setups")
+	initCmd.Flags().StringVar(&initCACertFile, "ca-cert", "", "PEM file of extra CAs to trust when calling the provider's API, e.g. for a private CA")
+	initCmd.Flags().StringVar(&initClientCertFile, "client-cert", "", "PEM client certificate to present to the provider, for mutual TLS. used by API calls and git over HTTPS")
+	initCmd.Flags().StringVar(&initClientKeyFile, "client-key", "", "PEM private key for --client-cert")
+	initCmd.Flags().StringVar(&initTokenEnv, "token-env", "", "environment variable holding the API token, used by every later command. defaults to GITHUB_API_TOKEN or GITLAB_API_TOKEN")
+	initCmd.Flags().BoolVar(&initInsecureSkipTLSVerify, "insecure-skip-tls-verify", false, "don't verify the provider's TLS certificate. insecure, prefer --ca-cert")
+	initCmd.Flags().StringSliceVar(&initTopics, "topics", nil, "get repos in an org with any of these github topics")
+	initCmd.Flags().BoolVar(&initTopicsMatchAll, "topics-match-all", false, "with --topics, only get repos that have all of the topics")
+	initCmd.Flags().IntVar(&initLimit, "limit", 0, "max number of repos to target, 0 means no limit")
+	initCmd.Flags().IntVar(&initMinStars, "min-stars", 0, "leave out repos found by a search with fewer stars")
+	initCmd.Flags().IntVar(&initMinForks, "min-forks", 0, "leave out repos found by a search with fewer forks")
+	initCmd.Flags().StringSliceVar(&initLanguages, "language", nil, "only get repos found by a search whose primary language is one of these, e.g. 'Go,Python'")
+	initCmd.Flags().BoolVar(&initSkipArchived, "skip-archived", true, "leave out archived repos found by a search")
+	initCmd.Flags().BoolVar(&initSkipForks, "skip-forks", false, "leave out forked repos found by a search")
 }
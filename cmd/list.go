@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/Clever/microplane/lib"
+	"github.com/Clever/microplane/merge"
+	"github.com/Clever/microplane/push"
+	"github.com/spf13/cobra"
+)
+
+var listFlagFilter string
+var listFlagBranch bool
+
+var listCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the open PRs opened by microplane",
+	Long: `List the URLs of open PRs opened by microplane, one per line.
+
+PRs are read from the outputs of the current workflow. No API calls are made,
+so run "mp sync" first to pick up changes made outside of microplane.`,
+	Example: `mp list
+mp list --filter 'app-*' | xargs -n1 open
+mp list --branch`,
+	Args: cobra.ExactArgs(0),
+	Run: func(cmd *cobra.Command, args []string) {
+		repos, err := whichRepos(cmd)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		repos, err = filterReposOrExit(repos, listFlagFilter)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		for _, r := range repos {
+			url, ok := openPullRequestURL(r)
+			if !ok {
+				continue
+			}
+			if listFlagBranch {
+				var pushOutput push.Output
+				loadJSON(outputPath(r.Name, "push"), &pushOutput)
+				fmt.Printf("%s\t%s\n", url, pushOutput.BranchName)
+			} else {
+				fmt.Println(url)
+			}
+		}
+	},
+}
+
+// openPullRequestURL returns the URL of the PR that was pushed for a repo, if it hasn't been merged yet
+func openPullRequestURL(r lib.Repo) (string, bool) {
+	var pushOutput push.Output
+	if loadJSON(outputPath(r.Name, "push"), &pushOutput) != nil || !pushOutput.Success || pushOutput.PullRequestURL == "" {
+		return "", false
+	}
+
+	var mergeOutput merge.Output
+	if loadJSON(outputPath(r.Name, "merge"), &mergeOutput) == nil && mergeOutput.Success {
+		return "", false
+	}
+	return pushOutput.PullRequestURL, true
+}
+
+func init() {
+	listCmd.Flags().BoolVar(&listFlagBranch, "branch", false, "also print the branch that was pushed for each PR, separated by a tab")
+	listCmd.Flags().StringVar(&listFlagFilter, "filter", "", "only list repos matching this glob, e.g. 'app-*' or 'clever/app-*'")
+}
@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"syscall"
+
+	"github.com/spf13/cobra"
+)
+
+// workDirLockFile is held while a command modifies the work dir, so that concurrent runs
+// don't clobber each other's outputs
+const workDirLockFile = ".microplane.lock"
+
+// workDirLock is the open lock file. The OS releases the lock when the process exits, even if
+// it's killed by a signal, so it's never left stale
+var workDirLock *os.File
+
+// needsWorkDirLock determines if a command modifies the work dir. Read only commands can run
+// alongside others, e.g. to watch progress with "mp status"
+func needsWorkDirLock(cmd *cobra.Command) bool {
+	switch cmd.Name() {
+	case "diff", "docs", "doctor", "export", "help", "list", "preview", "version":
+		return false
+	case "status":
+		sync, _ := cmd.Flags().GetBool("sync")
+		refresh, _ := cmd.Flags().GetBool("refresh")
+		reviews, _ := cmd.Flags().GetBool("reviews")
+		return sync || refresh || reviews
+	case "report":
+		trackingIssue, _ := cmd.Flags().GetString("tracking-issue")
+		return trackingIssue != ""
+	}
+	return true
+}
+
+// lockWorkDir takes an exclusive lock on the work dir, failing fast if another run holds it
+func lockWorkDir() error {
+	f, err := os.OpenFile(path.Join(workDir, workDirLockFile), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return fmt.Errorf("another microplane run is active in %s", workDir)
+		}
+		return err
+	}
+	workDirLock = f
+	return nil
+}
@@ -6,12 +6,16 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Clever/microplane/lib"
 	"github.com/Clever/microplane/merge"
+	"github.com/Clever/microplane/plan"
 	"github.com/Clever/microplane/push"
 	"github.com/spf13/cobra"
 )
@@ -21,10 +25,37 @@ var mergeFlagThrottle string
 var mergeFlagIgnoreReviewApproval bool
 var mergeFlagIgnoreBuildStatus bool
 var mergeMethod string
+var mergeFlagDeleteBranch bool
+var mergeFlagVerifyMerge bool
+var mergeFlagVerifyMergeTimeout time.Duration
+var mergeFlagYes bool
+var mergeFlagMergeStatusTimeout time.Duration
+var mergeFlagRequiredChecks []string
+var mergeFlagMergeMessage string
+var mergeFlagSquashMessage string
+var mergeFlagIncludeDrafts bool
+var mergeFlagPostMergeHook string
+var mergeFlagPostMergeScript string
+
+// count of merged repos whose --post-merge-script failed
+var mergePostMergeFailedCount int64
+var mergeFlagOnlyPushed bool
+var mergeFlagSince string
+var mergeFlagParallelism int64
+var mergeFlagWaveDelay time.Duration
+var mergeFlagWaveWaitForCI bool
+var mergeFlagWaveCITimeout time.Duration
+
+// how often to check CI on a wave's merge commits, with --wave-wait-for-ci
+var mergeCIPollInterval = 30 * time.Second
 
 // rate limits the # of PR merges. used to prevent load on CI system
 var mergeThrottle *time.Ticker
 
+// PRs that weren't ready to merge, and why
+var mergeSkips []string
+var mergeSkipsMutex sync.Mutex
+
 var supportedMergeMethods = []string{"merge", "squash", "rebase"}
 
 var mergeCmd = &cobra.Command{
@@ -32,6 +63,9 @@ var mergeCmd = &cobra.Command{
 	Short: "Merge pushed changes",
 	Args:  cobra.ExactArgs(0),
 	Run: func(cmd *cobra.Command, args []string) {
+		if err := checkSelectedRun(); err != nil {
+			log.Fatal(err)
+		}
 		repos, err := whichRepos(cmd)
 		if err != nil {
 			log.Fatal(err)
@@ -50,17 +84,250 @@ var mergeCmd = &cobra.Command{
 			mergeThrottle = time.NewTicker(dur)
 		}
 
+		if mergeFlagOnlyPushed || mergeFlagSince != "" {
+			var since time.Time
+			if mergeFlagSince != "" {
+				if since, err = parseSince(mergeFlagSince, time.Now()); err != nil {
+					log.Fatalf("Error parsing --since flag: %s", err.Error())
+				}
+			}
+			repos = pushedRepos(repos, mergeFlagOnlyPushed, since)
+			log.Printf("merging the %d repos pushed %s", len(repos), pushedDescription(mergeFlagOnlyPushed, mergeFlagSince))
+		}
+
+		repos = allowedRepos(repos)
+
+		if mergeFlagParallelism < 1 {
+			log.Fatalf("Invalid --parallelism: %d, must be at least 1", mergeFlagParallelism)
+		}
+
 		if !contains(supportedMergeMethods, mergeMethod) {
 			log.Fatalf("Invalid --merge-method: %s", mergeMethod)
 		}
+		if mergeFlagVerifyMerge && mergeFlagVerifyMergeTimeout <= 0 {
+			log.Fatalf("Invalid --verify-merge-timeout: %s", mergeFlagVerifyMergeTimeout)
+		}
+
+		for flag, text := range map[string]string{"merge-message": mergeFlagMergeMessage, "squash-message": mergeFlagSquashMessage} {
+			if _, err := merge.ParseMessageTemplate(text); err != nil {
+				log.Fatalf("Invalid --%s: %s", flag, err.Error())
+			}
+		}
 
-		err = parallelize(repos, mergeOneRepo)
+		if err := preflight(runCtx, repos); err != nil {
+			log.Fatal(err)
+		}
+
+		sample := mergeSample(repos)
+		if err := confirm(fmt.Sprintf("merge %d repos", len(sample)), sample, mergeFlagYes || dryRun); err != nil {
+			log.Fatal(err)
+		}
+
+		log.Printf("merging %d repos with parallelism limit [%d]", len(repos), mergeFlagParallelism)
+		err = mergeInWaves(runCtx, groupMergeWaves(repos, plannedMergeWave))
+		if dryRun {
+			printMergeVerdicts()
+			if err := writeMergeVerdicts(cmd); err != nil {
+				log.Printf("error writing --output-file: %s", err.Error())
+			}
+		} else {
+			if err := writeOutputFile(cmd, repos, "merge"); err != nil {
+				log.Printf("error writing --output-file: %s", err.Error())
+			}
+			printMergeSkips()
+		}
 		if err != nil {
 			log.Fatal(err)
 		}
+		if mergePostMergeFailedCount > 0 {
+			log.Fatalf("%d repos merged, but their --post-merge-script failed. Re-run merge to try it again", mergePostMergeFailedCount)
+		}
 	},
 }
 
+// parseSince parses a --since time, either as a duration before now, e.g. "2h", or a RFC 3339 time
+func parseSince(s string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("expected a duration like '2h' or a time like '2006-01-02T15:04:05Z07:00', got '%s'", s)
+	}
+	return t, nil
+}
+
+// pushedRepos narrows repos to those whose branch was pushed since a time and, if onlyLatestRun,
+// by the most recent push run
+func pushedRepos(repos []lib.Repo, onlyLatestRun bool, since time.Time) []lib.Repo {
+	outputs := map[string]push.Output{}
+	var latestRun time.Time
+	for _, r := range repos {
+		var output push.Output
+		if loadJSON(savedOutputPath(r.Name, "push"), &output) != nil {
+			continue
+		}
+		outputs[r.Name] = output
+		if output.RunStartedAt != nil && output.RunStartedAt.After(latestRun) {
+			latestRun = *output.RunStartedAt
+		}
+	}
+	if onlyLatestRun && latestRun.After(since) {
+		since = latestRun
+	}
+
+	pushed := []lib.Repo{}
+	for _, r := range repos {
+		output, ok := outputs[r.Name]
+		if ok && output.PushedAt != nil && !output.PushedAt.Before(since) {
+			pushed = append(pushed, r)
+		}
+	}
+	return pushed
+}
+
+// pushedDescription describes which pushes --only-pushed and --since select
+func pushedDescription(onlyLatestRun bool, since string) string {
+	switch {
+	case onlyLatestRun && since != "":
+		return fmt.Sprintf("by the most recent push, and since %s", since)
+	case onlyLatestRun:
+		return "by the most recent push"
+	}
+	return fmt.Sprintf("since %s", since)
+}
+
+// plannedMergeWave is the merge wave recorded in a repo's plan by plan --wave-file
+func plannedMergeWave(r lib.Repo) int {
+	var planOutput plan.Output
+	if loadJSON(savedOutputPath(r.Name, "plan"), &planOutput) != nil {
+		return 0
+	}
+	return planOutput.MergeWave
+}
+
+// groupMergeWaves groups repos by merge wave, lowest first. Repos without a wave (0) go last.
+func groupMergeWaves(repos []lib.Repo, waveOf func(lib.Repo) int) [][]lib.Repo {
+	byWave := map[int][]lib.Repo{}
+	numbers := []int{}
+	for _, r := range repos {
+		wave := waveOf(r)
+		if _, ok := byWave[wave]; !ok {
+			numbers = append(numbers, wave)
+		}
+		byWave[wave] = append(byWave[wave], r)
+	}
+	sort.Slice(numbers, func(i, j int) bool {
+		if numbers[i] == 0 || numbers[j] == 0 {
+			return numbers[j] == 0 && numbers[i] != 0
+		}
+		return numbers[i] < numbers[j]
+	})
+
+	waves := [][]lib.Repo{}
+	for _, n := range numbers {
+		waves = append(waves, byWave[n])
+	}
+	return waves
+}
+
+// mergeInWaves merges each wave of repos, only starting the next once every repo in the wave is
+// merged and, with --wave-wait-for-ci and --wave-delay, its CI has passed and the delay is up
+func mergeInWaves(ctx context.Context, waves [][]lib.Repo) error {
+	for i, wave := range waves {
+		if len(waves) > 1 {
+			log.Printf("merging wave %d of %d (%d repos)", i+1, len(waves), len(wave))
+		}
+		if err := parallelizeLimited(wave, mergeOneRepo, mergeFlagParallelism); err != nil {
+			if i < len(waves)-1 {
+				log.Printf("not starting wave %d, since wave %d had errors", i+2, i+1)
+			}
+			return err
+		}
+		if i == len(waves)-1 {
+			break
+		}
+		if dryRun {
+			log.Printf("%swould wait for wave %d to merge before starting wave %d", dryRunPrefix, i+1, i+2)
+			continue
+		}
+
+		if unmerged := unmergedRepos(wave); len(unmerged) > 0 {
+			return fmt.Errorf("not starting wave %d, since %d repos in wave %d weren't merged: %s. Re-run merge once they're ready", i+2, len(unmerged), i+1, strings.Join(unmerged, ", "))
+		}
+		if mergeFlagWaveWaitForCI {
+			if err := waitForWaveCI(ctx, wave); err != nil {
+				return fmt.Errorf("not starting wave %d: %s", i+2, err.Error())
+			}
+		}
+		if mergeFlagWaveDelay > 0 {
+			log.Printf("waiting %s before wave %d", mergeFlagWaveDelay, i+2)
+			sleepUntilDeadline(mergeFlagWaveDelay)
+		}
+	}
+	return nil
+}
+
+// unmergedRepos lists the repos whose PR isn't merged, as owner/name
+func unmergedRepos(repos []lib.Repo) []string {
+	unmerged := []string{}
+	for _, r := range repos {
+		var mergeOutput merge.Output
+		if loadJSON(selectedOutputPath(r.Name, "merge"), &mergeOutput) != nil || !mergeOutput.Success {
+			unmerged = append(unmerged, fmt.Sprintf("%s/%s", r.Owner, r.Name))
+		}
+	}
+	return unmerged
+}
+
+// waitForWaveCI waits for CI to pass on each repo's merge commit, up to --wave-ci-timeout for the wave
+func waitForWaveCI(ctx context.Context, repos []lib.Repo) error {
+	deadline := time.Now().Add(mergeFlagWaveCITimeout)
+	for _, r := range repos {
+		var mergeOutput merge.Output
+		if err := loadJSON(selectedOutputPath(r.Name, "merge"), &mergeOutput); err != nil {
+			return err
+		}
+		sha := mergeOutput.MergeCommitSHA
+		if sha == "" {
+			log.Printf("%s/%s - no merge commit to wait for CI on", r.Owner, r.Name)
+			continue
+		}
+		for {
+			state, err := merge.CommitCIState(ctx, r, sha, repoLimiter(r))
+			if err != nil {
+				return fmt.Errorf("%s/%s error checking CI on merge commit %s: %s", r.Owner, r.Name, sha, err.Error())
+			}
+			if state == merge.CIFailure {
+				return fmt.Errorf("%s/%s CI failed on merge commit %s", r.Owner, r.Name, sha)
+			}
+			if state == merge.CINone {
+				log.Printf("%s/%s - no CI found on merge commit %s", r.Owner, r.Name, sha)
+			}
+			if state != merge.CIPending {
+				break
+			}
+			if time.Now().After(deadline) {
+				return fmt.Errorf("timed out after %s waiting for CI on %s/%s merge commit %s", mergeFlagWaveCITimeout, r.Owner, r.Name, sha)
+			}
+			log.Printf("%s/%s - waiting for CI on merge commit %s", r.Owner, r.Name, sha)
+			sleepUntilDeadline(mergeCIPollInterval)
+		}
+	}
+	return nil
+}
+
+// mergeSample lists the PRs that will be merged
+func mergeSample(repos []lib.Repo) []string {
+	sample := []string{}
+	for _, r := range repos {
+		if url, ok := openPullRequestURL(r); ok {
+			sample = append(sample, fmt.Sprintf("%s/%s: %s", r.Owner, r.Name, url))
+		}
+	}
+	return sample
+}
+
 func mergeOneRepo(r lib.Repo, ctx context.Context) error {
 	log.Printf("%s/%s - merging...", r.Owner, r.Name)
 
@@ -69,15 +336,24 @@ func mergeOneRepo(r lib.Repo, ctx context.Context) error {
 		merge.Output
 		Error string
 	}
-	if loadJSON(outputPath(r.Name, "merge"), &mergeOutput) == nil && mergeOutput.Success {
+	if loadJSON(selectedOutputPath(r.Name, "merge"), &mergeOutput) == nil && mergeOutput.Success {
 		log.Printf("%s/%s - already merged", r.Owner, r.Name)
+		recordMergeVerdict(r, mergeVerdict{Verdict: verdictMerged})
+		if mergeOutput.PostMerge != nil && !mergeOutput.PostMerge.Success && mergeFlagPostMergeScript != "" && !dryRun {
+			// try the failed post-merge script again
+			var pushOutput push.Output
+			loadJSON(savedOutputPath(r.Name, "push"), &pushOutput)
+			postMerge(ctx, r, mergeOutput.Output, pushOutput.PullRequestURL)
+		}
 		return nil
 	}
 
 	// Get previous step's output
 	var pushOutput push.Output
-	if loadJSON(outputPath(r.Name, "push"), &pushOutput) != nil || !pushOutput.Success {
+	if loadJSON(savedOutputPath(r.Name, "push"), &pushOutput) != nil || !pushOutput.Success {
 		log.Printf("%s/%s - skipping, must successfully push first", r.Owner, r.Name)
+		annotateSkip(r, "must successfully push first")
+		recordMergeVerdict(r, mergeVerdict{Verdict: verdictNotPushed})
 		return nil
 	}
 	segments := strings.Split(pushOutput.PullRequestURL, "/")
@@ -87,10 +363,12 @@ func mergeOneRepo(r lib.Repo, ctx context.Context) error {
 	}
 
 	// Prepare workdir for current step's output
-	mergeOutputPath := outputPath(r.Name, "merge")
+	mergeOutputPath := selectedOutputPath(r.Name, "merge")
 	mergeWorkDir := filepath.Dir(mergeOutputPath)
-	if err := os.MkdirAll(mergeWorkDir, 0755); err != nil {
-		return err
+	if !dryRun {
+		if err := os.MkdirAll(mergeWorkDir, 0755); err != nil {
+			return err
+		}
 	}
 
 	// Execute
@@ -101,14 +379,27 @@ func mergeOneRepo(r lib.Repo, ctx context.Context) error {
 		RequireReviewApproval: !mergeFlagIgnoreReviewApproval,
 		RequireBuildSuccess:   !mergeFlagIgnoreBuildStatus,
 		MergeMethod:           mergeMethod,
+		DeleteBranch:          mergeFlagDeleteBranch,
+		VerifyTimeout:         mergeVerifyTimeout(),
+		MergeStatusTimeout:    mergeFlagMergeStatusTimeout,
+		RequiredChecks:        mergeFlagRequiredChecks,
+		MergeMessage:          mergeFlagMergeMessage,
+		SquashMessage:         mergeFlagSquashMessage,
+		IncludeDrafts:         mergeFlagIncludeDrafts,
+		DryRun:                dryRun,
 	}
-	var output merge.Output
-	if r.IsGitlab() {
-		output, err = merge.GitlabMerge(ctx, input, repoLimiter, mergeThrottle)
-	} else if r.IsGithub() {
-		output, err = merge.GitHubMerge(ctx, input, repoLimiter, mergeThrottle)
-	} else {
-		log.Fatal("Provider must be github or gitlab")
+	output, err := merge.Merge(ctx, input, repoLimiter(r), mergeThrottle)
+	if dryRun {
+		return dryRunMerge(r, output, err)
+	}
+	if err == nil && output.Skipped() {
+		log.Printf("%s/%s - skipping merge (%s): %s", r.Owner, r.Name, output.SkipReason, output.SkipDetails)
+		annotateSkip(r, fmt.Sprintf("not merged (%s): %s", output.SkipReason, output.SkipDetails))
+		mergeSkipsMutex.Lock()
+		mergeSkips = append(mergeSkips, fmt.Sprintf("%s/%s\t%s\t%s", r.Owner, r.Name, output.SkipReason, output.SkipDetails))
+		mergeSkipsMutex.Unlock()
+		writeJSON(output, mergeOutputPath)
+		return nil
 	}
 	if err != nil {
 		log.Printf("%s/%s - merge error: %s", r.Owner, r.Name, err.Error())
@@ -120,13 +411,192 @@ func mergeOneRepo(r lib.Repo, ctx context.Context) error {
 		return err
 	}
 	writeJSON(output, mergeOutputPath)
+	postMerge(ctx, r, output, pushOutput.PullRequestURL)
+
+	return runHook(ctx, hookPostMerge, mergeFlagPostMergeHook, r, filepath.Join(workDir, r.Name),
+		fmt.Sprintf("MICROPLANE_PR_URL=%s", pushOutput.PullRequestURL),
+		fmt.Sprintf("MICROPLANE_MERGE_COMMIT_SHA=%s", output.MergeCommitSHA),
+	)
+}
+
+// postMerge runs the --post-merge-script, if any, for a merged repo, and records its result in
+// the repo's merge output
+func postMerge(ctx context.Context, r lib.Repo, output merge.Output, prURL string) {
+	if mergeFlagPostMergeScript == "" {
+		return
+	}
+	output.PostMerge = runPostMergeScript(ctx, mergeFlagPostMergeScript, r, filepath.Join(workDir, r.Name),
+		fmt.Sprintf("MICROPLANE_PR_URL=%s", prURL),
+		fmt.Sprintf("MICROPLANE_MERGE_COMMIT_SHA=%s", output.MergeCommitSHA),
+	)
+	if !output.PostMerge.Success {
+		atomic.AddInt64(&mergePostMergeFailedCount, 1)
+		log.Printf("%s/%s - merged, but the post-merge script failed (exit %d): %s", r.Owner, r.Name, output.PostMerge.ExitCode, firstLine(output.PostMerge.Output))
+	}
+	if err := writeJSON(output, selectedOutputPath(r.Name, "merge")); err != nil {
+		log.Printf("%s/%s - error saving the post-merge script's result: %s", r.Owner, r.Name, err.Error())
+	}
+}
+
+// mergeVerifyTimeout is how long to wait for each merge to be confirmed, or 0 without --verify-merge
+func mergeVerifyTimeout() time.Duration {
+	if !mergeFlagVerifyMerge {
+		return 0
+	}
+	return mergeFlagVerifyMergeTimeout
+}
+
+// dryRunMerge reports if a PR would be merged, without recording anything
+func dryRunMerge(r lib.Repo, output merge.Output, err error) error {
+	verdict := dryRunVerdict(output, err)
+	recordMergeVerdict(r, verdict)
+	switch verdict.Verdict {
+	case verdictError:
+		log.Printf("%s%s/%s - merge error: %s", dryRunPrefix, r.Owner, r.Name, err.Error())
+		return err
+	case verdictMerged:
+		log.Printf("%s%s/%s - already merged", dryRunPrefix, r.Owner, r.Name)
+	case verdictWouldMerge:
+		log.Printf("%s%s/%s - would merge with method %s", dryRunPrefix, r.Owner, r.Name, mergeMethod)
+	case verdictSkip:
+		log.Printf("%s%s/%s - wouldn't merge (%s): %s", dryRunPrefix, r.Owner, r.Name, output.SkipReason, output.SkipDetails)
+	}
 	return nil
 }
 
+// Verdicts of a merge dry run on a repo
+const (
+	verdictWouldMerge = "would-merge"
+	verdictSkip       = "skip"
+	verdictMerged     = "already-merged"
+	verdictNotPushed  = "not-pushed"
+	verdictError      = "error"
+)
+
+// mergeVerdict is what a merge dry run found for a repo, using the same checks as a real merge
+type mergeVerdict struct {
+	Owner       string
+	Name        string
+	Verdict     string
+	SkipReason  string `json:",omitempty"`
+	SkipDetails string `json:",omitempty"`
+	Error       string `json:",omitempty"`
+}
+
+// verdicts of the merge dry run, for its report
+var mergeVerdicts []mergeVerdict
+var mergeVerdictsMutex sync.Mutex
+
+// dryRunVerdict is the verdict for the result of a dry run merge
+func dryRunVerdict(output merge.Output, err error) mergeVerdict {
+	switch {
+	case err != nil:
+		return mergeVerdict{Verdict: verdictError, Error: err.Error()}
+	case output.Success:
+		return mergeVerdict{Verdict: verdictMerged}
+	case output.WouldMerge:
+		return mergeVerdict{Verdict: verdictWouldMerge}
+	case output.Skipped():
+		return mergeVerdict{Verdict: verdictSkip, SkipReason: output.SkipReason, SkipDetails: output.SkipDetails}
+	}
+	return mergeVerdict{Verdict: verdictError, Error: "merge didn't report a result"}
+}
+
+// recordMergeVerdict records a repo's verdict in a dry run, for the report
+func recordMergeVerdict(r lib.Repo, verdict mergeVerdict) {
+	if !dryRun {
+		return
+	}
+	verdict.Owner = r.Owner
+	verdict.Name = r.Name
+	mergeVerdictsMutex.Lock()
+	defer mergeVerdictsMutex.Unlock()
+	mergeVerdicts = append(mergeVerdicts, verdict)
+}
+
+// sortedMergeVerdicts are the dry run's verdicts, by repo
+func sortedMergeVerdicts() []mergeVerdict {
+	mergeVerdictsMutex.Lock()
+	defer mergeVerdictsMutex.Unlock()
+	sort.Slice(mergeVerdicts, func(i, j int) bool {
+		a, b := mergeVerdicts[i], mergeVerdicts[j]
+		return a.Owner+"/"+a.Name < b.Owner+"/"+b.Name
+	})
+	return mergeVerdicts
+}
+
+// printMergeVerdicts prints the dry run's verdict on every repo
+func printMergeVerdicts() {
+	verdicts := sortedMergeVerdicts()
+	counts := map[string]int{}
+	out := tabWriterWithDefaults()
+	fmt.Fprintln(out, joinWithTab("REPO", "VERDICT", "REASON", "DETAILS"))
+	for _, v := range verdicts {
+		counts[v.Verdict]++
+		details := v.SkipDetails
+		if v.Error != "" {
+			details = v.Error
+		}
+		fmt.Fprintln(out, joinWithTab(fmt.Sprintf("%s/%s", v.Owner, v.Name), v.Verdict, v.SkipReason, details))
+	}
+	out.Flush()
+	fmt.Printf("%s%d would merge, %d wouldn't, %d already merged, %d not pushed, %d errors\n", dryRunPrefix,
+		counts[verdictWouldMerge], counts[verdictSkip], counts[verdictMerged], counts[verdictNotPushed], counts[verdictError])
+}
+
+// writeMergeVerdicts writes the dry run's verdicts to --output-file, if it's set
+func writeMergeVerdicts(cmd *cobra.Command) error {
+	outputFile, err := cmd.Flags().GetString("output-file")
+	if err != nil || outputFile == "" {
+		return err
+	}
+	return writeJSON(struct {
+		Step   string
+		DryRun bool
+		Repos  []mergeVerdict
+	}{"merge", true, sortedMergeVerdicts()}, outputFile)
+}
+
+// printMergeSkips lists the PRs that need attention before they can be merged
+func printMergeSkips() {
+	if len(mergeSkips) == 0 {
+		return
+	}
+	sort.Strings(mergeSkips)
+	fmt.Printf("%d PRs were not ready to merge:\n", len(mergeSkips))
+	out := tabWriterWithDefaults()
+	fmt.Fprintln(out, joinWithTab("REPO", "REASON", "DETAILS"))
+	for _, line := range mergeSkips {
+		fmt.Fprintln(out, line)
+	}
+	out.Flush()
+}
+
 func init() {
+	mergeCmd.Flags().StringVar(&mergeFlagPostMergeScript, "post-merge-script", "", "command to run in each repo's work dir once it's merged, e.g. to check the deploy. its exit code and output are recorded in the merge output, and a failure doesn't undo the merge. same variables as --post-merge-hook")
+	mergeCmd.Flags().StringVar(&mergeFlagPostMergeHook, "post-merge-hook", "", "command to run in each repo's work dir after it's merged. MICROPLANE_REPO, MICROPLANE_OWNER, MICROPLANE_PR_URL, and MICROPLANE_MERGE_COMMIT_SHA are set")
+	mergeCmd.Flags().StringSliceVar(&hookFlagBestEffort, "best-effort-hooks", nil, "hooks whose failure doesn't fail the repo, e.g. 'post-push,post-merge'")
+	addOutputFileFlag(mergeCmd)
+	addAllowedReposFlag(mergeCmd)
+	mergeCmd.Flags().StringVar(&selectedRunID, "run-id", "", "merge the PRs pushed as of a previous run, from the outputs saved under its ID in the work dir. merge outputs are saved under it too")
 	mergeCmd.Flags().StringVarP(&mergeFlagThrottle, "throttle", "t", "30s", "Throttle number of merges, e.g. '30s' means 1 merge per 30 seconds")
 	mergeCmd.Flags().BoolVar(&mergeFlagIgnoreReviewApproval, "ignore-review-approval", false, "Ignore whether or not the review has been approved")
 	mergeCmd.Flags().BoolVar(&mergeFlagIgnoreBuildStatus, "ignore-build-status", false, "Ignore whether or not builds are passing")
+	mergeCmd.Flags().BoolVarP(&mergeFlagYes, "yes", "y", false, "merge without asking for confirmation")
+	mergeCmd.Flags().DurationVar(&mergeFlagMergeStatusTimeout, "merge-status-timeout", time.Minute, "How long to wait for Github or Gitlab to finish checking if a PR is mergeable")
+	mergeCmd.Flags().StringSliceVar(&mergeFlagRequiredChecks, "required-checks", nil, "Names of statuses or checks which must have succeeded, e.g. 'ci/circleci,lint'")
+	mergeCmd.Flags().StringVar(&mergeFlagMergeMessage, "merge-message", "", "Go template for the merge commit message, whose first line is the title. Variables: .Owner .Name .PRNumber .PRTitle .PRURL .Branch")
+	mergeCmd.Flags().StringVar(&mergeFlagSquashMessage, "squash-message", "", "Go template for the commit message of squash merges, defaults to --merge-message")
+	mergeCmd.Flags().BoolVar(&mergeFlagIncludeDrafts, "include-drafts", false, "mark draft MRs as ready and merge them, instead of skipping them (only supported for gitlab)")
+	mergeCmd.Flags().Int64VarP(&mergeFlagParallelism, "parallelism", "p", defaultParallelism, "Parallelism limit. Each repo waits for its own checks, while --throttle still spaces out the merges themselves")
+	mergeCmd.Flags().BoolVar(&mergeFlagOnlyPushed, "only-pushed", false, "only merge repos whose branch changed in the most recent push")
+	mergeCmd.Flags().StringVar(&mergeFlagSince, "since", "", "only merge repos whose branch was pushed since this time, e.g. '2h' or '2006-01-02T15:04:05Z'")
+	mergeCmd.Flags().DurationVar(&mergeFlagWaveDelay, "wave-delay", 0, "with merge waves from plan --wave-file, how long to wait after a wave merges before starting the next, e.g. '10m'")
+	mergeCmd.Flags().BoolVar(&mergeFlagWaveWaitForCI, "wave-wait-for-ci", false, "with merge waves from plan --wave-file, wait for CI to pass on a wave's merge commits before starting the next")
+	mergeCmd.Flags().DurationVar(&mergeFlagWaveCITimeout, "wave-ci-timeout", 30*time.Minute, "how long --wave-wait-for-ci waits for a wave's CI")
+	mergeCmd.Flags().BoolVar(&mergeFlagDeleteBranch, "delete-branch", true, "delete each PR's branch once it's merged, with any --merge-method")
+	mergeCmd.Flags().BoolVar(&mergeFlagVerifyMerge, "verify-merge", false, "after requesting each merge, wait for the provider to confirm the PR merged, failing the repo if it doesn't")
+	mergeCmd.Flags().DurationVar(&mergeFlagVerifyMergeTimeout, "verify-merge-timeout", 10*time.Minute, "how long --verify-merge waits for each PR to merge")
 	mergeCmd.Flags().StringVarP(&mergeMethod, "merge-method", "m", "merge", fmt.Sprintf("Merge method to use. Possible values include: %s", strings.Join(supportedMergeMethods, ", ")))
 }
 
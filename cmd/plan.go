@@ -3,23 +3,65 @@ package cmd
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/Clever/microplane/clone"
 	"github.com/Clever/microplane/lib"
 	"github.com/Clever/microplane/merge"
 	"github.com/Clever/microplane/plan"
 	"github.com/spf13/cobra"
+	"github.com/waigani/diffparser"
 )
 
 var planFlagBranch string
 var planFlagDiff bool
 var planFlagMessage string
+var planFlagMessageFile string
 var planFlagParallelism int64
 var planAllowEmptyCommit bool
+var planFlagEmptyCommitMessage string
+var planFlagPreserveCommits bool
+var planFlagTitleFromCommit string
+var planFlagRetries int
+var planFlagChangedOnly bool
+var planFlagPrePlanHook string
+var planFlagBase string
+var planFlagBaseFile string
+
+var planFlagMetadataFile string
+var planFlagIgnore []string
+var planFlagPlanDir string
+var planFlagWaveFile string
+var planFlagSkipCI bool
+var planFlagCommitAuthor string
+var planFlagScripts []string
+var planFlagPostPlanFormat string
+var planFlagRepoTimeout time.Duration
+var planFlagCampaignID string
+
+// planBaseBranches are the per-repo base branches from --base-file
+var planBaseBranches map[string]string
+
+// planMergeWaves are the per-repo merge waves from --wave-file
+var planMergeWaves map[string]int
+
+// planRepoMetadata is the per-repo metadata from --metadata-file, for --branch templates
+var planRepoMetadata map[string]map[string]string
+
+// planDate is the day planning started, for --branch templates
+var planDate string
+
+// counts of repos whose plan did or didn't change, with --changed-only
+var planChangedCount, planUnchangedCount int64
+
+// count of repos skipped because they're in --ignore or have a plan.IgnoreFile
+var planIgnoredCount int64
 
 // TODO: Pass these *not* via globals
 // these variables are set when the cmd starts running
@@ -27,25 +69,27 @@ var (
 	allowEmptyCommit bool
 	branchName       string
 	commitMessage    string
-	changeCmd        string
-	changeCmdArgs    []string
+	changeCmds       []plan.Command
 	isSingleRepo     bool
 	showDiff         bool
+	preserveCommits  bool
+	titleFromCommit  string
 )
 
 var planCmd = &cobra.Command{
 	Use:   "plan [cmd] [args...]",
-	Args:  cobra.MinimumNArgs(1),
+	Args:  cobra.ArbitraryArgs,
 	Short: "Plan changes by running a command against cloned repos",
 	Example: `mp plan -b microplaning -m 'microplane fun' -r app-service -- sh -c /absolute/path/to/script
-mp plan -b microplaning -m 'microplane fun' -r app-service -- python /absolute/path/to/script`,
+mp plan -b microplaning -m 'microplane fun' -r app-service -- python /absolute/path/to/script
+mp plan -b microplaning -m 'microplane fun' --script 'gofmt -w .' --script /absolute/path/to/modify --script 'go generate ./...'`,
 	Run: func(cmd *cobra.Command, args []string) {
 		var err error
 		var parallelismLimit int64
 
-		changeCmd = args[0]
-		if len(args) > 1 {
-			changeCmdArgs = args[1:]
+		changeCmds = planChangeCommands(args, planFlagScripts)
+		if len(changeCmds) == 0 {
+			log.Fatal("plan needs a change command, as [cmd] [args...] or --script")
 		}
 
 		branchName, err = cmd.Flags().GetString("branch")
@@ -55,6 +99,56 @@ mp plan -b microplaning -m 'microplane fun' -r app-service -- python /absolute/p
 		if branchName == "" {
 			log.Fatal("--branch is required")
 		}
+		if _, err := plan.ParseBranchTemplate(branchName); err != nil {
+			log.Fatalf("Invalid --branch: %s", err.Error())
+		}
+		if !strings.Contains(branchName, "{{") {
+			// the same for every repo, so check it once up front
+			branch, err := plan.RenderBranchName(branchName, plan.BranchVars{})
+			if err != nil {
+				log.Fatal(err)
+			}
+			if branch != branchName {
+				log.Printf("using branch '%s' instead of '%s'", branch, branchName)
+			}
+		}
+
+		if planFlagMetadataFile != "" {
+			if err := loadJSON(planFlagMetadataFile, &planRepoMetadata); err != nil {
+				log.Fatalf("error loading --metadata-file: %s", err.Error())
+			}
+		}
+		planDate = time.Now().Format("2006-01-02")
+
+		if err := applyCommitAuthor(planFlagCommitAuthor); err != nil {
+			log.Fatal(err)
+		}
+
+		if planFlagBaseFile != "" {
+			if err := loadJSON(planFlagBaseFile, &planBaseBranches); err != nil {
+				log.Fatalf("error loading --base-file: %s", err.Error())
+			}
+		}
+		if planFlagBase != "" {
+			if err := lib.ValidateBranchName(planFlagBase); err != nil {
+				log.Fatalf("invalid --base: %s", err.Error())
+			}
+		}
+		if planFlagWaveFile != "" {
+			if err := loadJSON(planFlagWaveFile, &planMergeWaves); err != nil {
+				log.Fatalf("error loading --wave-file: %s", err.Error())
+			}
+		}
+		for repo, wave := range planMergeWaves {
+			if wave < 1 {
+				log.Fatalf("invalid merge wave for %s in --wave-file: %d, must be at least 1", repo, wave)
+			}
+		}
+		for repo, base := range planBaseBranches {
+			if err := lib.ValidateBranchName(base); err != nil {
+				log.Fatalf("invalid base branch for %s in --base-file: %s", repo, err.Error())
+			}
+		}
 
 		diff, err := cmd.Flags().GetBool("diff")
 		if err != nil {
@@ -62,18 +156,44 @@ mp plan -b microplaning -m 'microplane fun' -r app-service -- python /absolute/p
 		}
 		showDiff = diff
 
+		preserveCommits, err = cmd.Flags().GetBool("preserve-commits")
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		titleFromCommit, err = cmd.Flags().GetString("title-from-commit")
+		if err != nil {
+			log.Fatal(err)
+		}
+		if titleFromCommit != "first" && titleFromCommit != "latest" {
+			log.Fatalf("Invalid --title-from-commit: %s", titleFromCommit)
+		}
+
 		commitMessage, err = cmd.Flags().GetString("message")
 		if err != nil {
 			log.Fatal(err)
 		}
-		if commitMessage == "" {
-			log.Fatal("--message is required")
+		if planFlagMessageFile != "" {
+			if commitMessage != "" {
+				log.Fatal("--message and --message-file can't be used together")
+			}
+			if commitMessage, err = readFlagFile("message-file", planFlagMessageFile); err != nil {
+				log.Fatal(err)
+			}
+			commitMessage = strings.TrimSpace(commitMessage)
+		}
+		if commitMessage == "" && !preserveCommits {
+			log.Fatal("--message or --message-file is required")
 		}
 
 		repos, err := whichRepos(cmd)
 		if err != nil {
 			log.Fatal(err)
 		}
+
+		if err := lib.CheckGit(); err != nil {
+			log.Fatal(err)
+		}
 		isSingleRepo = len(repos) == 1
 
 		parallelismLimit, err = cmd.Flags().GetInt64("parallelism")
@@ -81,6 +201,16 @@ mp plan -b microplaning -m 'microplane fun' -r app-service -- python /absolute/p
 			log.Fatal(err)
 		}
 
+		if planFlagCampaignID != "" {
+			if err := lib.ValidateCampaignID(planFlagCampaignID); err != nil {
+				log.Fatalf("Invalid --campaign-id: %s", err.Error())
+			}
+		}
+
+		if planFlagRepoTimeout < 0 {
+			log.Fatal("--repo-timeout can't be negative")
+		}
+
 		allowEmptyCommit, err = cmd.Flags().GetBool("allow-empty-commit")
 		if err != nil {
 			log.Fatal(err)
@@ -88,12 +218,34 @@ mp plan -b microplaning -m 'microplane fun' -r app-service -- python /absolute/p
 
 		log.Printf("planning %d repos with parallelism limit [%d]", len(repos), parallelismLimit)
 		err = parallelizeLimited(repos, planOneRepo, parallelismLimit)
+		if err := writeOutputFile(cmd, repos, "plan"); err != nil {
+			log.Printf("error writing --output-file: %s", err.Error())
+		}
+		if planFlagChangedOnly && !dryRun {
+			log.Printf("%d repos changed since last plan, %d unchanged", planChangedCount, planUnchangedCount)
+		}
+		if planIgnoredCount > 0 {
+			log.Printf("%d repos ignored", planIgnoredCount)
+		}
 		if err != nil {
 			log.Fatalf("%d errors:\n %+v\n", strings.Count(err.Error(), " | ")+1, err)
 		}
 	},
 }
 
+// planChangeCommands are the change commands plan runs in each repo, in order: [cmd] [args...],
+// if given, then each --script, run with sh -c
+func planChangeCommands(args []string, scripts []string) []plan.Command {
+	cmds := []plan.Command{}
+	if len(args) > 0 {
+		cmds = append(cmds, plan.Command{Path: args[0], Args: args[1:]})
+	}
+	for _, script := range scripts {
+		cmds = append(cmds, plan.Command{Path: "sh", Args: []string{"-c", script}})
+	}
+	return cmds
+}
+
 func planOneRepo(r lib.Repo, ctx context.Context) error {
 	log.Printf("planning: %s/%s", r.Owner, r.Name)
 
@@ -101,6 +253,7 @@ func planOneRepo(r lib.Repo, ctx context.Context) error {
 	var cloneOutput clone.Output
 	if loadJSON(outputPath(r.Name, "clone"), &cloneOutput) != nil || !cloneOutput.Success {
 		log.Printf("skipping %s/%s, must successfully clone first", r.Owner, r.Name)
+		annotateSkip(r, "must successfully clone first")
 		return nil
 	}
 
@@ -114,24 +267,92 @@ func planOneRepo(r lib.Repo, ctx context.Context) error {
 		return nil
 	}
 
-	// Prepare workdir for current step's output
+	if !dryRun {
+		if err := keepPreviousPlan(r); err != nil {
+			return fmt.Errorf("%s/%s error: %+v", r.Owner, r.Name, err)
+		}
+	}
+
+	if contains(planFlagIgnore, fmt.Sprintf("%s/%s", r.Owner, r.Name)) || contains(planFlagIgnore, r.Name) {
+		return ignorePlan(r, plan.Output{Ignored: true, IgnoreReason: "excluded by --ignore"})
+	}
+
+	// Remember the previous plan, to tell if this one is any different
+	var previousOutput plan.Output
+	hasPreviousOutput := loadJSON(outputPath(r.Name, "plan"), &previousOutput) == nil && previousOutput.Success
+
+	// Prepare workdir for current step's output. A dry run plans in a temporary dir instead, so
+	// the previous plan is left as is
 	planOutputPath := outputPath(r.Name, "plan")
 	planWorkDir := filepath.Dir(planOutputPath)
-	if err := os.MkdirAll(planWorkDir, 0755); err != nil {
-		return err
+	branch, err := plan.RenderBranchName(branchName, branchVars(r))
+	if dryRun {
+		if err != nil {
+			return dryRunPlan(r, plan.Output{}, err)
+		}
+		if planWorkDir, err = ioutil.TempDir("", "mp-plan-"); err != nil {
+			return err
+		}
+		defer os.RemoveAll(planWorkDir)
+	} else {
+		if err := os.MkdirAll(planWorkDir, 0755); err != nil {
+			return err
+		}
+		if planFlagPlanDir != "" {
+			// keep the planned copy elsewhere, e.g. on a bigger disk. plan.json stays in the work dir
+			dir, absErr := filepath.Abs(filepath.Join(planFlagPlanDir, r.Name))
+			if absErr != nil {
+				return absErr
+			}
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return err
+			}
+			planWorkDir = dir
+		}
+
+		if err == nil {
+			err = runHook(ctx, hookPrePlan, planFlagPrePlanHook, r, cloneOutput.ClonedIntoDir, fmt.Sprintf("MICROPLANE_BRANCH=%s", branch))
+		}
+		if err != nil {
+			o := struct {
+				plan.Output
+				Error string
+			}{plan.Output{Success: false}, err.Error()}
+			writeJSON(o, planOutputPath)
+			return fmt.Errorf("%s/%s error: %+v", r.Owner, r.Name, err)
+		}
 	}
 
 	// Execute
 	input := plan.Input{
-		RepoName:         r.Name,
-		RepoDir:          cloneOutput.ClonedIntoDir,
-		WorkDir:          planWorkDir,
-		Command:          plan.Command{Path: changeCmd, Args: changeCmdArgs},
-		CommitMessage:    commitMessage,
-		BranchName:       branchName,
-		AllowEmptyCommit: allowEmptyCommit,
+		RepoName:           r.Name,
+		RepoDir:            cloneOutput.ClonedIntoDir,
+		WorkDir:            planWorkDir,
+		Commands:           changeCmds,
+		CommitMessage:      commitMessage,
+		BranchName:         branch,
+		BaseBranch:         baseBranch(r),
+		AllowEmptyCommit:   allowEmptyCommit,
+		EmptyCommitMessage: planFlagEmptyCommitMessage,
+		PreserveCommits:    preserveCommits,
+		TitleFromCommit:    titleFromCommit,
+		Retries:            planFlagRetries,
+		Timeout:            planFlagRepoTimeout,
+		CampaignID:         planFlagCampaignID,
+	}
+	if planFlagPostPlanFormat != "" {
+		input.FormatCommand = &plan.Command{Path: "sh", Args: []string{"-c", planFlagPostPlanFormat}}
+	}
+	if planFlagSkipCI {
+		input.SkipCIToken = r.SkipCIToken()
 	}
 	output, err := plan.Plan(ctx, input)
+	if output.Ignored {
+		return ignorePlan(r, output)
+	}
+	if dryRun {
+		return dryRunPlan(r, output, err)
+	}
 	if err != nil {
 		o := struct {
 			plan.Output
@@ -140,18 +361,112 @@ func planOneRepo(r lib.Repo, ctx context.Context) error {
 		writeJSON(o, planOutputPath)
 		return fmt.Errorf("%s/%s error: %+v", r.Owner, r.Name, err)
 	}
+	output.MergeWave = mergeWave(r)
+	output.Metadata = repoMetadata(planRepoMetadata, r)
+	if planFlagChangedOnly {
+		if hasPreviousOutput && samePlan(previousOutput, output) {
+			output.Unchanged = true
+			atomic.AddInt64(&planUnchangedCount, 1)
+			log.Printf("%s/%s - unchanged since last plan", r.Owner, r.Name)
+		} else {
+			atomic.AddInt64(&planChangedCount, 1)
+		}
+	}
 	writeJSON(output, planOutputPath)
-	if showDiff {
+	if showDiff && !output.Unchanged {
 		log.Printf("diffing: %s/%s", r.Owner, r.Name)
 		fmt.Println(output.GitDiff)
 	}
 	return nil
 }
 
+// ignorePlan records that a repo was skipped because it opted out of changes
+func ignorePlan(r lib.Repo, output plan.Output) error {
+	atomic.AddInt64(&planIgnoredCount, 1)
+	log.Printf("%s%s/%s - skipped (ignored): %s", dryRunLabel(), r.Owner, r.Name, output.IgnoreReason)
+	annotateSkip(r, "ignored: "+output.IgnoreReason)
+	if dryRun {
+		return nil
+	}
+	planOutputPath := outputPath(r.Name, "plan")
+	if err := os.MkdirAll(filepath.Dir(planOutputPath), 0755); err != nil {
+		return err
+	}
+	return writeJSON(output, planOutputPath)
+}
+
+// samePlan determines if two plans would result in the same change
+func samePlan(a, b plan.Output) bool {
+	return a.GitDiff == b.GitDiff && a.CommitMessage == b.CommitMessage && a.BranchName == b.BranchName && a.BaseBranch == b.BaseBranch
+}
+
+// baseBranch looks up the branch to plan a repo's change on, from --base-file by owner/name or name,
+// falling back to --base. Empty means the repo's default branch.
+func baseBranch(r lib.Repo) string {
+	if base, ok := planBaseBranches[fmt.Sprintf("%s/%s", r.Owner, r.Name)]; ok {
+		return base
+	}
+	if base, ok := planBaseBranches[r.Name]; ok {
+		return base
+	}
+	return planFlagBase
+}
+
+// mergeWave looks up a repo's merge wave in --wave-file, by owner/name or name. 0 means it has none.
+func mergeWave(r lib.Repo) int {
+	if wave, ok := planMergeWaves[fmt.Sprintf("%s/%s", r.Owner, r.Name)]; ok {
+		return wave
+	}
+	return planMergeWaves[r.Name]
+}
+
+// branchVars are the variables for a repo's --branch template. Metadata is looked up in
+// --metadata-file by owner/name or name.
+func branchVars(r lib.Repo) plan.BranchVars {
+	return plan.BranchVars{Owner: r.Owner, Name: r.Name, Date: planDate, Metadata: repoMetadata(planRepoMetadata, r)}
+}
+
+// dryRunPlan reports what a plan would change, without recording it
+func dryRunPlan(r lib.Repo, output plan.Output, err error) error {
+	if err != nil {
+		return fmt.Errorf("%s%s/%s error: %+v", dryRunPrefix, r.Owner, r.Name, err)
+	}
+	files := 0
+	if diff, err := diffparser.Parse(output.GitDiff); err == nil {
+		files = len(diff.Files)
+	}
+	log.Printf("%s%s/%s - would commit %d changed file(s) to branch %s", dryRunPrefix, r.Owner, r.Name, files, output.BranchName)
+	if showDiff {
+		fmt.Println(output.GitDiff)
+	}
+	return nil
+}
+
 func init() {
-	planCmd.Flags().StringVarP(&planFlagBranch, "branch", "b", "", "Git branch to commit to")
+	planCmd.Flags().StringVar(&planFlagPrePlanHook, "pre-plan-hook", "", "command to run in each cloned repo before planning. MICROPLANE_REPO, MICROPLANE_OWNER, and MICROPLANE_BRANCH are set")
+	planCmd.Flags().StringSliceVar(&hookFlagBestEffort, "best-effort-hooks", nil, "hooks whose failure doesn't fail the repo, e.g. 'post-push,post-merge'")
+	addOutputFileFlag(planCmd)
+	planCmd.Flags().StringVarP(&planFlagBranch, "branch", "b", "", "Git branch to commit to. This is a Go template, e.g. 'codemod/{{.Metadata.team}}/{{.Date}}'. Variables: .Owner .Name .Date .Metadata")
+	planCmd.Flags().StringVar(&planFlagMetadataFile, "metadata-file", "", "JSON file mapping repos to metadata for --branch templates, e.g. {\"clever/app\": {\"team\": \"infra\"}}")
+	planCmd.Flags().StringSliceVar(&planFlagIgnore, "ignore", nil, "repos to skip, as owner/name or name, as if they had a "+plan.IgnoreFile+" file")
+	planCmd.Flags().StringVar(&planFlagPlanDir, "plan-dir", "", "directory for the planned copies of each repo, as <plan-dir>/<repo>. defaults to the work dir")
+	planCmd.Flags().StringVar(&planFlagBase, "base", "", "branch to make the change on, which the PR will target. defaults to each repo's default branch")
+	planCmd.Flags().StringVar(&planFlagBaseFile, "base-file", "", "JSON file mapping repos to their base branch, overriding --base, e.g. {\"clever/app\": \"release-1.x\", \"lib\": \"main\"}")
+	planCmd.Flags().StringVar(&planFlagWaveFile, "wave-file", "", "JSON file mapping repos to the wave they merge in, e.g. {\"clever/lib\": 1, \"app\": 2}. merge merges each wave before starting the next, and repos not in the file merge last")
 	planCmd.Flags().BoolVarP(&planFlagDiff, "diff", "d", false, "Show the diffs of the changes made per repo")
 	planCmd.Flags().StringVarP(&planFlagMessage, "message", "m", "", "Commit message")
+	planCmd.Flags().StringVar(&planFlagMessageFile, "message-file", "", "File containing the commit message, instead of --message, or - to read it from stdin")
 	planCmd.Flags().Int64VarP(&planFlagParallelism, "parallelism", "p", defaultParallelism, "Parallelism limit")
+	planCmd.Flags().DurationVar(&planFlagRepoTimeout, "repo-timeout", 0, "fail a repo whose plan takes longer than this, e.g. 10m, killing its change commands. retries count toward it. 0 means no limit")
 	planCmd.Flags().BoolVarP(&planAllowEmptyCommit, "allow-empty-commit", "e", false, "Commit even if no changes were made")
+	planCmd.Flags().StringArrayVar(&planFlagScripts, "script", nil, "change command to run with sh -c, after [cmd] if given. repeat it to run several in order, e.g. to format, modify, then regenerate. plan stops at the first that fails")
+	planCmd.Flags().StringVar(&planFlagCampaignID, "campaign-id", "", "add a 'Microplane-Campaign: <id>' trailer to each branch's last commit, so push can tell the change already reached the base branch, even once the branch is gone")
+	planCmd.Flags().StringVar(&planFlagPostPlanFormat, "post-plan-format", "", "command to run with sh -c in each repo after the change commands and before committing, e.g. 'gofmt -w .', so the PR passes the repo's linters. the repo fails if it does")
+	planCmd.Flags().StringVar(&planFlagCommitAuthor, "commit-author", "", "author of the commits plan makes, e.g. 'Jane Doe <jane@example.com>'. defaults to git's user. PRs are opened by whoever push's API token authenticates as, see push --pr-opener")
+	planCmd.Flags().StringVar(&planFlagEmptyCommitMessage, "empty-commit-message", "", "Commit message for the empty commit made when the command makes no changes, e.g. to open a review PR anyway. Implies --allow-empty-commit")
+	planCmd.Flags().BoolVar(&planFlagPreserveCommits, "preserve-commits", false, "Keep commits made by the command instead of expecting uncommitted changes. --message is then only needed for leftover changes")
+	planCmd.Flags().BoolVar(&planFlagSkipCI, "skip-ci", false, "add the provider's skip CI token, e.g. '[skip ci]', to the commit message so pushing doesn't run CI. The PR title and body don't include it")
+	planCmd.Flags().BoolVar(&planFlagChangedOnly, "changed-only", false, "Compare against the previous plan, and mark repos whose changes are the same as unchanged")
+	planCmd.Flags().IntVar(&planFlagRetries, "retries", 0, "Number of times to re-run the command on a fresh copy of the repo if it fails")
+	planCmd.Flags().StringVar(&planFlagTitleFromCommit, "title-from-commit", "latest", "With --preserve-commits, which commit's message to use for the PR title and body: 'first' or 'latest'")
 }
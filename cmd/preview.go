@@ -0,0 +1,132 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/Clever/microplane/lib"
+	"github.com/Clever/microplane/plan"
+	"github.com/spf13/cobra"
+)
+
+// CLI flags
+var previewFlagFilter string
+var previewFlagPager bool
+var previewFlagOutputDir string
+
+// defaultPager is used for --pager when $PAGER isn't set
+const defaultPager = "less -R"
+
+var previewCmd = &cobra.Command{
+	Use:   "preview",
+	Short: "Preview the diffs planned for each repo, before pushing",
+	Long: `Preview the diffs planned for each repo, before pushing.
+
+The unified diff from each repo's plan is printed, one repo after another. Pass
+--pager to page through them, or --output-dir to write each to <repo>.diff.
+
+Repos that haven't been planned successfully are skipped.`,
+	Example: `mp preview
+mp preview --filter 'app-*' --pager
+mp preview --output-dir diffs`,
+	Args: cobra.ExactArgs(0),
+	Run: func(cmd *cobra.Command, args []string) {
+		repos, err := whichRepos(cmd)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		repos, err = filterReposOrExit(repos, previewFlagFilter)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if previewFlagOutputDir != "" {
+			if err := writeDiffFiles(previewFlagOutputDir, repos); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+
+		if !previewFlagPager {
+			writeDiffs(os.Stdout, repos)
+			return
+		}
+		var diffs bytes.Buffer
+		writeDiffs(&diffs, repos)
+		if err := page(&diffs); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+// plannedDiff loads the diff from a repo's plan, if it was planned successfully
+func plannedDiff(r lib.Repo) (string, bool) {
+	var planOutput plan.Output
+	if loadJSON(outputPath(r.Name, "plan"), &planOutput) != nil || !planOutput.Success {
+		return "", false
+	}
+	return planOutput.GitDiff, true
+}
+
+// writeDiffs writes each repo's planned diff, under a header naming the repo
+func writeDiffs(w io.Writer, repos []lib.Repo) {
+	for _, r := range repos {
+		diff, ok := plannedDiff(r)
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(w, "==> %s/%s <==\n", r.Owner, r.Name)
+		if diff == "" {
+			fmt.Fprintln(w, "(no changes)")
+		} else {
+			fmt.Fprint(w, diff)
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+// writeDiffFiles writes each repo's planned diff to <dir>/<repo>.diff
+func writeDiffFiles(dir string, repos []lib.Repo) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	written := 0
+	for _, r := range repos {
+		diff, ok := plannedDiff(r)
+		if !ok {
+			continue
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, r.Name+".diff"), []byte(diff), 0644); err != nil {
+			return err
+		}
+		written++
+	}
+	log.Printf("wrote %d diff(s) to %s", written, dir)
+	return nil
+}
+
+// page shows output in the user's pager
+func page(r io.Reader) error {
+	pager := os.Getenv("PAGER")
+	if pager == "" {
+		pager = defaultPager
+	}
+	cmd := exec.Command("sh", "-c", pager)
+	cmd.Stdin = r
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+func init() {
+	previewCmd.Flags().StringVar(&previewFlagFilter, "filter", "", "only preview repos matching this glob, e.g. 'app-*' or 'clever/app-*'")
+	previewCmd.Flags().BoolVar(&previewFlagPager, "pager", false, "page through the diffs with $PAGER, or '"+defaultPager+"' if it isn't set")
+	previewCmd.Flags().StringVar(&previewFlagOutputDir, "output-dir", "", "write each repo's diff to <repo>.diff in this directory, instead of printing them")
+}
@@ -0,0 +1,114 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/spf13/cobra"
+)
+
+// CLI flags
+var profileName string
+var profilesFile string
+
+// profile bundles the options for a target, e.g. a staging or production Gitlab, so that
+// switching targets is one --profile flag. Flags given explicitly override the profile's.
+type profile struct {
+	// Provider, ProviderURL, and TokenEnv are defaults for init's --provider, --provider-url,
+	// and --token-env
+	Provider    string
+	ProviderURL string
+	TokenEnv    string
+	// Flags are defaults for any command's flags, by flag name, e.g. {"throttle": "30s"}
+	Flags map[string]string
+}
+
+// defaultProfilesFile is where profiles are read from, without --profiles-file or $MICROPLANE_PROFILES_FILE
+func defaultProfilesFile() string {
+	if file := os.Getenv("MICROPLANE_PROFILES_FILE"); file != "" {
+		return file
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".microplane", "profiles.json")
+}
+
+// loadProfile reads a named profile from a JSON file of profiles by name
+func loadProfile(file string, name string) (profile, error) {
+	bs, err := ioutil.ReadFile(file)
+	if err != nil {
+		return profile{}, fmt.Errorf("cannot read profiles: %s", err.Error())
+	}
+	var profiles map[string]profile
+	if err := json.Unmarshal(bs, &profiles); err != nil {
+		return profile{}, fmt.Errorf("invalid profiles in %s: %s", file, err.Error())
+	}
+	p, ok := profiles[name]
+	if !ok {
+		names := []string{}
+		for n := range profiles {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return profile{}, fmt.Errorf("no profile %q in %s, it has %v", name, file, names)
+	}
+	return p, nil
+}
+
+// flagDefaults are the flag values a profile sets, by flag name
+func (p profile) flagDefaults() map[string]string {
+	defaults := map[string]string{}
+	for name, value := range p.Flags {
+		defaults[name] = value
+	}
+	for name, value := range map[string]string{"provider": p.Provider, "provider-url": p.ProviderURL, "token-env": p.TokenEnv} {
+		if value != "" {
+			defaults[name] = value
+		}
+	}
+	return defaults
+}
+
+// applyProfile sets the flags of the --profile, if any, that weren't given explicitly. Flags the
+// command doesn't have are left for the commands that do, but ones no command has are an error.
+func applyProfile(cmd *cobra.Command) error {
+	if profileName == "" {
+		return nil
+	}
+	p, err := loadProfile(profilesFile, profileName)
+	if err != nil {
+		return err
+	}
+	for name, value := range p.flagDefaults() {
+		if !anyCommandHasFlag(cmd.Root(), name) {
+			return fmt.Errorf("profile %q sets unknown flag --%s", profileName, name)
+		}
+		f := cmd.Flags().Lookup(name)
+		if f == nil || f.Changed {
+			continue
+		}
+		if err := cmd.Flags().Set(name, value); err != nil {
+			return fmt.Errorf("profile %q has an invalid --%s: %s", profileName, name, err.Error())
+		}
+	}
+	return nil
+}
+
+// anyCommandHasFlag determines if a command or any of its subcommands has a flag
+func anyCommandHasFlag(cmd *cobra.Command, name string) bool {
+	if cmd.Flags().Lookup(name) != nil || cmd.PersistentFlags().Lookup(name) != nil {
+		return true
+	}
+	for _, sub := range cmd.Commands() {
+		if anyCommandHasFlag(sub, name) {
+			return true
+		}
+	}
+	return false
+}
@@ -2,12 +2,18 @@ package cmd
 
 import (
 	"context"
-	"io/ioutil"
+	"errors"
+	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/Clever/microplane/initialize"
 	"github.com/Clever/microplane/lib"
 	"github.com/Clever/microplane/merge"
 	"github.com/Clever/microplane/plan"
@@ -19,8 +25,53 @@ import (
 var pushFlagAssignee string
 var pushFlagThrottle string
 var pushFlagBodyFile string
+var pushFlagBodyTemplate string
 var pushFlagLabels []string
 var pushFlagDraft bool
+var pushFlagSquashOnMerge bool
+var pushFlagPROpener string
+var pushFlagSkipExistingPRs bool
+var pushFlagOnExistingBranch string
+var pushFlagReopen bool
+var pushFlagCloneURLTemplate string
+var pushFlagCommitMessagePattern string
+var pushFlagSkipUnchanged bool
+var pushFlagAllowDirty bool
+var pushFlagChangedFilesAllow []string
+var pushFlagMaxChangedFiles int
+var pushFlagMaxOpenPRs int
+var pushFlagYes bool
+var pushFlagRebase bool
+var pushFlagReviewersFromCodeowners bool
+var pushFlagReviewersFromApprovalRules bool
+var pushFlagPipelineVariables []string
+var pushFlagAlsoBases []string
+var pushFlagClosesIssuesFile string
+var pushFlagApprovalRules []string
+var pushFlagPrePushHook string
+var pushFlagPostPushHook string
+var pushFlagComment string
+var pushFlagSourceRef string
+var pushFlagTitlePrefix string
+var pushFlagTitleSuffix string
+var pushFlagTag string
+var pushFlagTagMessage string
+var pushFlagExistingTag string
+var pushFlagMetadataFile string
+var pushFlagPRTemplate string
+var pushFlagPRTemplateName string
+var pushFlagForceWithLease bool
+var pushFlagPushAttempts int
+var pushFlagIncludeScriptOutput bool
+var pushFlagCampaignName string
+var pushFlagCampaignURL string
+var pushFlagPrintURLs bool
+var pushFlagQuiet bool
+var pushFlagBatchSize int
+var pushFlagBatchPause time.Duration
+
+// pushRepoMetadata is the per-repo metadata from --metadata-file, for --tag templates
+var pushRepoMetadata map[string]map[string]string
 
 // rate limits the # of git pushes. used to prevent load on CI system
 var pushThrottle *time.Ticker
@@ -29,12 +80,40 @@ var prAssignee string
 var prBody string
 var prLabels []string
 var prDraft bool
+var skipUnchanged bool
+var prClosesIssues map[string]int
+var prApprovalRules []push.ApprovalRule
+var prPipelineVariables map[string]string
+var pushRunStartedAt time.Time
+
+// count of repos skipped because their plan was ignored
+var pushIgnoredCount int64
+
+// count of repos skipped because their plan failed
+var pushPlanFailedCount int64
+
+// count of repos skipped because they already had an open PR, with --skip-existing-prs
+var pushSkippedExistingCount int64
+
+// count of repos skipped because their branch was already on the remote, with --on-existing-branch=skip
+var pushSkippedBranchCount int64
+
+// pushCampaign is the campaign each PR body notes it's part of, with --campaign-name
+var pushCampaign push.Campaign
+
+// pushOpenPRLimit caps the new PRs the run opens, with --max-open-prs
+var pushOpenPRLimit *push.OpenPRLimit
+
+// exitCodeMaxOpenPRs is the exit status when repos weren't pushed because the run opened as many
+// PRs as --max-open-prs allows, so scripts can tell it apart from a failure
+const exitCodeMaxOpenPRs = 4
 
 var pushCmd = &cobra.Command{
 	Use:   "push",
 	Short: "Push planned changes",
 	Args:  cobra.ExactArgs(0),
 	Run: func(cmd *cobra.Command, args []string) {
+		pushRunStartedAt = time.Now()
 		var err error
 		prAssignee, err = cmd.Flags().GetString("assignee")
 		if err != nil {
@@ -43,17 +122,31 @@ var pushCmd = &cobra.Command{
 		if prAssignee == "" {
 			log.Fatal("--assignee is required")
 		}
+		if _, err := push.ParseAssigneeTemplate(prAssignee); err != nil {
+			log.Fatalf("Invalid --assignee: %s", err.Error())
+		}
 
 		prBodyFile, err := cmd.Flags().GetString("body-file")
 		if err != nil {
 			log.Fatal(err)
 		}
 		if prBodyFile != "" {
-			prBodyBytes, err := ioutil.ReadFile(prBodyFile)
+			prBody, err = readFlagFile("body-file", prBodyFile)
 			if err != nil {
 				log.Fatal(err)
 			}
-			prBody = string(prBodyBytes)
+		}
+		if pushFlagBodyTemplate != "" {
+			if prBodyFile != "" {
+				log.Fatal("--body-file and --body-template can't both be given")
+			}
+			prBody, err = loadBodyTemplate(pushFlagBodyTemplate)
+			if err != nil {
+				log.Fatalf("error loading --body-template: %s", err.Error())
+			}
+			if _, err := push.ParsePRBodyTemplate(prBody); err != nil {
+				log.Fatalf("Invalid --body-template: %s", err.Error())
+			}
 		}
 
 		throttle, err := cmd.Flags().GetString("throttle")
@@ -83,16 +176,161 @@ var pushCmd = &cobra.Command{
 		}
 		prDraft = draft
 
+		skipUnchanged, err = cmd.Flags().GetBool("skip-unchanged")
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if pushFlagClosesIssuesFile != "" {
+			if err := loadJSON(pushFlagClosesIssuesFile, &prClosesIssues); err != nil {
+				log.Fatalf("error loading --closes-issues-file: %s", err.Error())
+			}
+		}
+
+		switch pushFlagPRTemplate {
+		case "", push.PRTemplatePrepend, push.PRTemplateAppend:
+		case push.PRTemplateFill:
+			if prBody == "" {
+				log.Fatal("--pr-template=fill needs a --body-file or --body-template that places the template with {{.PRTemplate}}")
+			}
+			if pushFlagBodyTemplate != "" {
+				break
+			}
+			if _, err := push.RenderPRBody(prBody, push.PRBodyVars{}); err != nil {
+				log.Fatalf("Invalid --body-file for --pr-template=fill: %s", err.Error())
+			}
+		default:
+			log.Fatalf("Invalid --pr-template: %s", pushFlagPRTemplate)
+		}
+
+		if pushFlagBatchSize < 0 {
+			log.Fatal("--batch-size must be at least 1, or 0 to push every repo at once")
+		}
+
+		if pushFlagMaxChangedFiles < 0 {
+			log.Fatal("--max-changed-files must be at least 1, or 0 for no limit")
+		}
+
+		if pushFlagMaxOpenPRs < 0 {
+			log.Fatal("--max-open-prs must be at least 1, or 0 for no limit")
+		} else if pushFlagMaxOpenPRs > 0 {
+			pushOpenPRLimit = push.NewOpenPRLimit(pushFlagMaxOpenPRs)
+		}
+
+		if pushFlagPushAttempts < 1 {
+			log.Fatal("--push-attempts must be at least 1")
+		}
+
+		if _, err := push.ParseCommentTemplate(pushFlagComment); err != nil {
+			log.Fatalf("Invalid --comment: %s", err.Error())
+		}
+
+		if _, err := push.ParseTagTemplate(pushFlagTag); err != nil {
+			log.Fatalf("Invalid --tag: %s", err.Error())
+		}
+		if pushFlagCloneURLTemplate != "" {
+			if _, err := lib.ParseCloneURLTemplate(pushFlagCloneURLTemplate); err != nil {
+				log.Fatalf("Invalid --clone-url-template: %s", err.Error())
+			}
+		}
+		if pushFlagOnExistingBranch != push.BranchExistingOverwrite && pushFlagOnExistingBranch != push.BranchExistingSkip && pushFlagOnExistingBranch != push.BranchExistingFail {
+			log.Fatalf("Invalid --on-existing-branch: %s", pushFlagOnExistingBranch)
+		}
+		if pushFlagExistingTag != push.TagExistingFail && pushFlagExistingTag != push.TagExistingSkip && pushFlagExistingTag != push.TagExistingOverwrite {
+			log.Fatalf("Invalid --existing-tag: %s", pushFlagExistingTag)
+		}
+		if pushFlagMetadataFile != "" {
+			if err := loadJSON(pushFlagMetadataFile, &pushRepoMetadata); err != nil {
+				log.Fatalf("error loading --metadata-file: %s", err.Error())
+			}
+		}
+
+		for _, r := range pushFlagApprovalRules {
+			rule, err := push.ParseApprovalRule(r)
+			if err != nil {
+				log.Fatal(err)
+			}
+			prApprovalRules = append(prApprovalRules, rule)
+		}
+
+		prPipelineVariables, err = parsePipelineVariables(pushFlagPipelineVariables)
+		if err != nil {
+			log.Fatal(err)
+		}
+
 		repos, err := whichRepos(cmd)
 		if err != nil {
 			log.Fatal(err)
 		}
+		repos = allowedRepos(repos)
+
+		if pushFlagCampaignURL != "" && pushFlagCampaignName == "" {
+			log.Fatal("--campaign-url needs a --campaign-name")
+		}
+		if pushFlagCampaignName != "" {
+			pushCampaign = push.Campaign{Name: pushFlagCampaignName, URL: pushFlagCampaignURL, Repos: plannedRepoCount()}
+		}
+
+		if pushFlagCommitMessagePattern != "" {
+			pattern, err := regexp.Compile(pushFlagCommitMessagePattern)
+			if err != nil {
+				log.Fatalf("Invalid --commit-message-pattern: %s", err.Error())
+			}
+			if mismatches := titleMismatches(repos, pattern); len(mismatches) > 0 {
+				log.Fatalf("%d PR titles don't match --commit-message-pattern '%s', so nothing was pushed:\n  %s", len(mismatches), pattern, strings.Join(mismatches, "\n  "))
+			}
+		}
+
+		if err := preflight(runCtx, repos); err != nil {
+			log.Fatal(err)
+		}
+		if err := checkPROpener(runCtx, repos, pushFlagPROpener); err != nil {
+			log.Fatal(err)
+		}
 
-		err = parallelize(repos, pushOneRepo)
+		sample := pushSample(repos)
+		if err := confirm(fmt.Sprintf("push to %d repos", len(sample)), sample, pushFlagYes || dryRun); err != nil {
+			log.Fatal(err)
+		}
+
+		setLogsQuiet(pushFlagQuiet)
+		if pushFlagBatchSize > 0 {
+			err = pushInBatches(repos)
+		} else {
+			err = parallelize(repos, pushOneRepo)
+		}
+		setLogsQuiet(false)
+		if pushFlagPrintURLs {
+			for _, url := range pushedPRURLs(repos, pushRunStartedAt) {
+				fmt.Println(url)
+			}
+		}
+		if err := writeOutputFile(cmd, repos, "push"); err != nil {
+			log.Printf("error writing --output-file: %s", err.Error())
+		}
+		if pushIgnoredCount > 0 && !pushFlagQuiet {
+			log.Printf("%d repos ignored", pushIgnoredCount)
+		}
+		if pushPlanFailedCount > 0 {
+			log.Printf("%d repos skipped because their plan failed, see mp status", pushPlanFailedCount)
+		}
+		if pushSkippedExistingCount > 0 {
+			log.Printf("%d repos skipped because they already have an open PR", pushSkippedExistingCount)
+		}
+		if pushSkippedBranchCount > 0 {
+			log.Printf("%d repos skipped because their branch already exists", pushSkippedBranchCount)
+		}
+		overLimit := overOpenPRLimit(repos, pushRunStartedAt)
+		if len(overLimit) > 0 {
+			log.Printf("stopped: opened %d new PRs, the limit set by --max-open-prs. %d PRs weren't pushed:\n  %s", pushOpenPRLimit.Opened(), len(overLimit), strings.Join(overLimit, "\n  "))
+		}
 		if err != nil {
 			// TODO: dig into errors and display them with more detail
 			log.Fatal(err)
 		}
+		if len(overLimit) > 0 {
+			os.Exit(exitCodeMaxOpenPRs)
+		}
 
 		// TODO: Fix this, doesn't play well with parallelize fn
 		// query := fmt.Sprintf("org:%s \"%s\" is:open", org, commitMessage)
@@ -101,6 +339,131 @@ var pushCmd = &cobra.Command{
 	},
 }
 
+// pushSample describes the branch and PR title that will be pushed for each planned repo
+func pushSample(repos []lib.Repo) []string {
+	sample := []string{}
+	for _, r := range repos {
+		var planOutput plan.Output
+		if loadJSON(outputPath(r.Name, "plan"), &planOutput) != nil || !planOutput.Success {
+			continue
+		}
+		title, _ := push.GetTitleBody(push.Input{CommitMessage: planOutput.CommitMessage, PRBody: prBody, TitlePrefix: pushFlagTitlePrefix, TitleSuffix: pushFlagTitleSuffix})
+		if issue := closesIssue(r); issue > 0 {
+			title += fmt.Sprintf(" (closes #%d)", issue)
+		}
+		sample = append(sample, fmt.Sprintf("%s/%s: %s - %s", r.Owner, r.Name, planOutput.BranchName, title))
+	}
+	return sample
+}
+
+// plannedRepoCount is how many of the work dir's repos were planned successfully, i.e. the size of
+// the campaign, even if only some of them are being pushed
+func plannedRepoCount() int {
+	var initOutput initialize.Output
+	if err := loadJSON(savedOutputPath("", "init"), &initOutput); err != nil {
+		return 0
+	}
+	count := 0
+	for _, r := range initOutput.Repos {
+		var planOutput plan.Output
+		if loadJSON(outputPath(r.Name, "plan"), &planOutput) == nil && planOutput.Success {
+			count++
+		}
+	}
+	return count
+}
+
+// titleMismatches lists the planned repos whose PR title doesn't match pattern, as
+// "owner/name: title", so a malformed templated message is caught before any PR is opened
+func titleMismatches(repos []lib.Repo, pattern *regexp.Regexp) []string {
+	mismatches := []string{}
+	for _, r := range repos {
+		var planOutput plan.Output
+		if loadJSON(outputPath(r.Name, "plan"), &planOutput) != nil || !planOutput.Success {
+			continue
+		}
+		title, _ := push.GetTitleBody(push.Input{CommitMessage: planOutput.CommitMessage, PRBody: prBody, TitlePrefix: pushFlagTitlePrefix, TitleSuffix: pushFlagTitleSuffix})
+		if !pattern.MatchString(title) {
+			mismatches = append(mismatches, fmt.Sprintf("%s/%s: %s", r.Owner, r.Name, title))
+		}
+	}
+	return mismatches
+}
+
+// pushedPRURLs are the URLs of the PRs opened or updated by the push run started at
+// runStartedAt, including backports, for --print-urls
+func pushedPRURLs(repos []lib.Repo, runStartedAt time.Time) []string {
+	urls := []string{}
+	for _, r := range repos {
+		var output push.Output
+		if loadJSON(outputPath(r.Name, "push"), &output) != nil {
+			continue
+		}
+		urls = append(urls, prURLs(output, runStartedAt)...)
+	}
+	return urls
+}
+
+// overOpenPRLimit are the repos, and their backports, the run started at runStartedAt didn't
+// push, because it had already opened as many PRs as --max-open-prs allows
+func overOpenPRLimit(repos []lib.Repo, runStartedAt time.Time) []string {
+	over := []string{}
+	for _, r := range repos {
+		var output push.Output
+		if loadJSON(outputPath(r.Name, "push"), &output) != nil {
+			continue
+		}
+		if output.RunStartedAt == nil || !output.RunStartedAt.Equal(runStartedAt) {
+			continue
+		}
+		if output.ErrorKind == lib.ErrorKind(lib.ErrMaxOpenPRs) {
+			over = append(over, fmt.Sprintf("%s/%s", r.Owner, r.Name))
+		}
+		bases := []string{}
+		for base, backport := range output.Backports {
+			if backport.ErrorKind == lib.ErrorKind(lib.ErrMaxOpenPRs) {
+				bases = append(bases, base)
+			}
+		}
+		sort.Strings(bases)
+		for _, base := range bases {
+			over = append(over, fmt.Sprintf("%s/%s (backport to %s)", r.Owner, r.Name, base))
+		}
+	}
+	return over
+}
+
+// prURLs are a repo's PR URLs from its push output, if it was pushed successfully by the run
+// started at runStartedAt, followed by its backports' by base branch
+func prURLs(output push.Output, runStartedAt time.Time) []string {
+	if !output.Success || output.RunStartedAt == nil || !output.RunStartedAt.Equal(runStartedAt) {
+		return nil
+	}
+	urls := []string{}
+	if output.PullRequestURL != "" {
+		urls = append(urls, output.PullRequestURL)
+	}
+	bases := []string{}
+	for base := range output.Backports {
+		bases = append(bases, base)
+	}
+	sort.Strings(bases)
+	for _, base := range bases {
+		if backport := output.Backports[base]; backport.Success && backport.PullRequestURL != "" {
+			urls = append(urls, backport.PullRequestURL)
+		}
+	}
+	return urls
+}
+
+// closesIssue looks up the issue a repo's PR closes in --closes-issues-file, by owner/name or name
+func closesIssue(r lib.Repo) int {
+	if issue, ok := prClosesIssues[fmt.Sprintf("%s/%s", r.Owner, r.Name)]; ok {
+		return issue
+	}
+	return prClosesIssues[r.Name]
+}
+
 func pushOneRepo(r lib.Repo, ctx context.Context) error {
 	log.Printf("pushing: %s/%s", r.Owner, r.Name)
 
@@ -115,37 +478,168 @@ func pushOneRepo(r lib.Repo, ctx context.Context) error {
 	}
 
 	// Get previous step's output
-	var planOutput plan.Output
-	if loadJSON(outputPath(r.Name, "plan"), &planOutput) != nil || !planOutput.Success {
+	var savedPlan struct {
+		plan.Output
+		Error string
+	}
+	if loadJSON(outputPath(r.Name, "plan"), &savedPlan) == nil && savedPlan.Ignored {
+		atomic.AddInt64(&pushIgnoredCount, 1)
+		log.Printf("%s/%s - skipped (ignored): %s", r.Owner, r.Name, savedPlan.IgnoreReason)
+		annotateSkip(r, "ignored: "+savedPlan.IgnoreReason)
+		return nil
+	}
+	if savedPlan.Error != "" {
+		atomic.AddInt64(&pushPlanFailedCount, 1)
+		log.Printf("%s/%s - skipped (plan failed): %s", r.Owner, r.Name, firstLine(savedPlan.Error))
+		annotateSkip(r, "plan failed: "+firstLine(savedPlan.Error))
+		return nil
+	}
+	planOutput := savedPlan.Output
+	if !planOutput.Success {
 		log.Printf("skipping %s/%s, must successfully plan first", r.Owner, r.Name)
+		annotateSkip(r, "must successfully plan first")
 		return nil
 	}
 
+	// Remember when the branch was last pushed, in case it's unchanged this time
+	var previousOutput push.Output
+	loadJSON(outputPath(r.Name, "push"), &previousOutput)
+
 	// Prepare workdir for current step's output
 	pushOutputPath := outputPath(r.Name, "push")
 	pushWorkDir := filepath.Dir(pushOutputPath)
-	if err := os.MkdirAll(pushWorkDir, 0755); err != nil {
-		return err
+	if !dryRun {
+		if err := os.MkdirAll(pushWorkDir, 0755); err != nil {
+			return err
+		}
+	}
+
+	metadata := repoMetadata(pushRepoMetadata, r)
+	if metadata == nil {
+		metadata = planOutput.Metadata
+	}
+	assignee, err := push.RenderAssignee(prAssignee, push.AssigneeVars{Owner: r.Owner, Name: r.Name, Branch: planOutput.BranchName, Metadata: metadata})
+	if err != nil {
+		return fmt.Errorf("%s/%s error rendering --assignee: %s", r.Owner, r.Name, err.Error())
+	}
+
+	if verbose {
+		commitAuthor := planOutput.CommitAuthor
+		if commitAuthor == "" {
+			commitAuthor = "git's user"
+		}
+		opener, _ := lib.NewProviderFromConfig(r.ProviderConfig).TokenUser(ctx)
+		log.Printf("%s/%s - commit authored by %s, PR opened by %s", r.Owner, r.Name, commitAuthor, opener)
+	}
+
+	remoteURL := ""
+	if pushFlagCloneURLTemplate != "" {
+		if remoteURL, err = r.TemplatedCloneURL(pushFlagCloneURLTemplate); err != nil {
+			return fmt.Errorf("%s/%s error rendering --clone-url-template: %s", r.Owner, r.Name, err.Error())
+		}
 	}
 
 	// Execute
 	input := push.Input{
-		Repo:          r,
-		PlanDir:       planOutput.PlanDir,
-		WorkDir:       pushWorkDir,
-		CommitMessage: planOutput.CommitMessage,
-		PRBody:        prBody,
-		PRAssignee:    prAssignee,
-		BranchName:    planOutput.BranchName,
-		Labels:        prLabels,
-		Draft:         prDraft,
+		Repo:                       r,
+		PlanDir:                    planOutput.PlanDir,
+		RemoteURL:                  remoteURL,
+		WorkDir:                    pushWorkDir,
+		CommitMessage:              planOutput.CommitMessage,
+		PRBody:                     prBody,
+		TitlePrefix:                pushFlagTitlePrefix,
+		TitleSuffix:                pushFlagTitleSuffix,
+		PRAssignee:                 assignee,
+		BranchName:                 planOutput.BranchName,
+		Labels:                     prLabels,
+		Draft:                      prDraft,
+		SquashOnMerge:              pushFlagSquashOnMerge,
+		SkipUnchanged:              skipUnchanged,
+		SkipExistingPR:             pushFlagSkipExistingPRs,
+		OpenPRLimit:                pushOpenPRLimit,
+		KeepClosed:                 !pushFlagReopen,
+		AllowDirty:                 pushFlagAllowDirty,
+		ChangedFilesAllow:          pushFlagChangedFilesAllow,
+		MaxChangedFiles:            pushFlagMaxChangedFiles,
+		Rebase:                     pushFlagRebase,
+		ReviewersFromCodeowners:    pushFlagReviewersFromCodeowners,
+		ReviewersFromApprovalRules: pushFlagReviewersFromApprovalRules,
+		BaseBranch:                 planOutput.BaseBranch,
+		ClosesIssue:                closesIssue(r),
+		ApprovalRules:              prApprovalRules,
+		PipelineVariables:          prPipelineVariables,
+		PRComment:                  pushFlagComment,
+		SourceRef:                  pushFlagSourceRef,
+		ForceWithLease:             pushFlagForceWithLease,
+		LeaseSHA:                   previousOutput.CommitSHA,
+		PushAttempts:               pushFlagPushAttempts,
+		Tag:                        pushFlagTag,
+		TagMessage:                 pushFlagTagMessage,
+		ExistingTag:                pushFlagExistingTag,
+		ExistingBranch:             pushFlagOnExistingBranch,
+		CampaignID:                 planOutput.CampaignID,
+		Metadata:                   metadata,
+		PRTemplateMode:             pushFlagPRTemplate,
+	}
+	input.Campaign = pushCampaign
+	if pushFlagIncludeScriptOutput {
+		input.ScriptOutput = planOutput.ScriptOutput
+	}
+	if pushFlagPRTemplate != "" {
+		prTemplate, err := push.FindPRTemplate(planOutput.PlanDir, r, pushFlagPRTemplateName)
+		if err != nil {
+			return fmt.Errorf("%s/%s error reading PR template: %s", r.Owner, r.Name, err.Error())
+		}
+		input.PRTemplate = prTemplate
 	}
+	if pushFlagBodyTemplate != "" || pushFlagPRTemplate == push.PRTemplateFill {
+		flag := "body-file"
+		if pushFlagBodyTemplate != "" {
+			flag = "body-template"
+		}
+		vars := push.PRBodyVars{Owner: r.Owner, Name: r.Name, Branch: planOutput.BranchName, Metadata: metadata, PRTemplate: input.PRTemplate}
+		if input.PRBody, err = push.RenderPRBody(prBody, vars); err != nil {
+			return fmt.Errorf("%s/%s error rendering --%s: %s", r.Owner, r.Name, flag, err.Error())
+		}
+	}
+	if dryRun {
+		title, _ := push.GetTitleBody(input)
+		log.Printf("%s%s/%s - would push branch %s and open or update a PR assigned to %s: %s", dryRunPrefix, r.Owner, r.Name, input.BranchName, input.PRAssignee, title)
+		if input.Tag != "" {
+			log.Printf("%s%s/%s - would push a tag from --tag '%s'", dryRunPrefix, r.Owner, r.Name, input.Tag)
+		}
+		return nil
+	}
+	branchEnv := fmt.Sprintf("MICROPLANE_BRANCH=%s", planOutput.BranchName)
+	err = runHook(ctx, hookPrePush, pushFlagPrePushHook, r, planOutput.PlanDir, branchEnv)
 	var output push.Output
-	var err error
-	if r.IsGitlab() {
-		output, err = push.GitlabPush(ctx, input, repoLimiter, pushThrottle)
-	} else if r.IsGithub() {
-		output, err = push.GithubPush(ctx, input, repoLimiter, pushThrottle)
+	if err == nil {
+		output, err = push.Push(ctx, input, repoLimiter(r), pushThrottle)
+	}
+	if err == nil && output.SkippedExistingPR {
+		atomic.AddInt64(&pushSkippedExistingCount, 1)
+		log.Printf("%s/%s - skipped (open PR exists): %s", r.Owner, r.Name, output.PullRequestURL)
+		annotateSkip(r, "open PR exists: "+output.PullRequestURL)
+		if previousOutput.Success && previousOutput.PullRequestNumber == output.PullRequestNumber {
+			// what's recorded about the PR is still right
+			return nil
+		}
+		output.PushedAt = previousOutput.PushedAt
+		return writeJSON(output, pushOutputPath)
+	}
+	if err == nil && output.SkippedExistingBranch {
+		atomic.AddInt64(&pushSkippedBranchCount, 1)
+		log.Printf("%s/%s - skipped (branch exists): %s", r.Owner, r.Name, output.BranchName)
+		annotateSkip(r, "branch exists: "+output.BranchName)
+		if previousOutput.Success {
+			// what's recorded about the branch's PR is still right
+			return nil
+		}
+		return writeJSON(output, pushOutputPath)
+	}
+	output.RunStartedAt = &pushRunStartedAt
+	if output.PushedAt == nil {
+		output.PushedAt = previousOutput.PushedAt
 	}
 	if err != nil {
 		o := struct {
@@ -153,16 +647,99 @@ func pushOneRepo(r lib.Repo, ctx context.Context) error {
 			Error string
 		}{output, err.Error()}
 		writeJSON(o, pushOutputPath)
-		return err
+		if errors.Is(err, lib.ErrMaxOpenPRs) {
+			// not a failure of the repo, it's listed once the run is done
+			log.Printf("%s/%s - not pushed: --max-open-prs reached", r.Owner, r.Name)
+			annotateSkip(r, "--max-open-prs reached")
+			return nil
+		}
+		return fmt.Errorf("%s/%s error: %+v", r.Owner, r.Name, err)
+	}
+	if output.AlreadyInBase {
+		// record it as merged, so later steps leave it alone
+		writeJSON(output, pushOutputPath)
+		log.Printf("%s/%s - already merged: the base branch has the change, so no PR was opened", r.Owner, r.Name)
+		return writeJSON(merge.Output{Success: true, MergedExternally: true}, outputPath(r.Name, "merge"))
+	}
+	for _, base := range pushFlagAlsoBases {
+		backport, err := push.Backport(ctx, input, base, repoLimiter(r), pushThrottle)
+		if output.Backports == nil {
+			output.Backports = map[string]push.Output{}
+		}
+		output.Backports[base] = backport
+		if errors.Is(err, lib.ErrMaxOpenPRs) {
+			// like the main PR, it's listed once the run is done
+			log.Printf("%s/%s - backport to %s not pushed: --max-open-prs reached", r.Owner, r.Name, base)
+			annotateSkip(r, fmt.Sprintf("backport to %s: --max-open-prs reached", base))
+			continue
+		}
+		if err != nil {
+			o := struct {
+				push.Output
+				Error string
+			}{output, fmt.Sprintf("backport to %s: %s", base, err.Error())}
+			writeJSON(o, pushOutputPath)
+			return fmt.Errorf("%s/%s backport to %s error: %+v", r.Owner, r.Name, base, err)
+		}
+		log.Printf("%s/%s - opened %s against %s", r.Owner, r.Name, backport.PullRequestURL, base)
 	}
 	writeJSON(output, pushOutputPath)
-	return nil
+
+	return runHook(ctx, hookPostPush, pushFlagPostPushHook, r, planOutput.PlanDir, branchEnv,
+		fmt.Sprintf("MICROPLANE_PR_URL=%s", output.PullRequestURL),
+		fmt.Sprintf("MICROPLANE_PR_NUMBER=%d", output.PullRequestNumber),
+	)
 }
 
 func init() {
+	pushCmd.Flags().StringVar(&pushFlagPrePushHook, "pre-push-hook", "", "command to run in each planned repo before pushing. MICROPLANE_REPO, MICROPLANE_OWNER, and MICROPLANE_BRANCH are set")
+	pushCmd.Flags().StringVar(&pushFlagPostPushHook, "post-push-hook", "", "command to run in each planned repo after its PR is opened. MICROPLANE_PR_URL and MICROPLANE_PR_NUMBER are also set")
+	pushCmd.Flags().StringSliceVar(&hookFlagBestEffort, "best-effort-hooks", nil, "hooks whose failure doesn't fail the repo, e.g. 'post-push,post-merge'")
+	addOutputFileFlag(pushCmd)
+	addAllowedReposFlag(pushCmd)
 	pushCmd.Flags().StringVarP(&pushFlagThrottle, "throttle", "t", "30s", "Throttle number of pushes, e.g. '30s' means 1 push per 30 seconds")
-	pushCmd.Flags().StringVarP(&pushFlagAssignee, "assignee", "a", "", "Github user to assign the PR to")
-	pushCmd.Flags().StringVarP(&pushFlagBodyFile, "body-file", "b", "", "body of PR")
+	pushCmd.Flags().StringVarP(&pushFlagAssignee, "assignee", "a", "", "user to assign the PR to. This is a Go template, e.g. '{{.Metadata.owner}}'. Variables: .Owner .Name .Branch .Metadata")
+	pushCmd.Flags().StringVarP(&pushFlagBodyFile, "body-file", "b", "", "file containing the body of PR, or - to read it from stdin")
+	pushCmd.Flags().StringVar(&pushFlagBodyTemplate, "body-template", "", "file or http(s) URL of a shared Go template for the PR body, rendered for each repo. URLs are fetched once per run, with the token in MICROPLANE_BODY_TEMPLATE_TOKEN if it's set. Variables: .Owner .Name .Branch .Metadata .PRTemplate")
+	pushCmd.Flags().StringVar(&pushFlagPRTemplate, "pr-template", "", "use each repo's own PR template in the PR body: prepend, append, or fill, which renders --body-file as a Go template that places it with {{.PRTemplate}}. Variables: .Owner .Name .Branch .PRTemplate")
+	pushCmd.Flags().StringVar(&pushFlagPRTemplateName, "pr-template-name", "", "with --pr-template, the named template to use from .github/PULL_REQUEST_TEMPLATE/ or .gitlab/merge_request_templates/, for repos that have it. defaults to the repo's default template")
 	pushCmd.Flags().StringSliceVarP(&pushFlagLabels, "labels", "l", nil, "labels to attach to PR. for example: `-l 'first label' -l 'second label'`")
-	pushCmd.Flags().BoolVarP(&pushFlagDraft, "draft", "d", false, "push a draft pull request (only supported for github)")
+	pushCmd.Flags().BoolVarP(&pushFlagDraft, "draft", "d", false, "push a draft pull request, which `mp ready` marks ready for review (only supported for github)")
+	pushCmd.Flags().StringVar(&pushFlagPROpener, "pr-opener", "", "user the API token must authenticate as, e.g. a service account, since it opens the PRs whoever authored the commits. push fails before changing anything if it doesn't")
+	pushCmd.Flags().BoolVar(&pushFlagSquashOnMerge, "squash-on-merge", false, "set each MR to squash its commits when merged, whoever merges it. existing MRs are updated to match (only supported for gitlab)")
+	pushCmd.Flags().BoolVarP(&pushFlagYes, "yes", "y", false, "push without asking for confirmation")
+	pushCmd.Flags().BoolVar(&pushFlagAllowDirty, "allow-dirty", false, "push even if the plan directory has changes that aren't in the planned commit")
+	pushCmd.Flags().IntVar(&pushFlagMaxOpenPRs, "max-open-prs", 0, fmt.Sprintf("open at most this many new PRs in this run, e.g. to guard against a bad repo filter. Updating existing PRs doesn't count. Repos past the limit aren't pushed, and push exits with status %d. 0 means no limit", exitCodeMaxOpenPRs))
+	pushCmd.Flags().IntVar(&pushFlagMaxChangedFiles, "max-changed-files", 0, "don't push repos whose plan changed more than this many files, e.g. because the script ran away. 0 means no limit")
+	pushCmd.Flags().StringSliceVar(&pushFlagChangedFilesAllow, "changed-files-allow", nil, "only push if every changed file matches one of these globs, by path or base name. for example: --changed-files-allow go.mod,'*.yaml'")
+	pushCmd.Flags().StringVar(&pushFlagSourceRef, "source-ref", "HEAD", "ref in the planned repo whose commit is pushed. push fails if the PR doesn't end up on that commit")
+	pushCmd.Flags().StringVar(&pushFlagCommitMessagePattern, "commit-message-pattern", "", "regexp every PR title must match, e.g. '^(feat|fix|chore)(\\(.+\\))?: .+' for Conventional Commits. checked before anything is pushed, and push fails if any title doesn't match")
+	pushCmd.Flags().StringVar(&pushFlagTitlePrefix, "title-prefix", "", "added to the start of each PR title, e.g. '[codemod]', unless it's already there")
+	pushCmd.Flags().StringVar(&pushFlagTitleSuffix, "title-suffix", "", "added to the end of each PR title, unless it's already there")
+	pushCmd.Flags().StringVar(&pushFlagTag, "tag", "", "Go template for an annotated tag to push on each repo's commit after the branch, e.g. 'v{{.Metadata.version}}'. Variables: .Owner .Name .Branch .Metadata")
+	pushCmd.Flags().StringVar(&pushFlagTagMessage, "tag-message", "", "message for --tag. defaults to the PR title")
+	pushCmd.Flags().StringVar(&pushFlagCloneURLTemplate, "clone-url-template", "", "Go template for the URL to push each repo to, like clone's. defaults to the URL it was cloned from. Variables: .Owner .Name .Host")
+	pushCmd.Flags().StringVar(&pushFlagOnExistingBranch, "on-existing-branch", push.BranchExistingOverwrite, "what to do when the branch is already on the remote on another commit, e.g. from a previous run: overwrite it, skip the repo, or fail it")
+	pushCmd.Flags().StringVar(&pushFlagExistingTag, "existing-tag", push.TagExistingFail, "what to do when --tag already exists on another commit: fail, skip, or overwrite")
+	pushCmd.Flags().StringVar(&pushFlagMetadataFile, "metadata-file", "", "JSON file mapping repos to metadata for --tag and --assignee templates, e.g. {\"clever/app\": {\"version\": \"1.2.0\"}}. defaults to plan's --metadata-file")
+	pushCmd.Flags().StringVar(&pushFlagComment, "comment", "", "Go template for a comment to post on each PR once it's opened, not repeated on re-runs. Variables: .Owner .Name .PRNumber .PRURL .Branch")
+	pushCmd.Flags().StringSliceVar(&pushFlagAlsoBases, "also-base", nil, "more base branches to open the change against, e.g. maintenance branches. the change is cherry-picked onto each, with one PR per base")
+	pushCmd.Flags().StringArrayVar(&pushFlagPipelineVariables, "pipeline-variable", nil, "KEY=VALUE variable to set on the pipeline started by the push, can be repeated (only supported for gitlab)")
+	pushCmd.Flags().StringArrayVar(&pushFlagApprovalRules, "approval-rule", nil, "approval rule to set on the MR, can be repeated. for example: --approval-rule 'name=security;approvals=1;users=12,34;groups=56' (only supported for gitlab)")
+	pushCmd.Flags().StringVar(&pushFlagClosesIssuesFile, "closes-issues-file", "", "JSON file mapping repos to the issue their PR closes, e.g. {\"clever/app\": 12, \"lib\": 3}. repos without an issue are pushed as usual")
+	pushCmd.Flags().BoolVar(&pushFlagReviewersFromApprovalRules, "reviewers-from-approval-rules", false, "request reviews from the eligible approvers of each project's approval rules. projects without approval rules are pushed as usual (only supported for gitlab)")
+	pushCmd.Flags().BoolVar(&pushFlagReviewersFromCodeowners, "reviewers-from-codeowners", false, "request reviews from the CODEOWNERS of the changed files. repos without a CODEOWNERS file are pushed as usual")
+	pushCmd.Flags().StringVar(&pushFlagCampaignName, "campaign-name", "", "add a note to each PR body that it's part of this campaign, and how many repos it changes, so reviewers know it isn't an isolated change. e.g. set it in a --profile")
+	pushCmd.Flags().StringVar(&pushFlagCampaignURL, "campaign-url", "", "with --campaign-name, a link to the campaign's overview for the note, e.g. its tracking issue")
+	pushCmd.Flags().BoolVar(&pushFlagIncludeScriptOutput, "include-script-output", false, "add what the plan's change command printed to stdout to the end of the PR body, in a collapsed section")
+	pushCmd.Flags().IntVar(&pushFlagBatchSize, "batch-size", 0, "open PRs this many repos at a time, pausing --batch-pause between batches so reviews arrive in waves. a re-run resumes at the next batch. 0 means all at once")
+	pushCmd.Flags().DurationVar(&pushFlagBatchPause, "batch-pause", 5*time.Minute, "with --batch-size, how long to pause between batches")
+	pushCmd.Flags().BoolVar(&pushFlagPrintURLs, "print-urls", false, "when done, print the URL of each PR opened or updated, one per line, e.g. to pipe to xargs")
+	pushCmd.Flags().BoolVarP(&pushFlagQuiet, "quiet", "q", false, "don't log progress, only errors, warnings and what --print-urls prints")
+	pushCmd.Flags().BoolVar(&pushFlagForceWithLease, "force-with-lease", false, "only overwrite the remote branch if it's still at the commit last pushed, e.g. so a reviewer's push isn't lost. if it moved, bring in its new commits and retry")
+	pushCmd.Flags().IntVar(&pushFlagPushAttempts, "push-attempts", 3, "with --force-with-lease, how many times to try pushing before giving up")
+	pushCmd.Flags().BoolVar(&pushFlagRebase, "rebase", false, "rebase the planned branch onto the latest base branch before pushing")
+	pushCmd.Flags().BoolVar(&pushFlagSkipExistingPRs, "skip-existing-prs", false, "leave repos alone that already have an open PR from the branch, e.g. to keep their review state, and only push the rest")
+	pushCmd.Flags().BoolVar(&pushFlagReopen, "reopen", false, "reopen and update a PR from the branch that was closed without merging, keeping its discussion, instead of opening a new one")
+	pushCmd.Flags().BoolVar(&pushFlagSkipUnchanged, "skip-unchanged", false, "don't push if the remote branch already contains the same changes, to avoid re-running CI")
 }
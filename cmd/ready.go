@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+
+	"github.com/Clever/microplane/lib"
+	"github.com/Clever/microplane/merge"
+	"github.com/Clever/microplane/push"
+	"github.com/Clever/microplane/ready"
+	"github.com/spf13/cobra"
+)
+
+// CLI flags
+var readyFlagFilter string
+
+// count of draft PRs marked ready
+var readyCount int64
+
+var readyCmd = &cobra.Command{
+	Use:   "ready",
+	Short: "Mark the draft PRs opened by microplane as ready for review",
+	Example: `mp ready
+mp ready --filter 'app-*'`,
+	Args: cobra.ExactArgs(0),
+	Run: func(cmd *cobra.Command, args []string) {
+		repos, err := whichRepos(cmd)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		repos, err = filterReposOrExit(repos, readyFlagFilter)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		err = parallelize(repos, readyOneRepo)
+		log.Printf("marked %d draft PRs ready for review", readyCount)
+		if err != nil {
+			log.Fatalf("%d errors:\n %+v\n", strings.Count(err.Error(), " | ")+1, err)
+		}
+	},
+}
+
+func readyOneRepo(r lib.Repo, ctx context.Context) error {
+	// Only open PRs can be drafts
+	var mergeOutput merge.Output
+	if loadJSON(outputPath(r.Name, "merge"), &mergeOutput) == nil && mergeOutput.Success {
+		return nil
+	}
+	var pushOutput push.Output
+	if loadJSON(outputPath(r.Name, "push"), &pushOutput) != nil || !pushOutput.Success {
+		return nil
+	}
+
+	output, err := ready.Ready(ctx, ready.Input{Repo: r, PRNumber: pushOutput.PullRequestNumber}, repoLimiter(r))
+	if err != nil {
+		return fmt.Errorf("%s/%s error: %+v", r.Owner, r.Name, err)
+	}
+	switch {
+	case output.WasDraft:
+		atomic.AddInt64(&readyCount, 1)
+		log.Printf("%s/%s - marked ready: %s", r.Owner, r.Name, pushOutput.PullRequestURL)
+	case output.NotOpen:
+		log.Printf("%s/%s - skipping, PR isn't open", r.Owner, r.Name)
+	}
+	return nil
+}
+
+func init() {
+	readyCmd.Flags().StringVar(&readyFlagFilter, "filter", "", "only mark repos matching this glob ready, e.g. 'app-*' or 'clever/app-*'")
+}
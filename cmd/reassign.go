@@ -0,0 +1,97 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/Clever/microplane/lib"
+	"github.com/Clever/microplane/merge"
+	"github.com/Clever/microplane/push"
+	"github.com/Clever/microplane/reassign"
+	"github.com/spf13/cobra"
+)
+
+// CLI flags
+var reassignFlagAssignees []string
+var reassignFlagReviewers []string
+var reassignFlagTeamReviewers []string
+var reassignFlagFilter string
+
+var reassignCmd = &cobra.Command{
+	Use:   "reassign",
+	Short: "Reassign the open PRs opened by microplane",
+	Long: `Reassign the open PRs opened by microplane.
+
+The given assignees and reviewers replace the PRs' current ones. Any of
+--assignee, --reviewer, or --team-reviewer that isn't given is left as it is.`,
+	Example: `mp reassign --assignee new-owner
+mp reassign --assignee new-owner --reviewer teammate1,teammate2 --filter 'app-*'
+mp reassign --team-reviewer clever/infra`,
+	Args: cobra.ExactArgs(0),
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(reassignFlagAssignees) == 0 && len(reassignFlagReviewers) == 0 && len(reassignFlagTeamReviewers) == 0 {
+			log.Fatal("--assignee, --reviewer, or --team-reviewer is required")
+		}
+
+		repos, err := whichRepos(cmd)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		repos, err = filterReposOrExit(repos, reassignFlagFilter)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		err = parallelize(repos, reassignOneRepo)
+		if err != nil {
+			log.Fatalf("%d errors:\n %+v\n", strings.Count(err.Error(), " | ")+1, err)
+		}
+	},
+}
+
+func reassignOneRepo(r lib.Repo, ctx context.Context) error {
+	// Only open PRs need reassigning
+	var mergeOutput merge.Output
+	if loadJSON(outputPath(r.Name, "merge"), &mergeOutput) == nil && mergeOutput.Success {
+		return nil
+	}
+	var pushOutput push.Output
+	if loadJSON(outputPath(r.Name, "push"), &pushOutput) != nil || !pushOutput.Success {
+		return nil
+	}
+	log.Printf("reassigning: %s/%s", r.Owner, r.Name)
+
+	input := reassign.Input{
+		Repo:          r,
+		PRNumber:      pushOutput.PullRequestNumber,
+		Assignees:     reassignFlagAssignees,
+		Reviewers:     reassignFlagReviewers,
+		TeamReviewers: reassignFlagTeamReviewers,
+	}
+	var output reassign.Output
+	var err error
+	if r.IsGitlab() {
+		output, err = reassign.GitlabReassign(ctx, input, repoLimiter(r))
+	} else if r.IsGithub() {
+		output, err = reassign.GithubReassign(ctx, input, repoLimiter(r))
+	}
+	if err != nil {
+		return fmt.Errorf("%s/%s error: %+v", r.Owner, r.Name, err)
+	}
+
+	if len(output.Assignees) > 0 {
+		pushOutput.PullRequestAssignee = strings.Join(output.Assignees, ",")
+		writeJSON(pushOutput, outputPath(r.Name, "push"))
+	}
+	return nil
+}
+
+func init() {
+	reassignCmd.Flags().StringSliceVarP(&reassignFlagAssignees, "assignee", "a", nil, "users to assign the PRs to")
+	reassignCmd.Flags().StringSliceVar(&reassignFlagReviewers, "reviewer", nil, "users to request reviews from")
+	reassignCmd.Flags().StringSliceVar(&reassignFlagTeamReviewers, "team-reviewer", nil, "team slugs to request reviews from, e.g. 'infra' or 'clever/infra' (only supported for github)")
+	reassignCmd.Flags().StringVar(&reassignFlagFilter, "filter", "", "only reassign repos matching this glob, e.g. 'app-*' or 'clever/app-*'")
+}
@@ -0,0 +1,157 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+
+	"github.com/Clever/microplane/lib"
+	"github.com/Clever/microplane/plan"
+	"github.com/Clever/microplane/push"
+	"github.com/Clever/microplane/track"
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+)
+
+var reportFlagTrackingIssue string
+var reportFlagTitle string
+
+// trackingIssueFile records the tracking issue in the work dir, so later runs update it
+const trackingIssueFile = "tracking-issue.json"
+
+// trackingIssue is what's recorded in trackingIssueFile
+type trackingIssue struct {
+	// Repo is where the issue is, as owner/name
+	Repo   string
+	Number int
+	URL    string
+}
+
+var reportCmd = &cobra.Command{
+	Use:   "report",
+	Short: "Report a workflow's progress as Markdown, optionally in a tracking issue",
+	Args:  cobra.ExactArgs(0),
+	Run: func(cmd *cobra.Command, args []string) {
+		repos, err := whichRepos(cmd)
+		if err != nil {
+			log.Fatal(err)
+		}
+		body := markdownReport(repos)
+		if reportFlagTrackingIssue == "" {
+			fmt.Print(body)
+			return
+		}
+
+		parts := strings.Split(reportFlagTrackingIssue, "/")
+		if len(parts) < 2 || parts[0] == "" || parts[len(parts)-1] == "" {
+			log.Fatalf("invalid --tracking-issue '%s', expected the repo for the issue as owner/name", reportFlagTrackingIssue)
+		}
+		issueRepo := lib.Repo{
+			Owner:          strings.Join(parts[:len(parts)-1], "/"),
+			Name:           parts[len(parts)-1],
+			ProviderConfig: repos[0].ProviderConfig,
+		}
+
+		// update the issue from a previous run, unless it was in a different repo
+		var previous trackingIssue
+		issuePath := path.Join(workDir, trackingIssueFile)
+		if loadJSON(issuePath, &previous) != nil || previous.Repo != reportFlagTrackingIssue {
+			previous = trackingIssue{}
+		}
+
+		output, err := track.Track(context.Background(), track.Input{
+			Repo:   issueRepo,
+			Title:  reportTitle(repos),
+			Body:   body,
+			Number: previous.Number,
+		}, repoLimiter(issueRepo))
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := writeJSON(trackingIssue{Repo: reportFlagTrackingIssue, Number: output.Number, URL: output.URL}, issuePath); err != nil {
+			log.Fatal(err)
+		}
+		if output.Created {
+			log.Printf("created tracking issue %s", output.URL)
+		} else {
+			log.Printf("updated tracking issue %s", output.URL)
+		}
+	},
+}
+
+// reportTitle is --title, or else a title naming the campaign's branch. It identifies the
+// tracking issue until its number is recorded, so it shouldn't change between runs.
+func reportTitle(repos []lib.Repo) string {
+	if reportFlagTitle != "" {
+		return reportFlagTitle
+	}
+	for _, r := range repos {
+		var planOutput plan.Output
+		if loadJSON(outputPath(r.Name, "plan"), &planOutput) == nil && planOutput.BranchName != "" {
+			return fmt.Sprintf("Microplane: %s", planOutput.BranchName)
+		}
+	}
+	return "Microplane campaign"
+}
+
+// markdownReport renders each repo's status as a Markdown table, after a count of repos in each status
+func markdownReport(repos []lib.Repo) string {
+	// the details are colored for a terminal
+	defer func(noColor bool) { color.NoColor = noColor }(color.NoColor)
+	color.NoColor = true
+
+	counts := map[string]int{}
+	failed := 0
+	rows := []string{}
+	for _, r := range repos {
+		status, details, repoFailed := getRepoStatus(r)
+		counts[status]++
+		if repoFailed {
+			failed++
+			status += " (failed)"
+		}
+		pr := ""
+		var pushOutput push.Output
+		if loadJSON(outputPath(r.Name, "push"), &pushOutput) == nil && pushOutput.PullRequestURL != "" {
+			ref := "#"
+			if r.IsGitlab() {
+				ref = "!"
+			}
+			pr = fmt.Sprintf("[%s%s](%s)", ref, path.Base(pushOutput.PullRequestURL), pushOutput.PullRequestURL)
+		}
+		rows = append(rows, fmt.Sprintf("| %s/%s | %s | %s | %s |", r.Owner, r.Name, status, pr, markdownCell(details)))
+	}
+
+	summary := []string{}
+	for _, status := range repoStatuses {
+		if counts[status] > 0 {
+			summary = append(summary, fmt.Sprintf("%d %s", counts[status], status))
+		}
+	}
+	if failed > 0 {
+		summary = append(summary, fmt.Sprintf("%d failed", failed))
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "<!-- generated by microplane, edits will be overwritten -->\n")
+	fmt.Fprintf(&b, "**%d repos:** %s\n\n", len(repos), strings.Join(summary, ", "))
+	fmt.Fprintln(&b, "| Repo | Status | Pull request | Details |")
+	fmt.Fprintln(&b, "| --- | --- | --- | --- |")
+	for _, row := range rows {
+		fmt.Fprintln(&b, row)
+	}
+	return b.String()
+}
+
+// markdownCell makes text safe to put in a Markdown table cell
+func markdownCell(text string) string {
+	text = strings.Join(strings.Fields(text), " ")
+	return strings.ReplaceAll(text, "|", "\\|")
+}
+
+func init() {
+	reportCmd.Flags().StringVar(&reportFlagTrackingIssue, "tracking-issue", "", "repo, as owner/name, to create or update a tracking issue in with the report, instead of printing it")
+	reportCmd.Flags().StringVar(&reportFlagTitle, "title", "", "title of the tracking issue, which finds it until its number is recorded in the work dir. defaults to 'Microplane: <branch>'")
+}
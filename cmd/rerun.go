@@ -0,0 +1,99 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/Clever/microplane/lib"
+	"github.com/Clever/microplane/merge"
+	"github.com/Clever/microplane/push"
+	"github.com/Clever/microplane/rerun"
+	"github.com/spf13/cobra"
+)
+
+// CLI flags
+var rerunFlagFilter string
+var rerunFlagPipelineVariables []string
+
+// rerunPipelineVariables are parsed from --pipeline-variable
+var rerunPipelineVariables map[string]string
+
+var rerunCmd = &cobra.Command{
+	Use:   "rerun",
+	Short: "Re-run CI on the open PRs opened by microplane",
+	Long: `Re-run CI on the open PRs opened by microplane, e.g. after a flaky build.
+
+For Github, the workflow runs on the PR's head commit that didn't succeed are
+re-run. For Gitlab, a new pipeline is started on the MR's source branch.
+
+Run "mp status --sync" afterwards to follow along.`,
+	Example: `mp rerun
+mp rerun --filter 'app-*'
+mp rerun --pipeline-variable RUN_VALIDATION=true`,
+	Args: cobra.ExactArgs(0),
+	Run: func(cmd *cobra.Command, args []string) {
+		repos, err := whichRepos(cmd)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		repos, err = filterReposOrExit(repos, rerunFlagFilter)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		rerunPipelineVariables, err = parsePipelineVariables(rerunFlagPipelineVariables)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		err = parallelize(repos, rerunOneRepo)
+		if err != nil {
+			log.Fatalf("%d errors:\n %+v\n", strings.Count(err.Error(), " | ")+1, err)
+		}
+	},
+}
+
+func rerunOneRepo(r lib.Repo, ctx context.Context) error {
+	// Only open PRs need CI re-run
+	var mergeOutput merge.Output
+	if loadJSON(outputPath(r.Name, "merge"), &mergeOutput) == nil && mergeOutput.Success {
+		return nil
+	}
+	var pushOutput push.Output
+	if loadJSON(outputPath(r.Name, "push"), &pushOutput) != nil || !pushOutput.Success {
+		return nil
+	}
+	log.Printf("re-running CI: %s/%s", r.Owner, r.Name)
+
+	input := rerun.Input{
+		Repo:              r,
+		PRNumber:          pushOutput.PullRequestNumber,
+		PipelineVariables: rerunPipelineVariables,
+	}
+	var output rerun.Output
+	var err error
+	if r.IsGitlab() {
+		output, err = rerun.GitlabRerun(ctx, input, repoLimiter(r))
+	} else if r.IsGithub() {
+		output, err = rerun.GithubRerun(ctx, input, repoLimiter(r))
+	}
+	if err != nil {
+		return fmt.Errorf("%s/%s error: %+v", r.Owner, r.Name, err)
+	}
+
+	if len(output.RunURLs) == 0 {
+		log.Printf("%s/%s - nothing to re-run", r.Owner, r.Name)
+	}
+	for _, url := range output.RunURLs {
+		log.Printf("%s/%s - re-running %s", r.Owner, r.Name, url)
+	}
+	return nil
+}
+
+func init() {
+	rerunCmd.Flags().StringArrayVar(&rerunFlagPipelineVariables, "pipeline-variable", nil, "KEY=VALUE variable to set on the started pipelines, can be repeated (only supported for gitlab)")
+	rerunCmd.Flags().StringVar(&rerunFlagFilter, "filter", "", "only re-run CI for repos matching this glob, e.g. 'app-*' or 'clever/app-*'")
+}
@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/Clever/microplane/initialize"
+	"github.com/Clever/microplane/lib"
 	"github.com/spf13/cobra"
 )
 
@@ -16,59 +17,182 @@ var workDir string
 var cliVersion string
 var defaultParallelism int64 = 10
 
-// Github's rate limit for authenticated requests is 5000 QPH = 83.3 QPM = 1.38 QPS = 720ms/query
-// We also use a global limiter to prevent concurrent requests, which trigger Github's abuse detection
-var repoLimiter = time.NewTicker(720 * time.Millisecond)
+// maxAPICalls is set by --max-api-calls, to stop a run before it uses up a shared token's rate limit
+var maxAPICalls int64
+
+// repoLimiter is the limiter that spaces out API requests for a repo, which also prevents bursts
+// of concurrent requests that trigger Github's abuse detection. It's shared by the repos on the
+// same host, see lib.HostLimiter.
+func repoLimiter(r lib.Repo) *time.Ticker {
+	return lib.HostLimiter(r.ProviderConfig)
+}
+
+// verbose is set by --verbose
+var verbose bool
+
+// rateLimitsFile is where each command saves what's left of the provider's rate limits, for the next
+const rateLimitsFile = "rate-limits.json"
 
 var rootCmd = &cobra.Command{
 	Use:   "mp",
 	Short: "Microplane makes git changes across many repos",
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		if err := applyProfile(cmd); err != nil {
+			log.Fatal(err)
+		}
+		if err := setupWorkDir(); err != nil {
+			log.Fatal(err)
+		}
+		if err := setupLogs(cmd.Name()); err != nil {
+			log.Fatal(err)
+		}
+		if err := setupRateLimits(); err != nil {
+			log.Fatal(err)
+		}
+		if err := setupDeadline(); err != nil {
+			log.Fatal(err)
+		}
+		if err := setupArtifactsDir(); err != nil {
+			log.Fatal(err)
+		}
+		if err := checkDryRun(cmd); err != nil {
+			log.Fatal(err)
+		}
+		if err := applySSHCommand(); err != nil {
+			log.Fatal(err)
+		}
+		if err := applyGitConfig(); err != nil {
+			log.Fatal(err)
+		}
+		if err := applyCIStatusMap(); err != nil {
+			log.Fatal(err)
+		}
+		if cmd != initCmd {
+			// init checks its own TLS flags, rather than the previous init's
+			if err := applyGitTLS(); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if maxAPICalls < 0 {
+			log.Fatal("--max-api-calls must be at least 1, or 0 for no limit")
+		}
+		lib.SetAPICallLimit(maxAPICalls)
+		if needsWorkDirLock(cmd) {
+			if err := lockWorkDir(); err != nil {
+				log.Fatal(err)
+			}
+			if !dryRun {
+				if err := startRun(cmd, args); err != nil {
+					log.Fatalf("error starting run: %s", err.Error())
+				}
+			}
+		}
+	},
+	PersistentPostRun: func(cmd *cobra.Command, args []string) {
+		if verbose && lib.APICalls() > 0 {
+			lib.LogAPIRateLimits()
+		}
+		saveRateLimits()
+		finishRun()
+		cancelRun()
+	},
 }
 
 func init() {
 	rootCmd.PersistentFlags().StringP("repo", "r", "", "single repo to operate on")
+	rootCmd.PersistentFlags().BoolVar(&dryRun, "dry-run", false, "check what plan, push, or merge would do, without doing it")
+	rootCmd.PersistentFlags().StringVar(&sshCommand, "ssh-command", "", "ssh command for git to use, e.g. 'ssh -i ~/.ssh/deploy_key -o IdentitiesOnly=yes'. sets GIT_SSH_COMMAND")
+	rootCmd.PersistentFlags().StringArrayVar(&gitConfigFlags, "git-config", nil, "git config to apply to every git command, as key=value, like git -c. repeatable, e.g. --git-config core.autocrlf=input")
+	rootCmd.PersistentFlags().BoolVar(&verbose, "verbose", false, "log more detail, including what's left of the provider's rate limit")
+	rootCmd.PersistentFlags().StringVar(&ciStatusMapFile, "ci-status-map-file", os.Getenv("MICROPLANE_CI_STATUS_MAP_FILE"), "JSON file mapping the raw statuses your CI reports to the success, pending, or failure shown for PRs, e.g. {\"manual\": \"pending\", \"skipped\": \"success\"}. defaults to $MICROPLANE_CI_STATUS_MAP_FILE")
+	rootCmd.PersistentFlags().StringVar(&logFormat, "log-format", logFormatText, "text, or json to log each event as a JSON object with level, timestamp, repo, command, and message fields, e.g. for a log pipeline")
+	rootCmd.PersistentFlags().BoolVar(&githubAnnotations, "github-annotations", os.Getenv("GITHUB_ACTIONS") == "true", "also print failed and skipped repos as Github Actions annotations, so they show up in the run's summary. defaults to on in Github Actions")
+	rootCmd.PersistentFlags().Int64Var(&maxAPICalls, "max-api-calls", 0, "most Github or Gitlab API requests this run may make. repos not started when it's reached are left for the next run. 0 means no limit")
+	rootCmd.PersistentFlags().DurationVar(&maxDuration, "max-duration", 0, "longest this run may take, e.g. 2h. when it's up, in-flight git commands and API calls are cancelled, their repos fail as timed out, and repos not started are left for the next run. 0 means no limit")
+	rootCmd.PersistentFlags().StringSlice("repos", nil, "repos to operate on, as owner/name or name. for example: --repos clever/app,lib")
 	rootCmd.AddCommand(cloneCmd)
+	rootCmd.AddCommand(closeCmd)
+	rootCmd.AddCommand(diffCmd)
+	rootCmd.AddCommand(dismissCmd)
 	rootCmd.AddCommand(docsCmd)
+	rootCmd.AddCommand(doctorCmd)
+	rootCmd.AddCommand(exportCmd)
+	rootCmd.AddCommand(listCmd)
 	rootCmd.AddCommand(mergeCmd)
 	rootCmd.AddCommand(planCmd)
+	rootCmd.AddCommand(previewCmd)
 	rootCmd.AddCommand(pushCmd)
+	rootCmd.AddCommand(readyCmd)
+	rootCmd.AddCommand(reassignCmd)
+	rootCmd.AddCommand(reportCmd)
+	rootCmd.AddCommand(rerunCmd)
 	rootCmd.AddCommand(statusCmd)
 	rootCmd.AddCommand(syncCmd)
 	rootCmd.AddCommand(initCmd)
 	rootCmd.AddCommand(versionCmd)
+	defaultWorkDir := os.Getenv("MICROPLANE_WORKDIR")
+	if defaultWorkDir == "" {
+		defaultWorkDir = "./mp"
+	}
+	rootCmd.PersistentFlags().StringVar(&profileName, "profile", "", "named profile of defaults for the target, e.g. its provider URL and token, from --profiles-file. explicit flags override it")
+	rootCmd.PersistentFlags().StringVar(&profilesFile, "profiles-file", defaultProfilesFile(), "JSON file of profiles by name. defaults to $MICROPLANE_PROFILES_FILE, or ~/.microplane/profiles.json")
+	rootCmd.PersistentFlags().StringVar(&artifactsDir, "artifacts-dir", os.Getenv("MICROPLANE_ARTIFACTS_DIR"), "directory to also save each repo's outputs in as they're written, e.g. to upload from CI: <repo>/<step>.json, <repo>/plan.diff, and <repo>/plan.log. defaults to $MICROPLANE_ARTIFACTS_DIR")
+	rootCmd.PersistentFlags().StringVar(&workDir, "workdir", defaultWorkDir, "directory holding a campaign's state, clones, and plans. use one per campaign to run several side by side. defaults to $MICROPLANE_WORKDIR, or ./mp")
+}
 
+// setupWorkDir resolves --workdir, creating it if it doesn't exist yet, and checks it wasn't
+// created by an incompatible version of microplane
+func setupWorkDir() error {
 	var err error
-	workDir, err = filepath.Abs("./mp")
+	workDir, err = filepath.Abs(workDir)
 	if err != nil {
-		log.Fatalf("error finding workDir: %s\n", err.Error())
+		return fmt.Errorf("error finding workDir: %s", err.Error())
 	}
 
 	// Create workDir, if doesn't yet exist
 	if _, err := os.Stat(workDir); os.IsNotExist(err) {
-		if err := os.Mkdir(workDir, 0755); err != nil {
-			log.Fatalf("error creating workDir: %s\n", err.Error())
+		if err := os.MkdirAll(workDir, 0755); err != nil {
+			return fmt.Errorf("error creating workDir: %s", err.Error())
 		}
 	}
-}
-
-// Execute starts the CLI
-func Execute(version string) error {
-	cliVersion = version
 
 	// Check if your current workdir was created with an incompatible version of microplane
 	var initOutput initialize.Output
-	err := loadJSON(outputPath("", "init"), &initOutput)
+	err = loadJSON(outputPath("", "init"), &initOutput)
 	if err != nil {
 		// If there's no file, that's OK
 		if !os.IsNotExist(err) {
-			log.Fatal(err)
+			return err
 		}
 	} else {
 		if initOutput.Version != cliVersion {
-			log.Fatalf("A workdir (%s) exists, created with microplane version %s. This is incompatible with your version %s. Either run again using a compatible version, or remove the workdir and restart.", workDir, initOutput.Version, version)
+			return fmt.Errorf("A workdir (%s) exists, created with microplane version %s. This is incompatible with your version %s. Either run again using a compatible version, or remove the workdir and restart.", workDir, initOutput.Version, cliVersion)
 		}
 	}
+	return nil
+}
+
+// setupRateLimits paces API requests starting from what was left of the providers' rate limits
+// after the previous command in the work dir
+func setupRateLimits() error {
+	lib.SetVerbose(verbose)
+	return lib.LoadAPIRateLimits(path.Join(workDir, rateLimitsFile))
+}
 
+// saveRateLimits saves what's left of the provider's rate limits for the next command, if this
+// one used any of them
+func saveRateLimits() {
+	if lib.APICalls() == 0 {
+		return
+	}
+	if err := lib.SaveAPIRateLimits(path.Join(workDir, rateLimitsFile)); err != nil {
+		log.Printf("error saving rate limits: %s", err.Error())
+	}
+}
+
+// Execute starts the CLI
+func Execute(version string) error {
+	cliVersion = version
 	return rootCmd.Execute()
 }
 
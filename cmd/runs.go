@@ -0,0 +1,191 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// runsDir is the directory in the work dir where each run's outputs are saved, by run ID
+const runsDir = ".runs"
+
+// runFile describes a saved run, in its directory
+const runFile = "run.json"
+
+// runIDLayout is the time format of a run ID, before any suffix for runs in the same second
+const runIDLayout = "20060102-150405"
+
+// runID identifies this run, if it modifies the work dir. Its outputs are saved under it, see startRun.
+var runID string
+
+// selectedRunID is set by --run-id, to read the outputs saved by a previous run instead of the
+// work dir's current ones
+var selectedRunID string
+
+// run describes a command that modified the work dir
+type run struct {
+	ID         string
+	Command    string
+	Args       []string
+	StartedAt  time.Time
+	FinishedAt *time.Time `json:",omitempty"`
+}
+
+// runDir is where a run's outputs are saved
+func runDir(id string) string {
+	return filepath.Join(workDir, runsDir, id)
+}
+
+// newRunID makes an ID for a run starting now, e.g. 20210601-120000, unique within the work dir
+func newRunID(now time.Time) string {
+	id := now.UTC().Format(runIDLayout)
+	for n := 2; ; n++ {
+		if _, err := os.Stat(runDir(id)); os.IsNotExist(err) {
+			return id
+		}
+		id = fmt.Sprintf("%s-%d", now.UTC().Format(runIDLayout), n)
+	}
+}
+
+// startRun assigns the run its ID. As the run writes outputs, writeJSON saves them under it, so
+// that even if it fails part way through, its directory holds the outputs it wrote before it
+// stopped. Outputs it didn't write are found in earlier runs, see savedOutputPath.
+func startRun(cmd *cobra.Command, args []string) error {
+	id := newRunID(time.Now())
+	if err := os.MkdirAll(runDir(id), 0755); err != nil {
+		return err
+	}
+	runID = id
+	return writeJSON(run{ID: id, Command: cmd.Name(), Args: args, StartedAt: time.Now()}, filepath.Join(runDir(id), runFile))
+}
+
+// finishRun records when the run finished, if it got that far
+func finishRun() {
+	if runID == "" {
+		return
+	}
+	var r run
+	path := filepath.Join(runDir(runID), runFile)
+	if err := loadJSON(path, &r); err != nil {
+		return
+	}
+	now := time.Now()
+	r.FinishedAt = &now
+	if err := writeJSON(r, path); err != nil {
+		log.Printf("error saving run %s: %s", runID, err.Error())
+	}
+}
+
+// saveToRun saves a file written to the work dir under a run, at the same relative path
+func saveToRun(id string, path string, bs []byte) error {
+	rel, err := filepath.Rel(workDir, path)
+	if err != nil || strings.HasPrefix(rel, "..") || strings.HasPrefix(rel, runsDir+string(filepath.Separator)) {
+		// not one of the work dir's outputs
+		return nil
+	}
+	saved := filepath.Join(runDir(id), rel)
+	if err := os.MkdirAll(filepath.Dir(saved), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(saved, bs, 0644)
+}
+
+// savedOutputPath is where a step's output is read from: the work dir, or with --run-id, the
+// latest one saved by that run or a run before it
+func savedOutputPath(repoName string, step string) string {
+	if selectedRunID == "" {
+		return outputPath(repoName, step)
+	}
+	rel, _ := filepath.Rel(workDir, outputPath(repoName, step))
+	ids := runIDs()
+	for i := len(ids) - 1; i >= 0; i-- {
+		if runIDLess(selectedRunID, ids[i]) {
+			continue
+		}
+		saved := filepath.Join(runDir(ids[i]), rel)
+		if _, err := os.Stat(saved); err == nil {
+			return saved
+		}
+	}
+	return selectedOutputPath(repoName, step)
+}
+
+// selectedOutputPath is where a command that acts on a previous run, like merge --run-id, writes
+// a step's output: the run's own directory, so the work dir's current outputs are left as they are
+func selectedOutputPath(repoName string, step string) string {
+	if selectedRunID == "" {
+		return outputPath(repoName, step)
+	}
+	rel, _ := filepath.Rel(workDir, outputPath(repoName, step))
+	return filepath.Join(runDir(selectedRunID), rel)
+}
+
+// runIDs lists the work dir's runs, oldest first
+func runIDs() []string {
+	ids := []string{}
+	infos, _ := ioutil.ReadDir(filepath.Join(workDir, runsDir))
+	for _, info := range infos {
+		if info.IsDir() {
+			ids = append(ids, info.Name())
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return runIDLess(ids[i], ids[j]) })
+	return ids
+}
+
+// runIDLess determines if run a started before run b. IDs are ordered by their timestamp, then by
+// the suffix newRunID adds to runs started in the same second, as numbers so -10 comes after -2.
+// IDs that newRunID didn't make are ordered as strings.
+func runIDLess(a, b string) bool {
+	aTime, aN, aErr := parseRunID(a)
+	bTime, bN, bErr := parseRunID(b)
+	if aErr != nil || bErr != nil {
+		return a < b
+	}
+	if !aTime.Equal(bTime) {
+		return aTime.Before(bTime)
+	}
+	return aN < bN
+}
+
+// parseRunID splits a run ID into when it started and its suffix, 1 if it has none
+func parseRunID(id string) (time.Time, int, error) {
+	if len(id) < len(runIDLayout) {
+		return time.Time{}, 0, fmt.Errorf("invalid run ID %q", id)
+	}
+	started, err := time.Parse(runIDLayout, id[:len(runIDLayout)])
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	suffix := id[len(runIDLayout):]
+	if suffix == "" {
+		return started, 1, nil
+	}
+	if !strings.HasPrefix(suffix, "-") {
+		return time.Time{}, 0, fmt.Errorf("invalid run ID %q", id)
+	}
+	n, err := strconv.Atoi(suffix[1:])
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("invalid run ID %q", id)
+	}
+	return started, n, nil
+}
+
+// checkSelectedRun checks that the --run-id was saved in the work dir
+func checkSelectedRun() error {
+	if selectedRunID == "" {
+		return nil
+	}
+	if _, err := os.Stat(filepath.Join(runDir(selectedRunID), runFile)); err == nil {
+		return nil
+	}
+	return fmt.Errorf("no run %q in %s, it has %v", selectedRunID, workDir, runIDs())
+}
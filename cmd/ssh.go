@@ -0,0 +1,21 @@
+package cmd
+
+import (
+	"log"
+	"os"
+)
+
+// sshCommand is set by --ssh-command, and replaces the ssh that git runs, e.g. to use a deploy key
+var sshCommand string
+
+// applySSHCommand sets GIT_SSH_COMMAND for every git subprocess, including those run by hooks
+// and plan scripts. It overrides GIT_SSH_COMMAND from the environment.
+func applySSHCommand() error {
+	if sshCommand == "" {
+		return nil
+	}
+	if existing := os.Getenv("GIT_SSH_COMMAND"); existing != "" && existing != sshCommand {
+		log.Printf("--ssh-command overrides GIT_SSH_COMMAND from the environment")
+	}
+	return os.Setenv("GIT_SSH_COMMAND", sshCommand)
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strconv"
 	"strings"
 	"text/tabwriter"
 
@@ -23,7 +24,10 @@ var statusCmd = &cobra.Command{
 	Short: "Status shows a workflow's progress",
 	Run: func(cmd *cobra.Command, args []string) {
 		// find files and folders to explain the status of each repo
-		initPath := outputPath("", "init")
+		if err := checkSelectedRun(); err != nil {
+			log.Fatal(err)
+		}
+		initPath := savedOutputPath("", "init")
 
 		if _, err := os.Stat(initPath); os.IsNotExist(err) {
 			log.Fatalf("must run init first: %s\n", err.Error())
@@ -34,6 +38,10 @@ var statusCmd = &cobra.Command{
 			log.Fatalf("error loading init.json: %s\n", err.Error())
 		}
 
+		if err := checkFailOn(statusFlagFailOn); err != nil {
+			log.Fatal(err)
+		}
+
 		repos, err := whichRepos(cmd)
 		if err != nil {
 			log.Fatal(err)
@@ -42,7 +50,10 @@ var statusCmd = &cobra.Command{
 		if err != nil {
 			log.Fatal(err)
 		}
-		if sync {
+		if selectedRunID != "" && (sync || syncRefresh || syncReviews) {
+			log.Fatal("--run-id shows a previous run's status as it was saved, so it can't be synced")
+		}
+		if sync || syncRefresh || syncReviews {
 			err = parallelize(repos, syncOneRepo)
 			if err != nil {
 				// TODO: dig into errors and display them with more detail
@@ -50,10 +61,49 @@ var statusCmd = &cobra.Command{
 			}
 		}
 
-		printStatus(repos)
+		if failures := printStatus(repos); len(failures) > 0 {
+			log.Printf("%d repos match --fail-on %s: %s", len(failures), strings.Join(statusFlagFailOn, ","), strings.Join(failures, ", "))
+			os.Exit(exitCodeStatusFailed)
+		}
 	},
 }
 
+var statusFlagFailOn []string
+
+// exitCodeStatusFailed is the exit status when a repo matches status --fail-on, so CI can tell
+// it apart from status itself failing
+const exitCodeStatusFailed = 2
+
+// statusFailOnStates are the states --fail-on accepts, besides the statuses themselves
+var statusFailOnStates = []string{"failed", "unmerged", "none"}
+
+// repoStatuses are the statuses getRepoStatus reports
+var repoStatuses = []string{"initialized", "cloned", "planned", "pushed", "merged", "closed", "ignored"}
+
+// checkFailOn validates --fail-on
+func checkFailOn(failOn []string) error {
+	for _, state := range failOn {
+		if !contains(statusFailOnStates, state) && !contains(repoStatuses, state) {
+			return fmt.Errorf("invalid --fail-on state '%s', expected one of: %s", state, strings.Join(append(append([]string{}, statusFailOnStates...), repoStatuses...), ", "))
+		}
+	}
+	return nil
+}
+
+// failsOn determines if a repo's status matches any of the --fail-on states. "failed" matches a
+// repo whose latest step errored, and "unmerged" one that isn't merged, unless it was ignored.
+func failsOn(failOn []string, status string, failed bool) bool {
+	for _, state := range failOn {
+		switch {
+		case state == "failed" && failed,
+			state == "unmerged" && status != "merged" && status != "ignored",
+			state == status:
+			return true
+		}
+	}
+	return false
+}
+
 func tabWriterWithDefaults() *tabwriter.Writer {
 	w := new(tabwriter.Writer)
 	minWidth := 0
@@ -69,22 +119,47 @@ func joinWithTab(s ...string) string {
 	return strings.Join(s, "\t")
 }
 
-func printStatus(repos []lib.Repo) {
+// printStatus prints each repo's status, returning the repos that match --fail-on
+func printStatus(repos []lib.Repo) []string {
+	failures := []string{}
 	out := tabWriterWithDefaults()
-	fmt.Fprintln(out, joinWithTab("REPO", "STATUS", "DETAILS"))
+	if syncReviews {
+		fmt.Fprintln(out, joinWithTab("REPO", "STATUS", "REVIEW", "APPROVALS", "DETAILS"))
+	} else {
+		fmt.Fprintln(out, joinWithTab("REPO", "STATUS", "DETAILS"))
+	}
 	for _, r := range repos {
-		status, details := getRepoStatus(r)
+		status, details, failed := getRepoStatus(r)
+		if failsOn(statusFlagFailOn, status, failed) {
+			failures = append(failures, fmt.Sprintf("%s/%s", r.Owner, r.Name))
+		}
 		d2 := strings.TrimSpace(details)
 		d3 := strings.Join(strings.Split(d2, "\n"), " ")
 		if len(d3) > 150 {
 			d3 = d3[:150] + "..."
 		}
-		fmt.Fprintln(out, joinWithTab(r.Name, status, d3))
+		if syncReviews {
+			review, approvals := getRepoReviews(r, status)
+			fmt.Fprintln(out, joinWithTab(r.Name, status, review, approvals, d3))
+		} else {
+			fmt.Fprintln(out, joinWithTab(r.Name, status, d3))
+		}
 	}
 	out.Flush()
+	return failures
 }
 
-func getRepoStatus(repo lib.Repo) (status, details string) {
+// getRepoReviews describes the review state of a repo's open PR, as of the last sync
+func getRepoReviews(repo lib.Repo, status string) (review, approvals string) {
+	var pushOutput push.Output
+	if status != "pushed" || loadJSON(savedOutputPath(repo.Name, "push"), &pushOutput) != nil || pushOutput.ReviewDecision == "" {
+		return "-", "-"
+	}
+	return pushOutput.ReviewDecision, strconv.Itoa(pushOutput.ReviewApprovals)
+}
+
+// getRepoStatus describes how far a repo has got, and whether its latest step failed
+func getRepoStatus(repo lib.Repo) (status, details string, failed bool) {
 	repoName := repo.Name
 	status = "initialized"
 	details = ""
@@ -92,8 +167,9 @@ func getRepoStatus(repo lib.Repo) (status, details string) {
 		clone.Output
 		Error string
 	}
-	if !(loadJSON(outputPath(repoName, "clone"), &cloneOutput) == nil && cloneOutput.Success) {
+	if !(loadJSON(savedOutputPath(repoName, "clone"), &cloneOutput) == nil && cloneOutput.Success) {
 		if cloneOutput.Error != "" {
+			failed = true
 			details = color.RedString("(clone error) ") + cloneOutput.Error
 		}
 		return
@@ -104,8 +180,12 @@ func getRepoStatus(repo lib.Repo) (status, details string) {
 		plan.Output
 		Error string
 	}
-	if !(loadJSON(outputPath(repoName, "plan"), &planOutput) == nil && planOutput.Success) {
-		if planOutput.Error != "" {
+	if !(loadJSON(savedOutputPath(repoName, "plan"), &planOutput) == nil && planOutput.Success) {
+		if planOutput.Ignored {
+			status = "ignored"
+			details = planOutput.IgnoreReason
+		} else if planOutput.Error != "" {
+			failed = true
 			details = color.RedString("(plan error) ") + planOutput.Error
 		}
 		return
@@ -114,6 +194,9 @@ func getRepoStatus(repo lib.Repo) (status, details string) {
 	diff, err := diffparser.Parse(planOutput.GitDiff)
 	if err == nil {
 		details = fmt.Sprintf("%d file(s) modified", len(diff.Files))
+		if planOutput.Unchanged {
+			details += " (unchanged since last plan)"
+		}
 	}
 	if isSingleRepo {
 		fmt.Println(planOutput.GitDiff)
@@ -123,9 +206,10 @@ func getRepoStatus(repo lib.Repo) (status, details string) {
 		push.Output
 		Error string
 	}
-	if !(loadJSON(outputPath(repoName, "push"), &pushOutput) == nil && pushOutput.Success) {
+	if !(loadJSON(savedOutputPath(repoName, "push"), &pushOutput) == nil && pushOutput.Success) {
 		if pushOutput.Error != "" {
-			details = color.RedString("(push error) ") + pushOutput.Error
+			failed = true
+			details = color.RedString("(push error%s) ", errorKindLabel(pushOutput.ErrorKind)) + pushOutput.Error
 		}
 		return
 	}
@@ -137,18 +221,43 @@ func getRepoStatus(repo lib.Repo) (status, details string) {
 		Error string
 	}
 	// check PR was merged
-	if !(loadJSON(outputPath(repoName, "merge"), &mergeOutput) == nil && mergeOutput.Success) {
+	if !(loadJSON(savedOutputPath(repoName, "merge"), &mergeOutput) == nil && mergeOutput.Success) {
 		if mergeOutput.Error != "" {
-			details = color.RedString("(merge error) ") + mergeOutput.Error
+			failed = true
+			details = color.RedString("(merge error%s) ", errorKindLabel(mergeOutput.ErrorKind)) + mergeOutput.Error
+		} else if mergeOutput.SkipReason == merge.SkipClosed {
+			status = "closed"
+			details = mergeOutput.SkipDetails
+		} else if mergeOutput.Skipped() {
+			details = color.YellowString("(merge skipped: %s) ", mergeOutput.SkipReason) + mergeOutput.SkipDetails
 		}
 		return
 	}
 	status = "merged"
 	details = ""
+	if mergeOutput.MergedExternally {
+		details = "(already in the base branch)"
+	}
+	if postMerge := mergeOutput.PostMerge; postMerge != nil && !postMerge.Success {
+		failed = true
+		details = color.RedString("(post-merge script failed: exit %d) ", postMerge.ExitCode) + postMerge.Output
+	}
 
 	return
 }
 
+// errorKindLabel adds the kind of failure to a step's error label, if it's known
+func errorKindLabel(kind string) string {
+	if kind == "" {
+		return ""
+	}
+	return ": " + kind
+}
+
 func init() {
 	statusCmd.Flags().BoolP("sync", "s", false, "Sync workflow status with repo origin")
+	statusCmd.Flags().BoolVar(&syncReviews, "reviews", false, "Sync and show each open PR's review state. This costs extra API calls")
+	statusCmd.Flags().StringSliceVar(&statusFlagFailOn, "fail-on", []string{"failed"}, fmt.Sprintf("exit with status %d if any repo is in one of these states: failed (its latest step errored), unmerged (not merged or ignored), a status like 'planned', or none", exitCodeStatusFailed))
+	statusCmd.Flags().StringVar(&selectedRunID, "run-id", "", "show the status as of a previous run, from the outputs saved under its ID in the work dir")
+	statusCmd.Flags().BoolVar(&syncRefresh, "refresh", false, "Sync workflow status with repo origin, including PRs that are already recorded as merged or closed")
 }
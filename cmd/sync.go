@@ -14,6 +14,12 @@ import (
 	"github.com/spf13/cobra"
 )
 
+// syncRefresh re-queries PRs that are already recorded as merged or closed
+var syncRefresh bool
+
+// syncReviews also fetches each PR's review state, which costs more API calls
+var syncReviews bool
+
 var syncCmd = &cobra.Command{
 	Use:   "sync",
 	Short: "Sync workflow status with remote repo",
@@ -52,7 +58,8 @@ func syncOneRepo(r lib.Repo, ctx context.Context) error {
 		Error string
 	}
 
-	if !(loadJSON(outputPath(repoName, "push"), &pushOutput) == nil && pushOutput.Success) {
+	if !(loadJSON(outputPath(repoName, "push"), &pushOutput) == nil && pushOutput.Success) || pushOutput.AlreadyInBase {
+		// there's no PR to sync
 		return nil
 	}
 	output, err := syncPush(r, ctx, pushOutput.Output)
@@ -65,11 +72,11 @@ func syncOneRepo(r lib.Repo, ctx context.Context) error {
 		Error string
 	}
 
-	if loadJSON(outputPath(repoName, "merge"), &mergeOutput) == nil && mergeOutput.Success {
+	if loadJSON(outputPath(repoName, "merge"), &mergeOutput) == nil && mergeOutput.Success && !syncRefresh {
 		return nil
 	}
 
-	if err := syncMerge(r, ctx, output); err != nil {
+	if err := syncMerge(r, ctx, output, mergeOutput.Output); err != nil {
 		return err
 	}
 
@@ -82,33 +89,67 @@ func syncPush(r lib.Repo, ctx context.Context, pushOutput push.Output) (sync.Out
 	var output sync.Output
 	var err error
 	if r.IsGitlab() {
-		output, err = sync.GitlabSyncPush(ctx, r, pushOutput, repoLimiter)
+		output, err = sync.GitlabSyncPush(ctx, r, pushOutput, repoLimiter(r))
 	} else if r.IsGithub() {
-		output, err = sync.GithubSyncPush(ctx, r, pushOutput, repoLimiter)
+		output, err = sync.GithubSyncPush(ctx, r, pushOutput, repoLimiter(r))
 	}
 	if err != nil {
 		return sync.Output{}, err
 	}
 	pushOutput.CommitSHA = output.CommitSHA
+	pushOutput.PullRequestNumber = output.PullRequestNumber
 	pushOutput.PullRequestCombinedStatus = output.PullRequestCombinedStatus
+	if syncReviews && !output.Merged && !output.Closed {
+		var reviews sync.Reviews
+		if r.IsGitlab() {
+			reviews, err = sync.GitlabSyncReviews(ctx, r, output.PullRequestNumber, repoLimiter(r))
+		} else if r.IsGithub() {
+			reviews, err = sync.GithubSyncReviews(ctx, r, output.PullRequestNumber, repoLimiter(r))
+		}
+		if err != nil {
+			return sync.Output{}, err
+		}
+		pushOutput.ReviewApprovals = reviews.Approvals
+		pushOutput.ReviewDecision = reviews.Decision
+	}
 
 	writeJSON(pushOutput, outputPath(r.Name, "push"))
 	return output, nil
 }
-func syncMerge(r lib.Repo, ctx context.Context, output sync.Output) error {
-	if !output.Merged {
+func syncMerge(r lib.Repo, ctx context.Context, output sync.Output, mergeOutput merge.Output) error {
+	mergeOutputPath := outputPath(r.Name, "merge")
+	if !output.Merged && !output.Closed {
+		if mergeOutput.Success || mergeOutput.SkipReason == merge.SkipClosed {
+			// the PR was reopened, or reverted outside of microplane
+			if err := os.Remove(mergeOutputPath); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
 		return nil
 	}
 
-	mergeOutputPath := outputPath(r.Name, "merge")
 	mergeWorkDir := filepath.Dir(mergeOutputPath)
 	if err := os.MkdirAll(mergeWorkDir, 0755); err != nil {
 		return err
 	}
 
-	writeJSON(merge.Output{
+	if output.Closed {
+		log.Printf("%s/%s - PR was closed without merging", r.Owner, r.Name)
+		return writeJSON(merge.Output{
+			SkipReason:  merge.SkipClosed,
+			SkipDetails: "PR was closed without merging",
+		}, mergeOutputPath)
+	}
+	if !mergeOutput.Success {
+		log.Printf("%s/%s - PR was merged outside of microplane", r.Owner, r.Name)
+	}
+	return writeJSON(merge.Output{
 		Success:        true,
 		MergeCommitSHA: output.MergeCommitSHA,
 	}, mergeOutputPath)
-	return nil
+}
+
+func init() {
+	syncCmd.Flags().BoolVar(&syncRefresh, "refresh", false, "Re-query PRs that are already recorded as merged or closed")
+	syncCmd.Flags().BoolVar(&syncReviews, "reviews", false, "Also sync each PR's review state. This costs extra API calls")
 }
@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/Clever/microplane/initialize"
+	"github.com/Clever/microplane/lib"
+)
+
+// applyGitTLS checks the TLS files init recorded for the provider, and has git present the client
+// cert, and trust the CA, when it talks to the provider over HTTPS. See addGitConfigEnv.
+func applyGitTLS() error {
+	var initOutput initialize.Output
+	if err := loadJSON(outputPath("", "init"), &initOutput); err != nil || len(initOutput.Repos) == 0 {
+		// nothing to configure until init has run
+		return nil
+	}
+	pc := initOutput.Repos[0].ProviderConfig
+	if err := pc.CheckTLSFiles(); err != nil {
+		return fmt.Errorf("invalid TLS options from init: %s. Re-run init with the correct --ca-cert, --client-cert, or --client-key", err.Error())
+	}
+
+	config, err := gitTLSConfig(pc)
+	if err != nil {
+		return err
+	}
+	return addGitConfigEnv(config)
+}
+
+// gitTLSConfig is the git config for a provider's TLS files, scoped to the provider's host so
+// that git's TLS setup for other hosts is left alone
+func gitTLSConfig(pc lib.ProviderConfig) ([][2]string, error) {
+	if pc.CACertFile == "" && pc.ClientCertFile == "" {
+		return nil, nil
+	}
+	host := "https://github.com/"
+	if pc.Backend == "gitlab" {
+		host = "https://gitlab.com/"
+	}
+	if pc.IsEnterprise() {
+		u, err := url.Parse(pc.BackendURL)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid provider URL '%s'", pc.BackendURL)
+		}
+		host = fmt.Sprintf("https://%s/", u.Host)
+	}
+
+	config := [][2]string{}
+	if pc.CACertFile != "" {
+		config = append(config, [2]string{fmt.Sprintf("http.%s.sslCAInfo", host), pc.CACertFile})
+	}
+	if pc.ClientCertFile != "" {
+		config = append(config,
+			[2]string{fmt.Sprintf("http.%s.sslCert", host), pc.ClientCertFile},
+			[2]string{fmt.Sprintf("http.%s.sslKey", host), pc.ClientKeyFile},
+		)
+	}
+	return config, nil
+}
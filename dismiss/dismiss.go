@@ -0,0 +1,156 @@
+// Package dismiss dismisses the reviews on PRs, so reviewers look at them again.
+package dismiss
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Clever/microplane/lib"
+	"github.com/google/go-github/v35/github"
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+// Input to Dismiss()
+type Input struct {
+	// Repo is the git Repo
+	Repo lib.Repo
+	// PRNumber of the PR opened by push. It's the IID for Gitlab.
+	PRNumber int
+	// Reason is why the reviews were dismissed. It's the dismissal message in Github, and a
+	// comment on the MR in Gitlab, which has no dismissal message.
+	Reason string
+}
+
+// Output from Dismiss()
+type Output struct {
+	Success bool
+	// Dismissed is how many reviews or approvals were dismissed
+	Dismissed int
+	// NotOpen is set if the PR was already merged or closed, so was left alone
+	NotOpen bool
+}
+
+// Dismiss dismisses the approving and changes requested reviews on a PR, if it's open.
+// A nil limiter means no rate limiting.
+func Dismiss(ctx context.Context, input Input, repoLimiter *time.Ticker) (Output, error) {
+	switch {
+	case input.Repo.IsGithub():
+		return GithubDismiss(ctx, input, repoLimiter)
+	case input.Repo.IsGitlab():
+		return GitlabDismiss(ctx, input, repoLimiter)
+	}
+	return Output{}, fmt.Errorf("unsupported provider: %s", input.Repo.ProviderConfig.Backend)
+}
+
+// GithubDismiss dismisses the reviews on a Github PR that approve it or request changes.
+// Comment-only reviews can't be dismissed, so they're left alone.
+func GithubDismiss(ctx context.Context, input Input, repoLimiter *time.Ticker) (Output, error) {
+	p := lib.NewProviderFromConfig(input.Repo.ProviderConfig)
+	client, err := p.GithubClient(ctx)
+	if err != nil {
+		return Output{}, err
+	}
+
+	lib.Wait(repoLimiter)
+	pr, _, err := client.PullRequests.Get(ctx, input.Repo.Owner, input.Repo.Name, input.PRNumber)
+	if err != nil {
+		return Output{Success: false}, err
+	}
+	if pr.GetState() != "open" {
+		return Output{Success: true, NotOpen: true}, nil
+	}
+
+	reviews := []*github.PullRequestReview{}
+	opts := &github.ListOptions{PerPage: 100}
+	for {
+		lib.Wait(repoLimiter)
+		page, resp, err := client.PullRequests.ListReviews(ctx, input.Repo.Owner, input.Repo.Name, input.PRNumber, opts)
+		if err != nil {
+			return Output{Success: false}, err
+		}
+		reviews = append(reviews, page...)
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+
+	dismissed := 0
+	for _, review := range reviews {
+		if review.GetState() != "APPROVED" && review.GetState() != "CHANGES_REQUESTED" {
+			continue
+		}
+		lib.Wait(repoLimiter)
+		_, _, err := client.PullRequests.DismissReview(ctx, input.Repo.Owner, input.Repo.Name, input.PRNumber, review.GetID(), &github.PullRequestReviewDismissalRequest{Message: &input.Reason})
+		if err != nil {
+			return Output{Success: false, Dismissed: dismissed}, fmt.Errorf("failed to dismiss %s's review: %w", review.GetUser().GetLogin(), err)
+		}
+		dismissed++
+	}
+	return Output{Success: true, Dismissed: dismissed}, nil
+}
+
+// GitlabDismiss resets the approvals of a Gitlab MR, and comments on it with the reason.
+// Resetting others' approvals needs a project or group access token, so with any other token
+// only its own approval is removed, and it's an error if others remain.
+func GitlabDismiss(ctx context.Context, input Input, repoLimiter *time.Ticker) (Output, error) {
+	p := lib.NewProviderFromConfig(input.Repo.ProviderConfig)
+	client, err := p.GitlabClient()
+	if err != nil {
+		return Output{}, err
+	}
+	ctxFunc := gitlab.WithContext(ctx)
+	pid := fmt.Sprintf("%s/%s", input.Repo.Owner, input.Repo.Name)
+
+	lib.Wait(repoLimiter)
+	mr, _, err := client.MergeRequests.GetMergeRequest(pid, input.PRNumber, &gitlab.GetMergeRequestsOptions{}, ctxFunc)
+	if err != nil {
+		return Output{Success: false}, err
+	}
+	if mr.State != "opened" {
+		return Output{Success: true, NotOpen: true}, nil
+	}
+
+	lib.Wait(repoLimiter)
+	approvals, _, err := client.MergeRequestApprovals.GetConfiguration(pid, input.PRNumber, ctxFunc)
+	if err != nil {
+		return Output{Success: false}, err
+	}
+	approved := len(approvals.ApprovedBy)
+	if approved == 0 {
+		return Output{Success: true}, nil
+	}
+
+	lib.Wait(repoLimiter)
+	resp, err := client.MergeRequestApprovals.ResetApprovalsOfMergeRequest(pid, input.PRNumber, ctxFunc)
+	remaining := 0
+	if err != nil {
+		if resp == nil || (resp.StatusCode != http.StatusUnauthorized && resp.StatusCode != http.StatusForbidden) {
+			return Output{Success: false}, fmt.Errorf("failed to reset approvals: %w", err)
+		}
+		// the token can't reset approvals, but it can take back its own
+		lib.Wait(repoLimiter)
+		if resp, err := client.MergeRequestApprovals.UnapproveMergeRequest(pid, input.PRNumber, ctxFunc); err != nil && (resp == nil || resp.StatusCode != http.StatusNotFound) {
+			return Output{Success: false}, fmt.Errorf("failed to unapprove: %w", err)
+		}
+		lib.Wait(repoLimiter)
+		if approvals, _, err = client.MergeRequestApprovals.GetConfiguration(pid, input.PRNumber, ctxFunc); err != nil {
+			return Output{Success: false}, err
+		}
+		remaining = len(approvals.ApprovedBy)
+	}
+
+	dismissed := approved - remaining
+	if dismissed > 0 && input.Reason != "" {
+		lib.Wait(repoLimiter)
+		if _, _, err := client.Notes.CreateMergeRequestNote(pid, input.PRNumber, &gitlab.CreateMergeRequestNoteOptions{Body: &input.Reason}, ctxFunc); err != nil {
+			return Output{Success: false, Dismissed: dismissed}, fmt.Errorf("dismissed approvals, but failed to comment with the reason: %w", err)
+		}
+	}
+	if remaining > 0 {
+		return Output{Success: false, Dismissed: dismissed}, fmt.Errorf("%d approvals remain: resetting others' approvals needs a project or group access token", remaining)
+	}
+	return Output{Success: true, Dismissed: dismissed}, nil
+}
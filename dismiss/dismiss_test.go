@@ -0,0 +1,92 @@
+package dismiss
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Clever/microplane/lib"
+	"github.com/google/go-github/v35/github"
+	"github.com/stretchr/testify/assert"
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+func TestGithubDismiss(t *testing.T) {
+	t.Setenv("GITHUB_API_TOKEN", "test")
+	dismissed := map[string]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/api/v3/repos/clever/app/pulls/7":
+			json.NewEncoder(w).Encode(github.PullRequest{Number: github.Int(7), State: github.String("open")})
+		case r.Method == http.MethodGet && r.URL.Path == "/api/v3/repos/clever/app/pulls/7/reviews":
+			json.NewEncoder(w).Encode([]github.PullRequestReview{
+				{ID: github.Int64(1), State: github.String("APPROVED")},
+				{ID: github.Int64(2), State: github.String("COMMENTED")},
+				{ID: github.Int64(3), State: github.String("CHANGES_REQUESTED")},
+				{ID: github.Int64(4), State: github.String("DISMISSED")},
+			})
+		case r.Method == http.MethodPut:
+			var request github.PullRequestReviewDismissalRequest
+			json.NewDecoder(r.Body).Decode(&request)
+			dismissed[r.URL.Path] = request.GetMessage()
+			json.NewEncoder(w).Encode(github.PullRequestReview{})
+		default:
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	output, err := Dismiss(context.Background(), Input{
+		Repo:     lib.Repo{Owner: "clever", Name: "app", ProviderConfig: lib.ProviderConfig{Backend: "github", BackendURL: server.URL}},
+		PRNumber: 7,
+		Reason:   "The approach changed",
+	}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, Output{Success: true, Dismissed: 2}, output)
+	assert.Equal(t, map[string]string{
+		"/api/v3/repos/clever/app/pulls/7/reviews/1/dismissals": "The approach changed",
+		"/api/v3/repos/clever/app/pulls/7/reviews/3/dismissals": "The approach changed",
+	}, dismissed)
+}
+
+func TestGitlabDismissWithoutResetPermission(t *testing.T) {
+	t.Setenv("GITLAB_API_TOKEN", "test")
+	approvers := []*gitlab.MergeRequestApproverUser{{}, {}}
+	comment := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/api/v4/projects/clever/app/merge_requests/7":
+			json.NewEncoder(w).Encode(gitlab.MergeRequest{IID: 7, State: "opened"})
+		case r.Method == http.MethodGet && r.URL.Path == "/api/v4/projects/clever/app/merge_requests/7/approvals":
+			json.NewEncoder(w).Encode(gitlab.MergeRequestApprovals{ApprovedBy: approvers})
+		case r.Method == http.MethodPut && r.URL.Path == "/api/v4/projects/clever/app/merge_requests/7/reset_approvals":
+			w.WriteHeader(http.StatusForbidden)
+		case r.Method == http.MethodPost && r.URL.Path == "/api/v4/projects/clever/app/merge_requests/7/unapprove":
+			approvers = approvers[1:]
+			w.WriteHeader(http.StatusCreated)
+		case r.Method == http.MethodPost && r.URL.Path == "/api/v4/projects/clever/app/merge_requests/7/notes":
+			var note map[string]string
+			json.NewDecoder(r.Body).Decode(&note)
+			comment = note["body"]
+			json.NewEncoder(w).Encode(gitlab.Note{})
+		default:
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	// only the token's own approval can be taken back
+	output, err := Dismiss(context.Background(), Input{
+		Repo:     lib.Repo{Owner: "clever", Name: "app", ProviderConfig: lib.ProviderConfig{Backend: "gitlab", BackendURL: server.URL}},
+		PRNumber: 7,
+		Reason:   "The approach changed",
+	}, nil)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "1 approvals remain")
+	assert.Equal(t, 1, output.Dismissed)
+	assert.Equal(t, "The approach changed", comment)
+}
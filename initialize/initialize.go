@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"os"
 	"sort"
 	"strings"
 	"time"
@@ -24,12 +25,205 @@ type Input struct {
 	ProviderURL   string
 	ReposFromFile string
 	RepoSearch    bool
+	// SearchURL is the URL of a search in the provider's web UI, whose matching repos are targeted
+	SearchURL string
+	// Topics restricts an org's repos to those tagged with these GitHub topics
+	Topics []string
+	// TopicsMatchAll requires repos to have all of Topics, rather than any of them
+	TopicsMatchAll bool
+	// Filter excludes searched repos based on their metadata. It isn't applied to ReposFromFile
+	Filter Filter
+	// CACertFile, InsecureSkipTLSVerify, ClientCertFile, and ClientKeyFile configure TLS for the
+	// provider, see lib.ProviderConfig
+	CACertFile            string
+	InsecureSkipTLSVerify bool
+	ClientCertFile        string
+	ClientKeyFile         string
+	// TokenEnv is the environment variable holding the API token, see lib.ProviderConfig
+	TokenEnv string
+}
+
+// Filter excludes repos based on the metadata returned by the provider
+type Filter struct {
+	SkipArchived bool
+	SkipForks    bool
+	// MinStars and MinForks exclude repos that are less popular
+	MinStars int
+	MinForks int
+	// Languages excludes repos whose primary language isn't one of these (case insensitive)
+	Languages []string
+	// Limit caps how many repos are found. 0 means no limit
+	Limit int
+
+	// skipped counts the repos excluded, by reason
+	skipped map[string]int
+}
+
+// repoMetadata is the subset of a provider's repo metadata that a Filter looks at
+type repoMetadata struct {
+	Archived bool
+	Fork     bool
+	Stars    int
+	Forks    int
+	Language string
+}
+
+func githubMetadata(r *github.Repository) repoMetadata {
+	return repoMetadata{
+		Archived: r.GetArchived(),
+		Fork:     r.GetFork(),
+		Stars:    r.GetStargazersCount(),
+		Forks:    r.GetForksCount(),
+		Language: r.GetLanguage(),
+	}
+}
+
+// gitlabMetadata gets a project's metadata. Gitlab doesn't include languages in project
+// results, so they're only looked up if the filter needs them
+func gitlabMetadata(client *gitlab.Client, project *gitlab.Project, filter *Filter) (repoMetadata, error) {
+	m := repoMetadata{
+		Archived: project.Archived,
+		Fork:     project.ForkedFromProject != nil,
+		Stars:    project.StarCount,
+		Forks:    project.ForksCount,
+	}
+	if len(filter.Languages) > 0 {
+		languages, _, err := client.Projects.GetProjectLanguages(project.ID)
+		if err != nil {
+			return repoMetadata{}, err
+		}
+		// the primary language is the one making up the largest % of the project
+		var max float32
+		for language, percent := range *languages {
+			if percent > max {
+				m.Language = language
+				max = percent
+			}
+		}
+	}
+	return m, nil
+}
+
+// needsFullMetadata determines if the filter uses metadata that isn't included in code search results
+func (f *Filter) needsFullMetadata() bool {
+	return f.MinStars > 0 || f.MinForks > 0 || len(f.Languages) > 0
+}
+
+// matchesLanguage determines if a primary language is one of the filter's languages
+func (f *Filter) matchesLanguage(language string) bool {
+	if len(f.Languages) == 0 {
+		return true
+	}
+	for _, l := range f.Languages {
+		if strings.EqualFold(l, language) {
+			return true
+		}
+	}
+	return false
+}
+
+// excludes determines if a repo should be left out, and counts it if so
+func (f *Filter) excludes(m repoMetadata) bool {
+	reason := ""
+	if f.SkipArchived && m.Archived {
+		reason = "archived"
+	} else if f.SkipForks && m.Fork {
+		reason = "forked"
+	} else if m.Stars < f.MinStars {
+		reason = fmt.Sprintf("fewer than %d stars", f.MinStars)
+	} else if m.Forks < f.MinForks {
+		reason = fmt.Sprintf("fewer than %d forks", f.MinForks)
+	} else if !f.matchesLanguage(m.Language) {
+		reason = fmt.Sprintf("primary language isn't %s", strings.Join(f.Languages, " or "))
+	}
+	if reason == "" {
+		return false
+	}
+
+	if f.skipped == nil {
+		f.skipped = map[string]int{}
+	}
+	f.skipped[reason]++
+	return true
+}
+
+// full determines if enough repos have been found, so that searching can stop early
+func (f *Filter) full(numRepos int) bool {
+	return f.Limit > 0 && numRepos >= f.Limit
+}
+
+// report logs how many repos were excluded
+func (f *Filter) report() {
+	reasons := []string{}
+	for reason := range f.skipped {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		log.Printf("skipped %d repos: %s", f.skipped[reason], reason)
+	}
+}
+
+// describe summarizes the filters that exclude repos, e.g. "min stars 10, skip archived"
+func (f Filter) describe() string {
+	filters := []string{}
+	if f.SkipArchived {
+		filters = append(filters, "skip archived")
+	}
+	if f.SkipForks {
+		filters = append(filters, "skip forks")
+	}
+	if f.MinStars > 0 {
+		filters = append(filters, fmt.Sprintf("min stars %d", f.MinStars))
+	}
+	if f.MinForks > 0 {
+		filters = append(filters, fmt.Sprintf("min forks %d", f.MinForks))
+	}
+	if len(f.Languages) > 0 {
+		filters = append(filters, fmt.Sprintf("language %s", strings.Join(f.Languages, ",")))
+	}
+	if f.Limit > 0 {
+		filters = append(filters, fmt.Sprintf("limit %d", f.Limit))
+	}
+	return strings.Join(filters, ", ")
+}
+
+// Target describes which repos the input targets, e.g. `code search "org:clever foo"`, with
+// the filters applied
+func (input Input) Target() string {
+	if input.ReposFromFile == "-" {
+		return "repos from stdin"
+	}
+	if input.ReposFromFile != "" {
+		return fmt.Sprintf("repos from file %s", input.ReposFromFile)
+	}
+	var target string
+	switch {
+	case input.SearchURL != "":
+		target = fmt.Sprintf("search URL %s", input.SearchURL)
+	case len(input.Topics) > 0 && input.TopicsMatchAll:
+		target = fmt.Sprintf("repos in %q with all of the topics %s", input.Query, strings.Join(input.Topics, ","))
+	case len(input.Topics) > 0:
+		target = fmt.Sprintf("repos in %q with any of the topics %s", input.Query, strings.Join(input.Topics, ","))
+	case input.RepoSearch:
+		target = fmt.Sprintf("repo search %q", input.Query)
+	case input.AllRepos:
+		target = fmt.Sprintf("all repos in %q", input.Query)
+	default:
+		target = fmt.Sprintf("code search %q", input.Query)
+	}
+	if filters := input.Filter.describe(); filters != "" {
+		target += fmt.Sprintf(" (filters: %s)", filters)
+	}
+	return target
 }
 
 // Output for Initialize
 type Output struct {
 	Version string
 	Repos   []lib.Repo
+	// Target describes how the repos were found, see Input.Target
+	Target string `json:",omitempty"`
 }
 
 // ByName allows sorting repos by name
@@ -42,27 +236,44 @@ func (a ByName) Less(i, j int) bool { return a[i].Name < a[j].Name }
 // Initialize searches Provider for matching repos
 func Initialize(input Input) (Output, error) {
 	p := lib.NewProviderFromConfig(lib.ProviderConfig{
-		Backend:    input.Provider,
-		BackendURL: input.ProviderURL,
+		Backend:               input.Provider,
+		BackendURL:            input.ProviderURL,
+		CACertFile:            input.CACertFile,
+		InsecureSkipTLSVerify: input.InsecureSkipTLSVerify,
+		ClientCertFile:        input.ClientCertFile,
+		ClientKeyFile:         input.ClientKeyFile,
+		TokenEnv:              input.TokenEnv,
 	})
 
 	var repos []lib.Repo
 	var err error
+	filter := &input.Filter
 	if input.ReposFromFile != "" {
 		// Read repos from file
 		repos, err = reposFromFile(p, input.ReposFromFile)
+	} else if input.SearchURL != "" {
+		// Do the search behind a URL from the web UI
+		repos, err = searchURLRepos(p, input.SearchURL, filter)
+	} else if len(input.Topics) > 0 {
+		// Do repo searches by topic
+		repos, err = githubTopicSearch(p, input.Query, input.Topics, input.TopicsMatchAll, filter)
 	} else if input.RepoSearch {
 		// Do search with Repo type only
-		repos, err = githubRepoSearch(p, input.Query)
+		repos, err = githubRepoSearch(p, input.Query, filter)
 	} else if input.AllRepos {
-		// Do search with Repo type only
-		repos, err = githubAllRepoSearch(p, input.Query)
+		// List all repos in an org or group
+		if p.Backend == "gitlab" {
+			repos, err = gitlabGroupSearch(p, input.Query, filter)
+		} else {
+			repos, err = githubAllRepoSearch(p, input.Query, filter)
+		}
 	} else {
 		// Do code search
 		if p.Backend == "github" {
-			repos, err = githubSearch(p, input.Query)
+			repos, err = githubSearch(p, input.Query, filter)
 		} else if p.Backend == "gitlab" {
-			repos, err = gitlabSearch(p, input.Query)
+			// enterprise instances are assumed to have advanced search, which searches code
+			repos, err = gitlabSearch(p, input.Query, gitlabScope{Blobs: p.IsEnterprise()}, filter)
 		} else {
 			return Output{}, fmt.Errorf("unsupported provider: %s", p.Backend)
 		}
@@ -71,12 +282,18 @@ func Initialize(input Input) (Output, error) {
 	if err != nil {
 		return Output{}, err
 	}
+	filter.report()
 
 	sort.Sort(ByName(repos))
 	repos = dedupe(repos)
+	if filter.Limit > 0 && len(repos) > filter.Limit {
+		log.Printf("limiting to the first %d of %d repos", filter.Limit, len(repos))
+		repos = repos[:filter.Limit]
+	}
 	return Output{
 		Version: input.Version,
 		Repos:   repos,
+		Target:  input.Target(),
 	}, nil
 }
 
@@ -95,23 +312,34 @@ func dedupe(repos []lib.Repo) []lib.Repo {
 	return out
 }
 
+// reposFromFile reads repos from a file with a repo per line, or from stdin if file is "-"
 func reposFromFile(p *lib.Provider, file string) ([]lib.Repo, error) {
-	// read file
-	bs, err := ioutil.ReadFile(file)
+	var bs []byte
+	var err error
+	if file == "-" {
+		bs, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		bs, err = ioutil.ReadFile(file)
+	}
 	if err != nil {
 		return []lib.Repo{}, err
 	}
+	return parseRepos(p, string(bs))
+}
 
+// parseRepos parses a list of repos, one '{org}/{repo}' per line. Anything after the repo on a
+// line is ignored, e.g. the description in the output of "gh repo list".
+func parseRepos(p *lib.Provider, list string) ([]lib.Repo, error) {
 	repos := []lib.Repo{}
-	items := strings.Split(string(bs), "\n")
-	for _, item := range items {
-		if item == "" {
+	for _, line := range strings.Split(list, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
 			// in case file ends with newline, ignore it
 			continue
 		}
-		parts := strings.Split(item, "/")
-		if len(parts) != 2 {
-			return []lib.Repo{}, fmt.Errorf("unable determine repo from line, expected format '{org}/{repo}': %s", item)
+		parts := strings.Split(fields[0], "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return []lib.Repo{}, fmt.Errorf("unable determine repo from line, expected format '{org}/{repo}': %s", line)
 		}
 		repos = append(repos, lib.Repo{
 			Owner:          parts[0],
@@ -122,31 +350,46 @@ func reposFromFile(p *lib.Provider, file string) ([]lib.Repo, error) {
 	return repos, nil
 }
 
+// githubSearchPerPage is the max page size for Github's API, to use as few requests as possible
+const githubSearchPerPage = 100
+
+// waitForGithubAbuseDetection waits out Github's abuse detection (secondary rate limit), if err
+// is due to it. It returns whether the request should be tried again.
+func waitForGithubAbuseDetection(err error) bool {
+	abuseErr, ok := err.(*github.AbuseRateLimitError)
+	if !ok {
+		return false
+	}
+	var waitTime time.Duration
+	if abuseErr.RetryAfter != nil {
+		waitTime = *abuseErr.RetryAfter
+	} else {
+		waitTime = 10 * time.Second
+	}
+	log.Printf("Triggered Github abuse detection - waiting %v then trying again.\n", waitTime)
+	time.Sleep(waitTime)
+	return true
+}
+
 // githubSearch queries github and returns a list of matching repos
 //
 // GitHub Code Search Syntax:
 // https://help.github.com/articles/searching-code/
-func githubSearch(p *lib.Provider, query string) ([]lib.Repo, error) {
+func githubSearch(p *lib.Provider, query string, filter *Filter) ([]lib.Repo, error) {
 	ctx := context.Background()
 	client, err := p.GithubClient(ctx)
 	if err != nil {
 		return []lib.Repo{}, err
 	}
 
-	opts := &github.SearchOptions{}
+	opts := &github.SearchOptions{ListOptions: github.ListOptions{PerPage: githubSearchPerPage}}
 	allRepos := map[string]*github.Repository{}
+	// a repo shows up in a result per matching file
+	seen := map[string]bool{}
 	numProcessedResults := 0
 	for {
 		result, resp, err := client.Search.Code(context.Background(), query, opts)
-		if abuseErr, ok := err.(*github.AbuseRateLimitError); ok {
-			var waitTime time.Duration
-			if abuseErr.RetryAfter != nil {
-				waitTime = *abuseErr.RetryAfter
-			} else {
-				waitTime = 10 * time.Second
-			}
-			log.Printf("Triggered Github abuse detection - waiting %v then trying again.\n", waitTime)
-			time.Sleep(waitTime)
+		if waitForGithubAbuseDetection(err) {
 			continue
 		} else if err != nil {
 			return []lib.Repo{}, err
@@ -154,8 +397,20 @@ func githubSearch(p *lib.Provider, query string) ([]lib.Repo, error) {
 
 		for _, codeResult := range result.CodeResults {
 			numProcessedResults = numProcessedResults + 1
+			if seen[*codeResult.Repository.Name] {
+				continue
+			}
+			seen[*codeResult.Repository.Name] = true
 			repoCopy := *codeResult.Repository
-			allRepos[*codeResult.Repository.Name] = &repoCopy
+			if filter.needsFullMetadata() {
+				// code search results only include some of a repo's metadata
+				fullRepo, err := githubGetRepo(ctx, client, repoCopy.Owner.GetLogin(), repoCopy.GetName())
+				if err != nil {
+					return []lib.Repo{}, err
+				}
+				repoCopy = *fullRepo
+			}
+			addGithubRepo(allRepos, &repoCopy, filter)
 		}
 
 		incompleteResults := result.GetIncompleteResults()
@@ -163,35 +418,39 @@ func githubSearch(p *lib.Provider, query string) ([]lib.Repo, error) {
 			log.Printf("processed %d of about %d results -- next page is %d", numProcessedResults, *result.Total, resp.NextPage)
 		}
 
-		if resp.NextPage == 0 {
+		if resp.NextPage == 0 || filter.full(len(allRepos)) {
 			break
 		}
 		opts.Page = resp.NextPage
 	}
+	warnIfSearchCapped(numProcessedResults)
 	return getFormattedRepos(p, allRepos), nil
 }
 
-func githubRepoSearch(p *lib.Provider, query string) ([]lib.Repo, error) {
+// githubGetRepo gets a repo's full metadata
+func githubGetRepo(ctx context.Context, client *github.Client, owner, name string) (*github.Repository, error) {
+	for {
+		repo, _, err := client.Repositories.Get(ctx, owner, name)
+		if waitForGithubAbuseDetection(err) {
+			continue
+		}
+		return repo, err
+	}
+}
+
+func githubRepoSearch(p *lib.Provider, query string, filter *Filter) ([]lib.Repo, error) {
 	ctx := context.Background()
 	client, err := p.GithubClient(ctx)
 	if err != nil {
 		return []lib.Repo{}, err
 	}
 
-	opts := &github.SearchOptions{}
+	opts := &github.SearchOptions{ListOptions: github.ListOptions{PerPage: githubSearchPerPage}}
 	allRepos := map[string]*github.Repository{}
 	numProcessedResults := 0
 	for {
 		result, resp, err := client.Search.Repositories(context.Background(), query, opts)
-		if abuseErr, ok := err.(*github.AbuseRateLimitError); ok {
-			var waitTime time.Duration
-			if abuseErr.RetryAfter != nil {
-				waitTime = *abuseErr.RetryAfter
-			} else {
-				waitTime = 10 * time.Second
-			}
-			log.Printf("Triggered Github abuse detection - waiting %v then trying again.\n", waitTime)
-			time.Sleep(waitTime)
+		if waitForGithubAbuseDetection(err) {
 			continue
 		} else if err != nil {
 			return []lib.Repo{}, err
@@ -199,7 +458,7 @@ func githubRepoSearch(p *lib.Provider, query string) ([]lib.Repo, error) {
 
 		for _, repoResult := range result.Repositories {
 			numProcessedResults = numProcessedResults + 1
-			allRepos[*repoResult.Name] = repoResult
+			addGithubRepo(allRepos, repoResult, filter)
 		}
 
 		incompleteResults := result.GetIncompleteResults()
@@ -207,16 +466,54 @@ func githubRepoSearch(p *lib.Provider, query string) ([]lib.Repo, error) {
 			log.Printf("processed %d of about %d results -- next page is %d", numProcessedResults, *result.Total, resp.NextPage)
 		}
 
-		if resp.NextPage == 0 {
+		if resp.NextPage == 0 || filter.full(len(allRepos)) {
 			break
 		}
 		opts.Page = resp.NextPage
 	}
+	warnIfSearchCapped(numProcessedResults)
 
 	return getFormattedRepos(p, allRepos), nil
 }
 
-func githubAllRepoSearch(p *lib.Provider, query string) ([]lib.Repo, error) {
+// githubSearchResultsCap is the most results Github's search API will return for a query
+const githubSearchResultsCap = 1000
+
+// warnIfSearchCapped warns that a Github search may be missing results, since the search
+// API won't return more than githubSearchResultsCap
+func warnIfSearchCapped(numResults int) {
+	if numResults >= githubSearchResultsCap {
+		log.Printf("warning: Github search returns at most %d results, so some repos may be missing. Try narrowing the query, or use --all-repos", githubSearchResultsCap)
+	}
+}
+
+// githubTopicSearch finds the repos in an org tagged with the given topics.
+// If matchAll is set, repos must have every topic. Otherwise any one topic is enough.
+func githubTopicSearch(p *lib.Provider, org string, topics []string, matchAll bool, filter *Filter) ([]lib.Repo, error) {
+	if p.Backend != "github" {
+		return []lib.Repo{}, fmt.Errorf("topic search is only supported for github")
+	}
+
+	if matchAll {
+		query := fmt.Sprintf("org:%s", org)
+		for _, topic := range topics {
+			query += fmt.Sprintf(" topic:%s", topic)
+		}
+		return githubRepoSearch(p, query, filter)
+	}
+
+	repos := []lib.Repo{}
+	for _, topic := range topics {
+		topicRepos, err := githubRepoSearch(p, fmt.Sprintf("org:%s topic:%s", org, topic), filter)
+		if err != nil {
+			return []lib.Repo{}, err
+		}
+		repos = append(repos, topicRepos...)
+	}
+	return repos, nil
+}
+
+func githubAllRepoSearch(p *lib.Provider, query string, filter *Filter) ([]lib.Repo, error) {
 	ctx := context.Background()
 	client, err := p.GithubClient(ctx)
 	if err != nil {
@@ -224,35 +521,23 @@ func githubAllRepoSearch(p *lib.Provider, query string) ([]lib.Repo, error) {
 	}
 
 	allRepos := map[string]*github.Repository{}
-	opts := &github.RepositoryListByOrgOptions{}
+	opts := &github.RepositoryListByOrgOptions{ListOptions: github.ListOptions{PerPage: githubSearchPerPage}}
 	numProcessedResults := 0
 
 	for {
 		result, resp, err := client.Repositories.ListByOrg(context.Background(), query, opts)
-		if abuseErr, ok := err.(*github.AbuseRateLimitError); ok {
-			var waitTime time.Duration
-			if abuseErr.RetryAfter != nil {
-				waitTime = *abuseErr.RetryAfter
-			} else {
-				waitTime = 10 * time.Second
-			}
-			log.Printf("Triggered Github abuse detection - waiting %v then trying again.\n", waitTime)
-			time.Sleep(waitTime)
+		if waitForGithubAbuseDetection(err) {
 			continue
 		} else if err != nil {
 			return []lib.Repo{}, err
 		}
 
-		if err != nil {
-			return []lib.Repo{}, err
-		}
-
 		for _, repoResult := range result {
 			numProcessedResults = numProcessedResults + 1
-			allRepos[*repoResult.Name] = repoResult
+			addGithubRepo(allRepos, repoResult, filter)
 		}
 
-		if resp.NextPage == 0 {
+		if resp.NextPage == 0 || filter.full(len(allRepos)) {
 			break
 		}
 		opts.Page = resp.NextPage
@@ -260,6 +545,15 @@ func githubAllRepoSearch(p *lib.Provider, query string) ([]lib.Repo, error) {
 	return getFormattedRepos(p, allRepos), nil
 }
 
+// addGithubRepo adds a search result to the repos found, by name, unless the filter excludes it.
+// Filtering as results come in means --limit counts only the repos that are kept.
+func addGithubRepo(allRepos map[string]*github.Repository, r *github.Repository, filter *Filter) {
+	if filter.excludes(githubMetadata(r)) {
+		return
+	}
+	allRepos[r.GetName()] = r
+}
+
 func getFormattedRepos(p *lib.Provider, allRepos map[string]*github.Repository) []lib.Repo {
 	formattedRepos := []lib.Repo{}
 	for _, r := range allRepos {
@@ -272,12 +566,20 @@ func getFormattedRepos(p *lib.Provider, allRepos map[string]*github.Repository)
 	return formattedRepos
 }
 
+// gitlabScope is what a Gitlab search looks through
+type gitlabScope struct {
+	// Blobs searches code, rather than the projects themselves
+	Blobs bool
+	// Group limits the search to a group, by ID or path. Empty means all of Gitlab.
+	Group string
+}
+
 // gitlabSearch queries gitlab and returns a list of matching repos
 //
 // Gitlab Code Search Syntax:
 // https://docs.gitlab.com/ee/user/search/advanced_global_search.html
 // https://docs.gitlab.com/ee/user/search/advanced_search_syntax.html
-func gitlabSearch(p *lib.Provider, query string) ([]lib.Repo, error) {
+func gitlabSearch(p *lib.Provider, query string, scope gitlabScope, filter *Filter) ([]lib.Repo, error) {
 	client, err := p.GitlabClient()
 	if err != nil {
 		return nil, err
@@ -285,62 +587,77 @@ func gitlabSearch(p *lib.Provider, query string) ([]lib.Repo, error) {
 
 	repos := []lib.Repo{}
 	repoNames := make(map[string]bool)
+	addProject := func(project *gitlab.Project) error {
+		if _, ok := repoNames[project.Name]; ok {
+			return nil
+		}
+		repoNames[project.Name] = true
+		m, err := gitlabMetadata(client, project, filter)
+		if err != nil {
+			return err
+		}
+		if !filter.excludes(m) {
+			repos = append(repos, gitlabRepo(p, project))
+		}
+		return nil
+	}
+
 	opt := &gitlab.SearchOptions{
 		ListOptions: gitlab.ListOptions{
 			PerPage: 20,
 			Page:    1,
 		},
 	}
-	if p.IsEnterprise() {
+	if scope.Blobs {
 		var projectIDs []int
 		for {
-			blobs, resp, err := client.Search.Blobs(query, opt)
+			var blobs []*gitlab.Blob
+			var resp *gitlab.Response
+			if scope.Group != "" {
+				blobs, resp, err = client.Search.BlobsByGroup(scope.Group, query, opt)
+			} else {
+				blobs, resp, err = client.Search.Blobs(query, opt)
+			}
 			if err != nil {
-				fmt.Println(err)
+				return nil, err
 			}
 			for _, blob := range blobs {
-				if !contains(projectIDs, blob.ProjectID) {
-					projectIDs = append(projectIDs, blob.ProjectID)
+				if contains(projectIDs, blob.ProjectID) {
+					continue
 				}
-			}
-			for _, i := range projectIDs {
-				project, _, err := client.Projects.GetProject(i, nil)
+				projectIDs = append(projectIDs, blob.ProjectID)
+				project, _, err := client.Projects.GetProject(blob.ProjectID, nil)
 				if err != nil {
-					fmt.Println(err)
+					return nil, err
 				}
-				if _, ok := repoNames[project.Name]; !ok {
-					repos = append(repos, lib.Repo{
-						Name:           project.Name,
-						Owner:          project.Namespace.FullPath,
-						CloneURL:       project.SSHURLToRepo,
-						ProviderConfig: p.ProviderConfig,
-					})
-					repoNames[project.Name] = true
+				if err := addProject(project); err != nil {
+					return nil, err
 				}
 			}
-			if resp.CurrentPage >= resp.TotalPages {
+			// Gitlab leaves out the total # of pages for large result sets, so rely on the next page instead
+			if resp.NextPage == 0 || filter.full(len(repos)) {
 				break
 			}
 			opt.Page = resp.NextPage
 		}
 	} else {
 		for {
-			projects, resp, err := client.Search.Projects(query, opt)
+			var projects []*gitlab.Project
+			var resp *gitlab.Response
+			if scope.Group != "" {
+				projects, resp, err = client.Search.ProjectsByGroup(scope.Group, query, opt)
+			} else {
+				projects, resp, err = client.Search.Projects(query, opt)
+			}
 			if err != nil {
-				fmt.Println(err)
+				return nil, err
 			}
 			for _, project := range projects {
-				if _, ok := repoNames[project.Name]; !ok {
-					repos = append(repos, lib.Repo{
-						Name:           project.Name,
-						Owner:          project.Namespace.FullPath,
-						CloneURL:       project.SSHURLToRepo,
-						ProviderConfig: p.ProviderConfig,
-					})
-					repoNames[project.Name] = true
+				if err := addProject(project); err != nil {
+					return nil, err
 				}
 			}
-			if resp.CurrentPage >= resp.TotalPages {
+			if resp.NextPage == 0 || filter.full(len(repos)) {
 				break
 			}
 			opt.Page = resp.NextPage
@@ -349,6 +666,53 @@ func gitlabSearch(p *lib.Provider, query string) ([]lib.Repo, error) {
 	return repos, nil
 }
 
+// gitlabGroupSearch returns all of the projects in a gitlab group, including its subgroups
+func gitlabGroupSearch(p *lib.Provider, group string, filter *Filter) ([]lib.Repo, error) {
+	client, err := p.GitlabClient()
+	if err != nil {
+		return nil, err
+	}
+
+	repos := []lib.Repo{}
+	truePointer := true
+	opt := &gitlab.ListGroupProjectsOptions{
+		ListOptions: gitlab.ListOptions{
+			PerPage: 100,
+			Page:    1,
+		},
+		IncludeSubGroups: &truePointer,
+	}
+	for {
+		projects, resp, err := client.Groups.ListGroupProjects(group, opt)
+		if err != nil {
+			return nil, err
+		}
+		for _, project := range projects {
+			m, err := gitlabMetadata(client, project, filter)
+			if err != nil {
+				return nil, err
+			}
+			if !filter.excludes(m) {
+				repos = append(repos, gitlabRepo(p, project))
+			}
+		}
+		if resp.NextPage == 0 || filter.full(len(repos)) {
+			break
+		}
+		opt.Page = resp.NextPage
+	}
+	return repos, nil
+}
+
+func gitlabRepo(p *lib.Provider, project *gitlab.Project) lib.Repo {
+	return lib.Repo{
+		Name:           project.Name,
+		Owner:          project.Namespace.FullPath,
+		CloneURL:       project.SSHURLToRepo,
+		ProviderConfig: p.ProviderConfig,
+	}
+}
+
 func contains(values []int, target int) bool {
 	for _, val := range values {
 		if val == target {
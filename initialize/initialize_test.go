@@ -0,0 +1,124 @@
+package initialize
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Clever/microplane/lib"
+	"github.com/google/go-github/v35/github"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilterExcludes(t *testing.T) {
+	filter := &Filter{SkipArchived: true, SkipForks: true, MinStars: 10, MinForks: 2}
+
+	assert.False(t, filter.excludes(repoMetadata{Stars: 10, Forks: 2}))
+	assert.True(t, filter.excludes(repoMetadata{Archived: true, Stars: 10, Forks: 2}))
+	assert.True(t, filter.excludes(repoMetadata{Fork: true, Stars: 10, Forks: 2}))
+	assert.True(t, filter.excludes(repoMetadata{Stars: 9, Forks: 2}))
+	assert.True(t, filter.excludes(repoMetadata{Stars: 10, Forks: 1}))
+	assert.Equal(t, map[string]int{
+		"archived":            1,
+		"forked":              1,
+		"fewer than 10 stars": 1,
+		"fewer than 2 forks":  1,
+	}, filter.skipped)
+}
+
+func TestFilterExcludesLanguages(t *testing.T) {
+	filter := &Filter{Languages: []string{"go", "Python"}}
+
+	assert.False(t, filter.excludes(repoMetadata{Language: "Go"}))
+	assert.False(t, filter.excludes(repoMetadata{Language: "Python"}))
+	assert.True(t, filter.excludes(repoMetadata{Language: "JavaScript"}))
+	assert.True(t, filter.excludes(repoMetadata{}))
+}
+
+func TestInputTarget(t *testing.T) {
+	assert.Equal(t, `code search "org:clever foo"`, Input{Query: "org:clever foo"}.Target())
+	assert.Equal(t, "repos from file repos.txt", Input{ReposFromFile: "repos.txt", Filter: Filter{SkipArchived: true}}.Target())
+	assert.Equal(t, `repos in "clever" with any of the topics a,b (filters: skip archived, min stars 10)`,
+		Input{Query: "clever", Topics: []string{"a", "b"}, Filter: Filter{SkipArchived: true, MinStars: 10}}.Target())
+}
+
+func TestParseRepos(t *testing.T) {
+	p := lib.NewProviderFromConfig(lib.ProviderConfig{Backend: "github"})
+	repos, err := parseRepos(p, "clever/app\tThe app\tpublic\t2022-01-01\n\n  clever/lib  \n")
+	assert.NoError(t, err)
+	assert.Equal(t, []lib.Repo{
+		{Owner: "clever", Name: "app", ProviderConfig: p.ProviderConfig},
+		{Owner: "clever", Name: "lib", ProviderConfig: p.ProviderConfig},
+	}, repos)
+
+	for _, invalid := range []string{"app", "clever/", "/app", "clever/app/extra"} {
+		_, err = parseRepos(p, invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestParseSearchURL(t *testing.T) {
+	github := lib.ProviderConfig{Backend: "github"}
+	search, err := parseSearchURL("https://github.com/search?q=org%3Aclever+language%3Ago&type=repositories", github)
+	assert.NoError(t, err)
+	assert.Equal(t, searchURL{Query: "org:clever language:go", Kind: searchRepos}, search)
+	search, err = parseSearchURL("https://github.com/search?q=org%3Aclever+filename%3Acircle.yml&type=code", github)
+	assert.NoError(t, err)
+	assert.Equal(t, searchURL{Query: "org:clever filename:circle.yml", Kind: searchCode}, search)
+
+	gitlab := lib.ProviderConfig{Backend: "gitlab", BackendURL: "https://gitlab.example.com"}
+	search, err = parseSearchURL("https://gitlab.example.com/search?search=microplane&scope=blobs&group_id=42", gitlab)
+	assert.NoError(t, err)
+	assert.Equal(t, searchURL{Query: "microplane", Kind: searchCode, Group: "42"}, search)
+
+	for _, invalid := range []string{
+		"not a url",
+		"https://gitlab.com/search?search=foo",
+		"https://github.com/clever/microplane",
+		"https://github.com/search?q=foo&type=issues",
+		"https://github.com/search?type=code",
+	} {
+		_, err := parseSearchURL(invalid, github)
+		assert.Error(t, err, invalid)
+	}
+}
+
+// TestGithubAllRepoSearchLimitAfterFilter checks that --limit counts the repos the filter keeps,
+// so a first page of filtered out repos doesn't stop the search early
+func TestGithubAllRepoSearchLimitAfterFilter(t *testing.T) {
+	t.Setenv("GITHUB_API_TOKEN", "test")
+	archived, active := true, false
+	repo := func(name string, isArchived *bool) *github.Repository {
+		return &github.Repository{Name: github.String(name), Owner: &github.User{Login: github.String("clever")}, Archived: isArchived}
+	}
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v3/orgs/clever/repos" {
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		switch r.URL.Query().Get("page") {
+		case "", "1":
+			w.Header().Set("Link", fmt.Sprintf(`<%s/api/v3/orgs/clever/repos?page=2>; rel="next"`, server.URL))
+			json.NewEncoder(w).Encode([]*github.Repository{repo("old-a", &archived), repo("old-b", &archived)})
+		case "2":
+			json.NewEncoder(w).Encode([]*github.Repository{repo("a", &active), repo("b", &active)})
+		}
+	}))
+	defer server.Close()
+
+	p := lib.NewProviderFromConfig(lib.ProviderConfig{Backend: "github", BackendURL: server.URL})
+	filter := &Filter{SkipArchived: true, Limit: 2}
+	repos, err := githubAllRepoSearch(p, "clever", filter)
+	assert.NoError(t, err)
+	names := []string{}
+	for _, r := range repos {
+		names = append(names, r.Name)
+	}
+	assert.ElementsMatch(t, []string{"a", "b"}, names)
+	assert.Equal(t, map[string]int{"archived": 2}, filter.skipped)
+}
@@ -0,0 +1,90 @@
+package initialize
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/Clever/microplane/lib"
+)
+
+// Kinds of search a search URL can be for
+const (
+	searchCode  = "code"
+	searchRepos = "repos"
+)
+
+// searchURL is a search in the provider's web UI, e.g. a saved search of a curated set of repos
+type searchURL struct {
+	Query string
+	// Kind is searchCode or searchRepos
+	Kind string
+	// Group limits a Gitlab search to a group, by ID. Empty means all of Gitlab.
+	Group string
+}
+
+// parseSearchURL parses the URL of a search in the provider's web UI, e.g.
+// https://github.com/search?q=org%3Aclever+language%3Ago&type=repositories or
+// https://gitlab.com/search?search=microplane&scope=projects. Its host must be the provider's.
+func parseSearchURL(raw string, pc lib.ProviderConfig) (searchURL, error) {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return searchURL{}, fmt.Errorf("invalid search URL '%s', expected something like 'https://github.com/search?q=...'", raw)
+	}
+	host := pc.Host()
+	if !strings.EqualFold(u.Host, host) {
+		return searchURL{}, fmt.Errorf("search URL is for %s, but the %s provider is %s. Pass --provider and --provider-url for it", u.Host, pc.Backend, host)
+	}
+	if strings.TrimSuffix(u.Path, "/") != "/search" {
+		return searchURL{}, fmt.Errorf("search URL '%s' isn't a search, expected a path of /search", raw)
+	}
+
+	params := u.Query()
+	if pc.Backend == "gitlab" {
+		search := searchURL{Query: params.Get("search"), Group: params.Get("group_id")}
+		switch params.Get("scope") {
+		case "", "projects":
+			search.Kind = searchRepos
+		case "blobs":
+			search.Kind = searchCode
+		default:
+			return searchURL{}, fmt.Errorf("search URL has scope '%s', only projects and blobs are supported", params.Get("scope"))
+		}
+		if params.Get("project_id") != "" {
+			return searchURL{}, fmt.Errorf("search URL is limited to a project, which isn't supported")
+		}
+		if search.Query == "" {
+			return searchURL{}, fmt.Errorf("search URL '%s' doesn't have a search", raw)
+		}
+		return search, nil
+	}
+
+	search := searchURL{Query: params.Get("q")}
+	switch params.Get("type") {
+	case "", "repositories":
+		search.Kind = searchRepos
+	case "code":
+		search.Kind = searchCode
+	default:
+		return searchURL{}, fmt.Errorf("search URL has type '%s', only repositories and code are supported", params.Get("type"))
+	}
+	if search.Query == "" {
+		return searchURL{}, fmt.Errorf("search URL '%s' doesn't have a query", raw)
+	}
+	return search, nil
+}
+
+// searchURLRepos returns the repos matching a search URL, see parseSearchURL
+func searchURLRepos(p *lib.Provider, raw string, filter *Filter) ([]lib.Repo, error) {
+	search, err := parseSearchURL(raw, p.ProviderConfig)
+	if err != nil {
+		return nil, err
+	}
+	if p.Backend == "gitlab" {
+		return gitlabSearch(p, search.Query, gitlabScope{Blobs: search.Kind == searchCode, Group: search.Group}, filter)
+	}
+	if search.Kind == searchCode {
+		return githubSearch(p, search.Query, filter)
+	}
+	return githubRepoSearch(p, search.Query, filter)
+}
@@ -69,16 +69,22 @@ echo "[Plan]"
 
 echo ""
 echo "[Push]"
-./bin/mp push --throttle 2s -a nathanleiby
+./bin/mp push --yes --throttle 2s -a nathanleiby
 
 ./bin/mp status
 ./bin/mp sync
 
 echo ""
 echo "[Merge]"
-cmd='./bin/mp merge --throttle 2s --ignore-build-status --ignore-review-approval'
+cmd='./bin/mp merge --yes --throttle 2s --ignore-build-status --ignore-review-approval'
 duration=10
-until $cmd; do
+# merge exits 0 when PRs are skipped as not ready yet, so check that each one merged
+all_merged() {
+  for repo in 1 2; do
+    grep -q '"Success": true' "mp/$repo/merge/merge.json" 2>/dev/null || return 1
+  done
+}
+until $cmd && all_merged; do
     echo "waiting a bit ($duration seconds) so PRs are mergeable..."
     sleep $duration
 done
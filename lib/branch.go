@@ -0,0 +1,60 @@
+package lib
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// branchNameInvalidChars can't appear anywhere in a git branch name, see "git help check-ref-format"
+const branchNameInvalidChars = " ~^:?*[\\"
+
+// SanitizeBranchName fixes up a branch name that's only invalid because of whitespace, e.g.
+// from a template, by trimming it and replacing inner whitespace with "-"
+func SanitizeBranchName(name string) string {
+	return strings.Join(strings.Fields(name), "-")
+}
+
+// ValidateBranchName checks that a branch name is valid for git, following the rules of
+// "git check-ref-format --branch". Branches are passed to git and provider APIs as is, so
+// it's best to catch a bad name before anything is pushed.
+func ValidateBranchName(name string) error {
+	invalid := func(reason string) error {
+		return fmt.Errorf("invalid branch name '%s': %s", name, reason)
+	}
+	switch {
+	case name == "":
+		return invalid("it's empty")
+	case name == "@":
+		return invalid("it can't be '@'")
+	case strings.HasPrefix(name, "-"):
+		return invalid("it can't start with '-'")
+	case strings.HasPrefix(name, "/") || strings.HasSuffix(name, "/"):
+		return invalid("it can't start or end with '/'")
+	case strings.HasSuffix(name, "."):
+		return invalid("it can't end with '.'")
+	case strings.Contains(name, ".."):
+		return invalid("it can't contain '..'")
+	case strings.Contains(name, "//"):
+		return invalid("it can't contain '//'")
+	case strings.Contains(name, "@{"):
+		return invalid("it can't contain '@{'")
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return invalid("it can't contain control characters")
+		}
+		if strings.ContainsRune(branchNameInvalidChars, r) {
+			return invalid(fmt.Sprintf("it can't contain '%c'", r))
+		}
+	}
+	for _, component := range strings.Split(name, "/") {
+		if strings.HasPrefix(component, ".") {
+			return invalid("path components can't start with '.'")
+		}
+		if strings.HasSuffix(component, ".lock") {
+			return invalid("path components can't end with '.lock'")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,21 @@
+package lib
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSanitizeBranchName(t *testing.T) {
+	assert.Equal(t, "bump-to-1.2.3+build4", SanitizeBranchName(" bump to\t1.2.3+build4 "))
+	assert.Equal(t, "feature/x", SanitizeBranchName("feature/x"))
+}
+
+func TestValidateBranchName(t *testing.T) {
+	for _, name := range []string{"bump-1.2.3+build4", "feature/x", "release@2", "v1.0_rc"} {
+		assert.NoError(t, ValidateBranchName(name), name)
+	}
+	for _, name := range []string{"", "@", "-x", "/x", "x/", "x.", "a..b", "a//b", "a@{1}", "a b", "a~1", "a^", "a:b", "a?", "a*", "a[b", "a\\b", "a\x7fb", "a/.b", "a.lock", "a.lock/b"} {
+		assert.Error(t, ValidateBranchName(name), name)
+	}
+}
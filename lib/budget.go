@@ -0,0 +1,53 @@
+package lib
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// apiCallLimit is the most API requests a run may make, or 0 for no limit
+var apiCallLimit int64
+
+// apiCalls counts the API requests made by this run, to Github or Gitlab
+var apiCalls int64
+
+// apiBudgetExhausted is set once a request has been refused for going over apiCallLimit
+var apiBudgetExhausted int32
+
+// ErrAPIBudgetExhausted is returned instead of making a request that would go over the run's limit
+var ErrAPIBudgetExhausted = WithKind(ErrRateLimited, fmt.Errorf("this run's API call budget is used up"))
+
+// SetAPICallLimit limits the API requests this run may make. 0 means no limit.
+func SetAPICallLimit(limit int64) {
+	atomic.StoreInt64(&apiCallLimit, limit)
+}
+
+// APICalls is how many API requests this run has made
+func APICalls() int64 {
+	return atomic.LoadInt64(&apiCalls)
+}
+
+// APIBudgetExhausted is whether a request has been refused for going over the run's limit
+func APIBudgetExhausted() bool {
+	return atomic.LoadInt32(&apiBudgetExhausted) == 1
+}
+
+// apiBudgetTransport counts every request sent to the provider, including retries, and refuses
+// to send any after the run's limit is reached
+type apiBudgetTransport struct {
+	base http.RoundTripper
+}
+
+func (t *apiBudgetTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	limit := atomic.LoadInt64(&apiCallLimit)
+	if n := atomic.AddInt64(&apiCalls, 1); limit > 0 && n > limit {
+		atomic.AddInt64(&apiCalls, -1)
+		atomic.StoreInt32(&apiBudgetExhausted, 1)
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, ErrAPIBudgetExhausted
+	}
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,35 @@
+package lib
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAPIBudgetTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	SetAPICallLimit(2)
+	defer func() {
+		SetAPICallLimit(0)
+		apiCalls = 0
+		apiBudgetExhausted = 0
+	}()
+
+	client := &http.Client{Transport: &apiBudgetTransport{base: http.DefaultTransport}}
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(server.URL)
+		assert.NoError(t, err)
+		resp.Body.Close()
+	}
+	assert.False(t, APIBudgetExhausted())
+
+	_, err := client.Get(server.URL)
+	assert.True(t, errors.Is(err, ErrAPIBudgetExhausted))
+	assert.True(t, errors.Is(err, ErrRateLimited))
+	assert.True(t, APIBudgetExhausted())
+	assert.Equal(t, int64(2), APICalls())
+}
@@ -0,0 +1,34 @@
+package lib
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// CampaignTrailer is the git trailer that marks the commits of a campaign, e.g.
+// "Microplane-Campaign: bump-go-1.17", so a repo that already has the change can be told apart
+// even after its branch is gone
+const CampaignTrailer = "Microplane-Campaign"
+
+// ValidateCampaignID checks that a campaign ID fits on a trailer line
+func ValidateCampaignID(id string) error {
+	if strings.TrimSpace(id) != id || id == "" {
+		return fmt.Errorf("invalid campaign ID %q: it can't be empty or start or end with spaces", id)
+	}
+	if strings.ContainsAny(id, "\r\n") {
+		return fmt.Errorf("invalid campaign ID %q: it must be on one line", id)
+	}
+	return nil
+}
+
+// CampaignTrailerLine is the trailer marking a campaign's commits, e.g. "Microplane-Campaign: <id>"
+func CampaignTrailerLine(id string) string {
+	return fmt.Sprintf("%s: %s", CampaignTrailer, id)
+}
+
+// CampaignTrailerPattern matches a campaign's trailer line, and only that campaign's, as an
+// extended regular expression for git log --extended-regexp --grep
+func CampaignTrailerPattern(id string) string {
+	return "^" + regexp.QuoteMeta(CampaignTrailerLine(id)) + "$"
+}
@@ -0,0 +1,14 @@
+package lib
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateCampaignID(t *testing.T) {
+	assert.NoError(t, ValidateCampaignID("go-1.17"))
+	for _, invalid := range []string{"", " go", "go ", "go\n1.17"} {
+		assert.Error(t, ValidateCampaignID(invalid), invalid)
+	}
+}
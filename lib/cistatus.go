@@ -0,0 +1,47 @@
+package lib
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// The CI states a PR's combined status is reported as
+const (
+	CIStatusSuccess = "success"
+	CIStatusPending = "pending"
+	CIStatusFailure = "failure"
+)
+
+// ciStatusMap maps the raw statuses a provider's CI reports, e.g. a Gitlab pipeline's "manual",
+// to the CI states. Statuses that aren't in it are reported as they are.
+var ciStatusMap map[string]string
+var ciStatusMapMu sync.RWMutex
+
+// SetCIStatusMap sets how raw CI statuses are normalized, e.g. {"manual": "pending", "skipped":
+// "success"}. Statuses are matched regardless of case.
+func SetCIStatusMap(m map[string]string) error {
+	normalized := map[string]string{}
+	for raw, state := range m {
+		switch state {
+		case CIStatusSuccess, CIStatusPending, CIStatusFailure:
+		default:
+			return fmt.Errorf("CI status '%s' maps to '%s', expected %s, %s, or %s", raw, state, CIStatusSuccess, CIStatusPending, CIStatusFailure)
+		}
+		normalized[strings.ToLower(raw)] = state
+	}
+	ciStatusMapMu.Lock()
+	defer ciStatusMapMu.Unlock()
+	ciStatusMap = normalized
+	return nil
+}
+
+// NormalizeCIStatus maps a raw CI status to a CI state, see SetCIStatusMap
+func NormalizeCIStatus(raw string) string {
+	ciStatusMapMu.RLock()
+	defer ciStatusMapMu.RUnlock()
+	if state, ok := ciStatusMap[strings.ToLower(raw)]; ok {
+		return state
+	}
+	return raw
+}
@@ -0,0 +1,21 @@
+package lib
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeCIStatus(t *testing.T) {
+	defer SetCIStatusMap(nil)
+	assert.Equal(t, "manual", NormalizeCIStatus("manual"))
+
+	assert.NoError(t, SetCIStatusMap(map[string]string{"manual": "pending", "Skipped": "success"}))
+	assert.Equal(t, "pending", NormalizeCIStatus("manual"))
+	assert.Equal(t, "success", NormalizeCIStatus("skipped"))
+	assert.Equal(t, "failed", NormalizeCIStatus("failed"))
+
+	err := SetCIStatusMap(map[string]string{"manual": "waiting"})
+	assert.EqualError(t, err, "CI status 'manual' maps to 'waiting', expected success, pending, or failure")
+	assert.Equal(t, "pending", NormalizeCIStatus("manual"))
+}
@@ -0,0 +1,169 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/google/go-github/v35/github"
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+// ErrorCategory classifies a failed provider API call, to tell if it's worth retrying
+type ErrorCategory string
+
+const (
+	// ErrorTimeout is a request that timed out
+	ErrorTimeout ErrorCategory = "timeout"
+	// ErrorServer is a 5xx from the provider
+	ErrorServer ErrorCategory = "server"
+	// ErrorRateLimited is a request rejected by the provider's rate limit
+	ErrorRateLimited ErrorCategory = "rate-limited"
+	// ErrorValidation is a request the provider rejected as invalid, e.g. a 422
+	ErrorValidation ErrorCategory = "validation"
+	// ErrorPermission is a request the token isn't allowed to make
+	ErrorPermission ErrorCategory = "permission"
+	// ErrorNotFound is a request for something that doesn't exist, or that the token can't see
+	ErrorNotFound ErrorCategory = "not-found"
+	// ErrorConflict is a request that conflicts with the current state, e.g. a 409
+	ErrorConflict ErrorCategory = "conflict"
+	// ErrorUnknown is any other error
+	ErrorUnknown ErrorCategory = "unknown"
+)
+
+// Retryable is whether a request that failed this way may succeed if it's sent again
+func (c ErrorCategory) Retryable() bool {
+	return c == ErrorTimeout || c == ErrorServer || c == ErrorRateLimited
+}
+
+// ClassifyError categorizes an error returned by the Github or Gitlab client
+func ClassifyError(err error) ErrorCategory {
+	var rateLimitErr *github.RateLimitError
+	var abuseErr *github.AbuseRateLimitError
+	var githubErr *github.ErrorResponse
+	var gitlabErr *gitlab.ErrorResponse
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return ""
+	case errors.As(err, &rateLimitErr), errors.As(err, &abuseErr):
+		return ErrorRateLimited
+	case errors.As(err, &githubErr) && githubErr.Response != nil:
+		return statusCategory(githubErr.Response.StatusCode)
+	case errors.As(err, &gitlabErr) && gitlabErr.Response != nil:
+		return statusCategory(gitlabErr.Response.StatusCode)
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return ErrorTimeout
+	}
+	return ErrorUnknown
+}
+
+// statusCategory categorizes an error response by its HTTP status
+func statusCategory(status int) ErrorCategory {
+	switch {
+	case status == http.StatusTooManyRequests:
+		return ErrorRateLimited
+	case status == http.StatusRequestTimeout || status == http.StatusGatewayTimeout:
+		return ErrorTimeout
+	case status >= 500:
+		return ErrorServer
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return ErrorPermission
+	case status == http.StatusNotFound:
+		return ErrorNotFound
+	case status == http.StatusConflict:
+		return ErrorConflict
+	case status >= 400:
+		return ErrorValidation
+	}
+	return ErrorUnknown
+}
+
+// Kinds of failure, for callers to check with errors.Is. Errors from push and merge match one of
+// these when their kind is known, and keep their own message.
+var (
+	ErrNoChanges   = errors.New("no changes")
+	ErrPermission  = errors.New("permission denied")
+	ErrRateLimited = errors.New("rate limited")
+	ErrConflict    = errors.New("conflict")
+	ErrGitPush     = errors.New("git push failed")
+	ErrTimedOut    = errors.New("timed out")
+	ErrMaxOpenPRs  = errors.New("max open PRs reached")
+)
+
+// errorKinds names each kind of failure, for recording in a step's output
+var errorKinds = []struct {
+	err  error
+	name string
+}{
+	{ErrNoChanges, "no-changes"},
+	{ErrPermission, "permission"},
+	{ErrRateLimited, "rate-limited"},
+	{ErrConflict, "conflict"},
+	{ErrGitPush, "git-push"},
+	{ErrTimedOut, "timed-out"},
+	{ErrMaxOpenPRs, "max-open-prs"},
+}
+
+// kindError is an error of a known kind
+type kindError struct {
+	kind error
+	err  error
+}
+
+func (e *kindError) Error() string {
+	return e.err.Error()
+}
+
+func (e *kindError) Unwrap() error {
+	return e.err
+}
+
+func (e *kindError) Is(target error) bool {
+	return target == e.kind
+}
+
+// WithKind marks err as one of the kinds of failure, e.g. ErrConflict, keeping its message
+func WithKind(kind error, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &kindError{kind: kind, err: err}
+}
+
+// WithAPIKind marks a failed Github or Gitlab API call with its kind of failure, if it has one
+// and isn't already marked
+func WithAPIKind(err error) error {
+	if err == nil || ErrorKind(err) != "" {
+		return err
+	}
+	switch ClassifyError(err) {
+	case ErrorPermission:
+		return WithKind(ErrPermission, err)
+	case ErrorRateLimited:
+		return WithKind(ErrRateLimited, err)
+	case ErrorConflict:
+		return WithKind(ErrConflict, err)
+	}
+	return err
+}
+
+// ErrorKind names the kind of failure err is, e.g. "permission", or is empty if it isn't known
+func ErrorKind(err error) string {
+	for _, kind := range errorKinds {
+		if errors.Is(err, kind.err) {
+			return kind.name
+		}
+	}
+	return ""
+}
+
+// WithDeadlineKind marks err as timed out if ctx's deadline passed, e.g. the run's --max-duration,
+// since a git command killed by it fails with just "signal: killed"
+func WithDeadlineKind(ctx context.Context, err error) error {
+	if err == nil || !errors.Is(ctx.Err(), context.DeadlineExceeded) || errors.Is(err, ErrTimedOut) {
+		return err
+	}
+	return WithKind(ErrTimedOut, err)
+}
@@ -0,0 +1,52 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-github/v35/github"
+	"github.com/stretchr/testify/assert"
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+func TestClassifyError(t *testing.T) {
+	githubErr := func(status int) error {
+		return &github.ErrorResponse{Response: &http.Response{StatusCode: status, Request: httptest.NewRequest("POST", "/", nil)}}
+	}
+	gitlabErr := func(status int) error {
+		return &gitlab.ErrorResponse{Response: &http.Response{StatusCode: status, Request: httptest.NewRequest("POST", "/", nil)}}
+	}
+
+	assert.Equal(t, ErrorCategory(""), ClassifyError(nil))
+	assert.Equal(t, ErrorServer, ClassifyError(githubErr(http.StatusBadGateway)))
+	assert.Equal(t, ErrorTimeout, ClassifyError(githubErr(http.StatusGatewayTimeout)))
+	assert.Equal(t, ErrorValidation, ClassifyError(githubErr(http.StatusUnprocessableEntity)))
+	assert.Equal(t, ErrorPermission, ClassifyError(githubErr(http.StatusForbidden)))
+	assert.Equal(t, ErrorRateLimited, ClassifyError(&github.AbuseRateLimitError{}))
+	assert.Equal(t, ErrorRateLimited, ClassifyError(gitlabErr(http.StatusTooManyRequests)))
+	assert.Equal(t, ErrorNotFound, ClassifyError(gitlabErr(http.StatusNotFound)))
+	assert.Equal(t, ErrorServer, ClassifyError(fmt.Errorf("wrapped: %w", gitlabErr(http.StatusInternalServerError))))
+	assert.Equal(t, ErrorTimeout, ClassifyError(context.DeadlineExceeded))
+	assert.Equal(t, ErrorUnknown, ClassifyError(errors.New("something else")))
+
+	assert.True(t, ErrorServer.Retryable())
+	assert.False(t, ErrorValidation.Retryable())
+}
+
+func TestErrorKind(t *testing.T) {
+	err := WithKind(ErrGitPush, errors.New("remote rejected"))
+	assert.True(t, errors.Is(err, ErrGitPush))
+	assert.False(t, errors.Is(err, ErrConflict))
+	assert.Equal(t, "remote rejected", err.Error())
+	assert.Equal(t, "git-push", ErrorKind(fmt.Errorf("wrapped: %w", err)))
+	assert.Equal(t, "", ErrorKind(errors.New("something else")))
+
+	forbidden := &github.ErrorResponse{Response: &http.Response{StatusCode: http.StatusForbidden, Request: httptest.NewRequest("POST", "/", nil)}}
+	assert.True(t, errors.Is(WithAPIKind(forbidden), ErrPermission))
+	assert.Equal(t, "conflict", ErrorKind(WithAPIKind(WithKind(ErrConflict, forbidden))))
+	assert.Nil(t, WithAPIKind(nil))
+}
@@ -0,0 +1,36 @@
+package lib
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	hostLimitersMutex sync.Mutex
+	// hostLimiters are by backend and host
+	hostLimiters = map[string]*time.Ticker{}
+)
+
+// HostLimiter is the limiter that spaces out API requests to the provider's host, at its
+// ProviderRequestInterval. Each host has its own, so that in a run across several hosts, a
+// slow or throttled one doesn't hold up the repos on the others.
+func HostLimiter(pc ProviderConfig) *time.Ticker {
+	key := fmt.Sprintf("%s %s", pc.Backend, pc.Host())
+	hostLimitersMutex.Lock()
+	defer hostLimitersMutex.Unlock()
+	limiter, ok := hostLimiters[key]
+	if !ok {
+		limiter = time.NewTicker(ProviderRequestInterval(pc.Backend))
+		hostLimiters[key] = limiter
+	}
+	return limiter
+}
+
+// Wait blocks until the limiter's next tick. A nil limiter means no rate limiting.
+func Wait(limiter *time.Ticker) {
+	if limiter == nil {
+		return
+	}
+	<-limiter.C
+}
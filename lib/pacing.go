@@ -0,0 +1,196 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProviderRequestInterval is the minimum time between API requests to a provider, used by the
+// run's shared limiter. Github also has secondary rate limits for bursts of requests, so it's
+// spaced out further than Gitlab.
+func ProviderRequestInterval(backend string) time.Duration {
+	if backend == "gitlab" {
+		return 200 * time.Millisecond
+	}
+	// Github's rate limit for authenticated requests is 5000 QPH = 83.3 QPM = 1.38 QPS = 720ms/query
+	return 720 * time.Millisecond
+}
+
+// APIRateLimit is a provider's rate limit for a token, as last reported by the provider
+type APIRateLimit struct {
+	Limit     int
+	Remaining int
+	Reset     time.Time
+}
+
+// apiRateLimitReserve is the share of a rate limit below which requests are spaced out, so the
+// remaining requests last until the limit resets
+const apiRateLimitReserve = 0.1
+
+var (
+	apiRateLimitsMutex sync.Mutex
+	// apiRateLimits are by rateLimitKey, shared by every client in the run
+	apiRateLimits = map[string]APIRateLimit{}
+	// apiRateLimitsLogged is when each rate limit was last logged, with verbose logging
+	apiRateLimitsLogged = map[string]time.Time{}
+	verbose             bool
+)
+
+// SetVerbose turns on verbose logging, which includes the remaining rate limit budget
+func SetVerbose(v bool) {
+	verbose = v
+}
+
+// LoadAPIRateLimits loads the rate limits saved by a previous command, so that chained commands
+// share what's left of the budget. A missing file is ignored.
+func LoadAPIRateLimits(path string) error {
+	bs, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var saved map[string]APIRateLimit
+	if err := json.Unmarshal(bs, &saved); err != nil {
+		return fmt.Errorf("invalid rate limits in %s: %s", path, err.Error())
+	}
+	apiRateLimitsMutex.Lock()
+	defer apiRateLimitsMutex.Unlock()
+	for key, limit := range saved {
+		if limit.Reset.After(time.Now()) {
+			apiRateLimits[key] = limit
+		}
+	}
+	return nil
+}
+
+// SaveAPIRateLimits saves the rate limits that haven't reset yet, for the next command
+func SaveAPIRateLimits(path string) error {
+	apiRateLimitsMutex.Lock()
+	current := map[string]APIRateLimit{}
+	for key, limit := range apiRateLimits {
+		if limit.Reset.After(time.Now()) {
+			current[key] = limit
+		}
+	}
+	apiRateLimitsMutex.Unlock()
+	b, err := json.MarshalIndent(current, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0644)
+}
+
+// LogAPIRateLimits logs what's left of each rate limit
+func LogAPIRateLimits() {
+	apiRateLimitsMutex.Lock()
+	defer apiRateLimitsMutex.Unlock()
+	for key, limit := range apiRateLimits {
+		logAPIRateLimit(key, limit)
+	}
+}
+
+func logAPIRateLimit(key string, limit APIRateLimit) {
+	log.Printf("rate limit for %s: %d of %d requests left, resets in %s", key, limit.Remaining, limit.Limit, time.Until(limit.Reset).Round(time.Second))
+}
+
+// rateLimitWait is how long to wait before the next request, so the remaining requests last
+// until the limit resets. Requests aren't slowed down until the limit is nearly used up.
+func rateLimitWait(limit APIRateLimit, now time.Time) time.Duration {
+	untilReset := limit.Reset.Sub(now)
+	if untilReset <= 0 || limit.Limit == 0 {
+		return 0
+	}
+	if limit.Remaining <= 0 {
+		return untilReset
+	}
+	if float64(limit.Remaining) >= apiRateLimitReserve*float64(limit.Limit) {
+		return 0
+	}
+	return untilReset / time.Duration(limit.Remaining)
+}
+
+// rateLimitKey identifies the rate limit a request counts against. Github limits some APIs,
+// like search, separately.
+func rateLimitKey(backend string, req *http.Request) string {
+	key := fmt.Sprintf("%s %s", backend, req.URL.Host)
+	if backend == "github" {
+		resource := "core"
+		if strings.Contains(req.URL.Path, "/search/") {
+			resource = "search"
+		} else if strings.HasSuffix(req.URL.Path, "/graphql") {
+			resource = "graphql"
+		}
+		key += " " + resource
+	}
+	return key
+}
+
+// parseRateLimit reads a provider's rate limit from a response's headers
+func parseRateLimit(backend string, header http.Header) (APIRateLimit, bool) {
+	prefix := "X-RateLimit-"
+	if backend == "gitlab" {
+		prefix = "RateLimit-"
+	}
+	limit, err1 := strconv.Atoi(header.Get(prefix + "Limit"))
+	remaining, err2 := strconv.Atoi(header.Get(prefix + "Remaining"))
+	reset, err3 := strconv.ParseInt(header.Get(prefix+"Reset"), 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return APIRateLimit{}, false
+	}
+	return APIRateLimit{Limit: limit, Remaining: remaining, Reset: time.Unix(reset, 0)}, true
+}
+
+// apiRateLimitTransport paces requests by the rate limit the provider reports, shared by every
+// client in the run, so that a run doesn't use up a token's limit and fail part way through
+type apiRateLimitTransport struct {
+	base    http.RoundTripper
+	backend string
+}
+
+func (t *apiRateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	key := rateLimitKey(t.backend, req)
+
+	apiRateLimitsMutex.Lock()
+	limit, known := apiRateLimits[key]
+	wait := rateLimitWait(limit, time.Now())
+	if known && limit.Remaining > 0 {
+		// count the request now, so that concurrent requests don't all spend the same budget
+		limit.Remaining--
+		apiRateLimits[key] = limit
+	}
+	apiRateLimitsMutex.Unlock()
+	if wait > 0 {
+		if wait > time.Minute {
+			log.Printf("%s rate limit is nearly used up - waiting %s for it to reset", key, wait.Round(time.Second))
+		}
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(wait):
+		}
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	if reported, ok := parseRateLimit(t.backend, resp.Header); ok {
+		apiRateLimitsMutex.Lock()
+		apiRateLimits[key] = reported
+		if verbose && time.Since(apiRateLimitsLogged[key]) > 30*time.Second {
+			apiRateLimitsLogged[key] = time.Now()
+			logAPIRateLimit(key, reported)
+		}
+		apiRateLimitsMutex.Unlock()
+	}
+	return resp, nil
+}
@@ -0,0 +1,55 @@
+package lib
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimitWait(t *testing.T) {
+	now := time.Now()
+	reset := now.Add(100 * time.Second)
+	assert.Equal(t, time.Duration(0), rateLimitWait(APIRateLimit{}, now))
+	assert.Equal(t, time.Duration(0), rateLimitWait(APIRateLimit{Limit: 5000, Remaining: 4000, Reset: reset}, now))
+	assert.Equal(t, 10*time.Second, rateLimitWait(APIRateLimit{Limit: 5000, Remaining: 10, Reset: reset}, now))
+	assert.Equal(t, 100*time.Second, rateLimitWait(APIRateLimit{Limit: 5000, Remaining: 0, Reset: reset}, now))
+	assert.Equal(t, time.Duration(0), rateLimitWait(APIRateLimit{Limit: 5000, Remaining: 0, Reset: now.Add(-time.Second)}, now))
+}
+
+func TestAPIRateLimitTransport(t *testing.T) {
+	reset := time.Now().Add(time.Hour).Unix()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("RateLimit-Limit", "2000")
+		w.Header().Set("RateLimit-Remaining", "1500")
+		w.Header().Set("RateLimit-Reset", strconv.FormatInt(reset, 10))
+	}))
+	defer server.Close()
+	defer func() { apiRateLimits = map[string]APIRateLimit{} }()
+
+	client := &http.Client{Transport: &apiRateLimitTransport{base: http.DefaultTransport, backend: "gitlab"}}
+	resp, err := client.Get(server.URL + "/api/v4/projects")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	key := rateLimitKey("gitlab", resp.Request)
+	assert.Equal(t, APIRateLimit{Limit: 2000, Remaining: 1500, Reset: time.Unix(reset, 0)}, apiRateLimits[key])
+
+	// the next command starts from what's left
+	path := filepath.Join(t.TempDir(), "rate-limits.json")
+	assert.NoError(t, SaveAPIRateLimits(path))
+	apiRateLimits = map[string]APIRateLimit{}
+	assert.NoError(t, LoadAPIRateLimits(path))
+	assert.Equal(t, 1500, apiRateLimits[key].Remaining)
+	assert.NoError(t, LoadAPIRateLimits(filepath.Join(t.TempDir(), "missing.json")))
+}
+
+func TestRateLimitKey(t *testing.T) {
+	req := httptest.NewRequest("GET", "https://api.github.com/search/code?q=x", nil)
+	assert.Equal(t, "github api.github.com search", rateLimitKey("github", req))
+	req = httptest.NewRequest("GET", "https://api.github.com/repos/clever/app", nil)
+	assert.Equal(t, "github api.github.com core", rateLimitKey("github", req))
+}
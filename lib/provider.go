@@ -2,8 +2,17 @@ package lib
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
+	"sync"
+	"time"
 
 	"github.com/google/go-github/v35/github"
 	"github.com/xanzy/go-gitlab"
@@ -14,17 +23,111 @@ import (
 type ProviderConfig struct {
 	Backend    string
 	BackendURL string
+	// CACertFile is a PEM bundle of CAs to trust, in addition to the system's, when calling the provider's API
+	CACertFile string `json:",omitempty"`
+	// InsecureSkipTLSVerify disables TLS certificate verification when calling the provider's API
+	InsecureSkipTLSVerify bool `json:",omitempty"`
+	// ClientCertFile and ClientKeyFile are a PEM client certificate and its key, presented to the
+	// provider for mutual TLS, by both API calls and git
+	ClientCertFile string `json:",omitempty"`
+	ClientKeyFile  string `json:",omitempty"`
+	// TokenEnv is the environment variable holding the API token. Empty means GITHUB_API_TOKEN
+	// or GITLAB_API_TOKEN, depending on the backend.
+	TokenEnv string `json:",omitempty"`
+}
+
+// APITokenEnv is the environment variable the provider's API token is read from
+func (pc ProviderConfig) APITokenEnv() string {
+	if pc.TokenEnv != "" {
+		return pc.TokenEnv
+	}
+	if pc.Backend == "gitlab" {
+		return "GITLAB_API_TOKEN"
+	}
+	return "GITHUB_API_TOKEN"
 }
 
 func (pc ProviderConfig) IsEnterprise() bool {
 	return pc.BackendURL != ""
 }
 
+// Host is the host the provider is reached at, e.g. github.com or a self-hosted Gitlab's host
+func (pc ProviderConfig) Host() string {
+	if pc.IsEnterprise() {
+		if parsed, err := url.Parse(pc.BackendURL); err == nil && parsed.Host != "" {
+			return parsed.Host
+		}
+		return pc.BackendURL
+	}
+	if pc.Backend == "gitlab" {
+		return "gitlab.com"
+	}
+	return "github.com"
+}
+
 // Provider is an abstraction over a Git provider (Github, Gitlab, etc)
 type Provider struct {
 	ProviderConfig
 }
 
+// hasTLSOptions determines if the provider's API needs a custom TLS setup
+func (pc ProviderConfig) hasTLSOptions() bool {
+	return pc.CACertFile != "" || pc.InsecureSkipTLSVerify || pc.ClientCertFile != "" || pc.ClientKeyFile != ""
+}
+
+// CheckTLSFiles checks that the CA and client cert files can be loaded, so that a missing or
+// mismatched file is reported up front rather than as a failure for every repo
+func (pc ProviderConfig) CheckTLSFiles() error {
+	_, err := pc.tlsConfig()
+	return err
+}
+
+// tlsConfig builds the TLS config for the provider's API from its TLS options
+func (pc ProviderConfig) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: pc.InsecureSkipTLSVerify}
+	if pc.CACertFile != "" {
+		pem, err := ioutil.ReadFile(pc.CACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read CA cert file: %s", err.Error())
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM certificates found in CA cert file %s", pc.CACertFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if pc.ClientCertFile == "" && pc.ClientKeyFile == "" {
+		return tlsConfig, nil
+	}
+	if pc.ClientCertFile == "" || pc.ClientKeyFile == "" {
+		return nil, errors.New("a client cert and client key must be given together")
+	}
+	cert, err := tls.LoadX509KeyPair(pc.ClientCertFile, pc.ClientKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load client cert %s with key %s: %s", pc.ClientCertFile, pc.ClientKeyFile, err.Error())
+	}
+	if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err == nil && time.Now().After(leaf.NotAfter) {
+		return nil, fmt.Errorf("client cert %s expired on %s", pc.ClientCertFile, leaf.NotAfter.Format("2006-01-02"))
+	}
+	tlsConfig.Certificates = []tls.Certificate{cert}
+	return tlsConfig, nil
+}
+
+// httpClient builds an HTTP client that applies the provider's TLS options
+func (pc ProviderConfig) httpClient() (*http.Client, error) {
+	tlsConfig, err := pc.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: transport}, nil
+}
+
 func NewProviderFromConfig(pc ProviderConfig) *Provider {
 	return &Provider{
 		ProviderConfig: pc,
@@ -36,12 +139,22 @@ func (p *Provider) GithubClient(ctx context.Context) (*github.Client, error) {
 	if p.Backend != "github" {
 		return nil, fmt.Errorf("cannot initialize GithubClient: backend is not 'github', but instead is '%s'", p.Backend)
 	}
-	token := os.Getenv("GITHUB_API_TOKEN")
+	token := os.Getenv(p.APITokenEnv())
 	if token == "" {
-		return nil, fmt.Errorf("cannot initialize GithubClient: GITHUB_API_TOKEN is not set")
+		return nil, fmt.Errorf("cannot initialize GithubClient: %s is not set", p.APITokenEnv())
 	}
 
 	// create the client
+	httpClient := &http.Client{Transport: http.DefaultTransport}
+	if p.hasTLSOptions() {
+		var err error
+		httpClient, err = p.httpClient()
+		if err != nil {
+			return nil, fmt.Errorf("cannot initialize GithubClient: %s", err.Error())
+		}
+	}
+	httpClient.Transport = &githubRateLimitTransport{base: &apiBudgetTransport{base: &apiRateLimitTransport{base: httpClient.Transport, backend: p.Backend}}}
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, httpClient)
 	ts := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token})
 	tc := oauth2.NewClient(ctx, ts)
 	if p.IsEnterprise() {
@@ -56,16 +169,87 @@ func (p *Provider) GitlabClient() (*gitlab.Client, error) {
 	if p.Backend != "gitlab" {
 		return nil, fmt.Errorf("cannot initialize GitlabClient: backend is not 'gitlab', but instead is '%s'", p.Backend)
 	}
-	token := os.Getenv("GITLAB_API_TOKEN")
+	token := os.Getenv(p.APITokenEnv())
 	if token == "" {
-		return nil, fmt.Errorf("cannot initialize GitlabClient: GITLAB_API_TOKEN is not set")
+		return nil, fmt.Errorf("cannot initialize GitlabClient: %s is not set", p.APITokenEnv())
 	}
 
 	// create client
 	clientOptions := []gitlab.ClientOptionFunc{}
 	if p.IsEnterprise() {
+		parsed, err := url.Parse(p.BackendURL)
+		if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+			return nil, fmt.Errorf("cannot initialize GitlabClient: invalid provider URL '%s', expected something like 'https://gitlab.example.com'", p.BackendURL)
+		}
 		clientOptions = append(clientOptions, gitlab.WithBaseURL(p.BackendURL))
 	}
+	httpClient := &http.Client{Transport: http.DefaultTransport}
+	if p.hasTLSOptions() {
+		var err error
+		httpClient, err = p.httpClient()
+		if err != nil {
+			return nil, fmt.Errorf("cannot initialize GitlabClient: %s", err.Error())
+		}
+	}
+	httpClient.Transport = &apiBudgetTransport{base: &apiRateLimitTransport{base: httpClient.Transport, backend: p.Backend}}
+	clientOptions = append(clientOptions, gitlab.WithHTTPClient(httpClient))
+
+	client, err := gitlab.NewClient(token, clientOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("cannot initialize GitlabClient with provider URL '%s': %s", p.BackendURL, err.Error())
+	}
+	return client, nil
+}
+
+// Check verifies that the provider's token is set and valid, and its API is reachable
+func (p *Provider) Check(ctx context.Context) error {
+	_, err := p.TokenUser(ctx)
+	return err
+}
+
+// tokenUsers caches who each provider's API token authenticates as, by host and token env
+var tokenUsers sync.Map
+
+// TokenUser is the username the provider's API token authenticates as. It's who opens the PRs,
+// whoever authored the commits in them.
+func (p *Provider) TokenUser(ctx context.Context) (string, error) {
+	key := p.Host() + " " + p.APITokenEnv()
+	if user, ok := tokenUsers.Load(key); ok {
+		return user.(string), nil
+	}
+	var user string
+	switch p.Backend {
+	case "github":
+		client, err := p.GithubClient(ctx)
+		if err != nil {
+			return "", err
+		}
+		u, _, err := client.Users.Get(ctx, "")
+		if err != nil {
+			return "", fmt.Errorf("cannot reach github at %s with %s: %s", client.BaseURL, p.APITokenEnv(), err.Error())
+		}
+		user = u.GetLogin()
+	case "gitlab":
+		client, err := p.GitlabClient()
+		if err != nil {
+			return "", err
+		}
+		u, _, err := client.Users.CurrentUser(gitlab.WithContext(ctx))
+		if err != nil {
+			return "", fmt.Errorf("cannot reach gitlab at %s with %s: %s", client.BaseURL(), p.APITokenEnv(), err.Error())
+		}
+		user = u.Username
+	default:
+		return "", fmt.Errorf("unsupported provider: %s", p.Backend)
+	}
+	tokenUsers.Store(key, user)
+	return user, nil
+}
 
-	return gitlab.NewClient(token, clientOptions...)
+// CheckGit verifies that git is installed
+func CheckGit() error {
+	if _, err := exec.LookPath("git"); err != nil {
+		return fmt.Errorf("git is required, but wasn't found: %s", err.Error())
+	}
+	return nil
 }
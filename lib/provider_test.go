@@ -0,0 +1,107 @@
+package lib
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeClientCert writes a self-signed client cert and its key, returning their paths
+func writeClientCert(t *testing.T, dir string, name string, notAfter time.Time) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-48 * time.Hour),
+		NotAfter:     notAfter,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	certFile, keyFile := filepath.Join(dir, name+".pem"), filepath.Join(dir, name+".key")
+	assert.NoError(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return certFile, keyFile
+}
+
+func TestClientCert(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeClientCert(t, dir, "client", time.Now().Add(time.Hour))
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	defer server.Close()
+	caFile := filepath.Join(dir, "ca.pem")
+	assert.NoError(t, ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600))
+
+	pc := ProviderConfig{CACertFile: caFile, ClientCertFile: certFile, ClientKeyFile: keyFile}
+	assert.NoError(t, pc.CheckTLSFiles())
+	client, err := pc.httpClient()
+	assert.NoError(t, err)
+	resp, err := client.Get(server.URL)
+	if assert.NoError(t, err) {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, "client", string(body))
+	}
+
+	_, otherKeyFile := writeClientCert(t, dir, "other", time.Now().Add(time.Hour))
+	assert.Error(t, ProviderConfig{ClientCertFile: certFile, ClientKeyFile: otherKeyFile}.CheckTLSFiles())
+	assert.Error(t, ProviderConfig{ClientCertFile: certFile}.CheckTLSFiles())
+	expiredCertFile, expiredKeyFile := writeClientCert(t, dir, "expired", time.Now().Add(-time.Hour))
+	err = ProviderConfig{ClientCertFile: expiredCertFile, ClientKeyFile: expiredKeyFile}.CheckTLSFiles()
+	assert.Contains(t, err.Error(), "expired")
+}
+
+func TestProviderHost(t *testing.T) {
+	assert.Equal(t, "github.com", ProviderConfig{Backend: "github"}.Host())
+	assert.Equal(t, "gitlab.com", ProviderConfig{Backend: "gitlab"}.Host())
+	assert.Equal(t, "gitlab.example.com:8443", ProviderConfig{Backend: "gitlab", BackendURL: "https://gitlab.example.com:8443/"}.Host())
+}
+
+func TestHostLimiter(t *testing.T) {
+	github := HostLimiter(ProviderConfig{Backend: "github"})
+	assert.Same(t, github, HostLimiter(ProviderConfig{Backend: "github", TokenEnv: "OTHER_TOKEN"}))
+	assert.NotSame(t, github, HostLimiter(ProviderConfig{Backend: "github", BackendURL: "https://github.example.com"}))
+	assert.NotSame(t, github, HostLimiter(ProviderConfig{Backend: "gitlab"}))
+}
+
+func TestTokenUser(t *testing.T) {
+	t.Setenv("BOT_GITLAB_TOKEN", "test")
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		assert.Equal(t, "/api/v4/user", r.URL.Path)
+		w.Write([]byte(`{"id": 7, "username": "mp-bot"}`))
+	}))
+	defer server.Close()
+
+	p := NewProviderFromConfig(ProviderConfig{Backend: "gitlab", BackendURL: server.URL, TokenEnv: "BOT_GITLAB_TOKEN"})
+	for i := 0; i < 2; i++ {
+		user, err := p.TokenUser(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, "mp-bot", user)
+	}
+	assert.Equal(t, 1, requests)
+}
@@ -0,0 +1,95 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// githubSecondaryRateLimitRetries is how many times a request is retried after hitting
+// Github's secondary rate limit, before giving up
+const githubSecondaryRateLimitRetries = 5
+
+// githubSecondaryRateLimitWait is how long to wait when Github doesn't say. Github's docs
+// recommend waiting at least a minute.
+var githubSecondaryRateLimitWait = time.Minute
+
+// githubRateLimitTransport retries requests that hit Github's secondary (abuse) rate limit,
+// after waiting as long as Github asks. Github reports these as a 403, like a real permission
+// error, so without this they'd fail the repo outright.
+type githubRateLimitTransport struct {
+	base http.RoundTripper
+}
+
+func (t *githubRateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := t.base.RoundTrip(req)
+		if err != nil || attempt == githubSecondaryRateLimitRetries {
+			return resp, err
+		}
+		if resp.StatusCode != http.StatusForbidden && resp.StatusCode != http.StatusTooManyRequests {
+			return resp, nil
+		}
+		if req.Body != nil && req.GetBody == nil {
+			// the request can't be sent again
+			return resp, nil
+		}
+
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		wait, limited := githubSecondaryRateLimit(resp, body)
+		if !limited {
+			resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+			return resp, nil
+		}
+
+		log.Printf("Hit Github's secondary rate limit - waiting %v then trying again.\n", wait)
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(wait):
+		}
+		if req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// githubSecondaryRateLimit determines if a response is from Github's secondary rate limit,
+// as opposed to e.g. a permission error, and how long Github asks to wait before retrying
+func githubSecondaryRateLimit(resp *http.Response, body []byte) (time.Duration, bool) {
+	var errorResponse struct {
+		Message          string `json:"message"`
+		DocumentationURL string `json:"documentation_url"`
+	}
+	json.Unmarshal(body, &errorResponse)
+	message := strings.ToLower(errorResponse.Message)
+	if !strings.Contains(message, "secondary rate limit") &&
+		!strings.Contains(message, "abuse detection") &&
+		!strings.Contains(errorResponse.DocumentationURL, "secondary-rate-limits") &&
+		!strings.Contains(errorResponse.DocumentationURL, "abuse-rate-limits") {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		if reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+			if wait := time.Until(time.Unix(reset, 0)); wait > 0 {
+				return wait, true
+			}
+		}
+	}
+	return githubSecondaryRateLimitWait, true
+}
@@ -0,0 +1,91 @@
+package lib
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// secondaryRateLimitBody is the shape of Github's response when the secondary rate limit is hit
+const secondaryRateLimitBody = `{
+  "message": "You have exceeded a secondary rate limit. Please wait a few minutes before you try again.",
+  "documentation_url": "https://docs.github.com/rest/overview/rate-limits-for-the-rest-api#about-secondary-rate-limits"
+}`
+
+// permissionErrorBody is the shape of Github's response for a real permission error
+const permissionErrorBody = `{
+  "message": "Resource not accessible by integration",
+  "documentation_url": "https://docs.github.com/rest/pulls/pulls#create-a-pull-request"
+}`
+
+func TestGithubSecondaryRateLimit(t *testing.T) {
+	header := func(kv ...string) http.Header {
+		h := http.Header{}
+		for i := 0; i < len(kv); i += 2 {
+			h.Set(kv[i], kv[i+1])
+		}
+		return h
+	}
+
+	wait, limited := githubSecondaryRateLimit(&http.Response{StatusCode: 403, Header: header("Retry-After", "30")}, []byte(secondaryRateLimitBody))
+	assert.True(t, limited)
+	assert.Equal(t, 30*time.Second, wait)
+
+	reset := strconv.FormatInt(time.Now().Add(90*time.Second).Unix(), 10)
+	wait, limited = githubSecondaryRateLimit(&http.Response{StatusCode: 403, Header: header("X-RateLimit-Remaining", "0", "X-RateLimit-Reset", reset)}, []byte(secondaryRateLimitBody))
+	assert.True(t, limited)
+	assert.InDelta(t, 90, wait.Seconds(), 2)
+
+	wait, limited = githubSecondaryRateLimit(&http.Response{StatusCode: 403, Header: header()}, []byte(secondaryRateLimitBody))
+	assert.True(t, limited)
+	assert.Equal(t, githubSecondaryRateLimitWait, wait)
+
+	_, limited = githubSecondaryRateLimit(&http.Response{StatusCode: 403, Header: header()}, []byte(permissionErrorBody))
+	assert.False(t, limited)
+}
+
+func TestGithubRateLimitTransport(t *testing.T) {
+	requests := 0
+	bodies := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		switch {
+		case r.URL.Path == "/forbidden":
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(permissionErrorBody))
+		case requests == 1:
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(secondaryRateLimitBody))
+		default:
+			w.Write([]byte(`{}`))
+		}
+	}))
+	defer server.Close()
+	client := &http.Client{Transport: &githubRateLimitTransport{base: http.DefaultTransport}}
+
+	// a secondary rate limit is waited out and retried, with the same body
+	req, _ := http.NewRequestWithContext(context.Background(), "POST", server.URL+"/pulls", strings.NewReader(`{"title":"x"}`))
+	resp, err := client.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 2, requests)
+	assert.Equal(t, []string{`{"title":"x"}`, `{"title":"x"}`}, bodies)
+
+	// a real permission error isn't retried, and its body is left for the caller
+	resp, err = client.Get(server.URL + "/forbidden")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Equal(t, 3, requests)
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, permissionErrorBody, string(body))
+}
@@ -1,8 +1,10 @@
 package lib
 
 import (
+	"bytes"
 	"fmt"
 	"net/url"
+	"text/template"
 )
 
 // Repo describes a git Repository with a given Provider
@@ -21,6 +23,18 @@ func (r Repo) IsGitlab() bool {
 	return r.ProviderConfig.Backend == "gitlab"
 }
 
+// SkipCIToken is the commit message token that stops the repo's provider from running CI for a
+// commit. Both Gitlab and Github Actions understand "[skip ci]".
+func (r Repo) SkipCIToken() string {
+	switch {
+	case r.IsGitlab():
+		return "[skip ci]"
+	case r.IsGithub():
+		return "[skip ci]"
+	}
+	return ""
+}
+
 func (r Repo) ComputedCloneURL() (string, error) {
 	// If we saved a CloneURL retrieved from provider's API, use that
 	if r.CloneURL != "" {
@@ -38,3 +52,35 @@ func (r Repo) ComputedCloneURL() (string, error) {
 	}
 	return fmt.Sprintf("git@%s:%s/%s", hostname, r.Owner, r.Name), nil
 }
+
+// CloneURLVars are the variables available to clone URL templates
+type CloneURLVars struct {
+	Owner string
+	Name  string
+	// Host is the provider's hostname, e.g. github.com, or the host of its enterprise URL
+	Host string
+}
+
+// ParseCloneURLTemplate parses a clone URL template, e.g. 'ssh://git@{{.Host}}:2222/mirror/{{.Owner}}/{{.Name}}.git'
+func ParseCloneURLTemplate(text string) (*template.Template, error) {
+	return template.New("clone-url").Option("missingkey=error").Parse(text)
+}
+
+// TemplatedCloneURL renders a clone URL template for the repo, for git hosts whose URLs neither
+// the provider's API nor ComputedCloneURL get right
+func (r Repo) TemplatedCloneURL(text string) (string, error) {
+	tmpl, err := ParseCloneURLTemplate(text)
+	if err != nil {
+		return "", err
+	}
+	// the API's port, if any, isn't git's
+	host := (&url.URL{Host: r.ProviderConfig.Host()}).Hostname()
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, CloneURLVars{Owner: r.Owner, Name: r.Name, Host: host}); err != nil {
+		return "", err
+	}
+	if b.Len() == 0 {
+		return "", fmt.Errorf("clone URL template %q rendered an empty URL", text)
+	}
+	return b.String(), nil
+}
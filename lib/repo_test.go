@@ -0,0 +1,24 @@
+package lib
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTemplatedCloneURL(t *testing.T) {
+	repo := Repo{Owner: "clever", Name: "app", CloneURL: "git@github.com:clever/app.git", ProviderConfig: ProviderConfig{Backend: "github"}}
+	url, err := repo.TemplatedCloneURL("ssh://git@mirror.{{.Host}}:2222/{{.Owner}}/{{.Name}}.git")
+	assert.NoError(t, err)
+	assert.Equal(t, "ssh://git@mirror.github.com:2222/clever/app.git", url)
+
+	repo.ProviderConfig = ProviderConfig{Backend: "gitlab", BackendURL: "https://gitlab.example.com"}
+	url, err = repo.TemplatedCloneURL("https://{{.Host}}/scm/{{.Owner}}/{{.Name}}")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://gitlab.example.com/scm/clever/app", url)
+
+	for _, invalid := range []string{"{{.Nope}}", "{{", ""} {
+		_, err = repo.TemplatedCloneURL(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
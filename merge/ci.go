@@ -0,0 +1,99 @@
+package merge
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Clever/microplane/lib"
+	"github.com/google/go-github/v35/github"
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+// Overall CI states of a commit, from CommitCIState
+const (
+	CIPending = "pending"
+	CISuccess = "success"
+	CIFailure = "failure"
+	// CINone means the commit has no statuses, checks, or pipelines to wait for
+	CINone = "none"
+)
+
+// CommitCIState gets the overall CI state of a commit, e.g. a merge commit on the base branch.
+// A nil limiter means no rate limiting.
+func CommitCIState(ctx context.Context, repo lib.Repo, sha string, repoLimiter *time.Ticker) (string, error) {
+	p := lib.NewProviderFromConfig(repo.ProviderConfig)
+	switch {
+	case repo.IsGithub():
+		client, err := p.GithubClient(ctx)
+		if err != nil {
+			return "", err
+		}
+		lib.Wait(repoLimiter)
+		status, _, err := client.Repositories.GetCombinedStatus(ctx, repo.Owner, repo.Name, sha, &github.ListOptions{})
+		if err != nil {
+			return "", err
+		}
+		lib.Wait(repoLimiter)
+		checkRuns, _, err := client.Checks.ListCheckRunsForRef(ctx, repo.Owner, repo.Name, sha, &github.ListCheckRunsOptions{})
+		if err != nil {
+			return "", err
+		}
+		return githubCIState(status, checkRuns.CheckRuns), nil
+	case repo.IsGitlab():
+		client, err := p.GitlabClient()
+		if err != nil {
+			return "", err
+		}
+		lib.Wait(repoLimiter)
+		pid := fmt.Sprintf("%s/%s", repo.Owner, repo.Name)
+		pipelines, _, err := client.Pipelines.ListProjectPipelines(pid, &gitlab.ListProjectPipelinesOptions{SHA: &sha}, gitlab.WithContext(ctx))
+		if err != nil {
+			return "", err
+		}
+		if len(pipelines) == 0 {
+			return CINone, nil
+		}
+		return gitlabCIState(pipelines[0].Status), nil
+	}
+	return "", fmt.Errorf("unsupported provider: %s", repo.ProviderConfig.Backend)
+}
+
+// githubCIState combines a commit's statuses and check runs into one CI state
+func githubCIState(status *github.CombinedStatus, checkRuns []*github.CheckRun) string {
+	if status.GetTotalCount() == 0 && len(checkRuns) == 0 {
+		return CINone
+	}
+	state := CISuccess
+	if status.GetTotalCount() > 0 {
+		switch status.GetState() {
+		case "failure", "error":
+			return CIFailure
+		case "pending":
+			state = CIPending
+		}
+	}
+	for _, run := range checkRuns {
+		if run.GetStatus() != "completed" {
+			state = CIPending
+			continue
+		}
+		switch run.GetConclusion() {
+		case "success", "neutral", "skipped":
+		default:
+			return CIFailure
+		}
+	}
+	return state
+}
+
+// gitlabCIState maps a Gitlab pipeline status to a CI state
+func gitlabCIState(status string) string {
+	switch status {
+	case "success", "skipped":
+		return CISuccess
+	case "failed", "canceled":
+		return CIFailure
+	}
+	return CIPending
+}
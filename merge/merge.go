@@ -1,8 +1,14 @@
+// Package merge merges a pushed PR, once it's ready to be merged. Use Merge, which supports
+// both Github and Gitlab. Nothing here depends on the mp CLI, so it can be embedded.
 package merge
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
 	"time"
 
 	"github.com/Clever/microplane/lib"
@@ -13,7 +19,9 @@ import (
 type Input struct {
 	// Repo is the git Repo
 	Repo lib.Repo
-	// PRNumber of Github, e.g. for https://github.com/Clever/microplane/pull/123, the PRNumber is 123
+	// PRNumber of Github, e.g. for https://github.com/Clever/microplane/pull/123, the PRNumber is 123.
+	// For Gitlab it's the MR's IID within its project, e.g. 7 for .../-/merge_requests/7, which
+	// is what the API takes, not the MR's global ID.
 	PRNumber int
 	// CommitSHA for the commit which opened the above PR. Used to look up Commit status.
 	CommitSHA string
@@ -25,12 +33,242 @@ type Input struct {
 	RequireBuildSuccess bool
 	// Merge method to use. Possible values include: "merge", "squash", and "rebase"
 	MergeMethod string
+	// DeleteBranch deletes the PR's branch once it's merged
+	DeleteBranch bool
+	// VerifyTimeout, if set, is how long to wait after requesting the merge for the provider to
+	// confirm the PR merged, e.g. in case a late check fails it. It's an error if it doesn't.
+	VerifyTimeout time.Duration
+	// MergeStatusTimeout is how long to wait for the provider to finish checking if a PR is mergeable
+	MergeStatusTimeout time.Duration
+	// RequiredChecks are the names of statuses or checks that must have succeeded on the PR's head commit
+	RequiredChecks []string
+	// MergeMessage is a template for the merge commit message. Its first line is the title.
+	// See MessageVars for the variables available. If empty, the provider's default is used.
+	MergeMessage string
+	// SquashMessage is a template for the commit message of squash merges. Falls back to MergeMessage.
+	SquashMessage string
+	// IncludeDrafts marks draft MRs as ready and merges them, instead of skipping them.
+	// Only supported for Gitlab.
+	IncludeDrafts bool
+	// DryRun checks if the PR is ready to merge, without merging it or changing it in any way
+	DryRun bool
+}
+
+// MessageVars are the variables available to MergeMessage and SquashMessage templates
+type MessageVars struct {
+	Owner    string
+	Name     string
+	PRNumber int
+	PRTitle  string
+	PRURL    string
+	Branch   string
+}
+
+// ParseMessageTemplate parses a merge or squash message template
+func ParseMessageTemplate(text string) (*template.Template, error) {
+	return template.New("message").Option("missingkey=error").Parse(text)
+}
+
+// messageTemplate picks the template to use for a merge method
+func (input Input) messageTemplate() string {
+	if input.MergeMethod == "squash" && input.SquashMessage != "" {
+		return input.SquashMessage
+	}
+	return input.MergeMessage
+}
+
+// renderMessage renders a message template, returning its first line as the title and the
+// rest as the body
+func renderMessage(text string, vars MessageVars) (string, string, error) {
+	tmpl, err := ParseMessageTemplate(text)
+	if err != nil {
+		return "", "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, vars); err != nil {
+		return "", "", err
+	}
+	lines := strings.SplitN(strings.TrimSpace(buf.String()), "\n", 2)
+	title := strings.TrimSpace(lines[0])
+	body := ""
+	if len(lines) > 1 {
+		body = strings.TrimSpace(lines[1])
+	}
+	return title, body, nil
 }
 
 // Output from Push()
 type Output struct {
 	Success        bool
 	MergeCommitSHA string
+	// SkipReason categorizes why the PR wasn't merged, when it isn't ready to be. See the Skip* constants
+	SkipReason  string `json:",omitempty"`
+	SkipDetails string `json:",omitempty"`
+	// WouldMerge is set by a dry run when the PR is ready to merge
+	WouldMerge bool `json:",omitempty"`
+	// Verified is set if the provider confirmed the PR merged, see Input.VerifyTimeout
+	Verified bool `json:",omitempty"`
+	// ErrorKind is the kind of failure, if known, e.g. "conflict". See lib.ErrorKind.
+	ErrorKind string `json:",omitempty"`
+	// MergedExternally is set if the change reached the base branch without microplane merging
+	// it, e.g. its PR was merged by hand. MergeCommitSHA is empty then.
+	MergedExternally bool `json:",omitempty"`
+	// PostMerge is the result of the script the caller ran after the PR merged, if any
+	PostMerge *PostMergeResult `json:",omitempty"`
+}
+
+// PostMergeResult is the result of a script run after a PR merged, e.g. to check the deploy. Its
+// failure doesn't undo the merge.
+type PostMergeResult struct {
+	Success  bool
+	ExitCode int
+	// Output is what the script printed, the last of it if it printed a lot
+	Output string `json:",omitempty"`
+	RanAt  time.Time
+}
+
+// Reasons a PR is skipped, rather than merged
+const (
+	SkipDraft         = "draft"
+	SkipBehindBase    = "behind-base"
+	SkipConflict      = "conflict"
+	SkipChecksFailing = "checks-failing"
+	SkipNotApproved   = "not-approved"
+	SkipNotMergeable  = "not-mergeable"
+	SkipBlocked       = "blocked"
+	SkipStillChecking = "still-checking"
+	SkipClosed        = "closed"
+)
+
+// skip builds the Output for a PR that isn't ready to merge
+func skip(reason string, details string) Output {
+	return Output{Success: false, SkipReason: reason, SkipDetails: details}
+}
+
+// Skipped determines if the PR wasn't merged because it isn't ready to be
+func (o Output) Skipped() bool {
+	return o.SkipReason != ""
+}
+
+// requiredChecksDetails describes which required checks are missing or haven't succeeded, given
+// the state of each check by name. It returns "" if all required checks succeeded.
+func requiredChecksDetails(required []string, results map[string]string) string {
+	missing := []string{}
+	failing := []string{}
+	for _, name := range required {
+		state, ok := results[name]
+		if !ok {
+			missing = append(missing, name)
+		} else if state != "success" {
+			failing = append(failing, fmt.Sprintf("%s (%s)", name, state))
+		}
+	}
+
+	details := []string{}
+	if len(missing) > 0 {
+		details = append(details, fmt.Sprintf("missing required checks: %s", strings.Join(missing, ", ")))
+	}
+	if len(failing) > 0 {
+		details = append(details, fmt.Sprintf("required checks not successful: %s", strings.Join(failing, ", ")))
+	}
+	return strings.Join(details, "; ")
+}
+
+// mergeStatusPollInterval is how often to check a PR whose mergeability is still being computed
+const mergeStatusPollInterval = 5 * time.Second
+
+// githubSkipReason categorizes why a PR can't be merged, if it can't. Failing or pending checks,
+// and missing reviews, only count when the input requires them, so --ignore-build-status and
+// --ignore-review-approval still let the merge be attempted. The reviews tell a PR blocked by a
+// missing approval apart from one blocked by its checks or other branch protection.
+func githubSkipReason(pr *github.PullRequest, input Input, reviews []*github.PullRequestReview) (string, string) {
+	if pr.GetDraft() {
+		return SkipDraft, "PR is a draft"
+	}
+	if pr.Mergeable == nil {
+		return SkipStillChecking, "Github is still checking if the PR is mergeable. Try again later, or raise --merge-status-timeout"
+	}
+	switch pr.GetMergeableState() {
+	case "dirty":
+		return SkipConflict, "PR has merge conflicts"
+	case "behind":
+		return SkipBehindBase, "PR branch is behind the base branch"
+	case "blocked":
+		if input.RequireReviewApproval && !githubApproved(reviews) {
+			return SkipNotApproved, "PR is blocked by branch protection, and isn't approved. Use --ignore-review-approval to override this check."
+		}
+		if input.RequireBuildSuccess || input.RequireReviewApproval {
+			return SkipBlocked, "PR is blocked by branch protection, e.g. by required checks or a code owner's review"
+		}
+		return "", ""
+	case "unstable":
+		if input.RequireBuildSuccess {
+			return SkipChecksFailing, "PR has failing checks"
+		}
+		return "", ""
+	}
+	if !pr.GetMergeable() {
+		return SkipNotMergeable, fmt.Sprintf("PR is not mergeable, mergeable state is '%s'", pr.GetMergeableState())
+	}
+	return "", ""
+}
+
+// githubCheckResults gets the state of each status and check run on the pushed commit, by name.
+// Both are read for the same commit, and paged through, so a repo with a lot of checks doesn't
+// have required ones reported missing.
+func githubCheckResults(ctx context.Context, client *github.Client, input Input, repoLimiter *time.Ticker) (map[string]string, error) {
+	results := map[string]string{}
+	statusOptions := &github.ListOptions{PerPage: 100}
+	for {
+		lib.Wait(repoLimiter)
+		status, resp, err := client.Repositories.GetCombinedStatus(ctx, input.Repo.Owner, input.Repo.Name, input.CommitSHA, statusOptions)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range status.Statuses {
+			results[s.GetContext()] = s.GetState()
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		statusOptions.Page = resp.NextPage
+	}
+
+	runOptions := &github.ListCheckRunsOptions{ListOptions: github.ListOptions{PerPage: 100}}
+	for {
+		lib.Wait(repoLimiter)
+		checkRuns, resp, err := client.Checks.ListCheckRunsForRef(ctx, input.Repo.Owner, input.Repo.Name, input.CommitSHA, runOptions)
+		if err != nil {
+			return nil, err
+		}
+		for _, run := range checkRuns.CheckRuns {
+			conclusion := run.GetConclusion()
+			if conclusion == "neutral" || conclusion == "skipped" {
+				conclusion = "success"
+			} else if run.GetStatus() != "completed" {
+				conclusion = run.GetStatus()
+			}
+			results[run.GetName()] = conclusion
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		runOptions.Page = resp.NextPage
+	}
+	return results, nil
+}
+
+// githubApproved determines if a PR's reviews approve it: it has some, and all of them approved
+func githubApproved(reviews []*github.PullRequestReview) bool {
+	if len(reviews) == 0 {
+		return false
+	}
+	for _, r := range reviews {
+		if r.GetState() != "APPROVED" {
+			return false
+		}
+	}
+	return true
 }
 
 // Error and details from Push()
@@ -39,9 +277,39 @@ type Error struct {
 	Details string
 }
 
+// Merge an open PR, with Github or Gitlab depending on the repo's provider
+// - repoLimiter rate limits the # of calls to the provider
+// - mergeLimiter rate limits # of merges, to prevent load when submitting builds to CI system
+// A nil limiter means no rate limiting.
+func Merge(ctx context.Context, input Input, repoLimiter *time.Ticker, mergeLimiter *time.Ticker) (Output, error) {
+	var output Output
+	var err error
+	switch {
+	case input.Repo.IsGithub():
+		output, err = GitHubMerge(ctx, input, repoLimiter, mergeLimiter)
+	case input.Repo.IsGitlab():
+		output, err = GitlabMerge(ctx, input, repoLimiter, mergeLimiter)
+	default:
+		return Output{}, fmt.Errorf("unsupported provider: %s", input.Repo.ProviderConfig.Backend)
+	}
+	err = lib.WithAPIKind(lib.WithDeadlineKind(ctx, err))
+	output.ErrorKind = lib.ErrorKind(err)
+	return output, err
+}
+
+// mergeConflict marks the error from a merge API call as a conflict, when the provider refused
+// the merge, rather than failing some other way
+func mergeConflict(err error, status int) error {
+	if status == http.StatusMethodNotAllowed || status == http.StatusNotAcceptable || status == http.StatusConflict {
+		return lib.WithKind(lib.ErrConflict, err)
+	}
+	return err
+}
+
 // Merge an open PR in Github
 // - repoLimiter rate limits the # of calls to Github
 // - mergeLimiter rate limits # of merges, to prevent load when submitting builds to CI system
+// A nil limiter means no rate limiting.
 func GitHubMerge(ctx context.Context, input Input, repoLimiter *time.Ticker, mergeLimiter *time.Ticker) (Output, error) {
 	// Create Github Client
 	p := lib.NewProviderFromConfig(input.Repo.ProviderConfig)
@@ -53,8 +321,7 @@ func GitHubMerge(ctx context.Context, input Input, repoLimiter *time.Ticker, mer
 	// OK to merge?
 
 	// (1) Check if the PR is mergeable
-	<-repoLimiter.C
-	pr, _, err := client.PullRequests.Get(ctx, input.Repo.Owner, input.Repo.Name, input.PRNumber)
+	pr, err := githubGetPullRequest(ctx, client, input, repoLimiter)
 	if err != nil {
 		return Output{Success: false}, err
 	}
@@ -64,12 +331,21 @@ func GitHubMerge(ctx context.Context, input Input, repoLimiter *time.Ticker, mer
 		return Output{Success: true, MergeCommitSHA: pr.GetMergeCommitSHA()}, nil
 	}
 
-	if !pr.GetMergeable() {
-		return Output{Success: false}, fmt.Errorf("PR is not mergeable")
+	if pr.GetState() == "closed" {
+		return skip(SkipClosed, "PR was closed without merging"), nil
+	}
+
+	lib.Wait(repoLimiter)
+	reviews, _, err := client.PullRequests.ListReviews(ctx, input.Repo.Owner, input.Repo.Name, input.PRNumber, &github.ListOptions{})
+	if err != nil {
+		return Output{Success: false}, err
+	}
+	if reason, details := githubSkipReason(pr, input, reviews); reason != "" {
+		return skip(reason, details), nil
 	}
 
 	// (2) Check commit status
-	<-repoLimiter.C
+	lib.Wait(repoLimiter)
 	status, _, err := client.Repositories.GetCombinedStatus(ctx, input.Repo.Owner, input.Repo.Name, input.CommitSHA, &github.ListOptions{})
 	if err != nil {
 		return Output{Success: false}, err
@@ -78,20 +354,28 @@ func GitHubMerge(ctx context.Context, input Input, repoLimiter *time.Ticker, mer
 	if input.RequireBuildSuccess {
 		state := status.GetState()
 		if state != "success" {
-			return Output{Success: false}, fmt.Errorf("Build status was not 'success', instead was '%s'. Use --ignore-build-status to override this check.", state)
+			return skip(SkipChecksFailing, fmt.Sprintf("Build status was not 'success', instead was '%s'. Use --ignore-build-status to override this check.", state)), nil
+		}
+	}
+
+	if len(input.RequiredChecks) > 0 {
+		results, err := githubCheckResults(ctx, client, input, repoLimiter)
+		if err != nil {
+			return Output{Success: false}, err
+		}
+		if details := requiredChecksDetails(input.RequiredChecks, results); details != "" {
+			return skip(SkipChecksFailing, details), nil
 		}
 	}
 
 	// (3) check if PR has been approved by a reviewer
-	<-repoLimiter.C
-	reviews, _, err := client.PullRequests.ListReviews(ctx, input.Repo.Owner, input.Repo.Name, input.PRNumber, &github.ListOptions{})
 	if input.RequireReviewApproval {
 		if len(reviews) == 0 {
-			return Output{Success: false}, fmt.Errorf("PR awaiting review. Use --ignore-review-approval to override this check.")
+			return skip(SkipNotApproved, "PR awaiting review. Use --ignore-review-approval to override this check."), nil
 		}
 		for _, r := range reviews {
 			if r.GetState() != "APPROVED" {
-				return Output{Success: false}, fmt.Errorf("PR is not approved. Review state is %s. Use --ignore-review-approval to override this check.", r.GetState())
+				return skip(SkipNotApproved, fmt.Sprintf("PR is not approved. Review state is %s. Use --ignore-review-approval to override this check.", r.GetState())), nil
 			}
 		}
 	}
@@ -101,23 +385,76 @@ func GitHubMerge(ctx context.Context, input Input, repoLimiter *time.Ticker, mer
 		MergeMethod: input.MergeMethod,
 	}
 	commitMsg := ""
-	<-mergeLimiter.C
-	<-repoLimiter.C
-	result, _, err := client.PullRequests.Merge(ctx, input.Repo.Owner, input.Repo.Name, input.PRNumber, commitMsg, options)
+	if text := input.messageTemplate(); text != "" && input.MergeMethod != "rebase" {
+		title, body, err := renderMessage(text, MessageVars{
+			Owner:    input.Repo.Owner,
+			Name:     input.Repo.Name,
+			PRNumber: input.PRNumber,
+			PRTitle:  pr.GetTitle(),
+			PRURL:    pr.GetHTMLURL(),
+			Branch:   pr.GetHead().GetRef(),
+		})
+		if err != nil {
+			return Output{Success: false}, fmt.Errorf("failed to render merge message: %w", err)
+		}
+		options.CommitTitle = title
+		commitMsg = body
+	}
+	if input.DryRun {
+		return Output{Success: false, WouldMerge: true}, nil
+	}
+	lib.Wait(mergeLimiter)
+	lib.Wait(repoLimiter)
+	result, resp, err := client.PullRequests.Merge(ctx, input.Repo.Owner, input.Repo.Name, input.PRNumber, commitMsg, options)
 	if err != nil {
+		if resp != nil {
+			err = mergeConflict(err, resp.StatusCode)
+		}
 		return Output{Success: false}, err
 	}
 
 	if !result.GetMerged() {
-		return Output{Success: false}, fmt.Errorf("failed to merge: %s", result.GetMessage())
+		return Output{Success: false}, lib.WithKind(lib.ErrConflict, fmt.Errorf("failed to merge: %s", result.GetMessage()))
+	}
+	sha := result.GetSHA()
+	if input.VerifyTimeout > 0 {
+		if sha, err = githubVerifyMerged(ctx, client, input, repoLimiter); err != nil {
+			return Output{Success: false}, err
+		}
 	}
 
 	// Delete the branch
-	<-repoLimiter.C
-	_, err = client.Git.DeleteRef(ctx, input.Repo.Owner, input.Repo.Name, "heads/"+*pr.Head.Ref)
-	if err != nil {
-		return Output{Success: false}, err
+	if input.DeleteBranch {
+		lib.Wait(repoLimiter)
+		_, err = client.Git.DeleteRef(ctx, input.Repo.Owner, input.Repo.Name, "heads/"+*pr.Head.Ref)
+		if err != nil {
+			return Output{Success: false}, err
+		}
 	}
 
-	return Output{Success: true, MergeCommitSHA: result.GetSHA()}, nil
+	return Output{Success: true, MergeCommitSHA: sha, Verified: input.VerifyTimeout > 0}, nil
+}
+
+// githubGetPullRequest gets a PR. Github computes mergeability in the background, e.g. right after
+// a push, and leaves it unset until then, so this waits up to MergeStatusTimeout for it
+func githubGetPullRequest(ctx context.Context, client *github.Client, input Input, repoLimiter *time.Ticker) (*github.PullRequest, error) {
+	lib.Wait(repoLimiter)
+	pr, _, err := client.PullRequests.Get(ctx, input.Repo.Owner, input.Repo.Name, input.PRNumber)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(input.MergeStatusTimeout)
+	for pr.Mergeable == nil && pr.GetState() == "open" && time.Now().Before(deadline) {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(mergeStatusPollInterval):
+		}
+		lib.Wait(repoLimiter)
+		pr, _, err = client.PullRequests.Get(ctx, input.Repo.Owner, input.Repo.Name, input.PRNumber)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return pr, nil
 }
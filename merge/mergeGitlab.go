@@ -3,6 +3,7 @@ package merge
 import (
 	"context"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/Clever/microplane/lib"
@@ -13,6 +14,7 @@ import (
 // Merge an open MR in Gitlab
 // - repoLimiter rate limits the # of calls to Github
 // - mergeLimiter rate limits # of merges, to prevent load when submitting builds to CI system
+// A nil limiter means no rate limiting.
 func GitlabMerge(ctx context.Context, input Input, repoLimiter *time.Ticker, mergeLimiter *time.Ticker) (Output, error) {
 	// Create client
 	p := lib.NewProviderFromConfig(input.Repo.ProviderConfig)
@@ -25,62 +27,304 @@ func GitlabMerge(ctx context.Context, input Input, repoLimiter *time.Ticker, mer
 	// OK to merge?
 
 	// (1) Check if the MR is mergeable
-	<-repoLimiter.C
 	pid := fmt.Sprintf("%s/%s", input.Repo.Owner, input.Repo.Name)
-	truePointer := true
-	mr, _, err := client.MergeRequests.GetMergeRequest(pid, input.PRNumber, &gitlab.GetMergeRequestsOptions{IncludeDivergedCommitsCount: &truePointer}, ctxFunc)
+	mr, err := gitlabGetMergeRequest(ctx, client, pid, input, repoLimiter)
 	if err != nil {
 		return Output{Success: false}, err
 	}
+	if input.IncludeDrafts && mr.State == "opened" && GitlabIsDraft(mr) {
+		if input.DryRun {
+			// Gitlab doesn't check if drafts are mergeable, so this is as far as a dry run gets
+			return Output{Success: false, WouldMerge: true}, nil
+		}
+		// mark it ready, then check again now that Gitlab will consider merging it
+		title := GitlabUndraftTitle(mr.Title)
+		lib.Wait(repoLimiter)
+		if _, _, err := client.MergeRequests.UpdateMergeRequest(pid, input.PRNumber, &gitlab.UpdateMergeRequestOptions{Title: &title}, ctxFunc); err != nil {
+			return Output{Success: false}, fmt.Errorf("failed to mark MR as ready: %w", err)
+		}
+		if mr, err = gitlabGetMergeRequest(ctx, client, pid, input, repoLimiter); err != nil {
+			return Output{Success: false}, err
+		}
+	}
 	if mr.State == "merged" {
 		// Success! already merged
 		return Output{Success: true, MergeCommitSHA: mr.MergeCommitSHA}, nil
 	}
+	if mr.State == "closed" {
+		return skip(SkipClosed, "MR was closed without merging"), nil
+	}
 
-	if mr.MergeStatus != "can_be_merged" {
-		return Output{Success: false}, fmt.Errorf("MR is not mergeable")
+	if reason, details := gitlabSkipReason(mr, input); reason != "" {
+		return skip(reason, details), nil
 	}
 
 	// (2) Check commit status
-	<-repoLimiter.C
+	lib.Wait(repoLimiter)
 	pipelineStatus, err := push.GetPipelineStatus(client, input.Repo.Owner, input.Repo.Name, &gitlab.ListProjectPipelinesOptions{SHA: &input.CommitSHA})
 	if err != nil {
 		return Output{Success: false}, err
 	}
 
 	if input.RequireBuildSuccess && pipelineStatus != "success" {
-		return Output{Success: false}, fmt.Errorf("status was not 'success', instead was '%s'", pipelineStatus)
+		return skip(SkipChecksFailing, fmt.Sprintf("Pipeline status was not 'success', instead was '%s'. Use --ignore-build-status to override this check.", pipelineStatus)), nil
+	}
+
+	if len(input.RequiredChecks) > 0 {
+		results, err := gitlabCheckResults(ctx, client, pid, input, repoLimiter)
+		if err != nil {
+			return Output{Success: false}, err
+		}
+		if details := requiredChecksDetails(input.RequiredChecks, results); details != "" {
+			return skip(SkipChecksFailing, details), nil
+		}
 	}
 
-	// // (3) check if MR has been approved by a reviewer
-	<-repoLimiter.C
-	approvals, _, err := client.MergeRequests.GetMergeRequestApprovals(pid, input.PRNumber, ctxFunc)
+	// (3) check if MR has the approvals the project requires
+	lib.Wait(repoLimiter)
+	approvals, _, err := client.MergeRequestApprovals.GetConfiguration(pid, input.PRNumber, ctxFunc)
 	if err != nil {
 		return Output{Success: false}, err
 	}
-
-	if input.RequireReviewApproval {
-		if approvals.ApprovalsRequired > len(approvals.ApprovedBy) {
-			return Output{Success: false}, fmt.Errorf("MR is not approved. Review state is %s", mr.State)
+	if input.RequireReviewApproval && approvals.ApprovalsLeft > 0 {
+		// the approval state breaks down which rules still need approvals. It isn't available
+		// on every Gitlab tier, so fall back to the overall count without it
+		lib.Wait(repoLimiter)
+		state, _, err := client.MergeRequestApprovals.GetApprovalState(pid, input.PRNumber, ctxFunc)
+		if err != nil {
+			state = nil
 		}
+		return skip(SkipNotApproved, gitlabApprovalDetails(approvals, state)), nil
+	}
+	if input.RequireReviewApproval && approvals.ApprovalsRequired > len(approvals.ApprovedBy) {
+		return skip(SkipNotApproved, fmt.Sprintf("MR is not approved. Review state is %s. Use --ignore-review-approval to override this check.", mr.State)), nil
+	}
+
+	// Merge the MR
+	vars := MessageVars{
+		Owner:    input.Repo.Owner,
+		Name:     input.Repo.Name,
+		PRNumber: input.PRNumber,
+		PRTitle:  mr.Title,
+		PRURL:    mr.WebURL,
+		Branch:   mr.SourceBranch,
+	}
+	options, err := gitlabAcceptOptions(input, vars)
+	if err != nil {
+		return Output{Success: false}, err
+	}
+	if input.DryRun {
+		// the rebase below force-pushes the MR's branch, so a dry run stops before it
+		return Output{Success: false, WouldMerge: true}, nil
 	}
 	// Try to rebase master if Diverged Commits greates that zero
 	if mr.DivergedCommitsCount > 0 {
-		_, err := client.MergeRequests.RebaseMergeRequest(pid, input.PRNumber, ctxFunc)
+		_, err := client.MergeRequests.RebaseMergeRequest(pid, input.PRNumber, nil, ctxFunc)
 		if err != nil {
-			return Output{Success: false}, fmt.Errorf("Failed to rebase from master")
+			return Output{Success: false}, lib.WithKind(lib.ErrConflict, fmt.Errorf("Failed to rebase from master"))
 		}
 	}
 
-	// Merge the MR
-	<-mergeLimiter.C
-	<-repoLimiter.C
-	result, _, err := client.MergeRequests.AcceptMergeRequest(pid, input.PRNumber, &gitlab.AcceptMergeRequestOptions{
-		ShouldRemoveSourceBranch: &truePointer,
-	}, ctxFunc)
+	lib.Wait(mergeLimiter)
+	lib.Wait(repoLimiter)
+	result, resp, err := client.MergeRequests.AcceptMergeRequest(pid, input.PRNumber, options, ctxFunc)
 	if err != nil {
+		if resp != nil {
+			err = mergeConflict(err, resp.StatusCode)
+		}
 		return Output{Success: false}, err
 	}
 
-	return Output{Success: true, MergeCommitSHA: result.SHA}, nil
+	sha := result.SHA
+	if input.VerifyTimeout > 0 {
+		if sha, err = gitlabVerifyMerged(ctx, client, pid, input, repoLimiter); err != nil {
+			return Output{Success: false}, err
+		}
+	}
+	return Output{Success: true, MergeCommitSHA: sha, Verified: input.VerifyTimeout > 0}, nil
+}
+
+// gitlabCheckResults gets the state of each status on the pushed commit, by name, the same
+// commit the pipeline status is read for. It pages through them, so a project with a lot of jobs
+// doesn't have required ones reported missing.
+func gitlabCheckResults(ctx context.Context, client *gitlab.Client, pid string, input Input, repoLimiter *time.Ticker) (map[string]string, error) {
+	results := map[string]string{}
+	options := &gitlab.GetCommitStatusesOptions{ListOptions: gitlab.ListOptions{PerPage: 100}}
+	for {
+		lib.Wait(repoLimiter)
+		statuses, resp, err := client.Commits.GetCommitStatuses(pid, input.CommitSHA, options, gitlab.WithContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range statuses {
+			results[s.Name] = s.Status
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		options.Page = resp.NextPage
+	}
+	return results, nil
+}
+
+// gitlabAcceptOptions are the options to merge an MR with. The merge method and branch deletion
+// are independent, so e.g. a squash merge can also remove the source branch.
+func gitlabAcceptOptions(input Input, vars MessageVars) (*gitlab.AcceptMergeRequestOptions, error) {
+	options := &gitlab.AcceptMergeRequestOptions{
+		Squash:                   gitlab.Bool(input.MergeMethod == "squash"),
+		ShouldRemoveSourceBranch: gitlab.Bool(input.DeleteBranch),
+	}
+	if input.MergeMessage != "" {
+		message, err := gitlabMessage(input.MergeMessage, vars)
+		if err != nil {
+			return nil, err
+		}
+		options.MergeCommitMessage = &message
+	}
+	if text := input.SquashMessage; text != "" || input.MergeMessage != "" {
+		if text == "" {
+			text = input.MergeMessage
+		}
+		message, err := gitlabMessage(text, vars)
+		if err != nil {
+			return nil, err
+		}
+		options.SquashCommitMessage = &message
+	}
+	return options, nil
+}
+
+// gitlabGetMergeRequest gets an MR. Gitlab computes mergeability asynchronously, e.g. right
+// after a push, so this waits up to MergeStatusTimeout for it to finish
+func gitlabGetMergeRequest(ctx context.Context, client *gitlab.Client, pid string, input Input, repoLimiter *time.Ticker) (*gitlab.MergeRequest, error) {
+	truePointer := true
+	options := &gitlab.GetMergeRequestsOptions{IncludeDivergedCommitsCount: &truePointer}
+	lib.Wait(repoLimiter)
+	mr, _, err := client.MergeRequests.GetMergeRequest(pid, input.PRNumber, options, gitlab.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(input.MergeStatusTimeout)
+	for gitlabStillChecking(mr) && time.Now().Before(deadline) {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(mergeStatusPollInterval):
+		}
+		lib.Wait(repoLimiter)
+		mr, _, err = client.MergeRequests.GetMergeRequest(pid, input.PRNumber, options, gitlab.WithContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return mr, nil
+}
+
+// gitlabDraftPrefixes mark an MR as a draft when its title starts with one of them
+var gitlabDraftPrefixes = []string{"draft:", "[draft]", "(draft)", "wip:", "[wip]"}
+
+// GitlabIsDraft determines if an MR is a draft, by its flags or the prefix of its title
+func GitlabIsDraft(mr *gitlab.MergeRequest) bool {
+	return mr.Draft || mr.WorkInProgress || GitlabUndraftTitle(mr.Title) != mr.Title
+}
+
+// GitlabUndraftTitle removes the draft prefixes from an MR title, which marks it ready
+func GitlabUndraftTitle(title string) string {
+	for {
+		trimmed := strings.TrimSpace(title)
+		found := false
+		for _, prefix := range gitlabDraftPrefixes {
+			if strings.HasPrefix(strings.ToLower(trimmed), prefix) {
+				trimmed = strings.TrimSpace(trimmed[len(prefix):])
+				found = true
+			}
+		}
+		if !found {
+			return title
+		}
+		title = trimmed
+	}
+}
+
+// gitlabMessage renders a message template as a full commit message
+func gitlabMessage(text string, vars MessageVars) (string, error) {
+	title, body, err := renderMessage(text, vars)
+	if err != nil {
+		return "", fmt.Errorf("failed to render merge message: %w", err)
+	}
+	if body == "" {
+		return title, nil
+	}
+	return title + "\n\n" + body, nil
+}
+
+// gitlabApprovalDetails describes how many more approvals an MR needs, and for which rules
+func gitlabApprovalDetails(approvals *gitlab.MergeRequestApprovals, state *gitlab.MergeRequestApprovalState) string {
+	details := fmt.Sprintf("MR needs %d more approval(s) (%d of %d)", approvals.ApprovalsLeft, len(approvals.ApprovedBy), approvals.ApprovalsRequired)
+	if state == nil {
+		return details
+	}
+	rules := []string{}
+	for _, rule := range state.Rules {
+		if rule.Approved || rule.ApprovalsRequired <= len(rule.ApprovedBy) {
+			continue
+		}
+		rules = append(rules, fmt.Sprintf("%s needs %d more", rule.Name, rule.ApprovalsRequired-len(rule.ApprovedBy)))
+	}
+	if len(rules) == 0 {
+		return details
+	}
+	return fmt.Sprintf("%s: %s", details, strings.Join(rules, ", "))
+}
+
+// gitlabStillChecking determines if Gitlab hasn't finished computing whether an MR is mergeable
+func gitlabStillChecking(mr *gitlab.MergeRequest) bool {
+	switch mr.DetailedMergeStatus {
+	case "checking", "unchecked", "preparing", "approvals_syncing":
+		return true
+	case "":
+		return mr.MergeStatus == "checking" || mr.MergeStatus == "unchecked" || mr.MergeStatus == "cannot_be_merged_recheck"
+	}
+	return false
+}
+
+// gitlabSkipReason categorizes why an MR can't be merged, if it can't. Like on Github, pipelines
+// and approvals only count when the input requires them.
+func gitlabSkipReason(mr *gitlab.MergeRequest, input Input) (string, string) {
+	if GitlabIsDraft(mr) {
+		return SkipDraft, "MR is a draft. Use --include-drafts to mark it ready and merge it anyway."
+	}
+	if gitlabStillChecking(mr) {
+		return SkipStillChecking, fmt.Sprintf("Gitlab is still checking if the MR is mergeable (%s). Try again later, or raise --merge-status-timeout", mr.DetailedMergeStatus)
+	}
+	if mr.HasConflicts {
+		return SkipConflict, "MR has merge conflicts"
+	}
+
+	switch mr.DetailedMergeStatus {
+	case "mergeable":
+		return "", ""
+	case "":
+		// older versions of Gitlab only report merge_status
+		if mr.MergeStatus == "can_be_merged" {
+			return "", ""
+		}
+	case "draft_status":
+		return SkipDraft, "MR is a draft"
+	case "conflict", "broken_status":
+		return SkipConflict, "MR has merge conflicts"
+	case "need_rebase":
+		return SkipBehindBase, "MR branch must be rebased onto the target branch"
+	case "ci_must_pass", "ci_still_running":
+		if input.RequireBuildSuccess {
+			return SkipChecksFailing, fmt.Sprintf("MR pipeline must succeed, detailed merge status is '%s'", mr.DetailedMergeStatus)
+		}
+		return "", ""
+	case "not_approved":
+		if input.RequireReviewApproval {
+			return SkipNotApproved, "MR is not approved"
+		}
+		return "", ""
+	}
+	return SkipNotMergeable, fmt.Sprintf("MR is not mergeable, merge status is '%s' (%s)", mr.MergeStatus, mr.DetailedMergeStatus)
 }
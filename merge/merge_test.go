@@ -0,0 +1,298 @@
+package merge
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Clever/microplane/lib"
+	"github.com/google/go-github/v35/github"
+	"github.com/stretchr/testify/assert"
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+func TestGithubSkipReason(t *testing.T) {
+	yes, no := true, false
+	state := func(s string) *string { return &s }
+	required := Input{RequireBuildSuccess: true, RequireReviewApproval: true}
+	approved := []*github.PullRequestReview{{State: state("APPROVED")}}
+	tests := []struct {
+		pr      github.PullRequest
+		input   Input
+		reviews []*github.PullRequestReview
+		reason  string
+	}{
+		{github.PullRequest{Mergeable: &yes, MergeableState: state("clean")}, required, nil, ""},
+		{github.PullRequest{Draft: &yes, Mergeable: &yes, MergeableState: state("draft")}, required, nil, SkipDraft},
+		{github.PullRequest{Mergeable: &no, MergeableState: state("dirty")}, required, nil, SkipConflict},
+		{github.PullRequest{Mergeable: &yes, MergeableState: state("behind")}, required, nil, SkipBehindBase},
+		{github.PullRequest{Mergeable: &yes, MergeableState: state("unstable")}, required, nil, SkipChecksFailing},
+		{github.PullRequest{Mergeable: &no, MergeableState: state("unknown")}, required, nil, SkipNotMergeable},
+		{github.PullRequest{MergeableState: state("unknown")}, required, nil, SkipStillChecking},
+		// --ignore-build-status and --ignore-review-approval let these be merged
+		{github.PullRequest{Mergeable: &yes, MergeableState: state("unstable")}, Input{RequireReviewApproval: true}, nil, ""},
+		{github.PullRequest{Mergeable: &yes, MergeableState: state("blocked")}, Input{}, nil, ""},
+		// blocked with green checks and no approval is a missing review, not failing checks
+		{github.PullRequest{Mergeable: &yes, MergeableState: state("blocked")}, required, nil, SkipNotApproved},
+		{github.PullRequest{Mergeable: &yes, MergeableState: state("blocked")}, Input{RequireBuildSuccess: true}, nil, SkipBlocked},
+		{github.PullRequest{Mergeable: &yes, MergeableState: state("blocked")}, required, approved, SkipBlocked},
+	}
+	for _, test := range tests {
+		reason, _ := githubSkipReason(&test.pr, test.input, test.reviews)
+		assert.Equal(t, test.reason, reason)
+	}
+}
+
+func TestGitlabSkipReason(t *testing.T) {
+	required := Input{RequireBuildSuccess: true, RequireReviewApproval: true}
+	tests := []struct {
+		mr     gitlab.MergeRequest
+		input  Input
+		reason string
+	}{
+		{gitlab.MergeRequest{DetailedMergeStatus: "mergeable"}, required, ""},
+		{gitlab.MergeRequest{MergeStatus: "can_be_merged"}, required, ""},
+		{gitlab.MergeRequest{Draft: true, DetailedMergeStatus: "draft_status"}, required, SkipDraft},
+		{gitlab.MergeRequest{HasConflicts: true, DetailedMergeStatus: "broken_status"}, required, SkipConflict},
+		{gitlab.MergeRequest{DetailedMergeStatus: "need_rebase"}, required, SkipBehindBase},
+		{gitlab.MergeRequest{DetailedMergeStatus: "ci_must_pass"}, required, SkipChecksFailing},
+		{gitlab.MergeRequest{DetailedMergeStatus: "not_approved"}, required, SkipNotApproved},
+		{gitlab.MergeRequest{MergeStatus: "cannot_be_merged"}, required, SkipNotMergeable},
+		{gitlab.MergeRequest{MergeStatus: "checking", DetailedMergeStatus: "checking"}, required, SkipStillChecking},
+		{gitlab.MergeRequest{MergeStatus: "unchecked"}, required, SkipStillChecking},
+		// --ignore-build-status and --ignore-review-approval let these be merged
+		{gitlab.MergeRequest{DetailedMergeStatus: "ci_must_pass"}, Input{RequireReviewApproval: true}, ""},
+		{gitlab.MergeRequest{DetailedMergeStatus: "not_approved"}, Input{RequireBuildSuccess: true}, ""},
+	}
+	for _, test := range tests {
+		reason, _ := gitlabSkipReason(&test.mr, test.input)
+		assert.Equal(t, test.reason, reason)
+	}
+}
+
+func TestRequiredChecksDetails(t *testing.T) {
+	results := map[string]string{"build": "success", "lint": "failure"}
+	assert.Equal(t, "", requiredChecksDetails([]string{"build"}, results))
+	assert.Equal(t, "missing required checks: deploy; required checks not successful: lint (failure)",
+		requiredChecksDetails([]string{"build", "lint", "deploy"}, results))
+}
+
+func TestRenderMessage(t *testing.T) {
+	vars := MessageVars{Owner: "Clever", Name: "microplane", PRNumber: 7, PRTitle: "Bump deps", Branch: "bump"}
+
+	title, body, err := renderMessage("CHG-1: {{.PRTitle}} (#{{.PRNumber}})\n\nMerged {{.Branch}} into {{.Owner}}/{{.Name}}\n", vars)
+	assert.NoError(t, err)
+	assert.Equal(t, "CHG-1: Bump deps (#7)", title)
+	assert.Equal(t, "Merged bump into Clever/microplane", body)
+
+	title, body, err = renderMessage("{{.PRTitle}}", vars)
+	assert.NoError(t, err)
+	assert.Equal(t, "Bump deps", title)
+	assert.Equal(t, "", body)
+
+	_, _, err = renderMessage("{{.Nope}}", vars)
+	assert.Error(t, err)
+}
+
+func TestMessageTemplate(t *testing.T) {
+	input := Input{MergeMethod: "squash", MergeMessage: "merge", SquashMessage: "squash"}
+	assert.Equal(t, "squash", input.messageTemplate())
+	input.MergeMethod = "merge"
+	assert.Equal(t, "merge", input.messageTemplate())
+	input = Input{MergeMethod: "squash", MergeMessage: "merge"}
+	assert.Equal(t, "merge", input.messageTemplate())
+}
+
+func TestGitlabApprovalDetails(t *testing.T) {
+	approvals := &gitlab.MergeRequestApprovals{
+		ApprovalsRequired: 3,
+		ApprovalsLeft:     2,
+		ApprovedBy:        []*gitlab.MergeRequestApproverUser{{}},
+	}
+	assert.Equal(t, "MR needs 2 more approval(s) (1 of 3)", gitlabApprovalDetails(approvals, nil))
+
+	state := &gitlab.MergeRequestApprovalState{Rules: []*gitlab.MergeRequestApprovalRule{
+		{Name: "maintainers", ApprovalsRequired: 2, ApprovedBy: []*gitlab.BasicUser{{}}},
+		{Name: "security", ApprovalsRequired: 1},
+		{Name: "all", ApprovalsRequired: 1, ApprovedBy: []*gitlab.BasicUser{{}}, Approved: true},
+	}}
+	assert.Equal(t, "MR needs 2 more approval(s) (1 of 3): maintainers needs 1 more, security needs 1 more", gitlabApprovalDetails(approvals, state))
+}
+
+func TestGitlabDrafts(t *testing.T) {
+	tests := []struct {
+		title   string
+		draft   bool
+		undraft string
+	}{
+		{"Bump deps", false, "Bump deps"},
+		{"Draft: Bump deps", true, "Bump deps"},
+		{"[Draft] Bump deps", true, "Bump deps"},
+		{"(draft) Bump deps", true, "Bump deps"},
+		{"WIP: Bump deps", true, "Bump deps"},
+		{"Draft: WIP: Bump deps", true, "Bump deps"},
+		{"Drafting: Bump deps", false, "Drafting: Bump deps"},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.draft, GitlabIsDraft(&gitlab.MergeRequest{Title: test.title}), test.title)
+		assert.Equal(t, test.undraft, GitlabUndraftTitle(test.title), test.title)
+	}
+	assert.True(t, GitlabIsDraft(&gitlab.MergeRequest{Title: "Bump deps", WorkInProgress: true}))
+}
+
+func TestGithubCIState(t *testing.T) {
+	run := func(status, conclusion string) *github.CheckRun {
+		return &github.CheckRun{Status: &status, Conclusion: &conclusion}
+	}
+	combined := func(state string, count int) *github.CombinedStatus {
+		return &github.CombinedStatus{State: &state, TotalCount: &count}
+	}
+	assert.Equal(t, CINone, githubCIState(combined("pending", 0), nil))
+	assert.Equal(t, CISuccess, githubCIState(combined("pending", 0), []*github.CheckRun{run("completed", "success"), run("completed", "skipped")}))
+	assert.Equal(t, CIPending, githubCIState(combined("success", 1), []*github.CheckRun{run("in_progress", "")}))
+	assert.Equal(t, CIFailure, githubCIState(combined("pending", 2), []*github.CheckRun{run("completed", "timed_out")}))
+	assert.Equal(t, CIFailure, githubCIState(combined("error", 1), nil))
+}
+
+func TestGitlabAcceptOptions(t *testing.T) {
+	options, err := gitlabAcceptOptions(Input{MergeMethod: "squash", DeleteBranch: true, SquashMessage: "Squash {{.Branch}}"}, MessageVars{Branch: "bump"})
+	assert.NoError(t, err)
+	assert.True(t, *options.Squash)
+	assert.True(t, *options.ShouldRemoveSourceBranch)
+	assert.Equal(t, "Squash bump", *options.SquashCommitMessage)
+
+	options, err = gitlabAcceptOptions(Input{MergeMethod: "merge"}, MessageVars{})
+	assert.NoError(t, err)
+	assert.False(t, *options.Squash)
+	assert.False(t, *options.ShouldRemoveSourceBranch)
+	assert.Nil(t, options.MergeCommitMessage)
+}
+
+func TestWaitForMerged(t *testing.T) {
+	verifyPollInterval = time.Millisecond
+	states := []mergeState{{}, {}, {Merged: true, SHA: "abc"}}
+	sha, err := waitForMerged(context.Background(), time.Minute, func() (mergeState, error) {
+		state := states[0]
+		states = states[1:]
+		return state, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "abc", sha)
+
+	_, err = waitForMerged(context.Background(), time.Minute, func() (mergeState, error) {
+		return mergeState{Error: "pipeline failed"}, nil
+	})
+	assert.True(t, errors.Is(err, errNotMerged))
+	assert.Contains(t, err.Error(), "pipeline failed")
+
+	_, err = waitForMerged(context.Background(), time.Minute, func() (mergeState, error) {
+		return mergeState{Closed: true}, nil
+	})
+	assert.True(t, errors.Is(err, errNotMerged))
+
+	_, err = waitForMerged(context.Background(), 5*time.Millisecond, func() (mergeState, error) {
+		return mergeState{}, nil
+	})
+	assert.True(t, errors.Is(err, errNotMerged))
+}
+
+// TestGitlabMergeUsesIID checks that merge calls the MR's project-scoped IID, not its global ID
+func TestGitlabMergeUsesIID(t *testing.T) {
+	t.Setenv("GITLAB_API_TOKEN", "test")
+	merged := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/merge_requests/") && !strings.Contains(r.URL.Path, "/merge_requests/7") {
+			t.Errorf("MR not called by its IID: %s %s", r.Method, r.URL.Path)
+		}
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/api/v4/projects/owner/name/merge_requests/7":
+			json.NewEncoder(w).Encode(gitlab.MergeRequest{ID: 1007, IID: 7, State: "opened", DetailedMergeStatus: "mergeable"})
+		case r.Method == http.MethodGet && r.URL.Path == "/api/v4/projects/owner/name/pipelines":
+			json.NewEncoder(w).Encode([]gitlab.PipelineInfo{})
+		case r.Method == http.MethodGet && r.URL.Path == "/api/v4/projects/owner/name/merge_requests/7/approvals":
+			json.NewEncoder(w).Encode(gitlab.MergeRequestApprovals{})
+		case r.Method == http.MethodPut && r.URL.Path == "/api/v4/projects/owner/name/merge_requests/7/merge":
+			merged = true
+			json.NewEncoder(w).Encode(gitlab.MergeRequest{ID: 1007, IID: 7, State: "merged", SHA: "abc"})
+		default:
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	output, err := GitlabMerge(context.Background(), Input{
+		Repo:     lib.Repo{Owner: "owner", Name: "name", ProviderConfig: lib.ProviderConfig{Backend: "gitlab", BackendURL: server.URL}},
+		PRNumber: 7,
+	}, nil, nil)
+	assert.NoError(t, err)
+	assert.True(t, output.Success)
+	assert.True(t, merged)
+}
+
+// TestGitlabMergeDryRunDoesntRebase checks that a dry run of an MR that's behind its base doesn't
+// rebase it, since that force-pushes the branch
+func TestGitlabMergeDryRunDoesntRebase(t *testing.T) {
+	t.Setenv("GITLAB_API_TOKEN", "test")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/api/v4/projects/owner/name/merge_requests/7":
+			json.NewEncoder(w).Encode(gitlab.MergeRequest{IID: 7, State: "opened", DetailedMergeStatus: "mergeable", DivergedCommitsCount: 2})
+		case r.Method == http.MethodGet && r.URL.Path == "/api/v4/projects/owner/name/pipelines":
+			json.NewEncoder(w).Encode([]gitlab.PipelineInfo{})
+		case r.Method == http.MethodGet && r.URL.Path == "/api/v4/projects/owner/name/merge_requests/7/approvals":
+			json.NewEncoder(w).Encode(gitlab.MergeRequestApprovals{})
+		default:
+			t.Errorf("unexpected request in a dry run: %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	output, err := GitlabMerge(context.Background(), Input{
+		Repo:     lib.Repo{Owner: "owner", Name: "name", ProviderConfig: lib.ProviderConfig{Backend: "gitlab", BackendURL: server.URL}},
+		PRNumber: 7,
+		DryRun:   true,
+	}, nil, nil)
+	assert.NoError(t, err)
+	assert.False(t, output.Success)
+	assert.True(t, output.WouldMerge)
+}
+
+// TestGithubCheckResults checks that statuses and check runs are both read for the pushed commit,
+// and paged through
+func TestGithubCheckResults(t *testing.T) {
+	t.Setenv("GITHUB_API_TOKEN", "test")
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page := r.URL.Query().Get("page")
+		switch r.URL.Path {
+		case "/api/v3/repos/owner/name/commits/abc/status":
+			json.NewEncoder(w).Encode(github.CombinedStatus{Statuses: []*github.RepoStatus{{Context: github.String("ci"), State: github.String("success")}}})
+		case "/api/v3/repos/owner/name/commits/abc/check-runs":
+			if page == "" || page == "1" {
+				w.Header().Set("Link", fmt.Sprintf(`<%s/api/v3/repos/owner/name/commits/abc/check-runs?page=2>; rel="next"`, server.URL))
+				json.NewEncoder(w).Encode(github.ListCheckRunsResults{CheckRuns: []*github.CheckRun{{Name: github.String("lint"), Status: github.String("completed"), Conclusion: github.String("success")}}})
+				return
+			}
+			json.NewEncoder(w).Encode(github.ListCheckRunsResults{CheckRuns: []*github.CheckRun{{Name: github.String("test"), Status: github.String("in_progress")}}})
+		default:
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	p := lib.NewProviderFromConfig(lib.ProviderConfig{Backend: "github", BackendURL: server.URL})
+	client, err := p.GithubClient(context.Background())
+	assert.NoError(t, err)
+	results, err := githubCheckResults(context.Background(), client, Input{Repo: lib.Repo{Owner: "owner", Name: "name"}, CommitSHA: "abc"}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"ci": "success", "lint": "success", "test": "in_progress"}, results)
+}
@@ -0,0 +1,94 @@
+package merge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Clever/microplane/lib"
+	"github.com/google/go-github/v35/github"
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+// verifyPollInterval is how often to check a PR that's been asked to merge, with VerifyTimeout
+var verifyPollInterval = 10 * time.Second
+
+// errNotMerged is returned when a merge was requested, but the provider didn't go through with it
+var errNotMerged = errors.New("merge was requested, but the PR didn't merge")
+
+// mergeState is a PR's state as far as verifying a merge goes
+type mergeState struct {
+	Merged bool
+	// Closed is set if the PR was closed without merging
+	Closed bool
+	// SHA of the merge commit, once merged
+	SHA string
+	// Error is the provider's explanation of why the merge failed, if any
+	Error string
+}
+
+// waitForMerged polls a PR's state until it's merged, or it's clear it won't merge, or timeout
+// passes. It returns the SHA of the merge commit.
+func waitForMerged(ctx context.Context, timeout time.Duration, getState func() (mergeState, error)) (string, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		state, err := getState()
+		if err != nil {
+			return "", err
+		}
+		switch {
+		case state.Merged:
+			return state.SHA, nil
+		case state.Closed:
+			return "", fmt.Errorf("%w: it was closed", errNotMerged)
+		case state.Error != "":
+			return "", fmt.Errorf("%w: %s", errNotMerged, state.Error)
+		}
+		if !time.Now().Before(deadline) {
+			return "", fmt.Errorf("%w: still not merged after %s", errNotMerged, timeout)
+		}
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(verifyPollInterval):
+		}
+	}
+}
+
+// githubVerifyMerged waits for Github to confirm a PR merged
+func githubVerifyMerged(ctx context.Context, client *github.Client, input Input, repoLimiter *time.Ticker) (string, error) {
+	return waitForMerged(ctx, input.VerifyTimeout, func() (mergeState, error) {
+		lib.Wait(repoLimiter)
+		pr, _, err := client.PullRequests.Get(ctx, input.Repo.Owner, input.Repo.Name, input.PRNumber)
+		if err != nil {
+			return mergeState{}, err
+		}
+		return mergeState{
+			Merged: pr.GetMerged(),
+			Closed: pr.GetState() == "closed" && !pr.GetMerged(),
+			SHA:    pr.GetMergeCommitSHA(),
+		}, nil
+	})
+}
+
+// gitlabVerifyMerged waits for Gitlab to confirm an MR merged
+func gitlabVerifyMerged(ctx context.Context, client *gitlab.Client, pid string, input Input, repoLimiter *time.Ticker) (string, error) {
+	return waitForMerged(ctx, input.VerifyTimeout, func() (mergeState, error) {
+		lib.Wait(repoLimiter)
+		mr, _, err := client.MergeRequests.GetMergeRequest(pid, input.PRNumber, &gitlab.GetMergeRequestsOptions{}, gitlab.WithContext(ctx))
+		if err != nil {
+			return mergeState{}, err
+		}
+		sha := mr.MergeCommitSHA
+		if sha == "" {
+			sha = mr.SquashCommitSHA
+		}
+		return mergeState{
+			Merged: mr.State == "merged",
+			Closed: mr.State == "closed",
+			SHA:    sha,
+			Error:  mr.MergeError,
+		}, nil
+	})
+}
@@ -1,14 +1,30 @@
+// Package plan runs a change command against a copy of a cloned repo and commits the result.
 package plan
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
 	"os"
 	"os/exec"
 	"path"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Clever/microplane/lib"
 )
 
+// IgnoreFile is a file repo owners can add to opt their repo out of changes. Its contents, if
+// any, are shown as the reason.
+const IgnoreFile = ".microplaneignore"
+
 // Command represents a command to run.
 type Command struct {
 	Path string
@@ -26,14 +42,44 @@ type Input struct {
 	WorkDir string
 	// Command to run
 	Command Command
+	// Commands, if set, are run in order instead of Command, e.g. format, modify, then
+	// regenerate. Planning stops at the first that fails.
+	Commands []Command
+	// FormatCommand, if set, runs after the change commands and before their changes are
+	// committed, e.g. to fix line endings or formatting they left behind. If it fails, so does
+	// the plan.
+	FormatCommand *Command
 	// CommitMessage to send to `git commit -m`
 	CommitMessage string
 	// BranchName where the commit will be made
 	BranchName string
+	// BaseBranch is the branch to make the change on top of, which the PR will target.
+	// If empty, the repo's default branch is used.
+	BaseBranch string
 	// Whether to display the diff of changes made
 	Diff bool
 	// AllowEmptyCommit is whether to allow an empty commit
 	AllowEmptyCommit bool
+	// EmptyCommitMessage, if set, is the message of the empty commit made when Command makes no
+	// changes, instead of CommitMessage. It implies AllowEmptyCommit.
+	EmptyCommitMessage string
+	// PreserveCommits keeps the commits made by Command instead of expecting it to leave
+	// uncommitted changes behind. Any leftover changes are committed with CommitMessage.
+	PreserveCommits bool
+	// TitleFromCommit is which preserved commit, "first" or "latest", provides the
+	// commit message used for the PR title and body. Only used with PreserveCommits.
+	TitleFromCommit string
+	// SkipCIToken, if set, is added to the message of the branch's last commit, so the
+	// provider doesn't run CI for the push. See lib.Repo.SkipCIToken.
+	SkipCIToken string
+	// Retries is how many more times to run Command, on a fresh copy of the repo, if it fails
+	Retries int
+	// CampaignID, if set, is added to the message of the branch's last commit as a
+	// lib.CampaignTrailer, so push can tell if the change already made it to the base branch
+	CampaignID string
+	// Timeout, if set, limits how long planning the repo may take, including retries. Its
+	// commands are killed once it's up, and the plan fails with lib.ErrTimedOut.
+	Timeout time.Duration
 }
 
 // Output for Plan
@@ -44,11 +90,108 @@ type Output struct {
 	GitDiff       string
 	CommitMessage string
 	BranchName    string
+	// BaseBranch is the branch the change was made on top of. Empty means the default branch.
+	BaseBranch string `json:",omitempty"`
+	// Unchanged is set when re-planning produced the same result as the previous plan
+	Unchanged bool
+	// Ignored is set, instead of Success, when the repo opted out of changes, and IgnoreReason says why
+	Ignored      bool   `json:",omitempty"`
+	IgnoreReason string `json:",omitempty"`
+	// ScriptOutput is what the change command wrote to stdout, e.g. a summary of what it changed,
+	// cut off at scriptOutputLimit
+	ScriptOutput string `json:",omitempty"`
+	// MergeWave orders merges across repos: merge merges lower waves first. 0 means the repo
+	// wasn't given a wave, and merges in the last wave.
+	MergeWave int `json:",omitempty"`
+	// Metadata is what plan's --metadata-file attached to the repo, so later steps can use it too
+	Metadata map[string]string `json:",omitempty"`
+	// CommitAuthor is the author of the branch's last commit, as "Name <email>". The PR is opened
+	// by whoever the API token authenticates as, which may be someone else.
+	CommitAuthor string `json:",omitempty"`
+	// CampaignID is the campaign trailered onto the branch's last commit, see Input.CampaignID
+	CampaignID string `json:",omitempty"`
+}
+
+// BranchVars are the variables available to branch name templates
+type BranchVars struct {
+	Owner string
+	Name  string
+	// Date is the day of the run, as YYYY-MM-DD
+	Date string
+	// Metadata is whatever was attached to the repo, e.g. its team
+	Metadata map[string]string
+}
+
+// ParseBranchTemplate parses a branch name template
+func ParseBranchTemplate(text string) (*template.Template, error) {
+	return template.New("branch").Option("missingkey=error").Parse(text)
+}
+
+// RenderBranchName renders a branch name template for a repo. Whitespace in the result is
+// replaced with "-", and the result must be a valid branch name.
+func RenderBranchName(text string, vars BranchVars) (string, error) {
+	tmpl, err := ParseBranchTemplate(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, vars); err != nil {
+		return "", fmt.Errorf("failed to render branch name: %w", err)
+	}
+	branch := lib.SanitizeBranchName(buf.String())
+	if err := lib.ValidateBranchName(branch); err != nil {
+		return "", err
+	}
+	return branch, nil
+}
+
+// changeCommands are the change commands to run, in order
+func (input Input) changeCommands() []Command {
+	if len(input.Commands) > 0 {
+		return input.Commands
+	}
+	return []Command{input.Command}
+}
+
+// changeCommandError is returned when the user's change command fails, as opposed to git
+type changeCommandError struct {
+	error
 }
 
 // Plan creates a copy of the cloned repo and executes a command on it.
 // This allows the user to preview a change to the repo.
 func Plan(ctx context.Context, input Input) (Output, error) {
+	if err := lib.ValidateBranchName(input.BranchName); err != nil {
+		return Output{Success: false}, err
+	}
+	if input.BaseBranch != "" {
+		if err := lib.ValidateBranchName(input.BaseBranch); err != nil {
+			return Output{Success: false}, fmt.Errorf("base branch: %w", err)
+		}
+	}
+	repoCtx := ctx
+	if input.Timeout > 0 {
+		var cancel context.CancelFunc
+		repoCtx, cancel = context.WithTimeout(ctx, input.Timeout)
+		defer cancel()
+	}
+	output, err := planOnce(repoCtx, input)
+	for attempt := 1; attempt <= input.Retries; attempt++ {
+		var cmdErr changeCommandError
+		if !errors.As(err, &cmdErr) || repoCtx.Err() != nil {
+			break
+		}
+		log.Printf("%s - change command failed, retrying (%d/%d): %s", input.RepoName, attempt, input.Retries, err.Error())
+		output, err = planOnce(repoCtx, input)
+	}
+	if err != nil && ctx.Err() == nil && errors.Is(repoCtx.Err(), context.DeadlineExceeded) {
+		err = lib.WithKind(lib.ErrTimedOut, fmt.Errorf("timed out after %s: %w", input.Timeout, err))
+	}
+	return output, err
+}
+
+// planOnce makes a single attempt at planning, starting from a fresh copy of the cloned repo
+func planOnce(ctx context.Context, input Input) (Output, error) {
 	// create a copy of the cloned repo and run all commands there
 	// wipe out the directory in case Plan has been run previously
 	// but the change command has been edited and you want to run again
@@ -62,47 +205,286 @@ func Plan(ctx context.Context, input Input) (Output, error) {
 		return Output{Success: false}, errors.New(string(output))
 	}
 
-	// run the change command, git add, and git commit
+	// start from the base branch, rather than the default branch the repo was cloned on
+	if input.BaseBranch != "" {
+		if _, err := gitOutput(ctx, planDir, "checkout", "--detach", "origin/"+input.BaseBranch); err != nil {
+			return Output{Success: false}, fmt.Errorf("could not check out base branch '%s': %s", input.BaseBranch, err.Error())
+		}
+	}
+
+	if reason, ignored, err := ignoreReason(planDir); err != nil {
+		return Output{Success: false}, err
+	} else if ignored {
+		return Output{Success: false, Ignored: true, IgnoreReason: reason, BaseBranch: input.BaseBranch}, nil
+	}
+
+	// remember where we started, so we know which commits the change command made
+	baseSHA, err := gitOutput(ctx, planDir, "rev-parse", "HEAD")
+	if err != nil {
+		return Output{Success: false}, err
+	}
+
+	// run the change commands, git add, and git commit
+	changeCmds := input.changeCommands()
+	var stdouts []string
+	for i, cmd := range changeCmds {
+		stdout, err := run(ctx, planDir, input, cmd)
+		if err != nil {
+			if len(changeCmds) > 1 {
+				err = fmt.Errorf("change command %d of %d (%s) failed: %w", i+1, len(changeCmds), strings.Join(append([]string{cmd.Path}, cmd.Args...), " "), err)
+			}
+			return Output{Success: false}, changeCommandError{err}
+		}
+		if stdout = strings.TrimSpace(stdout); stdout != "" {
+			stdouts = append(stdouts, stdout)
+		}
+	}
+	scriptOutput := truncateScriptOutput(strings.Join(stdouts, "\n"), scriptOutputLimit)
+	if input.FormatCommand != nil {
+		if _, err := run(ctx, planDir, input, *input.FormatCommand); err != nil {
+			return Output{Success: false}, fmt.Errorf("format command (%s) failed: %w", strings.Join(append([]string{input.FormatCommand.Path}, input.FormatCommand.Args...), " "), err)
+		}
+	}
 	cmds := []Command{
-		input.Command,
 		{Path: "git", Args: []string{"checkout", "-b", input.BranchName}},
 		{Path: "git", Args: []string{"add", "-A"}},
 	}
-	if input.AllowEmptyCommit {
-		cmds = append(cmds, Command{Path: "git", Args: []string{"commit", "--allow-empty", "-m", input.CommitMessage}})
+	for _, cmd := range cmds {
+		if _, err := run(ctx, planDir, input, cmd); err != nil {
+			return Output{Success: false}, err
+		}
+	}
+
+	commitMessage := input.CommitMessage
+	if !input.PreserveCommits {
+		if commitMessage, err = commitChanges(ctx, planDir, input); err != nil {
+			return Output{Success: false}, err
+		}
 	} else {
-		cmds = append(cmds, Command{Path: "git", Args: []string{"commit", "-m", input.CommitMessage}})
+		commitMessage, err = commitLeftovers(ctx, planDir, input, baseSHA)
+		if err != nil {
+			return Output{Success: false}, err
+		}
 	}
-	for _, cmd := range cmds {
-		execCmd := exec.CommandContext(ctx, cmd.Path, cmd.Args...)
-		execCmd.Dir = planDir
-		// Set MICROPLANE_<X> convenience env vars, for use in user's script
-		execCmd.Env = append(os.Environ(), fmt.Sprintf("MICROPLANE_REPO=%s", input.RepoName))
-		if output, err := execCmd.CombinedOutput(); err != nil {
-			var exerr *exec.ExitError
-			if errors.As(err, &exerr) {
-				return Output{Success: false}, fmt.Errorf("[%s] %s", exerr, output)
-			} else {
-				return Output{Success: false}, err
-			}
+
+	if input.SkipCIToken != "" {
+		if err := addSkipCIToken(ctx, planDir, input.SkipCIToken); err != nil {
+			return Output{Success: false}, fmt.Errorf("could not add %s to the commit message: %s", input.SkipCIToken, err.Error())
+		}
+	}
+
+	// the trailer goes last, after any skip CI token, so git still reads it as a trailer
+	if input.CampaignID != "" {
+		if err := addCampaignTrailer(ctx, planDir, input.CampaignID); err != nil {
+			return Output{Success: false}, fmt.Errorf("could not add the %s trailer to the commit message: %s", lib.CampaignTrailer, err.Error())
 		}
 	}
 
 	// add the git diff to output, might be useful / convenient?
-	var gitDiff string
-	gitDiffCmd := exec.CommandContext(ctx, "git", "diff", "HEAD^", "HEAD")
-	gitDiffCmd.Dir = planDir
-	output, err := gitDiffCmd.CombinedOutput()
+	gitDiff, err := gitOutput(ctx, planDir, "diff", baseSHA, "HEAD")
 	if err != nil {
-		return Output{Success: false}, errors.New(string(output))
+		return Output{Success: false}, err
+	}
+
+	commitAuthor, err := gitOutput(ctx, planDir, "log", "-1", "--format=%an <%ae>")
+	if err != nil {
+		return Output{Success: false}, err
 	}
-	gitDiff = string(output)
 
 	return Output{
 		Success:       true,
 		PlanDir:       planDir,
 		GitDiff:       gitDiff,
 		BranchName:    input.BranchName,
-		CommitMessage: input.CommitMessage,
+		BaseBranch:    input.BaseBranch,
+		CommitMessage: commitMessage,
+		ScriptOutput:  scriptOutput,
+		CommitAuthor:  commitAuthor,
+		CampaignID:    input.CampaignID,
 	}, nil
 }
+
+// addSkipCIToken amends the last commit's message to include a skip CI token, unless it already does.
+// Providers only look at the last commit pushed.
+func addSkipCIToken(ctx context.Context, planDir string, token string) error {
+	message, err := gitOutput(ctx, planDir, "log", "-1", "--pretty=format:%B")
+	if err != nil {
+		return err
+	}
+	if withToken := withSkipCIToken(message, token); withToken != message {
+		_, err = gitOutput(ctx, planDir, "commit", "--amend", "--allow-empty", "-m", withToken)
+	}
+	return err
+}
+
+// withSkipCIToken adds a skip CI token to the end of a commit message, unless it's already there
+func withSkipCIToken(message string, token string) string {
+	if strings.Contains(message, token) {
+		return message
+	}
+	return strings.TrimRight(message, "\n") + "\n\n" + token
+}
+
+// addCampaignTrailer amends the last commit's message to end with the campaign's trailer, unless
+// it already does
+func addCampaignTrailer(ctx context.Context, planDir string, id string) error {
+	message, err := gitOutput(ctx, planDir, "log", "-1", "--pretty=format:%B")
+	if err != nil {
+		return err
+	}
+	if withTrailer := withCampaignTrailer(message, id); withTrailer != message {
+		_, err = gitOutput(ctx, planDir, "commit", "--amend", "--allow-empty", "-m", withTrailer)
+	}
+	return err
+}
+
+// trailerLine matches a line of a commit message's trailers, e.g. "Signed-off-by: ..."
+var trailerLine = regexp.MustCompile(`^[A-Za-z0-9-]+: `)
+
+// withCampaignTrailer adds the campaign's trailer to the end of a commit message. It joins the
+// message's trailers if it ends with some, e.g. Signed-off-by, or else starts a paragraph of its own.
+func withCampaignTrailer(message string, id string) string {
+	line := lib.CampaignTrailerLine(id)
+	message = strings.TrimRight(message, "\n")
+	paragraphs := strings.Split(message, "\n\n")
+	last := strings.Split(paragraphs[len(paragraphs)-1], "\n")
+	for _, l := range last {
+		if l == line {
+			return message
+		}
+	}
+	if len(paragraphs) == 1 {
+		// the message is just a title
+		return message + "\n\n" + line
+	}
+	for _, l := range last {
+		if !trailerLine.MatchString(l) {
+			return message + "\n\n" + line
+		}
+	}
+	return message + "\n" + line
+}
+
+// ignoreReason checks the repo for an IgnoreFile, on the branch being changed
+func ignoreReason(planDir string) (string, bool, error) {
+	content, err := ioutil.ReadFile(path.Join(planDir, IgnoreFile))
+	if os.IsNotExist(err) {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	reason := strings.TrimSpace(string(content))
+	if reason == "" {
+		reason = fmt.Sprintf("repo has a %s file", IgnoreFile)
+	}
+	return reason, true, nil
+}
+
+// run runs a command in the plan directory, returning what it wrote to stdout
+func run(ctx context.Context, planDir string, input Input, cmd Command) (string, error) {
+	execCmd := exec.CommandContext(ctx, cmd.Path, cmd.Args...)
+	execCmd.Dir = planDir
+	// Set MICROPLANE_<X> convenience env vars, for use in user's script
+	execCmd.Env = append(os.Environ(), fmt.Sprintf("MICROPLANE_REPO=%s", input.RepoName))
+	var stdout, combined bytes.Buffer
+	execCmd.Stdout = io.MultiWriter(&stdout, &combined)
+	execCmd.Stderr = &combined
+	if err := execCmd.Run(); err != nil {
+		var exerr *exec.ExitError
+		if errors.As(err, &exerr) {
+			return "", fmt.Errorf("[%s] %s", exerr, combined.String())
+		}
+		return "", err
+	}
+	return stdout.String(), nil
+}
+
+// scriptOutputLimit is the most of the change command's output kept in the plan, so a chatty
+// script doesn't bloat plan.json or the PRs it's added to
+const scriptOutputLimit = 16 * 1024
+
+// truncateScriptOutput trims a script's output, and cuts it off at limit bytes with a note
+func truncateScriptOutput(output string, limit int) string {
+	output = strings.TrimSpace(output)
+	if len(output) <= limit {
+		return output
+	}
+	// don't cut a multi-byte character in half
+	for limit > 0 && !utf8.RuneStart(output[limit]) {
+		limit--
+	}
+	return fmt.Sprintf("%s\n... (truncated, %d more bytes)", output[:limit], len(output)-limit)
+}
+
+// gitOutput runs a git command in dir and returns its trimmed output
+func gitOutput(ctx context.Context, dir string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", errors.New(string(output))
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// commitChanges commits the staged changes with CommitMessage, returning the message used. If
+// nothing is staged, it's an error unless the commit is allowed to be empty, in which case it's
+// made with EmptyCommitMessage, if given.
+func commitChanges(ctx context.Context, planDir string, input Input) (string, error) {
+	staged, err := gitOutput(ctx, planDir, "diff", "--cached", "--name-only")
+	if err != nil {
+		return "", err
+	}
+	message := input.CommitMessage
+	args := []string{"commit", "-m", message}
+	if staged == "" && input.EmptyCommitMessage != "" {
+		message = input.EmptyCommitMessage
+		args = []string{"commit", "--allow-empty", "-m", message}
+	} else if input.AllowEmptyCommit {
+		args = []string{"commit", "--allow-empty", "-m", message}
+	}
+	if _, err := run(ctx, planDir, input, Command{Path: "git", Args: args}); err != nil {
+		return "", err
+	}
+	return message, nil
+}
+
+// commitLeftovers commits whatever the change command didn't commit itself, keeping the
+// commits it did make. It returns the commit message to use for the PR title and body.
+func commitLeftovers(ctx context.Context, planDir string, input Input, baseSHA string) (string, error) {
+	status, err := gitOutput(ctx, planDir, "status", "--porcelain")
+	if err != nil {
+		return "", err
+	}
+	commits, err := gitOutput(ctx, planDir, "rev-list", "--reverse", baseSHA+"..HEAD")
+	if err != nil {
+		return "", err
+	}
+
+	if status != "" || (commits == "" && (input.AllowEmptyCommit || input.EmptyCommitMessage != "")) {
+		message := input.CommitMessage
+		if status == "" && input.EmptyCommitMessage != "" {
+			message = input.EmptyCommitMessage
+		}
+		if message == "" {
+			return "", errors.New("change command left uncommitted changes, but no commit message was given")
+		}
+		commit := Command{Path: "git", Args: []string{"commit", "--allow-empty", "-m", message}}
+		if _, err := run(ctx, planDir, input, commit); err != nil {
+			return "", err
+		}
+		if commits, err = gitOutput(ctx, planDir, "rev-list", "--reverse", baseSHA+"..HEAD"); err != nil {
+			return "", err
+		}
+	}
+	if commits == "" {
+		return "", lib.WithKind(lib.ErrNoChanges, errors.New("change command made no changes"))
+	}
+
+	shas := strings.Split(commits, "\n")
+	sha := shas[len(shas)-1]
+	if input.TitleFromCommit == "first" {
+		sha = shas[0]
+	}
+	return gitOutput(ctx, planDir, "log", "-1", "--pretty=format:%B", sha)
+}
@@ -0,0 +1,200 @@
+package plan
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Clever/microplane/lib"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderBranchName(t *testing.T) {
+	vars := BranchVars{Owner: "clever", Name: "app", Date: "2020-01-02", Metadata: map[string]string{"team": "infra"}}
+
+	branch, err := RenderBranchName("codemod/{{.Metadata.team}}/{{.Date}}", vars)
+	assert.NoError(t, err)
+	assert.Equal(t, "codemod/infra/2020-01-02", branch)
+
+	branch, err = RenderBranchName("bump {{.Name}}", vars)
+	assert.NoError(t, err)
+	assert.Equal(t, "bump-app", branch)
+
+	_, err = RenderBranchName("codemod/{{.Metadata.owner}}", vars)
+	assert.Error(t, err, "missing metadata")
+
+	_, err = RenderBranchName("codemod/{{.Metadata.team}}", BranchVars{Name: "app"})
+	assert.Error(t, err, "no metadata")
+
+	_, err = RenderBranchName("codemod/{{.Name}}..x", vars)
+	assert.Error(t, err, "invalid branch")
+}
+
+func TestIgnoreReason(t *testing.T) {
+	dir := t.TempDir()
+	_, ignored, err := ignoreReason(dir)
+	assert.NoError(t, err)
+	assert.False(t, ignored)
+
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, IgnoreFile), nil, 0644))
+	reason, ignored, err := ignoreReason(dir)
+	assert.NoError(t, err)
+	assert.True(t, ignored)
+	assert.Equal(t, "repo has a .microplaneignore file", reason)
+
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, IgnoreFile), []byte("frozen for the 2.0 release\n"), 0644))
+	reason, _, err = ignoreReason(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, "frozen for the 2.0 release", reason)
+}
+
+func TestWithSkipCIToken(t *testing.T) {
+	assert.Equal(t, "Bump deps\n\n[skip ci]", withSkipCIToken("Bump deps\n", "[skip ci]"))
+	assert.Equal(t, "Bump deps\n\nBecause\n\n[skip ci]", withSkipCIToken("Bump deps\n\nBecause", "[skip ci]"))
+	assert.Equal(t, "[skip ci] Bump deps", withSkipCIToken("[skip ci] Bump deps", "[skip ci]"))
+}
+
+func TestTruncateScriptOutput(t *testing.T) {
+	assert.Equal(t, "changed 2 files", truncateScriptOutput("changed 2 files\n", 100))
+	assert.Equal(t, "abcd\n... (truncated, 6 more bytes)", truncateScriptOutput("abcdefghij", 4))
+	assert.Equal(t, "ab\n... (truncated, 2 more bytes)", truncateScriptOutput("abé", 3))
+}
+
+func TestCommitChangesEmpty(t *testing.T) {
+	for _, env := range []string{"GIT_AUTHOR_NAME", "GIT_AUTHOR_EMAIL", "GIT_COMMITTER_NAME", "GIT_COMMITTER_EMAIL"} {
+		t.Setenv(env, "microplane@example.com")
+	}
+	ctx := context.Background()
+	dir := t.TempDir()
+	_, err := gitOutput(ctx, dir, "init", "--quiet")
+	assert.NoError(t, err)
+
+	// nothing staged is an error by default
+	_, err = commitChanges(ctx, dir, Input{CommitMessage: "Change"})
+	assert.Error(t, err)
+
+	message, err := commitChanges(ctx, dir, Input{CommitMessage: "Change", EmptyCommitMessage: "Open for review"})
+	assert.NoError(t, err)
+	assert.Equal(t, "Open for review", message)
+	logged, err := gitOutput(ctx, dir, "log", "-1", "--pretty=format:%s")
+	assert.NoError(t, err)
+	assert.Equal(t, "Open for review", logged)
+
+	// staged changes use the regular message
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "file"), []byte("changed"), 0644))
+	_, err = gitOutput(ctx, dir, "add", "-A")
+	assert.NoError(t, err)
+	message, err = commitChanges(ctx, dir, Input{CommitMessage: "Change", EmptyCommitMessage: "Open for review"})
+	assert.NoError(t, err)
+	assert.Equal(t, "Change", message)
+}
+
+func TestPlanRunsCommandsInOrder(t *testing.T) {
+	for _, env := range []string{"GIT_AUTHOR_NAME", "GIT_AUTHOR_EMAIL", "GIT_COMMITTER_NAME", "GIT_COMMITTER_EMAIL"} {
+		t.Setenv(env, "microplane@example.com")
+	}
+	ctx := context.Background()
+	repoDir := t.TempDir()
+	_, err := gitOutput(ctx, repoDir, "init", "--quiet")
+	assert.NoError(t, err)
+	_, err = gitOutput(ctx, repoDir, "commit", "--quiet", "--allow-empty", "-m", "Initial")
+	assert.NoError(t, err)
+
+	sh := func(script string) Command { return Command{Path: "sh", Args: []string{"-c", script}} }
+	input := Input{
+		RepoName:      "app",
+		RepoDir:       repoDir,
+		WorkDir:       t.TempDir(),
+		CommitMessage: "Change",
+		BranchName:    "mp-change",
+		Commands:      []Command{sh("echo one > file && echo formatted"), sh("echo two >> file && echo modified")},
+	}
+	output, err := Plan(ctx, input)
+	assert.NoError(t, err)
+	assert.Equal(t, "formatted\nmodified", output.ScriptOutput)
+	contents, err := ioutil.ReadFile(filepath.Join(output.PlanDir, "file"))
+	assert.NoError(t, err)
+	assert.Equal(t, "one\ntwo\n", string(contents))
+
+	// later commands don't run after one fails
+	input.Commands = []Command{sh("exit 3"), sh("touch ran")}
+	_, err = Plan(ctx, input)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "change command 1 of 2 (sh -c exit 3) failed")
+	_, statErr := ioutil.ReadFile(filepath.Join(input.WorkDir, "planned", "ran"))
+	assert.Error(t, statErr)
+}
+
+func TestPlanRunsFormatCommand(t *testing.T) {
+	for _, env := range []string{"GIT_AUTHOR_NAME", "GIT_AUTHOR_EMAIL", "GIT_COMMITTER_NAME", "GIT_COMMITTER_EMAIL"} {
+		t.Setenv(env, "microplane@example.com")
+	}
+	ctx := context.Background()
+	repoDir := t.TempDir()
+	_, err := gitOutput(ctx, repoDir, "init", "--quiet")
+	assert.NoError(t, err)
+	_, err = gitOutput(ctx, repoDir, "commit", "--quiet", "--allow-empty", "-m", "Initial")
+	assert.NoError(t, err)
+
+	input := Input{
+		RepoName:      "app",
+		RepoDir:       repoDir,
+		WorkDir:       t.TempDir(),
+		CommitMessage: "Change",
+		BranchName:    "mp-change",
+		Command:       Command{Path: "sh", Args: []string{"-c", "printf 'a\\r\\n' > file"}},
+		FormatCommand: &Command{Path: "sh", Args: []string{"-c", "tr -d '\\r' < file > tmp && mv tmp file"}},
+	}
+	output, err := Plan(ctx, input)
+	assert.NoError(t, err)
+	// the formatted file is what's committed
+	committed, err := gitOutput(ctx, output.PlanDir, "show", "HEAD:file")
+	assert.NoError(t, err)
+	assert.Equal(t, "a", committed)
+	status, err := gitOutput(ctx, output.PlanDir, "status", "--porcelain")
+	assert.NoError(t, err)
+	assert.Empty(t, status)
+
+	input.FormatCommand = &Command{Path: "sh", Args: []string{"-c", "exit 1"}}
+	_, err = Plan(ctx, input)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "format command (sh -c exit 1) failed")
+}
+
+func TestPlanTimeout(t *testing.T) {
+	for _, env := range []string{"GIT_AUTHOR_NAME", "GIT_AUTHOR_EMAIL", "GIT_COMMITTER_NAME", "GIT_COMMITTER_EMAIL"} {
+		t.Setenv(env, "microplane@example.com")
+	}
+	ctx := context.Background()
+	repoDir := t.TempDir()
+	_, err := gitOutput(ctx, repoDir, "init", "--quiet")
+	assert.NoError(t, err)
+	_, err = gitOutput(ctx, repoDir, "commit", "--quiet", "--allow-empty", "-m", "Initial")
+	assert.NoError(t, err)
+
+	start := time.Now()
+	_, err = Plan(ctx, Input{
+		RepoName:      "app",
+		RepoDir:       repoDir,
+		WorkDir:       t.TempDir(),
+		CommitMessage: "Change",
+		BranchName:    "mp-change",
+		Command:       Command{Path: "sleep", Args: []string{"10"}},
+		Retries:       2,
+		Timeout:       100 * time.Millisecond,
+	})
+	assert.True(t, errors.Is(err, lib.ErrTimedOut))
+	assert.Contains(t, err.Error(), "timed out after 100ms")
+	assert.Less(t, int64(time.Since(start)), int64(5*time.Second))
+}
+
+func TestWithCampaignTrailer(t *testing.T) {
+	assert.Equal(t, "Bump deps\n\nMicroplane-Campaign: go1.17", withCampaignTrailer("Bump deps\n", "go1.17"))
+	assert.Equal(t, "Bump deps\n\nBecause\n\nMicroplane-Campaign: go1.17", withCampaignTrailer("Bump deps\n\nBecause", "go1.17"))
+	assert.Equal(t, "Bump deps\n\nSigned-off-by: A <a@example.com>\nMicroplane-Campaign: go1.17", withCampaignTrailer("Bump deps\n\nSigned-off-by: A <a@example.com>", "go1.17"))
+	assert.Equal(t, "Bump deps\n\n[skip ci]\n\nMicroplane-Campaign: go1.17", withCampaignTrailer("Bump deps\n\n[skip ci]", "go1.17"))
+	assert.Equal(t, "Bump deps\n\nMicroplane-Campaign: go1.17", withCampaignTrailer("Bump deps\n\nMicroplane-Campaign: go1.17", "go1.17"))
+}
@@ -0,0 +1,84 @@
+package push
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/Clever/microplane/lib"
+	"github.com/google/go-github/v35/github"
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+// AssigneeVars are the variables available to PRAssignee templates
+type AssigneeVars struct {
+	Owner  string
+	Name   string
+	Branch string
+	// Metadata is whatever was attached to the repo, e.g. the team that owns it
+	Metadata map[string]string
+}
+
+// ParseAssigneeTemplate parses a PRAssignee template
+func ParseAssigneeTemplate(text string) (*template.Template, error) {
+	return template.New("assignee").Option("missingkey=error").Parse(text)
+}
+
+// RenderAssignee renders a PRAssignee template for a repo, e.g. '{{.Metadata.owner}}', into a username
+func RenderAssignee(text string, vars AssigneeVars) (string, error) {
+	tmpl, err := ParseAssigneeTemplate(text)
+	if err != nil {
+		return "", err
+	}
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, vars); err != nil {
+		return "", err
+	}
+	assignee := strings.TrimPrefix(strings.TrimSpace(b.String()), "@")
+	if assignee == "" {
+		return "", errors.New("assignee is empty")
+	}
+	return assignee, nil
+}
+
+// checkedAssignees are the assignees found to exist, by host and username, so that each is only
+// looked up once per run
+var checkedAssignees sync.Map
+
+// githubCheckAssignee checks that the PR's assignee is a Github user. Github silently ignores
+// assigning someone who doesn't exist.
+func githubCheckAssignee(ctx context.Context, client *github.Client, input Input, repoLimiter *time.Ticker) error {
+	key := fmt.Sprintf("%s %s", input.Repo.Host(), input.PRAssignee)
+	if _, ok := checkedAssignees.Load(key); ok || input.PRAssignee == "" {
+		return nil
+	}
+	lib.Wait(repoLimiter)
+	_, _, err := client.Users.Get(ctx, input.PRAssignee)
+	var errResp *github.ErrorResponse
+	if errors.As(err, &errResp) && errResp.Response.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("github user '%s' not found, so the PR can't be assigned to them", input.PRAssignee)
+	} else if err != nil {
+		return err
+	}
+	checkedAssignees.Store(key, true)
+	return nil
+}
+
+// gitlabCheckAssignee checks that the MR's assignee is a Gitlab user
+func gitlabCheckAssignee(ctx context.Context, client *gitlab.Client, input Input, repoLimiter *time.Ticker) error {
+	key := fmt.Sprintf("%s %s", input.Repo.Host(), input.PRAssignee)
+	if _, ok := checkedAssignees.Load(key); ok || input.PRAssignee == "" {
+		return nil
+	}
+	if _, err := GitlabUserIDs(ctx, client, []string{input.PRAssignee}, repoLimiter); err != nil {
+		return err
+	}
+	checkedAssignees.Store(key, true)
+	return nil
+}
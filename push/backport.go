@@ -0,0 +1,102 @@
+package push
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Clever/microplane/lib"
+)
+
+// Backport opens the same change as input against another base branch, e.g. a maintenance
+// branch. The planned commits are cherry-picked onto the base, and pushed to their own branch
+// (see BackportBranchName), so each base gets its own PR.
+// - repoLimiter rate limits the # of calls to the provider
+// - pushLimiter rate limits the # of PRs opened
+// A nil limiter means no rate limiting.
+func Backport(ctx context.Context, input Input, base string, repoLimiter *time.Ticker, pushLimiter *time.Ticker) (Output, error) {
+	if err := lib.ValidateBranchName(base); err != nil {
+		return Output{Success: false}, fmt.Errorf("base branch: %w", err)
+	}
+	sha, err := cherryPickOnto(ctx, input, base)
+	if err != nil {
+		return Output{Success: false}, err
+	}
+
+	backport := input
+	backport.BaseBranch = base
+	backport.BranchName = BackportBranchName(input.BranchName, base)
+	backport.SourceRef = sha
+	backport.CommitMessage = backportCommitMessage(input.CommitMessage, base)
+	// the cherry-picked commit is already on the latest base
+	backport.Rebase = false
+	// the tag is on the main base's commit
+	backport.Tag = ""
+	return Push(ctx, backport, repoLimiter, pushLimiter)
+}
+
+// BackportBranchName is the branch a change is pushed to for a backport to base
+func BackportBranchName(branch string, base string) string {
+	return fmt.Sprintf("%s-%s", branch, strings.ReplaceAll(base, "/", "-"))
+}
+
+// backportCommitMessage marks the PR title as a backport, so it can be told apart from the
+// PR against the main base
+func backportCommitMessage(message string, base string) string {
+	lines := strings.SplitN(message, "\n", 2)
+	lines[0] = fmt.Sprintf("%s (%s)", lines[0], base)
+	return strings.Join(lines, "\n")
+}
+
+// cherryPickOnto cherry-picks the planned commits onto the latest base, in a separate worktree
+// so the plan dir is left as it is, and returns the resulting commit
+func cherryPickOnto(ctx context.Context, input Input, base string) (string, error) {
+	sha, err := resolveSourceRef(ctx, input)
+	if err != nil {
+		return "", err
+	}
+	if _, err := gitOutput(ctx, input.PlanDir, "fetch", "origin", fmt.Sprintf("+refs/heads/%s:refs/remotes/origin/%s", base, base)); err != nil {
+		return "", fmt.Errorf("could not fetch base branch '%s': %s", base, err.Error())
+	}
+	mergeBase, err := gitOutput(ctx, input.PlanDir, "merge-base", input.baseRef(), sha)
+	if err != nil {
+		return "", err
+	}
+
+	worktree := filepath.Join(input.WorkDir, "backport-"+strings.ReplaceAll(base, "/", "-"))
+	if err := os.RemoveAll(worktree); err != nil {
+		return "", err
+	}
+	if _, err := gitOutput(ctx, input.PlanDir, "worktree", "add", "--detach", worktree, "origin/"+base); err != nil {
+		return "", err
+	}
+	defer func() {
+		gitOutput(context.Background(), input.PlanDir, "worktree", "remove", "--force", worktree)
+	}()
+
+	if _, err := gitOutput(ctx, worktree, "cherry-pick", fmt.Sprintf("%s..%s", mergeBase, sha)); err != nil {
+		conflicts, _ := gitOutput(ctx, worktree, "diff", "--name-only", "--diff-filter=U")
+		gitOutput(ctx, worktree, "cherry-pick", "--abort")
+		if conflicts != "" {
+			return "", lib.WithKind(lib.ErrConflict, fmt.Errorf("change doesn't apply cleanly to '%s', conflicts in: %s", base, strings.Join(strings.Fields(conflicts), ", ")))
+		}
+		return "", fmt.Errorf("could not cherry-pick the change onto '%s': %s", base, err.Error())
+	}
+	return gitOutput(ctx, worktree, "rev-parse", "HEAD")
+}
+
+// gitOutput runs a git command in dir, returning its trimmed output
+func gitOutput(ctx context.Context, dir string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", errors.New(strings.TrimSpace(string(output)))
+	}
+	return strings.TrimSpace(string(output)), nil
+}
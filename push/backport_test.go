@@ -0,0 +1,17 @@
+package push
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackportBranchName(t *testing.T) {
+	assert.Equal(t, "mp-fix-release-1.2", BackportBranchName("mp-fix", "release/1.2"))
+	assert.Equal(t, "mp-fix-main", BackportBranchName("mp-fix", "main"))
+}
+
+func TestBackportCommitMessage(t *testing.T) {
+	assert.Equal(t, "Fix thing (release/1.2)\n\ndetails", backportCommitMessage("Fix thing\n\ndetails", "release/1.2"))
+	assert.Equal(t, "Fix thing (main)", backportCommitMessage("Fix thing", "main"))
+}
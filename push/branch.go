@@ -0,0 +1,108 @@
+package push
+
+import (
+	"context"
+	"time"
+)
+
+// pushedBranch is the result of pushPlannedBranch
+type pushedBranch struct {
+	// SHA is the commit the branch was pushed to, which the PR must end up on
+	SHA string
+	// Unchanged is set if the push was skipped because the remote branch already had the same
+	// changes, see Input.SkipUnchanged. PushedAt is nil then.
+	Unchanged bool
+	PushedAt  *time.Time
+	// Tag is the tag pushed with the branch, if any, and TagSkipped is set if it was left alone
+	Tag        string
+	TagSkipped bool
+	// Done, if set, is the output to return without opening a PR, e.g. because the base branch
+	// already has the change
+	Done *Output
+}
+
+// pushPlannedBranch checks the planned commit and pushes it to the branch, with any extra git
+// push options, and then pushes the tag. These steps are the same whatever the provider, which
+// only opens or updates the PR afterwards.
+func pushPlannedBranch(ctx context.Context, input Input, options []string) (pushedBranch, error) {
+	// Make sure nothing besides the planned commit is lying around
+	if !input.AllowDirty {
+		if err := checkClean(ctx, input); err != nil {
+			return pushedBranch{}, err
+		}
+	}
+
+	// Don't re-open a PR for a change that's already merged, e.g. if its PR was merged outside
+	// of microplane and its branch deleted
+	if inBase, err := changeInBase(ctx, input); err != nil {
+		return pushedBranch{}, err
+	} else if inBase {
+		sha, err := resolveSourceRef(ctx, input)
+		if err != nil {
+			return pushedBranch{}, err
+		}
+		return pushedBranch{Done: &Output{Success: true, CommitSHA: sha, BranchName: input.BranchName, AlreadyInBase: true}}, nil
+	}
+
+	// Bring the branch up to date with the base branch
+	if input.Rebase {
+		if err := rebaseOntoBase(ctx, input); err != nil {
+			return pushedBranch{}, err
+		}
+	}
+
+	// Make sure the change only touches the files it's allowed to
+	if len(input.ChangedFilesAllow) > 0 {
+		if err := checkChangedFilesAllowed(ctx, input); err != nil {
+			return pushedBranch{}, err
+		}
+	}
+	if input.MaxChangedFiles > 0 {
+		if err := checkChangedFileCount(ctx, input); err != nil {
+			return pushedBranch{}, err
+		}
+	}
+
+	// Resolve the commit to push, to check that the PR ends up on it
+	sha, err := resolveSourceRef(ctx, input)
+	if err != nil {
+		return pushedBranch{}, err
+	}
+
+	// Leave the branch alone if it's already on the remote, or stop, if asked to
+	if existing, err := existingBranch(ctx, input, sha); err != nil {
+		return pushedBranch{}, err
+	} else if existing != "" {
+		return pushedBranch{Done: &Output{Success: true, CommitSHA: existing, BranchName: input.BranchName, SkippedExistingBranch: true}}, nil
+	}
+
+	// Push the commit, unless the remote branch already has the same changes. Then the branch,
+	// and so the PR and tag, stay on the remote's commit, since the planned one isn't pushed
+	pushed := pushedBranch{}
+	if input.SkipUnchanged {
+		remote, err := remoteBranchUnchanged(ctx, input, sha)
+		if err != nil {
+			return pushedBranch{}, err
+		}
+		if remote != "" {
+			sha = remote
+			pushed.Unchanged = true
+		}
+	}
+	if !pushed.Unchanged {
+		if sha, err = pushBranch(ctx, input, sha, options); err != nil {
+			return pushedBranch{}, err
+		}
+		now := time.Now()
+		pushed.PushedAt = &now
+	}
+	pushed.SHA = sha
+
+	// Tag the pushed commit
+	if input.Tag != "" {
+		if pushed.Tag, pushed.TagSkipped, err = pushTag(ctx, input, sha); err != nil {
+			return pushedBranch{}, err
+		}
+	}
+	return pushed, nil
+}
@@ -0,0 +1,130 @@
+package push
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// codeownersPaths are where Github and Gitlab look for a CODEOWNERS file, in order
+var codeownersPaths = []string{"CODEOWNERS", ".github/CODEOWNERS", ".gitlab/CODEOWNERS", "docs/CODEOWNERS"}
+
+// codeownersRule is a line of a CODEOWNERS file: a path pattern, and who owns matching paths
+type codeownersRule struct {
+	pattern *regexp.Regexp
+	owners  []string
+}
+
+// parseCodeowners parses a CODEOWNERS file. Lines it doesn't understand, e.g. Gitlab's
+// [Section] headers, are ignored.
+func parseCodeowners(content string) []codeownersRule {
+	rules := []codeownersRule{}
+	for _, line := range strings.Split(content, "\n") {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "[") || strings.HasPrefix(fields[0], "^[") {
+			continue
+		}
+		rules = append(rules, codeownersRule{pattern: codeownersPattern(fields[0]), owners: fields[1:]})
+	}
+	return rules
+}
+
+// codeownersPattern converts a CODEOWNERS path pattern, which follows gitignore's rules, into a
+// regexp matching the paths it applies to
+func codeownersPattern(pattern string) *regexp.Regexp {
+	anchored := strings.HasPrefix(pattern, "/") || strings.Contains(strings.TrimSuffix(pattern, "/"), "/")
+	pattern = strings.Trim(pattern, "/")
+
+	var re strings.Builder
+	if anchored {
+		re.WriteString("^")
+	} else {
+		re.WriteString("^(.*/)?")
+	}
+	for i := 0; i < len(pattern); i++ {
+		switch {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			re.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			re.WriteString(".*")
+			i++
+		case pattern[i] == '*':
+			re.WriteString("[^/]*")
+		case pattern[i] == '?':
+			re.WriteString("[^/]")
+		default:
+			re.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	if strings.HasSuffix(pattern, "/*") {
+		// e.g. "docs/*" owns the files in docs, but not in its subdirectories
+		re.WriteString("$")
+	} else {
+		// a pattern matching a directory owns everything in it
+		re.WriteString("(/.*)?$")
+	}
+	return regexp.MustCompile(re.String())
+}
+
+// codeowners finds who owns each path. As with Github and Gitlab, the last matching rule wins.
+// Owners are returned as written, e.g. "@user", "@org/team", or an email address.
+func codeowners(rules []codeownersRule, paths []string) []string {
+	owners := []string{}
+	seen := map[string]bool{}
+	for _, path := range paths {
+		for i := len(rules) - 1; i >= 0; i-- {
+			if !rules[i].pattern.MatchString(path) {
+				continue
+			}
+			for _, owner := range rules[i].owners {
+				if !seen[owner] {
+					seen[owner] = true
+					owners = append(owners, owner)
+				}
+			}
+			break
+		}
+	}
+	return owners
+}
+
+// codeownersReviewers reads the planned repo's CODEOWNERS file, and finds the owners of the
+// files changed by the plan. It returns nothing, rather than an error, if there's no CODEOWNERS.
+func codeownersReviewers(ctx context.Context, input Input) (users []string, teams []string, err error) {
+	var content []byte
+	for _, p := range codeownersPaths {
+		content, err = ioutil.ReadFile(filepath.Join(input.PlanDir, p))
+		if err == nil {
+			break
+		} else if !os.IsNotExist(err) {
+			return nil, nil, err
+		}
+	}
+	if content == nil {
+		return nil, nil, nil
+	}
+
+	files, err := changedFiles(ctx, input)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, owner := range codeowners(parseCodeowners(string(content)), files) {
+		if !strings.HasPrefix(owner, "@") {
+			// an email address, which can't be requested as a reviewer directly
+			continue
+		}
+		if strings.Contains(owner, "/") {
+			teams = append(teams, owner[1:])
+		} else {
+			users = append(users, owner[1:])
+		}
+	}
+	return users, teams, nil
+}
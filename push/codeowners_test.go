@@ -0,0 +1,40 @@
+package push
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCodeowners(t *testing.T) {
+	rules := parseCodeowners(`# default owners
+*       @clever/everyone
+
+[Docs]
+/docs/*         @writer docs@clever.com
+*.go            @gopher
+/build/logs/    @clever/infra
+apps/           @appdev
+**/config.yml   @configurer
+`)
+
+	cases := map[string][]string{
+		"README.md":                {"@clever/everyone"},
+		"docs/intro.md":            {"@writer", "docs@clever.com"},
+		"docs/guides/intro.md":     {"@clever/everyone"},
+		"main.go":                  {"@gopher"},
+		"cmd/root.go":              {"@gopher"},
+		"build/logs/today.log":     {"@clever/infra"},
+		"src/build/logs/today.log": {"@clever/everyone"},
+		"apps/web/index.js":        {"@appdev"},
+		"src/apps/web/index.js":    {"@appdev"},
+		"deploy/prod/config.yml":   {"@configurer"},
+		"config.yml":               {"@configurer"},
+	}
+	for path, expected := range cases {
+		assert.Equal(t, expected, codeowners(rules, []string{path}), path)
+	}
+
+	assert.Equal(t, []string{"@gopher", "@clever/everyone"}, codeowners(rules, []string{"main.go", "README.md", "lib.go"}))
+	assert.Equal(t, []string{}, codeowners(parseCodeowners(""), []string{"main.go"}))
+}
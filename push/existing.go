@@ -0,0 +1,77 @@
+package push
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/Clever/microplane/lib"
+	"github.com/google/go-github/v35/github"
+	"github.com/xanzy/go-gitlab"
+)
+
+// What to do when the branch already exists on the remote, on a different commit, e.g. from
+// a previous run
+const (
+	BranchExistingOverwrite = "overwrite"
+	BranchExistingSkip      = "skip"
+	BranchExistingFail      = "fail"
+)
+
+// existingBranch applies ExistingBranch if the branch is already on the remote, on a commit other
+// than the one about to be pushed. It returns the remote branch's commit if the repo should be
+// left alone, or "" if pushing should go ahead.
+func existingBranch(ctx context.Context, input Input, sha string) (string, error) {
+	if input.ExistingBranch != BranchExistingSkip && input.ExistingBranch != BranchExistingFail {
+		return "", nil
+	}
+	// fully qualify the branch, since ls-remote would also match e.g. "other/<branch>"
+	remote, err := gitOutput(ctx, input.PlanDir, "ls-remote", "--heads", "origin", "refs/heads/"+input.BranchName)
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(remote)
+	if len(fields) == 0 || fields[0] == sha {
+		return "", nil
+	}
+	if input.ExistingBranch == BranchExistingSkip {
+		log.Printf("%s/%s - branch %s already exists on %s, skipping the repo", input.Repo.Owner, input.Repo.Name, input.BranchName, fields[0])
+		return fields[0], nil
+	}
+	return "", lib.WithKind(lib.ErrConflict, fmt.Errorf("branch %s already exists on commit %s. Use --on-existing-branch=overwrite to push anyway", input.BranchName, fields[0]))
+}
+
+// githubOpenPR finds the open PR from the branch, against BaseBranch if it's set. It returns nil
+// if there isn't one.
+func githubOpenPR(ctx context.Context, client *github.Client, input Input, repoLimiter *time.Ticker) (*github.PullRequest, error) {
+	lib.Wait(repoLimiter)
+	prs, _, err := client.PullRequests.List(ctx, input.Repo.Owner, input.Repo.Name, &github.PullRequestListOptions{
+		Head:  fmt.Sprintf("%s:%s", input.Repo.Owner, input.BranchName),
+		Base:  input.BaseBranch,
+		State: "open",
+	})
+	if err != nil || len(prs) == 0 {
+		return nil, err
+	}
+	return prs[0], nil
+}
+
+// gitlabOpenMR finds the open MR from the branch, against BaseBranch if it's set. It returns nil
+// if there isn't one.
+func gitlabOpenMR(ctx context.Context, client *gitlab.Client, input Input, repoLimiter *time.Ticker) (*gitlab.MergeRequest, error) {
+	opts := &gitlab.ListProjectMergeRequestsOptions{
+		SourceBranch: &input.BranchName,
+		State:        gitlab.String("opened"),
+	}
+	if input.BaseBranch != "" {
+		opts.TargetBranch = &input.BaseBranch
+	}
+	lib.Wait(repoLimiter)
+	mrs, _, err := client.MergeRequests.ListProjectMergeRequests(fmt.Sprintf("%s/%s", input.Repo.Owner, input.Repo.Name), opts, gitlab.WithContext(ctx))
+	if err != nil || len(mrs) == 0 {
+		return nil, err
+	}
+	return mrs[0], nil
+}
@@ -0,0 +1,98 @@
+package push
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+
+	"github.com/Clever/microplane/lib"
+)
+
+// pushBranch pushes a commit to BranchName, with any extra git push options, returning the
+// commit that was pushed. Without ForceWithLease it force pushes. With it, the push is rejected
+// if the remote branch isn't at LeaseSHA, e.g. because a reviewer pushed to it. Then, up to
+// PushAttempts in all, the remote branch's new commits are replayed onto the planned branch and
+// it's pushed again.
+func pushBranch(ctx context.Context, input Input, sha string, options []string) (string, error) {
+	lease := input.LeaseSHA
+	for attempt := 1; ; attempt++ {
+		args := []string{"push", "-f"}
+		if input.ForceWithLease {
+			args = []string{"push", fmt.Sprintf("--force-with-lease=refs/heads/%s:%s", input.BranchName, lease)}
+		}
+		args = append(args, options...)
+		args = append(args, "origin", fmt.Sprintf("%s:refs/heads/%s", sha, input.BranchName))
+		gitPush := exec.CommandContext(ctx, "git", args...)
+		gitPush.Dir = input.PlanDir
+		output, err := gitPush.CombinedOutput()
+		if err == nil {
+			return sha, nil
+		}
+
+		// a rebase can only replay the planned branch, not another SourceRef
+		if !input.ForceWithLease || !pushRejected(string(output)) || (input.SourceRef != "" && input.SourceRef != "HEAD") {
+			return "", lib.WithKind(lib.ErrGitPush, errors.New(string(output)))
+		}
+		if attempt >= input.PushAttempts {
+			return "", lib.WithKind(lib.ErrGitPush, fmt.Errorf("push was rejected %d times, since the remote branch changed each time: %s", attempt, string(output)))
+		}
+		log.Printf("%s/%s - push rejected, since the remote branch changed. replaying its new commits and retrying (%d/%d)", input.Repo.Owner, input.Repo.Name, attempt, input.PushAttempts-1)
+		if lease, err = replayRemoteCommits(ctx, input, lease); err != nil {
+			return "", err
+		}
+		if sha, err = resolveSourceRef(ctx, input); err != nil {
+			return "", err
+		}
+	}
+}
+
+// pushRejected determines if git push failed because the remote branch moved, as opposed to
+// e.g. a hook or permission failure
+func pushRejected(output string) bool {
+	for _, reason := range []string{"(stale info)", "(non-fast-forward)", "(fetch first)"} {
+		if strings.Contains(output, reason) {
+			return true
+		}
+	}
+	return false
+}
+
+// replayRemoteCommits fetches the remote branch and brings its commits since lease, e.g. a
+// reviewer's fixes, onto the planned branch, returning the remote branch's commit. If the remote
+// branch doesn't descend from lease, e.g. because it was rewritten, the planned branch is rebased
+// onto it instead. Either way, a conflict is aborted.
+func replayRemoteCommits(ctx context.Context, input Input, lease string) (string, error) {
+	fetch := exec.CommandContext(ctx, "git", "fetch", "origin", fmt.Sprintf("refs/heads/%s", input.BranchName))
+	fetch.Dir = input.PlanDir
+	if output, err := fetch.CombinedOutput(); err != nil {
+		return "", errors.New(string(output))
+	}
+	revParse := exec.CommandContext(ctx, "git", "rev-parse", "FETCH_HEAD")
+	revParse.Dir = input.PlanDir
+	output, err := revParse.CombinedOutput()
+	if err != nil {
+		return "", errors.New(string(output))
+	}
+	remote := strings.TrimSpace(string(output))
+
+	replay := []string{"rebase", remote}
+	abort := []string{"rebase", "--abort"}
+	isAncestor := exec.CommandContext(ctx, "git", "merge-base", "--is-ancestor", lease, remote)
+	isAncestor.Dir = input.PlanDir
+	if lease != "" && isAncestor.Run() == nil {
+		replay = []string{"cherry-pick", fmt.Sprintf("%s..%s", lease, remote)}
+		abort = []string{"cherry-pick", "--abort"}
+	}
+	apply := exec.CommandContext(ctx, "git", replay...)
+	apply.Dir = input.PlanDir
+	if output, err := apply.CombinedOutput(); err != nil {
+		undo := exec.CommandContext(ctx, "git", abort...)
+		undo.Dir = input.PlanDir
+		undo.Run()
+		return "", lib.WithKind(lib.ErrConflict, fmt.Errorf("bringing in the commits pushed to the branch since the last push failed: %s", output))
+	}
+	return remote, nil
+}
@@ -0,0 +1,65 @@
+package push
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/Clever/microplane/lib"
+)
+
+// OpenPRLimit caps how many new PRs a push run opens across its repos, see Input.OpenPRLimit.
+// A nil *OpenPRLimit means no cap.
+type OpenPRLimit struct {
+	max    int
+	mutex  sync.Mutex
+	opened map[string]bool
+}
+
+// NewOpenPRLimit caps a push run at opening max new PRs
+func NewOpenPRLimit(max int) *OpenPRLimit {
+	return &OpenPRLimit{max: max, opened: map[string]bool{}}
+}
+
+// Opened is how many new PRs the run has opened, or is opening
+func (l *OpenPRLimit) Opened() int {
+	if l == nil {
+		return 0
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return len(l.opened)
+}
+
+// openPRKey identifies a PR by its repo and branch, so a repo's backports count as PRs of their own
+func openPRKey(input Input) string {
+	return fmt.Sprintf("%s/%s:%s", input.Repo.Owner, input.Repo.Name, input.BranchName)
+}
+
+// reserve counts the PR the input is about to open, or refuses with lib.ErrMaxOpenPRs if the run
+// has already opened as many as it may
+func (l *OpenPRLimit) reserve(input Input) error {
+	if l == nil {
+		return nil
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	key := openPRKey(input)
+	if l.opened[key] {
+		return nil
+	}
+	if len(l.opened) >= l.max {
+		return lib.WithKind(lib.ErrMaxOpenPRs, fmt.Errorf("not pushed: this run already opened the most PRs it may, %d", l.max))
+	}
+	l.opened[key] = true
+	return nil
+}
+
+// release gives back the input's reservation, if it didn't open its PR after all
+func (l *OpenPRLimit) release(input Input) {
+	if l == nil {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	delete(l.opened, openPRKey(input))
+}
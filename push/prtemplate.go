@@ -0,0 +1,141 @@
+package push
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/Clever/microplane/lib"
+)
+
+// Ways to use a repo's PR template, see Input.PRTemplateMode
+const (
+	// PRTemplatePrepend puts the repo's PR template before the PR body
+	PRTemplatePrepend = "prepend"
+	// PRTemplateAppend puts the repo's PR template after the PR body
+	PRTemplateAppend = "append"
+	// PRTemplateFill renders the PR body as a template, which places the repo's PR template
+	// itself with {{.PRTemplate}}. See RenderPRBody.
+	PRTemplateFill = "fill"
+)
+
+// githubPRTemplates are where Github looks for a repo's default PR template, in order
+var githubPRTemplates = []string{
+	".github/pull_request_template.md",
+	"pull_request_template.md",
+	"docs/pull_request_template.md",
+	".github/pull_request_template.txt",
+	"pull_request_template.txt",
+	"docs/pull_request_template.txt",
+}
+
+// githubPRTemplateDir holds a repo's named PR templates in Github
+const githubPRTemplateDir = ".github/pull_request_template"
+
+// gitlabMRTemplateDir holds a repo's MR templates in Gitlab, where "Default" is used by default
+const gitlabMRTemplateDir = ".gitlab/merge_request_templates"
+
+// FindPRTemplate reads a repo's PR template from a checkout of it. If name is given, that named
+// template is used if the repo has it, e.g. .github/PULL_REQUEST_TEMPLATE/<name>.md for Github.
+// Otherwise it's the provider's default template. Paths are matched case insensitively, like
+// the providers do. It returns "" if the repo doesn't have a template.
+func FindPRTemplate(dir string, repo lib.Repo, name string) (string, error) {
+	paths := []string{}
+	switch {
+	case repo.IsGithub():
+		if name != "" {
+			paths = append(paths, filepath.Join(githubPRTemplateDir, name+".md"))
+		}
+		paths = append(paths, githubPRTemplates...)
+	case repo.IsGitlab():
+		if name != "" {
+			paths = append(paths, filepath.Join(gitlabMRTemplateDir, name+".md"))
+		}
+		paths = append(paths, filepath.Join(gitlabMRTemplateDir, "Default.md"))
+	}
+
+	for _, p := range paths {
+		found, ok := findFileFold(dir, p)
+		if !ok {
+			continue
+		}
+		content, err := ioutil.ReadFile(found)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(content)), nil
+	}
+	return "", nil
+}
+
+// findFileFold finds a file by its path relative to dir, ignoring case
+func findFileFold(dir string, path string) (string, bool) {
+	for _, segment := range strings.Split(filepath.ToSlash(path), "/") {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return "", false
+		}
+		found := ""
+		for _, entry := range entries {
+			if strings.EqualFold(entry.Name(), segment) {
+				found = entry.Name()
+				break
+			}
+		}
+		if found == "" {
+			return "", false
+		}
+		dir = filepath.Join(dir, found)
+	}
+	if info, err := os.Stat(dir); err != nil || info.IsDir() {
+		return "", false
+	}
+	return dir, true
+}
+
+// withPRTemplate adds a repo's PR template to the PR body, for PRTemplatePrepend and PRTemplateAppend
+func withPRTemplate(body string, prTemplate string, mode string) string {
+	body = strings.TrimRight(body, "\n")
+	if prTemplate == "" || (mode != PRTemplatePrepend && mode != PRTemplateAppend) {
+		return body
+	}
+	if body == "" {
+		return prTemplate
+	}
+	if mode == PRTemplatePrepend {
+		return prTemplate + "\n\n" + body
+	}
+	return body + "\n\n" + prTemplate
+}
+
+// PRBodyVars are the variables available to the PR body with PRTemplateFill, or a shared body template
+type PRBodyVars struct {
+	Owner  string
+	Name   string
+	Branch string
+	// Metadata is whatever was attached to the repo, e.g. the team that owns it
+	Metadata map[string]string
+	// PRTemplate is the repo's PR template, or "" if it doesn't have one
+	PRTemplate string
+}
+
+// ParsePRBodyTemplate parses a PR body for PRTemplateFill, or a shared body template
+func ParsePRBodyTemplate(text string) (*template.Template, error) {
+	return template.New("body").Option("missingkey=error").Parse(text)
+}
+
+// RenderPRBody renders a PR body for PRTemplateFill, or a shared body template
+func RenderPRBody(text string, vars PRBodyVars) (string, error) {
+	tmpl, err := ParsePRBodyTemplate(text)
+	if err != nil {
+		return "", err
+	}
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, vars); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
@@ -1,12 +1,21 @@
+// Package push pushes a planned commit and opens, or updates, a PR for it. Use Push, which
+// supports both Github and Gitlab. Nothing here depends on the mp CLI, so it can be embedded.
 package push
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"log"
+	"net/http"
 	"net/url"
 	"os/exec"
+	"path"
+	"sort"
+	"strconv"
 	"strings"
+	"text/template"
 	"time"
 
 	"github.com/Clever/microplane/lib"
@@ -25,6 +34,9 @@ type Input struct {
 	Repo lib.Repo
 	// PlanDir is where the git repo that has been modified lives.
 	PlanDir string
+	// RemoteURL, if set, replaces the URL of the planned repo's origin before anything is pushed
+	// or fetched, e.g. from --clone-url-template
+	RemoteURL string
 	// WorkDir is where the work associated with the Push operation happens
 	WorkDir string
 	// CommitMessage is the commit message for the PR
@@ -33,6 +45,10 @@ type Input struct {
 	CommitMessage string
 	// PRBody is the body of the PR submitted to Github
 	PRBody string
+	// TitlePrefix and TitleSuffix are added to the PR title, e.g. "[codemod]", unless it
+	// already starts or ends with them
+	TitlePrefix string
+	TitleSuffix string
 	// PRAssignee is the user who will be assigned the PR
 	PRAssignee string
 	// BranchName is the branch name in Git
@@ -41,17 +57,220 @@ type Input struct {
 	Labels []string
 	// Draft controls whether it should be a draft PR
 	Draft bool
+	// SquashOnMerge sets the MR to squash its commits when merged, whoever merges it. Only
+	// supported for Gitlab, since Github PRs don't have a setting for it.
+	SquashOnMerge bool
+	// PipelineVariables are set on the pipeline Gitlab starts for the pushed branch, via git
+	// push options. Only supported for Gitlab.
+	PipelineVariables map[string]string
+	// ReviewersFromApprovalRules requests reviews from the eligible approvers of the project's
+	// approval rules. Only supported for Gitlab.
+	ReviewersFromApprovalRules bool
+	// ReviewersFromCodeowners requests reviews from the CODEOWNERS of the files the plan changed.
+	// Repos without a CODEOWNERS file are left alone.
+	ReviewersFromCodeowners bool
+	// KeepClosed leaves a PR from the branch that was closed without merging as it is, and opens
+	// a new one, instead of reopening it
+	KeepClosed bool
+	// SkipExistingPR leaves repos alone that already have an open PR from the branch, e.g. so
+	// re-running push doesn't reset their review state
+	SkipExistingPR bool
+	// OpenPRLimit, if set, is shared by the run's repos to cap how many new PRs it opens. Repos
+	// over the cap aren't pushed, and fail with lib.ErrMaxOpenPRs.
+	OpenPRLimit *OpenPRLimit
+	// SkipUnchanged skips the git push if the remote branch already has the same tree,
+	// so re-running push doesn't reset CI and review context
+	SkipUnchanged bool
+	// AllowDirty pushes even if the plan directory has modified or untracked files
+	// that aren't part of the planned commit
+	AllowDirty bool
+	// ChangedFilesAllow is a list of glob patterns. If set, every file changed by the plan
+	// must match one of them, either by its full path or by its base name
+	ChangedFilesAllow []string
+	// MaxChangedFiles, if set, is the most files the plan may change, as a guard against a
+	// runaway script
+	MaxChangedFiles int
+	// Rebase the planned branch onto the latest base branch before pushing
+	Rebase bool
+	// BaseBranch is the branch the PR targets. If empty, the repo's default branch is used.
+	BaseBranch string
+	// ClosesIssue is the number of an issue in the repo to close when the PR is merged.
+	// 0 means the PR doesn't close an issue.
+	ClosesIssue int
+	// ApprovalRules are applied to the MR after it's opened. Only supported for Gitlab.
+	ApprovalRules []ApprovalRule
+	// SourceRef is the ref whose commit is pushed to BranchName. Defaults to HEAD.
+	SourceRef string
+	// PRComment is a template for a comment to post on the PR once it's opened. See CommentVars
+	// for the variables available. It isn't posted again if the PR already has the same comment.
+	PRComment string
+	// Tag is a template for an annotated tag to create on the pushed commit, and push after the
+	// branch. See TagVars for the variables available. Empty means no tag.
+	Tag string
+	// TagMessage is the tag's annotation. Defaults to the PR title.
+	TagMessage string
+	// ExistingTag is what to do when Tag already exists on another commit: TagExistingFail
+	// (the default), TagExistingSkip, or TagExistingOverwrite
+	ExistingTag string
+	// CampaignID, if set, is the campaign whose lib.CampaignTrailer the planned commit has. If a
+	// commit in the base branch has it too, the change is already there.
+	CampaignID string
+	// ExistingBranch is what to do when the branch already exists on the remote on another
+	// commit: BranchExistingOverwrite (the default, also if it's empty), BranchExistingSkip, or
+	// BranchExistingFail
+	ExistingBranch string
+	// Metadata is whatever was attached to the repo, for Tag templates
+	Metadata map[string]string
+	// ForceWithLease only overwrites the remote branch if it's still at LeaseSHA, the commit last
+	// pushed. Empty means the branch isn't expected to exist. See pushBranch.
+	ForceWithLease bool
+	LeaseSHA       string
+	// ScriptOutput is the plan's change command output, added to the end of the PR body in a
+	// collapsed section. Empty means it isn't added.
+	ScriptOutput string
+	// Campaign, if its Name is set, adds a note to the PR body that the PR is part of it
+	Campaign Campaign
+	// PushAttempts is how many times to try pushing with ForceWithLease, bringing in the remote
+	// branch's new commits after each rejection
+	PushAttempts int
+	// PRTemplate is the repo's PR template, see FindPRTemplate, which PRTemplateMode adds to the
+	// PR body. With PRTemplateFill it's expected to be in PRBody already, see RenderPRBody.
+	PRTemplate     string
+	PRTemplateMode string
+}
+
+// CommentVars are the variables available to PRComment templates
+type CommentVars struct {
+	Owner    string
+	Name     string
+	PRNumber int
+	PRURL    string
+	Branch   string
+}
+
+// ParseCommentTemplate parses a PRComment template
+func ParseCommentTemplate(text string) (*template.Template, error) {
+	return template.New("comment").Option("missingkey=error").Parse(text)
+}
+
+// renderComment renders the PRComment template for a PR
+func renderComment(input Input, prNumber int, prURL string) (string, error) {
+	tmpl, err := ParseCommentTemplate(input.PRComment)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, CommentVars{
+		Owner:    input.Repo.Owner,
+		Name:     input.Repo.Name,
+		PRNumber: prNumber,
+		PRURL:    prURL,
+		Branch:   input.BranchName,
+	}); err != nil {
+		return "", fmt.Errorf("failed to render PR comment: %w", err)
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
+
+// ApprovalRule is a named Gitlab MR approval rule, and who can approve for it
+type ApprovalRule struct {
+	Name              string
+	ApprovalsRequired int
+	UserIDs           []int
+	GroupIDs          []int
+}
+
+// ParseApprovalRule parses an approval rule of the form
+// "name=<rule name>;approvals=<n>;users=<id>,<id>;groups=<id>,<id>". Only name is required.
+func ParseApprovalRule(s string) (ApprovalRule, error) {
+	rule := ApprovalRule{ApprovalsRequired: 1, UserIDs: []int{}, GroupIDs: []int{}}
+	for _, field := range strings.Split(s, ";") {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return ApprovalRule{}, fmt.Errorf("invalid approval rule %q: expected key=value, got %q", s, field)
+		}
+		key, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		var err error
+		switch key {
+		case "name":
+			rule.Name = value
+		case "approvals":
+			rule.ApprovalsRequired, err = strconv.Atoi(value)
+		case "users":
+			rule.UserIDs, err = parseIDs(value)
+		case "groups":
+			rule.GroupIDs, err = parseIDs(value)
+		default:
+			err = fmt.Errorf("unknown key %q", key)
+		}
+		if err != nil {
+			return ApprovalRule{}, fmt.Errorf("invalid approval rule %q: %s", s, err.Error())
+		}
+	}
+	if rule.Name == "" {
+		return ApprovalRule{}, fmt.Errorf("invalid approval rule %q: name is required", s)
+	}
+	return rule, nil
+}
+
+// parseIDs parses a comma separated list of numeric IDs
+func parseIDs(s string) ([]int, error) {
+	ids := []int{}
+	for _, id := range strings.Split(s, ",") {
+		if id = strings.TrimSpace(id); id == "" {
+			continue
+		}
+		n, err := strconv.Atoi(id)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ID %q", id)
+		}
+		ids = append(ids, n)
+	}
+	return ids, nil
 }
 
 // Output from Push()
 type Output struct {
-	Success                   bool
-	CommitSHA                 string
-	PullRequestURL            string
+	Success        bool
+	CommitSHA      string
+	PullRequestURL string
+	// PullRequestNumber is the PR's number. For Gitlab it's the MR's IID within its project,
+	// as shown in its URL, rather than its global ID.
 	PullRequestNumber         int
 	PullRequestCombinedStatus string // failure, pending, or success
 	PullRequestAssignee       string
 	CircleCIBuildURL          string
+	// BranchName is the branch that was pushed
+	BranchName string
+	// PushedAt is when the branch was last pushed. It's nil if push was skipped because the
+	// remote branch was unchanged.
+	PushedAt *time.Time `json:",omitempty"`
+	// RunStartedAt is when the push run that wrote this output started, to tell which repos
+	// were pushed by the most recent run. It's set by the caller.
+	RunStartedAt *time.Time `json:",omitempty"`
+	// ReviewApprovals and ReviewDecision are the PR's review state, as of the last sync that
+	// fetched it. ReviewDecision is empty if it hasn't been fetched.
+	ReviewApprovals int    `json:",omitempty"`
+	ReviewDecision  string `json:",omitempty"`
+	// Backports are the PRs opened against other base branches by Backport, keyed by base
+	Backports map[string]Output `json:",omitempty"`
+	// ErrorCategory is set when opening the PR failed, e.g. "permission" or "server"
+	ErrorCategory lib.ErrorCategory `json:",omitempty"`
+	// ErrorKind is the kind of failure, if known, e.g. "git-push". See lib.ErrorKind.
+	ErrorKind string `json:",omitempty"`
+	// Tag is the tag pushed with the branch, if any. TagSkipped is set if it already existed on
+	// another commit, and was left alone.
+	Tag        string `json:",omitempty"`
+	TagSkipped bool   `json:",omitempty"`
+	// SkippedExistingPR is set if push left the branch and PR alone because the PR was already
+	// open, see Input.SkipExistingPR
+	SkippedExistingPR bool `json:",omitempty"`
+	// SkippedExistingBranch is set if push left the repo alone because the branch was already
+	// on the remote, see Input.ExistingBranch
+	SkippedExistingBranch bool `json:",omitempty"`
+	// AlreadyInBase is set if nothing was pushed because the base branch already has the
+	// planned change, e.g. because its PR was merged outside of microplane
+	AlreadyInBase bool `json:",omitempty"`
 }
 
 func (o Output) String() string {
@@ -67,14 +286,64 @@ func (o Output) String() string {
 		s += "?"
 	}
 
-	s += fmt.Sprintf("  assignee:%s %s", o.PullRequestAssignee, o.PullRequestURL)
+	s += fmt.Sprintf("  assignee:%s", o.PullRequestAssignee)
+	if o.BranchName != "" {
+		s += fmt.Sprintf("  branch:%s", o.BranchName)
+	}
+	s += fmt.Sprintf(" %s", o.PullRequestURL)
 	if o.CircleCIBuildURL != "" {
 		s += fmt.Sprintf(" %s", o.CircleCIBuildURL)
 	}
+	if o.Tag != "" && !o.TagSkipped {
+		s += fmt.Sprintf("  tag:%s", o.Tag)
+	}
+	bases := []string{}
+	for base := range o.Backports {
+		bases = append(bases, base)
+	}
+	sort.Strings(bases)
+	for _, base := range bases {
+		s += fmt.Sprintf("  %s:%s", base, o.Backports[base].PullRequestURL)
+	}
 	return s
 }
 
-// Push pushes the commit to Github and opens a pull request
+// Push pushes the commit and opens a pull request, with Github or Gitlab depending on the repo's provider
+// - repoLimiter rate limits the # of calls to the provider
+// - pushLimiter rate limits the # of PRs opened
+// A nil limiter means no rate limiting.
+func Push(ctx context.Context, input Input, repoLimiter *time.Ticker, pushLimiter *time.Ticker) (Output, error) {
+	if err := lib.ValidateBranchName(input.BranchName); err != nil {
+		return Output{Success: false}, err
+	}
+	if input.RemoteURL != "" {
+		if _, err := gitOutput(ctx, input.PlanDir, "remote", "set-url", "origin", input.RemoteURL); err != nil {
+			return Output{Success: false}, fmt.Errorf("could not set origin to %s: %w", input.RemoteURL, err)
+		}
+	}
+	var output Output
+	var err error
+	switch {
+	case input.Repo.IsGithub():
+		output, err = GithubPush(ctx, input, repoLimiter, pushLimiter)
+	case input.Repo.IsGitlab():
+		output, err = GitlabPush(ctx, input, repoLimiter, pushLimiter)
+	default:
+		return Output{}, fmt.Errorf("unsupported provider: %s", input.Repo.ProviderConfig.Backend)
+	}
+	// a PR that was opened still counts, even if a later step failed
+	if output.PullRequestNumber == 0 && (err != nil || output.AlreadyInBase || output.SkippedExistingBranch) {
+		input.OpenPRLimit.release(input)
+	}
+	err = lib.WithAPIKind(lib.WithDeadlineKind(ctx, err))
+	output.ErrorKind = lib.ErrorKind(err)
+	return output, err
+}
+
+// GithubPush pushes the commit to Github and opens a pull request
+// - repoLimiter rate limits the # of calls to Github
+// - pushLimiter rate limits the # of PRs opened
+// A nil limiter means no rate limiting.
 func GithubPush(ctx context.Context, input Input, repoLimiter *time.Ticker, pushLimiter *time.Ticker) (Output, error) {
 	// Create Github Client
 	p := lib.NewProviderFromConfig(input.Repo.ProviderConfig)
@@ -82,23 +351,39 @@ func GithubPush(ctx context.Context, input Input, repoLimiter *time.Ticker, push
 	if err != nil {
 		return Output{}, err
 	}
+	if err := githubCheckAssignee(ctx, client, input, repoLimiter); err != nil {
+		return Output{Success: false}, err
+	}
 
-	// Get the commit SHA from the last commit
-	cmd := Command{Path: "git", Args: []string{"log", "-1", "--pretty=format:%H"}}
-	gitLog := exec.CommandContext(ctx, cmd.Path, cmd.Args...)
-	gitLog.Dir = input.PlanDir
-	gitLogOutput, err := gitLog.CombinedOutput()
-	if err != nil {
-		return Output{Success: false}, errors.New(string(gitLogOutput))
+	// Leave the repo alone if it already has an open PR, if asked to. Otherwise the PR it opens
+	// counts toward the run's OpenPRLimit.
+	if input.SkipExistingPR || input.OpenPRLimit != nil {
+		pr, err := githubOpenPR(ctx, client, input, repoLimiter)
+		if err != nil {
+			return Output{Success: false}, err
+		} else if pr == nil {
+			if err := input.OpenPRLimit.reserve(input); err != nil {
+				return Output{Success: false}, err
+			}
+		} else if input.SkipExistingPR {
+			return Output{
+				Success:             true,
+				CommitSHA:           pr.GetHead().GetSHA(),
+				PullRequestURL:      pr.GetHTMLURL(),
+				PullRequestNumber:   pr.GetNumber(),
+				PullRequestAssignee: pr.GetAssignee().GetLogin(),
+				BranchName:          input.BranchName,
+				SkippedExistingPR:   true,
+			}, nil
+		}
 	}
 
-	// Push the commit
-	gitHeadBranch := fmt.Sprintf("HEAD:%s", input.BranchName)
-	cmd = Command{Path: "git", Args: []string{"push", "-f", "origin", gitHeadBranch}}
-	gitPush := exec.CommandContext(ctx, cmd.Path, cmd.Args...)
-	gitPush.Dir = input.PlanDir
-	if output, err := gitPush.CombinedOutput(); err != nil {
-		return Output{Success: false}, errors.New(string(output))
+	// Push the planned commit to the branch
+	pushed, err := pushPlannedBranch(ctx, input, nil)
+	if err != nil {
+		return Output{Success: false}, err
+	} else if pushed.Done != nil {
+		return *pushed.Done, nil
 	}
 
 	// Open a pull request, if one doesn't exist already
@@ -108,40 +393,77 @@ func GithubPush(ctx context.Context, input Input, repoLimiter *time.Ticker, push
 		return Output{Success: false}, err
 	}
 	base := *repository.DefaultBranch
+	if input.BaseBranch != "" {
+		base = input.BaseBranch
+	}
 
-	title, body := getTitleBody(input)
-	pr, err := findOrCreatePR(ctx, client, input.Repo.Owner, input.Repo.Name, &github.NewPullRequest{
-		Title: &title,
-		Body:  &body,
-		Head:  &head,
-		Base:  &base,
-		Draft: &input.Draft,
-	}, repoLimiter, pushLimiter)
+	title, body := GetTitleBody(input)
+	var pr *github.PullRequest
+	err = withRetries(ctx, "open PR", func() (err error) {
+		pr, err = findOrCreatePR(ctx, client, input.Repo.Owner, input.Repo.Name, &github.NewPullRequest{
+			Title: &title,
+			Body:  &body,
+			Head:  &head,
+			Base:  &base,
+			Draft: &input.Draft,
+		}, input.KeepClosed, repoLimiter, pushLimiter)
+		return err
+	})
 	if err != nil {
-		return Output{Success: false}, err
+		return Output{Success: false, ErrorCategory: errorCategory(err)}, err
+	}
+
+	// the PR is open from here on, so a failure still records it
+	opened := Output{Success: false, PullRequestURL: pr.GetHTMLURL(), PullRequestNumber: pr.GetNumber(), BranchName: input.BranchName}
+
+	if !pushed.Unchanged {
+		err := waitForPushedSHA(ctx, pushed.SHA, pr.GetHead().GetSHA(), func() (string, error) {
+			lib.Wait(repoLimiter)
+			updated, _, err := client.PullRequests.Get(ctx, input.Repo.Owner, input.Repo.Name, pr.GetNumber())
+			if err != nil {
+				return "", err
+			}
+			pr = updated
+			return pr.GetHead().GetSHA(), nil
+		})
+		if err != nil {
+			return opened, err
+		}
 	}
 
 	if pr.Assignee == nil || pr.Assignee.Login == nil || *pr.Assignee.Login != input.PRAssignee {
-		<-repoLimiter.C
+		lib.Wait(repoLimiter)
 		_, _, err := client.Issues.AddAssignees(ctx, input.Repo.Owner, input.Repo.Name, *pr.Number, []string{input.PRAssignee})
 		if err != nil {
-			return Output{Success: false}, err
+			return opened, err
 		}
 	}
 
 	if pr.Labels == nil || len(input.Labels) > 0 {
-		<-repoLimiter.C
+		lib.Wait(repoLimiter)
 		// TODO: Compare current labels
 		_, _, err := client.Issues.AddLabelsToIssue(ctx, input.Repo.Owner, input.Repo.Name, *pr.Number, input.Labels)
 		if err != nil {
-			return Output{Success: false}, err
+			return opened, err
+		}
+	}
+
+	if input.ReviewersFromCodeowners {
+		if err := requestCodeownersReviews(ctx, client, input, pr, repoLimiter); err != nil {
+			return opened, fmt.Errorf("failed to request reviews from CODEOWNERS: %w", err)
 		}
 	}
 
-	<-repoLimiter.C
+	if input.PRComment != "" {
+		if err := commentOnPR(ctx, client, input, pr, repoLimiter); err != nil {
+			return opened, err
+		}
+	}
+
+	lib.Wait(repoLimiter)
 	cs, _, err := client.Repositories.GetCombinedStatus(ctx, input.Repo.Owner, input.Repo.Name, *pr.Head.SHA, nil)
 	if err != nil {
-		return Output{Success: false}, err
+		return opened, err
 	}
 
 	var circleCIBuildURL string
@@ -165,57 +487,522 @@ func GithubPush(ctx context.Context, input Input, repoLimiter *time.Ticker, push
 		CommitSHA:                 *pr.Head.SHA,
 		PullRequestNumber:         *pr.Number,
 		PullRequestURL:            *pr.HTMLURL,
-		PullRequestCombinedStatus: *cs.State,
+		PullRequestCombinedStatus: lib.NormalizeCIStatus(cs.GetState()),
 		PullRequestAssignee:       input.PRAssignee,
 		CircleCIBuildURL:          circleCIBuildURL,
+		BranchName:                input.BranchName,
+		PushedAt:                  pushed.PushedAt,
+		Tag:                       pushed.Tag,
+		TagSkipped:                pushed.TagSkipped,
 	}, nil
 }
 
-func findOrCreatePR(ctx context.Context, client *github.Client, owner string, name string, pull *github.NewPullRequest, repoLimiter *time.Ticker, pushLimiter *time.Ticker) (*github.PullRequest, error) {
-	var pr *github.PullRequest
-	<-pushLimiter.C
-	<-repoLimiter.C
-	newPR, _, err := client.PullRequests.Create(ctx, owner, name, pull)
+// findOrCreatePR finds the PR for the branch, or else opens one. A closed PR for the branch is
+// reopened rather than opening a second one, so re-running push doesn't duplicate PRs and the
+// PR's discussion is kept, unless keepClosed is set.
+func findOrCreatePR(ctx context.Context, client *github.Client, owner string, name string, pull *github.NewPullRequest, keepClosed bool, repoLimiter *time.Ticker, pushLimiter *time.Ticker) (*github.PullRequest, error) {
+	existing, err := findPR(ctx, client, owner, name, *pull.Head, *pull.Base, repoLimiter)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil && existing.GetState() == "closed" && keepClosed {
+		existing = nil
+	}
+
+	if existing != nil {
+		update := &github.PullRequest{}
+		updated := false
+		if existing.GetState() == "closed" {
+			update.State = github.String("open")
+			updated = true
+		}
+		// If needed, update PR title and body
+		if different(existing.Title, pull.Title) || different(existing.Body, pull.Body) {
+			update.Title = pull.Title
+			update.Body = pull.Body
+			updated = true
+		}
+		if !updated {
+			return existing, nil
+		}
+		if update.State != nil {
+			lib.Wait(pushLimiter)
+		}
+		lib.Wait(repoLimiter)
+		pr, _, err := client.PullRequests.Edit(ctx, owner, name, existing.GetNumber(), update)
+		if err == nil {
+			return pr, nil
+		}
+		var errResp *github.ErrorResponse
+		if update.State == nil || !errors.As(err, &errResp) || errResp.Response.StatusCode != http.StatusUnprocessableEntity {
+			return nil, err
+		}
+		// Github won't reopen a PR whose branch has been recreated since it was closed
+		log.Printf("%s/%s - couldn't reopen PR #%d, opening a new one: %s", owner, name, existing.GetNumber(), err.Error())
+	}
+
+	lib.Wait(pushLimiter)
+	lib.Wait(repoLimiter)
+	pr, _, err := client.PullRequests.Create(ctx, owner, name, pull)
 	if err != nil && strings.Contains(err.Error(), "pull request already exists") {
-		<-repoLimiter.C
-		existingPRs, _, err := client.PullRequests.List(ctx, owner, name, &github.PullRequestListOptions{
-			Head: *pull.Head,
-			Base: *pull.Base,
-		})
+		// opened since we looked, e.g. by another run
+		if pr, err = findPR(ctx, client, owner, name, *pull.Head, *pull.Base, repoLimiter); err == nil && pr == nil {
+			err = errors.New("unexpected: PR already exists for branch, but wasn't found")
+		}
+	} else if err != nil && strings.Contains(err.Error(), "No commits between") {
+		err = lib.WithKind(lib.ErrNoChanges, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pr, nil
+}
+
+// findPR finds the open PR from head to base or, if there isn't one, the most recently
+// updated PR that was closed without being merged. It returns nil if neither exists.
+func findPR(ctx context.Context, client *github.Client, owner, name, head, base string, repoLimiter *time.Ticker) (*github.PullRequest, error) {
+	opts := &github.PullRequestListOptions{
+		Head:        head,
+		Base:        base,
+		State:       "all",
+		Sort:        "updated",
+		Direction:   "desc",
+		ListOptions: github.ListOptions{PerPage: 100},
+	}
+	var open []*github.PullRequest
+	var closed *github.PullRequest
+	for {
+		lib.Wait(repoLimiter)
+		prs, resp, err := client.PullRequests.List(ctx, owner, name, opts)
 		if err != nil {
 			return nil, err
-		} else if len(existingPRs) != 1 {
-			return nil, errors.New("unexpected: found more than 1 PR for branch")
 		}
-		pr = existingPRs[0]
+		for _, pr := range prs {
+			if pr.GetState() == "open" {
+				open = append(open, pr)
+			} else if closed == nil && pr.MergedAt == nil {
+				closed = pr
+			}
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
 
-		// If needed, update PR title and body
-		if different(pr.Title, pull.Title) || different(pr.Body, pull.Body) {
-			pr.Title = pull.Title
-			pr.Body = pull.Body
-			<-repoLimiter.C
-			pr, _, err = client.PullRequests.Edit(ctx, owner, name, *pr.Number, pr)
+	if len(open) > 1 {
+		return nil, errors.New("unexpected: found more than 1 PR for branch")
+	} else if len(open) == 1 {
+		return open[0], nil
+	}
+	return closed, nil
+}
+
+// requestCodeownersReviews requests reviews on a PR from the CODEOWNERS of its changed files.
+// Teams from other orgs, and the PR's author, can't be requested so they're left out.
+func requestCodeownersReviews(ctx context.Context, client *github.Client, input Input, pr *github.PullRequest, repoLimiter *time.Ticker) error {
+	users, teams, err := codeownersReviewers(ctx, input)
+	if err != nil {
+		return err
+	}
+	request := github.ReviewersRequest{}
+	for _, user := range users {
+		if !strings.EqualFold(user, pr.GetUser().GetLogin()) {
+			request.Reviewers = append(request.Reviewers, user)
+		}
+	}
+	for _, team := range teams {
+		parts := strings.SplitN(team, "/", 2)
+		if strings.EqualFold(parts[0], input.Repo.Owner) {
+			request.TeamReviewers = append(request.TeamReviewers, parts[1])
+		}
+	}
+	if len(request.Reviewers) == 0 && len(request.TeamReviewers) == 0 {
+		return nil
+	}
+	lib.Wait(repoLimiter)
+	_, _, err = client.PullRequests.RequestReviewers(ctx, input.Repo.Owner, input.Repo.Name, pr.GetNumber(), request)
+	return err
+}
+
+// commentOnPR posts the PRComment on a PR, unless it already has the same comment
+func commentOnPR(ctx context.Context, client *github.Client, input Input, pr *github.PullRequest, repoLimiter *time.Ticker) error {
+	comment, err := renderComment(input, pr.GetNumber(), pr.GetHTMLURL())
+	if err != nil {
+		return err
+	}
+
+	opts := &github.IssueListCommentsOptions{ListOptions: github.ListOptions{PerPage: 100}}
+	for {
+		lib.Wait(repoLimiter)
+		comments, resp, err := client.Issues.ListComments(ctx, input.Repo.Owner, input.Repo.Name, pr.GetNumber(), opts)
+		if err != nil {
+			return err
+		}
+		for _, c := range comments {
+			if strings.TrimSpace(c.GetBody()) == comment {
+				return nil
+			}
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+
+	lib.Wait(repoLimiter)
+	_, _, err = client.Issues.CreateComment(ctx, input.Repo.Owner, input.Repo.Name, pr.GetNumber(), &github.IssueComment{Body: &comment})
+	return err
+}
+
+// checkClean errors if the plan directory has changes that aren't in the planned commit,
+// or isn't on the planned branch, e.g. because a previous plan failed partway through. The branch
+// is only checked when HEAD is pushed, since e.g. a backport's commit isn't checked out.
+func checkClean(ctx context.Context, input Input) error {
+	gitStatus := exec.CommandContext(ctx, "git", "status", "--porcelain", "--untracked-files=all")
+	gitStatus.Dir = input.PlanDir
+	output, err := gitStatus.CombinedOutput()
+	if err != nil {
+		return errors.New(string(output))
+	}
+	if dirty := strings.TrimSpace(string(output)); dirty != "" {
+		return fmt.Errorf("plan directory has changes that aren't in the planned commit. Re-run plan, or use --allow-dirty to override this check:\n%s", dirty)
+	}
+
+	if input.sourceRef() != "HEAD" {
+		return nil
+	}
+	gitBranch := exec.CommandContext(ctx, "git", "rev-parse", "--abbrev-ref", "HEAD")
+	gitBranch.Dir = input.PlanDir
+	output, err = gitBranch.CombinedOutput()
+	if err != nil {
+		return errors.New(string(output))
+	}
+	if branch := strings.TrimSpace(string(output)); branch != input.BranchName {
+		return fmt.Errorf("plan directory is on branch '%s' instead of '%s'. Re-run plan, or use --allow-dirty to override this check", branch, input.BranchName)
+	}
+	return nil
+}
+
+// changedFiles lists the files changed by the commit being pushed, relative to the branch it's
+// based on
+func changedFiles(ctx context.Context, input Input) ([]string, error) {
+	gitDiff := exec.CommandContext(ctx, "git", "diff", "--name-only", input.baseRef()+"..."+input.sourceRef())
+	gitDiff.Dir = input.PlanDir
+	output, err := gitDiff.CombinedOutput()
+	if err != nil {
+		return nil, errors.New(string(output))
+	}
+
+	files := []string{}
+	for _, file := range strings.Split(string(output), "\n") {
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+	return files, nil
+}
+
+// checkChangedFilesAllowed errors if the plan changed a file that doesn't match ChangedFilesAllow
+func checkChangedFilesAllowed(ctx context.Context, input Input) error {
+	files, err := changedFiles(ctx, input)
+	if err != nil {
+		return err
+	}
+
+	disallowed := []string{}
+	for _, file := range files {
+		allowed := false
+		for _, pattern := range input.ChangedFilesAllow {
+			matchPath, err := path.Match(pattern, file)
 			if err != nil {
-				return nil, err
+				return fmt.Errorf("invalid --changed-files-allow pattern %q: %s", pattern, err.Error())
+			}
+			matchBase, _ := path.Match(pattern, path.Base(file))
+			if matchPath || matchBase {
+				allowed = true
+				break
 			}
 		}
+		if !allowed {
+			disallowed = append(disallowed, file)
+		}
+	}
+	if len(disallowed) > 0 {
+		return fmt.Errorf("plan changed files that aren't allowed by --changed-files-allow: %s", strings.Join(disallowed, ", "))
+	}
+	return nil
+}
 
-	} else if err != nil {
-		return nil, err
-	} else {
-		pr = newPR
+// checkChangedFileCount errors if the plan changed more than MaxChangedFiles files
+func checkChangedFileCount(ctx context.Context, input Input) error {
+	files, err := changedFiles(ctx, input)
+	if err != nil {
+		return err
 	}
-	return pr, nil
+	return tooManyChangedFiles(files, input.MaxChangedFiles)
+}
+
+// tooManyChangedFiles errors if there are more than max files, naming a few of them
+func tooManyChangedFiles(files []string, max int) error {
+	if len(files) <= max {
+		return nil
+	}
+	const examples = 5
+	named := files
+	if len(named) > examples {
+		named = named[:examples]
+	}
+	more := ""
+	if len(files) > examples {
+		more = fmt.Sprintf(" and %d more", len(files)-examples)
+	}
+	return fmt.Errorf("plan changed %d files, more than --max-changed-files allows (%d), so it wasn't pushed: %s%s", len(files), max, strings.Join(named, ", "), more)
+}
+
+// sourceRef is the ref whose commit is pushed, HEAD unless SourceRef is set
+func (input Input) sourceRef() string {
+	if input.SourceRef == "" {
+		return "HEAD"
+	}
+	return input.SourceRef
+}
+
+// resolveSourceRef finds the commit SourceRef points to
+func resolveSourceRef(ctx context.Context, input Input) (string, error) {
+	ref := input.sourceRef()
+	revParse := exec.CommandContext(ctx, "git", "rev-parse", "--verify", ref+"^{commit}")
+	revParse.Dir = input.PlanDir
+	output, err := revParse.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("source ref '%s' doesn't resolve to a commit: %s", ref, strings.TrimSpace(string(output)))
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// pushedSHATimeout is how long to wait for the provider to update the PR's head after a push
+const pushedSHATimeout = 30 * time.Second
+
+// waitForPushedSHA errors if the PR's head doesn't become the commit that was pushed. Providers
+// update the PR asynchronously, so getHead is polled until it does, or until pushedSHATimeout.
+func waitForPushedSHA(ctx context.Context, pushed string, head string, getHead func() (string, error)) error {
+	deadline := time.Now().Add(pushedSHATimeout)
+	for head != pushed && time.Now().Before(deadline) {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(2 * time.Second):
+		}
+		var err error
+		if head, err = getHead(); err != nil {
+			return err
+		}
+	}
+	if head != pushed {
+		return fmt.Errorf("pushed commit %s, but the PR's head is commit %s", pushed, head)
+	}
+	return nil
+}
+
+// baseRef is the remote-tracking ref of the branch the PR targets
+func (input Input) baseRef() string {
+	if input.BaseBranch != "" {
+		return "origin/" + input.BaseBranch
+	}
+	return "origin/HEAD"
+}
+
+// rebaseOntoBase fetches the base branch and rebases the planned branch onto it, if it's behind.
+// If the rebase conflicts, it's aborted so the plan directory is left as it was.
+func rebaseOntoBase(ctx context.Context, input Input) error {
+	fetch := exec.CommandContext(ctx, "git", "fetch", "origin")
+	fetch.Dir = input.PlanDir
+	if output, err := fetch.CombinedOutput(); err != nil {
+		return errors.New(string(output))
+	}
+
+	isAncestor := exec.CommandContext(ctx, "git", "merge-base", "--is-ancestor", input.baseRef(), "HEAD")
+	isAncestor.Dir = input.PlanDir
+	if err := isAncestor.Run(); err == nil {
+		// already up to date
+		return nil
+	}
+
+	rebase := exec.CommandContext(ctx, "git", "rebase", input.baseRef())
+	rebase.Dir = input.PlanDir
+	output, err := rebase.CombinedOutput()
+	if err == nil {
+		return nil
+	}
+
+	conflicts := exec.CommandContext(ctx, "git", "diff", "--name-only", "--diff-filter=U")
+	conflicts.Dir = input.PlanDir
+	conflictsOutput, _ := conflicts.CombinedOutput()
+	abort := exec.CommandContext(ctx, "git", "rebase", "--abort")
+	abort.Dir = input.PlanDir
+	if abortOutput, err := abort.CombinedOutput(); err != nil {
+		return fmt.Errorf("rebase onto base branch failed, and could not be aborted: %s", abortOutput)
+	}
+	if files := strings.Fields(string(conflictsOutput)); len(files) > 0 {
+		return lib.WithKind(lib.ErrConflict, fmt.Errorf("rebase onto base branch conflicted in: %s. Re-run plan, or push without --rebase", strings.Join(files, ", ")))
+	}
+	return fmt.Errorf("rebase onto base branch failed: %s", output)
+}
+
+// remoteBranchUnchanged returns the remote branch's commit, if it exists and has the same tree as
+// sha, the planned commit. It returns "" if the branch needs to be pushed.
+func remoteBranchUnchanged(ctx context.Context, input Input, sha string) (string, error) {
+	// fully qualify the branch, since ls-remote would also match e.g. "other/<branch>"
+	lsRemote := exec.CommandContext(ctx, "git", "ls-remote", "--heads", "origin", fmt.Sprintf("refs/heads/%s", input.BranchName))
+	lsRemote.Dir = input.PlanDir
+	output, err := lsRemote.CombinedOutput()
+	if err != nil {
+		return "", errors.New(string(output))
+	}
+	if strings.TrimSpace(string(output)) == "" {
+		// the branch hasn't been pushed yet
+		return "", nil
+	}
+
+	fetch := exec.CommandContext(ctx, "git", "fetch", "origin", fmt.Sprintf("refs/heads/%s", input.BranchName))
+	fetch.Dir = input.PlanDir
+	if output, err := fetch.CombinedOutput(); err != nil {
+		return "", errors.New(string(output))
+	}
+
+	remote, err := gitOutput(ctx, input.PlanDir, "rev-parse", "FETCH_HEAD")
+	if err != nil {
+		return "", err
+	}
+	trees := []string{}
+	for _, rev := range []string{sha + "^{tree}", remote + "^{tree}"} {
+		revParse := exec.CommandContext(ctx, "git", "rev-parse", rev)
+		revParse.Dir = input.PlanDir
+		output, err := revParse.CombinedOutput()
+		if err != nil {
+			return "", errors.New(string(output))
+		}
+		trees = append(trees, strings.TrimSpace(string(output)))
+	}
+	if trees[0] != trees[1] {
+		return "", nil
+	}
+	return remote, nil
+}
+
+// changeInBase determines if the base branch already has the planned change, e.g. because its PR
+// was merged and its branch deleted. It's only checked if the branch isn't on the remote, since
+// otherwise the PR tells whether it merged. Either a commit in the base has the campaign's
+// trailer, the commit being pushed was merged, or the base has the same contents for every file the
+// commit changes, e.g. after a squash merge.
+func changeInBase(ctx context.Context, input Input) (bool, error) {
+	lsRemote := exec.CommandContext(ctx, "git", "ls-remote", "--heads", "origin", fmt.Sprintf("refs/heads/%s", input.BranchName))
+	lsRemote.Dir = input.PlanDir
+	output, err := lsRemote.CombinedOutput()
+	if err != nil {
+		return false, errors.New(string(output))
+	}
+	if strings.TrimSpace(string(output)) != "" {
+		return false, nil
+	}
+
+	fetch := exec.CommandContext(ctx, "git", "fetch", "origin")
+	fetch.Dir = input.PlanDir
+	if output, err := fetch.CombinedOutput(); err != nil {
+		return false, errors.New(string(output))
+	}
+	verify := exec.CommandContext(ctx, "git", "rev-parse", "--verify", "--quiet", input.baseRef())
+	verify.Dir = input.PlanDir
+	if err := verify.Run(); err != nil {
+		// there's no base to compare with, e.g. the repo is empty
+		return false, nil
+	}
+
+	if input.CampaignID != "" {
+		marked, err := gitOutput(ctx, input.PlanDir, "log", "-1", "--format=%H", "--extended-regexp", "--grep", lib.CampaignTrailerPattern(input.CampaignID), input.baseRef())
+		if err != nil {
+			return false, err
+		} else if marked != "" {
+			return true, nil
+		}
+	}
+
+	isAncestor := exec.CommandContext(ctx, "git", "merge-base", "--is-ancestor", input.sourceRef(), input.baseRef())
+	isAncestor.Dir = input.PlanDir
+	if err := isAncestor.Run(); err == nil {
+		return true, nil
+	}
+
+	files, err := changedFiles(ctx, input)
+	if err != nil || len(files) == 0 {
+		// an empty commit can't already be in the base
+		return false, err
+	}
+	gitDiff := exec.CommandContext(ctx, "git", append([]string{"diff", "--quiet", input.baseRef(), input.sourceRef(), "--"}, files...)...)
+	gitDiff.Dir = input.PlanDir
+	if err := gitDiff.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
 }
 
 func different(s1, s2 *string) bool {
 	return s1 != nil && s2 != nil && *s1 != *s2
 }
 
-// Determine PR title and body
+// withTitleAffixes adds a prefix and suffix to a PR title, separated by a space, unless the
+// title already has them
+func withTitleAffixes(title string, prefix string, suffix string) string {
+	if prefix = strings.TrimSpace(prefix); prefix != "" && !strings.HasPrefix(title, prefix) {
+		title = prefix + " " + title
+	}
+	if suffix = strings.TrimSpace(suffix); suffix != "" && !strings.HasSuffix(title, suffix) {
+		title = title + " " + suffix
+	}
+	return title
+}
+
+// scriptOutputSection puts the plan script's output in a collapsed section of the PR body. The
+// code fence is longer than any run of backticks in the output, so the output can't end it.
+func scriptOutputSection(output string) string {
+	fence := "```"
+	for strings.Contains(output, fence) {
+		fence += "`"
+	}
+	return fmt.Sprintf("<details>\n<summary>Output of the plan script</summary>\n\n%s\n%s\n%s\n\n</details>\n", fence, output, fence)
+}
+
+// Campaign is the larger change a PR is part of, so its reviewers know it isn't an isolated one
+type Campaign struct {
+	Name string
+	// URL links to an overview of the campaign, e.g. its tracking issue. It's optional.
+	URL string
+	// Repos is how many repos the campaign changes
+	Repos int
+}
+
+// campaignNote says which campaign a PR is part of, linking to its overview if it has one
+func campaignNote(c Campaign) string {
+	name := c.Name
+	if c.URL != "" {
+		name = fmt.Sprintf("[%s](%s)", c.Name, c.URL)
+	}
+	repos := "repos"
+	if c.Repos == 1 {
+		repos = "repo"
+	}
+	return fmt.Sprintf("Part of campaign %s (%d %s)\n", name, c.Repos, repos)
+}
+
+// GetTitleBody determines the PR title and body
 // Title is first line of commit message.
-// Body is the remainder of the commit message after title AND/OR `body-file` content if given
-func getTitleBody(input Input) (string, string) {
+// Body is the remainder of the commit message after title AND/OR `body-file` content if given,
+// with the repo's PR template added if PRTemplateMode says to, followed by a note about the
+// campaign the PR is part of, if any, and a closing keyword if the PR closes an issue
+func GetTitleBody(input Input) (string, string) {
 	title := input.CommitMessage
 	body := input.PRBody
 
@@ -225,5 +1012,31 @@ func getTitleBody(input Input) (string, string) {
 		body = splitMsg[1] + "\n" + input.PRBody
 	}
 
+	title = withTitleAffixes(title, input.TitlePrefix, input.TitleSuffix)
+	if input.PRTemplate != "" {
+		body = withPRTemplate(body, input.PRTemplate, input.PRTemplateMode) + "\n"
+	}
+	if input.ScriptOutput != "" {
+		if body = strings.TrimRight(body, "\n"); body != "" {
+			body += "\n\n"
+		}
+		body += scriptOutputSection(input.ScriptOutput)
+	}
+	if input.Campaign.Name != "" {
+		if body = strings.TrimRight(body, "\n"); body != "" {
+			body += "\n\n"
+		}
+		body += campaignNote(input.Campaign)
+	}
+
+	if input.ClosesIssue > 0 {
+		// both Github and Gitlab close the issue when a PR with this keyword is merged
+		closes := fmt.Sprintf("Closes #%d\n", input.ClosesIssue)
+		if body = strings.TrimRight(body, "\n"); body != "" {
+			body += "\n\n"
+		}
+		body += closes
+	}
+
 	return title, body
 }
@@ -4,7 +4,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"os/exec"
+	"net/http"
+	"sort"
 	"strings"
 	"time"
 
@@ -13,6 +14,9 @@ import (
 )
 
 // GitlabPush pushes the commit to Gitlab and opens a pull request
+// - repoLimiter rate limits the # of calls to Gitlab
+// - pushLimiter rate limits the # of MRs opened
+// A nil limiter means no rate limiting.
 func GitlabPush(ctx context.Context, input Input, repoLimiter *time.Ticker, pushLimiter *time.Ticker) (Output, error) {
 	// Create client
 	p := lib.NewProviderFromConfig(input.Repo.ProviderConfig)
@@ -20,23 +24,43 @@ func GitlabPush(ctx context.Context, input Input, repoLimiter *time.Ticker, push
 	if err != nil {
 		return Output{}, err
 	}
+	if err := gitlabCheckAssignee(ctx, client, input, repoLimiter); err != nil {
+		return Output{Success: false}, err
+	}
 
-	// Get the commit SHA from the last commit
-	cmd := Command{Path: "git", Args: []string{"log", "-1", "--pretty=format:%H"}}
-	gitLog := exec.CommandContext(ctx, cmd.Path, cmd.Args...)
-	gitLog.Dir = input.PlanDir
-	gitLogOutput, err := gitLog.CombinedOutput()
-	if err != nil {
-		return Output{Success: false}, errors.New(string(gitLogOutput))
+	// Leave the repo alone if it already has an open MR, if asked to. Otherwise the MR it opens
+	// counts toward the run's OpenPRLimit.
+	if input.SkipExistingPR || input.OpenPRLimit != nil {
+		mr, err := gitlabOpenMR(ctx, client, input, repoLimiter)
+		if err != nil {
+			return Output{Success: false}, err
+		} else if mr == nil {
+			if err := input.OpenPRLimit.reserve(input); err != nil {
+				return Output{Success: false}, err
+			}
+		} else if input.SkipExistingPR {
+			assignee := ""
+			if mr.Assignee != nil {
+				assignee = mr.Assignee.Username
+			}
+			return Output{
+				Success:             true,
+				CommitSHA:           mr.SHA,
+				PullRequestURL:      mr.WebURL,
+				PullRequestNumber:   mr.IID,
+				PullRequestAssignee: assignee,
+				BranchName:          input.BranchName,
+				SkippedExistingPR:   true,
+			}, nil
+		}
 	}
 
-	// Push the commit
-	gitHeadBranch := fmt.Sprintf("HEAD:%s", input.BranchName)
-	cmd = Command{Path: "git", Args: []string{"push", "-f", "origin", gitHeadBranch}}
-	gitPush := exec.CommandContext(ctx, cmd.Path, cmd.Args...)
-	gitPush.Dir = input.PlanDir
-	if output, err := gitPush.CombinedOutput(); err != nil {
-		return Output{Success: false}, errors.New(string(output))
+	// Push the planned commit to the branch
+	pushed, err := pushPlannedBranch(ctx, input, gitlabPipelineVariableOptions(input.PipelineVariables))
+	if err != nil {
+		return Output{Success: false}, err
+	} else if pushed.Done != nil {
+		return *pushed.Done, nil
 	}
 
 	project, _, err := client.Projects.GetProject(fmt.Sprintf("%s/%s", input.Repo.Owner, input.Repo.Name), nil)
@@ -47,21 +71,76 @@ func GitlabPush(ctx context.Context, input Input, repoLimiter *time.Ticker, push
 	// Open a pull request, if one doesn't exist already
 	head := input.BranchName
 	base := project.DefaultBranch
+	if input.BaseBranch != "" {
+		base = input.BaseBranch
+	}
 
-	title, body := getTitleBody(input)
-	pr, err := findOrCreateGitlabMR(ctx, client, input.Repo.Owner, input.Repo.Name, &gitlab.CreateMergeRequestOptions{
-		Title:        &title,
-		Description:  &body,
-		SourceBranch: &head,
-		TargetBranch: &base,
-	}, repoLimiter, pushLimiter)
+	title, body := GetTitleBody(input)
+	var squash *bool
+	if input.SquashOnMerge {
+		// otherwise the project's default applies
+		squash = gitlab.Bool(true)
+	}
+	var pr *gitlab.MergeRequest
+	err = withRetries(ctx, "open MR", func() (err error) {
+		pr, err = findOrCreateGitlabMR(ctx, client, input.Repo.Owner, input.Repo.Name, &gitlab.CreateMergeRequestOptions{
+			Title:        &title,
+			Description:  &body,
+			SourceBranch: &head,
+			TargetBranch: &base,
+			Squash:       squash,
+		}, input.KeepClosed, repoLimiter, pushLimiter)
+		return err
+	})
 	if err != nil {
-		return Output{Success: false}, err
+		return Output{Success: false, ErrorCategory: errorCategory(err)}, err
+	}
+
+	// the MR is open from here on, so a failure still records it
+	opened := Output{Success: false, PullRequestURL: pr.WebURL, PullRequestNumber: pr.IID, BranchName: input.BranchName}
+
+	if !pushed.Unchanged {
+		err := waitForPushedSHA(ctx, pushed.SHA, pr.SHA, func() (string, error) {
+			lib.Wait(repoLimiter)
+			mr, _, err := client.MergeRequests.GetMergeRequest(project.ID, pr.IID, nil, gitlab.WithContext(ctx))
+			if err != nil {
+				return "", err
+			}
+			pr = mr
+			return pr.SHA, nil
+		})
+		if err != nil {
+			return opened, err
+		}
+	}
+
+	if len(input.ApprovalRules) > 0 {
+		if err := applyGitlabApprovalRules(ctx, client, project.ID, pr.IID, input.ApprovalRules, repoLimiter); err != nil {
+			return opened, fmt.Errorf("failed to apply approval rules: %w", err)
+		}
+	}
+
+	if input.ReviewersFromApprovalRules {
+		if err := requestDefaultGitlabReviews(ctx, client, project.ID, pr, repoLimiter); err != nil {
+			return opened, fmt.Errorf("failed to request reviews from the project's approval rules: %w", err)
+		}
+	}
+
+	if input.ReviewersFromCodeowners {
+		if err := requestCodeownersGitlabReviews(ctx, client, input, project.ID, pr, repoLimiter); err != nil {
+			return opened, fmt.Errorf("failed to request reviews from CODEOWNERS: %w", err)
+		}
+	}
+
+	if input.PRComment != "" {
+		if err := commentOnGitlabMR(ctx, client, input, project.ID, pr, repoLimiter); err != nil {
+			return opened, err
+		}
 	}
 
 	pipelineStatus, err := GetPipelineStatus(client, input.Repo.Owner, input.Repo.Name, &gitlab.ListProjectPipelinesOptions{SHA: &pr.SHA})
 	if err != nil {
-		return Output{Success: false}, err
+		return opened, err
 	}
 
 	buildURL := ""
@@ -74,53 +153,184 @@ func GitlabPush(ctx context.Context, input Input, repoLimiter *time.Ticker, push
 		CommitSHA:                 pr.SHA,
 		PullRequestNumber:         pr.IID,
 		PullRequestURL:            pr.WebURL,
-		PullRequestCombinedStatus: pipelineStatus,
+		PullRequestCombinedStatus: lib.NormalizeCIStatus(pipelineStatus),
 		PullRequestAssignee:       input.PRAssignee,
 		CircleCIBuildURL:          buildURL,
+		BranchName:                input.BranchName,
+		PushedAt:                  pushed.PushedAt,
+		Tag:                       pushed.Tag,
+		TagSkipped:                pushed.TagSkipped,
 	}, nil
 }
 
-func findOrCreateGitlabMR(ctx context.Context, client *gitlab.Client, owner string, name string, pull *gitlab.CreateMergeRequestOptions, repoLimiter *time.Ticker, pushLimiter *time.Ticker) (*gitlab.MergeRequest, error) {
-	var pr *gitlab.MergeRequest
-	prStatus := "opened"
-	<-pushLimiter.C
-	<-repoLimiter.C
+// findOrCreateGitlabMR finds the MR for the branch, or else opens one. A closed MR for the branch
+// is reopened rather than opening a second one, so re-running push doesn't duplicate MRs and the
+// MR's discussion is kept, unless keepClosed is set.
+func findOrCreateGitlabMR(ctx context.Context, client *gitlab.Client, owner string, name string, pull *gitlab.CreateMergeRequestOptions, keepClosed bool, repoLimiter *time.Ticker, pushLimiter *time.Ticker) (*gitlab.MergeRequest, error) {
+	ctxFunc := gitlab.WithContext(ctx)
 	pid := fmt.Sprintf("%s/%s", owner, name)
-	newMR, _, err := client.MergeRequests.CreateMergeRequest(pid, pull)
-	if err != nil && strings.Contains(err.Error(), "merge request already exists") {
-		<-repoLimiter.C
-		existingMRs, _, err := client.MergeRequests.ListMergeRequests(&gitlab.ListMergeRequestsOptions{
-			SourceBranch: pull.SourceBranch,
-			TargetBranch: pull.TargetBranch,
-			State:        &prStatus,
-		})
+	existing, err := findGitlabMR(ctx, client, pid, *pull.SourceBranch, *pull.TargetBranch, repoLimiter)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil && existing.State == "closed" && keepClosed {
+		existing = nil
+	}
+
+	if existing == nil {
+		lib.Wait(pushLimiter)
+		lib.Wait(repoLimiter)
+		pr, _, err := client.MergeRequests.CreateMergeRequest(pid, pull, ctxFunc)
+		if err != nil && strings.Contains(err.Error(), "merge request already exists") {
+			// opened since we looked, e.g. by another run
+			if pr, err = findGitlabMR(ctx, client, pid, *pull.SourceBranch, *pull.TargetBranch, repoLimiter); err == nil && pr == nil {
+				err = errors.New("unexpected: MR already exists for branch, but wasn't found")
+			}
+		}
 		if err != nil {
 			return nil, err
-		} else if len(existingMRs) != 1 {
-			return nil, errors.New("unexpected: found more than 1 MR for branch")
-		}
-		pr = existingMRs[0]
-		//If needed, update MR title and body
-		if different(&pr.Title, pull.Title) || different(&pr.Description, pull.Description) {
-			pr.Title = *pull.Title
-			pr.Description = *pull.Description
-			<-repoLimiter.C
-			pr, _, err = client.MergeRequests.UpdateMergeRequest(pid, existingMRs[0].ID, &gitlab.UpdateMergeRequestOptions{
-				TargetBranch: pull.TargetBranch,
-			})
-			if err != nil {
-				return nil, err
-			}
 		}
+		return pr, nil
+	}
 
-	} else if err != nil {
+	update := &gitlab.UpdateMergeRequestOptions{}
+	updated := false
+	if existing.State == "closed" {
+		update.StateEvent = gitlab.String("reopen")
+		updated = true
+	}
+	// If needed, update MR title and body
+	if different(&existing.Title, pull.Title) || different(&existing.Description, pull.Description) {
+		update.Title = pull.Title
+		update.Description = pull.Description
+		updated = true
+	}
+	if pull.Squash != nil && existing.Squash != *pull.Squash {
+		update.Squash = pull.Squash
+		updated = true
+	}
+	if !updated {
+		return existing, nil
+	}
+	if update.StateEvent != nil {
+		lib.Wait(pushLimiter)
+	}
+	lib.Wait(repoLimiter)
+	pr, _, err := client.MergeRequests.UpdateMergeRequest(pid, existing.IID, update, ctxFunc)
+	if err != nil {
 		return nil, err
-	} else {
-		pr = newMR
 	}
 	return pr, nil
 }
 
+// findGitlabMR finds the open MR from source to target or, if there isn't one, the most
+// recently updated MR that was closed without being merged. It returns nil if neither exists.
+func findGitlabMR(ctx context.Context, client *gitlab.Client, pid string, source, target string, repoLimiter *time.Ticker) (*gitlab.MergeRequest, error) {
+	opts := &gitlab.ListProjectMergeRequestsOptions{
+		SourceBranch: &source,
+		TargetBranch: &target,
+		OrderBy:      gitlab.String("updated_at"),
+		Sort:         gitlab.String("desc"),
+		ListOptions:  gitlab.ListOptions{PerPage: 100},
+	}
+	var open []*gitlab.MergeRequest
+	var closed *gitlab.MergeRequest
+	for {
+		lib.Wait(repoLimiter)
+		mrs, resp, err := client.MergeRequests.ListProjectMergeRequests(pid, opts, gitlab.WithContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+		for _, mr := range mrs {
+			if mr.State == "opened" {
+				open = append(open, mr)
+			} else if closed == nil && mr.State == "closed" {
+				closed = mr
+			}
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+
+	if len(open) > 1 {
+		return nil, errors.New("unexpected: found more than 1 MR for branch")
+	} else if len(open) == 1 {
+		return open[0], nil
+	}
+	return closed, nil
+}
+
+// applyGitlabApprovalRules creates the MR's approval rules, or updates the existing rules
+// with the same names, so re-running push doesn't duplicate them
+func applyGitlabApprovalRules(ctx context.Context, client *gitlab.Client, pid int, iid int, rules []ApprovalRule, repoLimiter *time.Ticker) error {
+	ctxFunc := gitlab.WithContext(ctx)
+	lib.Wait(repoLimiter)
+	existing, _, err := client.MergeRequestApprovals.GetApprovalRules(pid, iid, ctxFunc)
+	if err != nil {
+		return err
+	}
+	existingByName := map[string]*gitlab.MergeRequestApprovalRule{}
+	for _, rule := range existing {
+		existingByName[rule.Name] = rule
+	}
+
+	for _, rule := range rules {
+		rule := rule
+		lib.Wait(repoLimiter)
+		if current, ok := existingByName[rule.Name]; ok {
+			_, _, err = client.MergeRequestApprovals.UpdateApprovalRule(pid, iid, current.ID, &gitlab.UpdateMergeRequestApprovalRuleOptions{
+				ApprovalsRequired: &rule.ApprovalsRequired,
+				UserIDs:           &rule.UserIDs,
+				GroupIDs:          &rule.GroupIDs,
+			}, ctxFunc)
+		} else {
+			_, _, err = client.MergeRequestApprovals.CreateApprovalRule(pid, iid, &gitlab.CreateMergeRequestApprovalRuleOptions{
+				Name:              &rule.Name,
+				ApprovalsRequired: &rule.ApprovalsRequired,
+				UserIDs:           &rule.UserIDs,
+				GroupIDs:          &rule.GroupIDs,
+			}, ctxFunc)
+		}
+		if err != nil {
+			return fmt.Errorf("rule '%s': %w", rule.Name, err)
+		}
+	}
+	return nil
+}
+
+// commentOnGitlabMR posts the PRComment on an MR, unless it already has the same comment
+func commentOnGitlabMR(ctx context.Context, client *gitlab.Client, input Input, pid int, mr *gitlab.MergeRequest, repoLimiter *time.Ticker) error {
+	comment, err := renderComment(input, mr.IID, mr.WebURL)
+	if err != nil {
+		return err
+	}
+	ctxFunc := gitlab.WithContext(ctx)
+
+	opts := &gitlab.ListMergeRequestNotesOptions{ListOptions: gitlab.ListOptions{PerPage: 100}}
+	for {
+		lib.Wait(repoLimiter)
+		notes, resp, err := client.Notes.ListMergeRequestNotes(pid, mr.IID, opts, ctxFunc)
+		if err != nil {
+			return err
+		}
+		for _, note := range notes {
+			if !note.System && strings.TrimSpace(note.Body) == comment {
+				return nil
+			}
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+
+	lib.Wait(repoLimiter)
+	_, _, err = client.Notes.CreateMergeRequestNote(pid, mr.IID, &gitlab.CreateMergeRequestNoteOptions{Body: &comment}, ctxFunc)
+	return err
+}
+
 // GetPipelineStatus returns status of pipeline, if pipeline is absent, returns unknown string
 func GetPipelineStatus(client *gitlab.Client, owner string, name string, opts *gitlab.ListProjectPipelinesOptions) (string, error) {
 	pid := fmt.Sprintf("%s/%s", owner, name)
@@ -132,3 +342,118 @@ func GetPipelineStatus(client *gitlab.Client, owner string, name string, opts *g
 	}
 	return pipeline[0].Status, nil
 }
+
+// requestCodeownersGitlabReviews adds the CODEOWNERS of an MR's changed files to its reviewers.
+// Groups, and owners that aren't Gitlab users, can't be reviewers so they're left out.
+func requestCodeownersGitlabReviews(ctx context.Context, client *gitlab.Client, input Input, pid int, mr *gitlab.MergeRequest, repoLimiter *time.Ticker) error {
+	users, _, err := codeownersReviewers(ctx, input)
+	if err != nil {
+		return err
+	}
+	ids := []int{}
+	for _, username := range users {
+		username := username
+		lib.Wait(repoLimiter)
+		found, _, err := client.Users.ListUsers(&gitlab.ListUsersOptions{Username: &username}, gitlab.WithContext(ctx))
+		if err != nil {
+			return err
+		} else if len(found) == 0 {
+			continue
+		}
+		ids = append(ids, found[0].ID)
+	}
+	return addGitlabReviewers(ctx, client, pid, mr, ids, repoLimiter)
+}
+
+// requestDefaultGitlabReviews adds the eligible approvers of the project's approval rules to an
+// MR's reviewers, so it lands in their review queues. Projects without approval rules, including
+// those on Gitlab tiers that don't have them, are left alone.
+func requestDefaultGitlabReviews(ctx context.Context, client *gitlab.Client, pid int, mr *gitlab.MergeRequest, repoLimiter *time.Ticker) error {
+	lib.Wait(repoLimiter)
+	rules, resp, err := client.Projects.GetProjectApprovalRules(pid, nil, gitlab.WithContext(ctx))
+	if err != nil {
+		if resp != nil && (resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusForbidden) {
+			return nil
+		}
+		return err
+	}
+	ids := []int{}
+	for _, rule := range rules {
+		approvers := rule.EligibleApprovers
+		if len(approvers) == 0 {
+			approvers = rule.Users
+		}
+		for _, approver := range approvers {
+			ids = append(ids, approver.ID)
+		}
+	}
+	return addGitlabReviewers(ctx, client, pid, mr, ids, repoLimiter)
+}
+
+// addGitlabReviewers adds users to an MR's reviewers, besides its author and those it has, and
+// updates mr with the result
+func addGitlabReviewers(ctx context.Context, client *gitlab.Client, pid int, mr *gitlab.MergeRequest, userIDs []int, repoLimiter *time.Ticker) error {
+	ids := []int{}
+	for _, reviewer := range mr.Reviewers {
+		ids = append(ids, reviewer.ID)
+	}
+	added := false
+	for _, id := range userIDs {
+		if (mr.Author != nil && id == mr.Author.ID) || containsInt(ids, id) {
+			continue
+		}
+		ids = append(ids, id)
+		added = true
+	}
+	if !added {
+		return nil
+	}
+	lib.Wait(repoLimiter)
+	updated, _, err := client.MergeRequests.UpdateMergeRequest(pid, mr.IID, &gitlab.UpdateMergeRequestOptions{ReviewerIDs: &ids}, gitlab.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	mr.Reviewers = updated.Reviewers
+	return nil
+}
+
+func containsInt(list []int, item int) bool {
+	for _, each := range list {
+		if each == item {
+			return true
+		}
+	}
+	return false
+}
+
+// gitlabPipelineVariableOptions are the git push options that set variables on the pipeline
+// Gitlab starts for a push, sorted by key
+func gitlabPipelineVariableOptions(variables map[string]string) []string {
+	keys := []string{}
+	for key := range variables {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	options := []string{}
+	for _, key := range keys {
+		options = append(options, "-o", fmt.Sprintf("ci.variable=%s=%s", key, variables[key]))
+	}
+	return options
+}
+
+// GitlabUserIDs looks up the IDs of Gitlab users by username, erroring if any don't exist
+func GitlabUserIDs(ctx context.Context, client *gitlab.Client, usernames []string, repoLimiter *time.Ticker) ([]int, error) {
+	ids := []int{}
+	for _, username := range usernames {
+		username := username
+		lib.Wait(repoLimiter)
+		users, _, err := client.Users.ListUsers(&gitlab.ListUsersOptions{Username: &username}, gitlab.WithContext(ctx))
+		if err != nil {
+			return nil, err
+		} else if len(users) == 0 {
+			return nil, fmt.Errorf("gitlab user '%s' not found", username)
+		}
+		ids = append(ids, users[0].ID)
+	}
+	return ids, nil
+}
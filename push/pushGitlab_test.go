@@ -0,0 +1,152 @@
+package push
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xanzy/go-gitlab"
+)
+
+func TestFindOrCreateGitlabMRWithoutLimiters(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v4/projects/owner/name/merge_requests", r.URL.Path)
+		if r.Method == http.MethodGet {
+			json.NewEncoder(w).Encode([]gitlab.MergeRequest{})
+			return
+		}
+		assert.Equal(t, http.MethodPost, r.Method)
+		json.NewEncoder(w).Encode(gitlab.MergeRequest{IID: 7, Title: "title", WebURL: "https://gitlab.com/owner/name/-/merge_requests/7"})
+	}))
+	defer server.Close()
+
+	client, err := gitlab.NewClient("token", gitlab.WithBaseURL(server.URL))
+	assert.NoError(t, err)
+
+	title, head, base := "title", "branch", "main"
+	mr, err := findOrCreateGitlabMR(context.Background(), client, "owner", "name", &gitlab.CreateMergeRequestOptions{
+		Title:        &title,
+		SourceBranch: &head,
+		TargetBranch: &base,
+	}, false, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 7, mr.IID)
+}
+
+func TestFindOrCreateGitlabMRReopensClosedMR(t *testing.T) {
+	var update map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/api/v4/projects/owner/name/merge_requests":
+			assert.Equal(t, "branch", r.URL.Query().Get("source_branch"))
+			assert.Equal(t, "main", r.URL.Query().Get("target_branch"))
+			json.NewEncoder(w).Encode([]gitlab.MergeRequest{
+				{ID: 1002, IID: 8, State: "merged", Title: "title"},
+				{ID: 1001, IID: 7, State: "closed", Title: "old title"},
+			})
+		case r.Method == http.MethodPut && r.URL.Path == "/api/v4/projects/owner/name/merge_requests/7":
+			json.NewDecoder(r.Body).Decode(&update)
+			json.NewEncoder(w).Encode(gitlab.MergeRequest{ID: 1001, IID: 7, State: "opened", Title: "title"})
+		default:
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	client, err := gitlab.NewClient("token", gitlab.WithBaseURL(server.URL))
+	assert.NoError(t, err)
+
+	title, body, head, base := "title", "body", "branch", "main"
+	mr, err := findOrCreateGitlabMR(context.Background(), client, "owner", "name", &gitlab.CreateMergeRequestOptions{
+		Title:        &title,
+		Description:  &body,
+		SourceBranch: &head,
+		TargetBranch: &base,
+	}, false, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 7, mr.IID)
+	assert.Equal(t, "opened", mr.State)
+	assert.Equal(t, "reopen", update["state_event"])
+	assert.Equal(t, "title", update["title"])
+}
+
+func TestFindOrCreateGitlabMRReconcilesSquash(t *testing.T) {
+	var update map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/api/v4/projects/owner/name/merge_requests":
+			json.NewEncoder(w).Encode([]gitlab.MergeRequest{{ID: 1001, IID: 7, State: "opened", Title: "title"}})
+		case r.Method == http.MethodPut && r.URL.Path == "/api/v4/projects/owner/name/merge_requests/7":
+			json.NewDecoder(r.Body).Decode(&update)
+			json.NewEncoder(w).Encode(gitlab.MergeRequest{ID: 1001, IID: 7, State: "opened", Title: "title", Squash: true})
+		default:
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	client, err := gitlab.NewClient("token", gitlab.WithBaseURL(server.URL))
+	assert.NoError(t, err)
+
+	title, head, base := "title", "branch", "main"
+	mr, err := findOrCreateGitlabMR(context.Background(), client, "owner", "name", &gitlab.CreateMergeRequestOptions{
+		Title:        &title,
+		SourceBranch: &head,
+		TargetBranch: &base,
+		Squash:       gitlab.Bool(true),
+	}, false, nil, nil)
+	assert.NoError(t, err)
+	assert.True(t, mr.Squash)
+	assert.Equal(t, map[string]interface{}{"squash": true}, update)
+}
+
+func TestGitlabPipelineVariableOptions(t *testing.T) {
+	assert.Equal(t, []string{}, gitlabPipelineVariableOptions(nil))
+	assert.Equal(t, []string{"-o", "ci.variable=A=1", "-o", "ci.variable=B=x=y"}, gitlabPipelineVariableOptions(map[string]string{"B": "x=y", "A": "1"}))
+}
+
+func TestRequestDefaultGitlabReviews(t *testing.T) {
+	var update map[string]interface{}
+	rulesStatus := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/api/v4/projects/42/approval_rules":
+			w.WriteHeader(rulesStatus)
+			json.NewEncoder(w).Encode([]gitlab.ProjectApprovalRule{
+				{Name: "All Members", RuleType: "any_approver"},
+				{Name: "Backend", EligibleApprovers: []*gitlab.BasicUser{{ID: 1}, {ID: 2}, {ID: 3}}},
+			})
+		case r.Method == http.MethodPut && r.URL.Path == "/api/v4/projects/42/merge_requests/7":
+			json.NewDecoder(r.Body).Decode(&update)
+			json.NewEncoder(w).Encode(gitlab.MergeRequest{IID: 7, Reviewers: []*gitlab.BasicUser{{ID: 2}, {ID: 3}, {ID: 4}}})
+		default:
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	client, err := gitlab.NewClient("token", gitlab.WithBaseURL(server.URL))
+	assert.NoError(t, err)
+
+	// the author can't review their own MR, and existing reviewers are kept
+	mr := &gitlab.MergeRequest{IID: 7, Author: &gitlab.BasicUser{ID: 1}, Reviewers: []*gitlab.BasicUser{{ID: 4}}}
+	assert.NoError(t, requestDefaultGitlabReviews(context.Background(), client, 42, mr, nil))
+	assert.Equal(t, []interface{}{4.0, 2.0, 3.0}, update["reviewer_ids"])
+	assert.Len(t, mr.Reviewers, 3)
+
+	// nothing to add
+	update = nil
+	assert.NoError(t, requestDefaultGitlabReviews(context.Background(), client, 42, mr, nil))
+	assert.Nil(t, update)
+
+	// tiers without approval rules are left alone
+	rulesStatus = http.StatusForbidden
+	assert.NoError(t, requestDefaultGitlabReviews(context.Background(), client, 42, &gitlab.MergeRequest{IID: 7}, nil))
+	assert.Nil(t, update)
+}
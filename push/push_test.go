@@ -0,0 +1,628 @@
+package push
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Clever/microplane/lib"
+	"github.com/google/go-github/v35/github"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetTitleBody(t *testing.T) {
+	title, body := GetTitleBody(Input{CommitMessage: "Bump deps\nBecause they're old"})
+	assert.Equal(t, "Bump deps", title)
+	assert.Equal(t, "Because they're old\n", body)
+
+	title, body = GetTitleBody(Input{CommitMessage: "Bump deps\nBecause they're old", ClosesIssue: 12})
+	assert.Equal(t, "Bump deps", title)
+	assert.Equal(t, "Because they're old\n\nCloses #12\n", body)
+
+	title, body = GetTitleBody(Input{CommitMessage: "Bump deps", ClosesIssue: 12})
+	assert.Equal(t, "Bump deps", title)
+	assert.Equal(t, "Closes #12\n", body)
+
+	_, body = GetTitleBody(Input{CommitMessage: "Bump deps\nBecause they're old", ClosesIssue: 12, Campaign: Campaign{Name: "Go 1.17", URL: "https://example.com/go117", Repos: 40}})
+	assert.Equal(t, "Because they're old\n\nPart of campaign [Go 1.17](https://example.com/go117) (40 repos)\n\nCloses #12\n", body)
+
+	_, body = GetTitleBody(Input{CommitMessage: "Bump deps", Campaign: Campaign{Name: "Go 1.17", Repos: 1}})
+	assert.Equal(t, "Part of campaign Go 1.17 (1 repo)\n", body)
+
+	title, _ = GetTitleBody(Input{CommitMessage: "Bump deps\nBecause", TitlePrefix: "[codemod]", TitleSuffix: "(infra) "})
+	assert.Equal(t, "[codemod] Bump deps (infra)", title)
+
+	title, _ = GetTitleBody(Input{CommitMessage: "[codemod] Bump deps", TitlePrefix: "[codemod] "})
+	assert.Equal(t, "[codemod] Bump deps", title)
+}
+
+func TestParseApprovalRule(t *testing.T) {
+	rule, err := ParseApprovalRule("name=security;approvals=2;users=12, 34;groups=56")
+	assert.NoError(t, err)
+	assert.Equal(t, ApprovalRule{Name: "security", ApprovalsRequired: 2, UserIDs: []int{12, 34}, GroupIDs: []int{56}}, rule)
+
+	rule, err = ParseApprovalRule("name=owners")
+	assert.NoError(t, err)
+	assert.Equal(t, ApprovalRule{Name: "owners", ApprovalsRequired: 1, UserIDs: []int{}, GroupIDs: []int{}}, rule)
+
+	for _, invalid := range []string{"", "approvals=1", "name=x;approvals=one", "name=x;users=alice", "name=x;colour=red", "name"} {
+		_, err = ParseApprovalRule(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestRenderComment(t *testing.T) {
+	input := Input{
+		Repo:       lib.Repo{Owner: "clever", Name: "app"},
+		BranchName: "bump",
+		PRComment:  "Rolling out {{.Branch}} to {{.Owner}}/{{.Name}} in #{{.PRNumber}}\n",
+	}
+	comment, err := renderComment(input, 7, "https://github.com/clever/app/pull/7")
+	assert.NoError(t, err)
+	assert.Equal(t, "Rolling out bump to clever/app in #7", comment)
+
+	input.PRComment = "{{.Nope}}"
+	_, err = renderComment(input, 7, "")
+	assert.Error(t, err)
+}
+
+// githubTestClient returns a Github client for a test server, along with the PR to open from branch to main
+func githubTestClient(t *testing.T, handler http.HandlerFunc) (*github.Client, *github.NewPullRequest, func()) {
+	server := httptest.NewServer(handler)
+	client := github.NewClient(nil)
+	baseURL, err := url.Parse(server.URL + "/")
+	assert.NoError(t, err)
+	client.BaseURL = baseURL
+	return client, &github.NewPullRequest{
+		Title: github.String("title"),
+		Body:  github.String("body"),
+		Head:  github.String("owner:branch"),
+		Base:  github.String("main"),
+	}, server.Close
+}
+
+func TestFindOrCreatePRReopensClosedPR(t *testing.T) {
+	var update map[string]interface{}
+	mergedAt := time.Now()
+	client, pull, done := githubTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/repos/owner/name/pulls":
+			assert.Equal(t, "owner:branch", r.URL.Query().Get("head"))
+			assert.Equal(t, "all", r.URL.Query().Get("state"))
+			json.NewEncoder(w).Encode([]github.PullRequest{
+				{Number: github.Int(8), State: github.String("closed"), MergedAt: &mergedAt, Title: github.String("title")},
+				{Number: github.Int(7), State: github.String("closed"), Title: github.String("title"), Body: github.String("body")},
+			})
+		case r.Method == http.MethodPatch && r.URL.Path == "/repos/owner/name/pulls/7":
+			json.NewDecoder(r.Body).Decode(&update)
+			json.NewEncoder(w).Encode(github.PullRequest{Number: github.Int(7), State: github.String("open")})
+		default:
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	defer done()
+
+	pr, err := findOrCreatePR(context.Background(), client, "owner", "name", pull, false, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 7, pr.GetNumber())
+	assert.Equal(t, map[string]interface{}{"state": "open"}, update)
+}
+
+func TestFindOrCreatePROpensPRWhenReopenFails(t *testing.T) {
+	created := false
+	client, pull, done := githubTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/repos/owner/name/pulls":
+			json.NewEncoder(w).Encode([]github.PullRequest{{Number: github.Int(7), State: github.String("closed")}})
+		case r.Method == http.MethodPatch && r.URL.Path == "/repos/owner/name/pulls/7":
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(`{"message": "state cannot be changed. The branch has been force-pushed."}`))
+		case r.Method == http.MethodPost && r.URL.Path == "/repos/owner/name/pulls":
+			created = true
+			json.NewEncoder(w).Encode(github.PullRequest{Number: github.Int(9), State: github.String("open")})
+		default:
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	defer done()
+
+	pr, err := findOrCreatePR(context.Background(), client, "owner", "name", pull, false, nil, nil)
+	assert.NoError(t, err)
+	assert.True(t, created)
+	assert.Equal(t, 9, pr.GetNumber())
+}
+
+func TestFindOrCreatePRKeepsClosedPR(t *testing.T) {
+	created := false
+	client, pull, done := githubTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/repos/owner/name/pulls":
+			json.NewEncoder(w).Encode([]github.PullRequest{{Number: github.Int(7), State: github.String("closed")}})
+		case r.Method == http.MethodPost && r.URL.Path == "/repos/owner/name/pulls":
+			created = true
+			json.NewEncoder(w).Encode(github.PullRequest{Number: github.Int(9), State: github.String("open")})
+		default:
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	defer done()
+
+	pr, err := findOrCreatePR(context.Background(), client, "owner", "name", pull, true, nil, nil)
+	assert.NoError(t, err)
+	assert.True(t, created)
+	assert.Equal(t, 9, pr.GetNumber())
+}
+
+func TestRenderTag(t *testing.T) {
+	input := Input{
+		Repo:       lib.Repo{Owner: "clever", Name: "app"},
+		BranchName: "bump",
+		Tag:        "{{.Name}}/v{{.Metadata.version}}",
+		Metadata:   map[string]string{"version": "1.2.0"},
+	}
+	tag, err := renderTag(input)
+	assert.NoError(t, err)
+	assert.Equal(t, "app/v1.2.0", tag)
+
+	input.Tag = "v{{.Metadata.missing}}"
+	_, err = renderTag(input)
+	assert.Error(t, err)
+
+	input.Tag = "bad tag"
+	_, err = renderTag(input)
+	assert.Error(t, err)
+}
+
+// TestPushRejected checks that a rejected git push fails just that repo, with git's output
+func TestPushRejected(t *testing.T) {
+	t.Setenv("GITHUB_API_TOKEN", "test")
+	for _, env := range []string{"GIT_AUTHOR_NAME", "GIT_AUTHOR_EMAIL", "GIT_COMMITTER_NAME", "GIT_COMMITTER_EMAIL"} {
+		t.Setenv(env, "microplane@example.com")
+	}
+	dir := t.TempDir()
+	git := func(dir string, args ...string) {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		output, err := cmd.CombinedOutput()
+		assert.NoError(t, err, string(output))
+	}
+	remote := filepath.Join(dir, "remote.git")
+	planDir := filepath.Join(dir, "planned")
+	git(dir, "init", "--quiet", "--bare", remote)
+	hook := "#!/bin/sh\necho 'protected branch hook declined' >&2\nexit 1\n"
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(remote, "hooks", "pre-receive"), []byte(hook), 0755))
+	git(dir, "clone", "--quiet", remote, planDir)
+	git(planDir, "checkout", "--quiet", "-b", "mp-change")
+	git(planDir, "commit", "--quiet", "--allow-empty", "-m", "Change")
+
+	output, err := Push(context.Background(), Input{
+		Repo:          lib.Repo{Owner: "clever", Name: "app", ProviderConfig: lib.ProviderConfig{Backend: "github"}},
+		PlanDir:       planDir,
+		BranchName:    "mp-change",
+		CommitMessage: "Change",
+	}, nil, nil)
+	assert.False(t, output.Success)
+	assert.True(t, errors.Is(err, lib.ErrGitPush))
+	assert.Equal(t, "git-push", output.ErrorKind)
+	assert.Contains(t, err.Error(), "protected branch hook declined")
+}
+
+func TestFindPRTemplate(t *testing.T) {
+	dir := t.TempDir()
+	githubRepo := lib.Repo{ProviderConfig: lib.ProviderConfig{Backend: "github"}}
+	gitlabRepo := lib.Repo{ProviderConfig: lib.ProviderConfig{Backend: "gitlab"}}
+	write := func(path, content string) {
+		assert.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(dir, path)), 0755))
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, path), []byte(content), 0644))
+	}
+
+	prTemplate, err := FindPRTemplate(dir, githubRepo, "")
+	assert.NoError(t, err)
+	assert.Equal(t, "", prTemplate)
+
+	write("docs/pull_request_template.md", "docs template")
+	write(".github/PULL_REQUEST_TEMPLATE.md", "## Checklist\n")
+	write(".github/PULL_REQUEST_TEMPLATE/deps.md", "deps template")
+	write(".gitlab/merge_request_templates/Default.md", "gitlab template")
+	for _, test := range []struct {
+		repo     lib.Repo
+		name     string
+		expected string
+	}{
+		{githubRepo, "", "## Checklist"},
+		{githubRepo, "deps", "deps template"},
+		{githubRepo, "missing", "## Checklist"},
+		{gitlabRepo, "", "gitlab template"},
+	} {
+		prTemplate, err := FindPRTemplate(dir, test.repo, test.name)
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, prTemplate)
+	}
+}
+
+func TestPRTemplateBody(t *testing.T) {
+	input := Input{CommitMessage: "Bump deps\nBecause", PRTemplate: "## Checklist", PRTemplateMode: PRTemplatePrepend, ClosesIssue: 3}
+	_, body := GetTitleBody(input)
+	assert.Equal(t, "## Checklist\n\nBecause\n\nCloses #3\n", body)
+
+	input.PRTemplateMode = PRTemplateAppend
+	_, body = GetTitleBody(input)
+	assert.Equal(t, "Because\n\n## Checklist\n\nCloses #3\n", body)
+
+	body, err := RenderPRBody("{{.PRTemplate}}\n\nUpdates {{.Name}}", PRBodyVars{Name: "app", PRTemplate: "## Checklist"})
+	assert.NoError(t, err)
+	assert.Equal(t, "## Checklist\n\nUpdates app", body)
+	_, err = RenderPRBody("{{.Nope}}", PRBodyVars{})
+	assert.Error(t, err)
+}
+
+// TestPushBranchWithLease checks that a push rejected because someone else pushed to the branch
+// is rebased onto their commit and retried
+func TestPushBranchWithLease(t *testing.T) {
+	for _, env := range []string{"GIT_AUTHOR_NAME", "GIT_AUTHOR_EMAIL", "GIT_COMMITTER_NAME", "GIT_COMMITTER_EMAIL"} {
+		t.Setenv(env, "microplane@example.com")
+	}
+	dir := t.TempDir()
+	git := func(dir string, args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		output, err := cmd.CombinedOutput()
+		assert.NoError(t, err, string(output))
+		return strings.TrimSpace(string(output))
+	}
+	remote := filepath.Join(dir, "remote.git")
+	planDir := filepath.Join(dir, "planned")
+	reviewerDir := filepath.Join(dir, "reviewer")
+	git(dir, "init", "--quiet", "--bare", remote)
+	git(dir, "clone", "--quiet", remote, planDir)
+	git(planDir, "commit", "--quiet", "--allow-empty", "-m", "Initial")
+	git(planDir, "push", "--quiet", "origin", "HEAD:refs/heads/main")
+	git(planDir, "checkout", "--quiet", "-b", "mp-change")
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(planDir, "change"), []byte("v1"), 0644))
+	git(planDir, "add", "change")
+	git(planDir, "commit", "--quiet", "-m", "Change")
+	lease := git(planDir, "rev-parse", "HEAD")
+	git(planDir, "push", "--quiet", "origin", "HEAD:refs/heads/mp-change")
+
+	// a reviewer pushes a fix to the branch
+	git(dir, "clone", "--quiet", "--branch", "mp-change", remote, reviewerDir)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(reviewerDir, "fix"), []byte("fix"), 0644))
+	git(reviewerDir, "add", "fix")
+	git(reviewerDir, "commit", "--quiet", "-m", "Fix")
+	git(reviewerDir, "push", "--quiet", "origin", "mp-change")
+
+	// and the change is re-planned
+	git(planDir, "reset", "--quiet", "--hard", "HEAD~1")
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(planDir, "change"), []byte("v2"), 0644))
+	git(planDir, "add", "change")
+	git(planDir, "commit", "--quiet", "-m", "Change")
+	planned := git(planDir, "rev-parse", "HEAD")
+
+	input := Input{Repo: lib.Repo{Owner: "clever", Name: "app"}, PlanDir: planDir, BranchName: "mp-change", ForceWithLease: true, LeaseSHA: lease, PushAttempts: 1}
+	_, err := pushBranch(context.Background(), input, planned, nil)
+	assert.True(t, errors.Is(err, lib.ErrGitPush))
+
+	input.PushAttempts = 2
+	pushed, err := pushBranch(context.Background(), input, planned, nil)
+	assert.NoError(t, err)
+	assert.NotEqual(t, planned, pushed)
+	assert.Equal(t, pushed, git(planDir, "rev-parse", "refs/remotes/origin/mp-change"))
+	assert.Equal(t, "fix", git(planDir, "show", pushed+":fix"))
+	assert.Equal(t, "v2", git(planDir, "show", pushed+":change"))
+	assert.Equal(t, planned, git(planDir, "rev-parse", pushed+"~1"))
+}
+
+// TestRemoteBranchUnchanged checks that a re-planned commit with the same tree as the remote
+// branch resolves to the remote's commit, which is the one the PR is on
+func TestRemoteBranchUnchanged(t *testing.T) {
+	for _, env := range []string{"GIT_AUTHOR_NAME", "GIT_AUTHOR_EMAIL", "GIT_COMMITTER_NAME", "GIT_COMMITTER_EMAIL"} {
+		t.Setenv(env, "microplane@example.com")
+	}
+	dir := t.TempDir()
+	git := func(dir string, args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		output, err := cmd.CombinedOutput()
+		assert.NoError(t, err, string(output))
+		return strings.TrimSpace(string(output))
+	}
+	remote := filepath.Join(dir, "remote.git")
+	planDir := filepath.Join(dir, "planned")
+	git(dir, "init", "--quiet", "--bare", remote)
+	git(dir, "clone", "--quiet", remote, planDir)
+	git(planDir, "commit", "--quiet", "--allow-empty", "-m", "Initial")
+	git(planDir, "checkout", "--quiet", "-b", "mp-change")
+	input := Input{PlanDir: planDir, BranchName: "mp-change"}
+
+	// the branch hasn't been pushed yet
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(planDir, "change"), []byte("v1"), 0644))
+	git(planDir, "add", "change")
+	git(planDir, "commit", "--quiet", "-m", "Change")
+	pushed := git(planDir, "rev-parse", "HEAD")
+	unchanged, err := remoteBranchUnchanged(context.Background(), input, pushed)
+	assert.NoError(t, err)
+	assert.Equal(t, "", unchanged)
+	git(planDir, "push", "--quiet", "origin", "HEAD:refs/heads/mp-change")
+
+	// re-planning makes a new commit with the same tree
+	git(planDir, "commit", "--quiet", "--amend", "--date", "2001-01-01T00:00:00", "-m", "Change again")
+	replanned := git(planDir, "rev-parse", "HEAD")
+	assert.NotEqual(t, pushed, replanned)
+	unchanged, err = remoteBranchUnchanged(context.Background(), input, replanned)
+	assert.NoError(t, err)
+	assert.Equal(t, pushed, unchanged)
+
+	// or a different one
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(planDir, "change"), []byte("v2"), 0644))
+	git(planDir, "commit", "--quiet", "--amend", "-a", "-m", "Change")
+	unchanged, err = remoteBranchUnchanged(context.Background(), input, git(planDir, "rev-parse", "HEAD"))
+	assert.NoError(t, err)
+	assert.Equal(t, "", unchanged)
+}
+
+func TestScriptOutputBody(t *testing.T) {
+	_, body := GetTitleBody(Input{CommitMessage: "Bump deps\nBecause", ScriptOutput: "bumped 3 deps", ClosesIssue: 3})
+	assert.Equal(t, "Because\n\n<details>\n<summary>Output of the plan script</summary>\n\n```\nbumped 3 deps\n```\n\n</details>\n\nCloses #3\n", body)
+
+	assert.Equal(t, "<details>\n<summary>Output of the plan script</summary>\n\n````\nsee ```code```\n````\n\n</details>\n", scriptOutputSection("see ```code```"))
+}
+
+func TestRenderAssignee(t *testing.T) {
+	vars := AssigneeVars{Owner: "clever", Name: "app", Metadata: map[string]string{"owner": "@alice "}}
+	assignee, err := RenderAssignee("{{.Metadata.owner}}", vars)
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", assignee)
+	assignee, err = RenderAssignee("bob", vars)
+	assert.NoError(t, err)
+	assert.Equal(t, "bob", assignee)
+
+	_, err = RenderAssignee("{{.Metadata.team}}", vars)
+	assert.Error(t, err)
+	_, err = RenderAssignee("{{.Metadata.owner}}", AssigneeVars{Metadata: map[string]string{"owner": ""}})
+	assert.Error(t, err)
+}
+
+func TestGithubCheckAssignee(t *testing.T) {
+	lookups := 0
+	client, _, done := githubTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		lookups++
+		if r.URL.Path == "/users/alice" {
+			json.NewEncoder(w).Encode(github.User{Login: github.String("alice")})
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	})
+	defer done()
+
+	input := Input{Repo: lib.Repo{Owner: "owner", Name: "name", ProviderConfig: lib.ProviderConfig{Backend: "github", BackendURL: "https://github.test"}}, PRAssignee: "alice"}
+	assert.NoError(t, githubCheckAssignee(context.Background(), client, input, nil))
+	// found users are only looked up once
+	assert.NoError(t, githubCheckAssignee(context.Background(), client, input, nil))
+	assert.Equal(t, 1, lookups)
+
+	input.PRAssignee = "nobody"
+	err := githubCheckAssignee(context.Background(), client, input, nil)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "github user 'nobody' not found")
+}
+
+func TestTooManyChangedFiles(t *testing.T) {
+	files := []string{"a", "b", "c", "d", "e", "f", "g"}
+	assert.NoError(t, tooManyChangedFiles(files, 7))
+	err := tooManyChangedFiles(files, 6)
+	assert.Error(t, err)
+	assert.Equal(t, "plan changed 7 files, more than --max-changed-files allows (6), so it wasn't pushed: a, b, c, d, e and 2 more", err.Error())
+	assert.Equal(t, "plan changed 2 files, more than --max-changed-files allows (1), so it wasn't pushed: a, b", tooManyChangedFiles(files[:2], 1).Error())
+}
+
+func TestChangeInBase(t *testing.T) {
+	for _, env := range []string{"GIT_AUTHOR_NAME", "GIT_AUTHOR_EMAIL", "GIT_COMMITTER_NAME", "GIT_COMMITTER_EMAIL"} {
+		t.Setenv(env, "microplane@example.com")
+	}
+	dir := t.TempDir()
+	git := func(dir string, args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		output, err := cmd.CombinedOutput()
+		assert.NoError(t, err, string(output))
+		return strings.TrimSpace(string(output))
+	}
+	remote := filepath.Join(dir, "remote.git")
+	planDir := filepath.Join(dir, "planned")
+	otherDir := filepath.Join(dir, "other")
+	git(dir, "init", "--quiet", "--bare", remote)
+	git(dir, "clone", "--quiet", remote, planDir)
+	git(planDir, "commit", "--quiet", "--allow-empty", "-m", "Initial")
+	git(planDir, "push", "--quiet", "origin", "HEAD:refs/heads/main")
+	git(planDir, "checkout", "--quiet", "-b", "mp-change")
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(planDir, "change"), []byte("v1"), 0644))
+	git(planDir, "add", "change")
+	git(planDir, "commit", "--quiet", "-m", "Change")
+	input := Input{PlanDir: planDir, BranchName: "mp-change", BaseBranch: "main"}
+
+	inBase, err := changeInBase(context.Background(), input)
+	assert.NoError(t, err)
+	assert.False(t, inBase)
+
+	// while the branch is pushed, its PR decides
+	git(planDir, "push", "--quiet", "origin", "HEAD:refs/heads/mp-change")
+	inBase, err = changeInBase(context.Background(), input)
+	assert.NoError(t, err)
+	assert.False(t, inBase)
+
+	// the PR is squash merged by hand, and the branch deleted
+	git(dir, "clone", "--quiet", "--branch", "main", remote, otherDir)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(otherDir, "change"), []byte("v1"), 0644))
+	git(otherDir, "add", "change")
+	git(otherDir, "commit", "--quiet", "-m", "Change (#1)")
+	git(otherDir, "push", "--quiet", "origin", "main", ":mp-change")
+	inBase, err = changeInBase(context.Background(), input)
+	assert.NoError(t, err)
+	assert.True(t, inBase)
+
+	// a backport is checked by its own commit, not the plan dir's HEAD
+	git(planDir, "checkout", "--quiet", "-b", "backport", "origin/main~1")
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(planDir, "backported"), []byte("v1"), 0644))
+	git(planDir, "add", "backported")
+	git(planDir, "commit", "--quiet", "-m", "Change (release-1)")
+	backport := git(planDir, "rev-parse", "HEAD")
+	git(planDir, "checkout", "--quiet", "mp-change")
+	input.BranchName = "mp-change-release-1"
+	input.SourceRef = backport
+	files, err := changedFiles(context.Background(), input)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"backported"}, files)
+	inBase, err = changeInBase(context.Background(), input)
+	assert.NoError(t, err)
+	assert.False(t, inBase)
+}
+
+func TestChangeInBaseByCampaignTrailer(t *testing.T) {
+	for _, env := range []string{"GIT_AUTHOR_NAME", "GIT_AUTHOR_EMAIL", "GIT_COMMITTER_NAME", "GIT_COMMITTER_EMAIL"} {
+		t.Setenv(env, "microplane@example.com")
+	}
+	dir := t.TempDir()
+	git := func(dir string, args ...string) {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		output, err := cmd.CombinedOutput()
+		assert.NoError(t, err, string(output))
+	}
+	remote := filepath.Join(dir, "remote.git")
+	planDir := filepath.Join(dir, "planned")
+	otherDir := filepath.Join(dir, "other")
+	git(dir, "init", "--quiet", "--bare", remote)
+	git(dir, "clone", "--quiet", remote, planDir)
+	git(planDir, "commit", "--quiet", "--allow-empty", "-m", "Initial")
+	git(planDir, "push", "--quiet", "origin", "HEAD:refs/heads/main")
+	git(planDir, "checkout", "--quiet", "-b", "mp-change")
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(planDir, "change"), []byte("v1"), 0644))
+	git(planDir, "add", "change")
+	git(planDir, "commit", "--quiet", "-m", "Change\n\nMicroplane-Campaign: go1.17")
+
+	// the change was merged, then the file changed again since
+	git(dir, "clone", "--quiet", "--branch", "main", remote, otherDir)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(otherDir, "change"), []byte("v2"), 0644))
+	git(otherDir, "add", "change")
+	git(otherDir, "commit", "--quiet", "-m", "Change (#1)\n\nMicroplane-Campaign: go1.17")
+	git(otherDir, "push", "--quiet", "origin", "main")
+
+	for id, expected := range map[string]bool{"": false, "go1.17": true, "go1": false, "go1x17": false} {
+		inBase, err := changeInBase(context.Background(), Input{PlanDir: planDir, BranchName: "mp-change", BaseBranch: "main", CampaignID: id})
+		assert.NoError(t, err)
+		assert.Equal(t, expected, inBase, id)
+	}
+}
+
+func TestGithubOpenPR(t *testing.T) {
+	client, _, done := githubTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/repos/owner/name/pulls", r.URL.Path)
+		assert.Equal(t, "open", r.URL.Query().Get("state"))
+		if r.URL.Query().Get("head") == "owner:mp-change" {
+			json.NewEncoder(w).Encode([]github.PullRequest{{Number: github.Int(7), HTMLURL: github.String("https://github.com/owner/name/pull/7")}})
+			return
+		}
+		json.NewEncoder(w).Encode([]github.PullRequest{})
+	})
+	defer done()
+
+	input := Input{Repo: lib.Repo{Owner: "owner", Name: "name"}, BranchName: "mp-change"}
+	pr, err := githubOpenPR(context.Background(), client, input, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 7, pr.GetNumber())
+
+	input.BranchName = "mp-other"
+	pr, err = githubOpenPR(context.Background(), client, input, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, pr)
+}
+
+func TestOpenPRLimit(t *testing.T) {
+	limit := NewOpenPRLimit(2)
+	pr := func(name string, branch string) Input {
+		return Input{Repo: lib.Repo{Owner: "clever", Name: name}, BranchName: branch}
+	}
+	a, b, c := pr("a", "mp-change"), pr("b", "mp-change"), pr("c", "mp-change")
+	assert.NoError(t, limit.reserve(a))
+	assert.NoError(t, limit.reserve(b))
+	// re-trying a repo doesn't take another slot
+	assert.NoError(t, limit.reserve(a))
+	err := limit.reserve(c)
+	assert.True(t, errors.Is(err, lib.ErrMaxOpenPRs))
+	assert.Equal(t, "max-open-prs", lib.ErrorKind(err))
+
+	// a repo that didn't open its PR gives its slot back
+	limit.release(b)
+	assert.NoError(t, limit.reserve(c))
+	assert.Equal(t, 2, limit.Opened())
+	// a backport is a PR of its own
+	assert.True(t, errors.Is(limit.reserve(pr("a", BackportBranchName("mp-change", "release-1"))), lib.ErrMaxOpenPRs))
+
+	// no limit
+	var none *OpenPRLimit
+	assert.NoError(t, none.reserve(a))
+	assert.Equal(t, 0, none.Opened())
+}
+
+func TestExistingBranch(t *testing.T) {
+	for _, env := range []string{"GIT_AUTHOR_NAME", "GIT_AUTHOR_EMAIL", "GIT_COMMITTER_NAME", "GIT_COMMITTER_EMAIL"} {
+		t.Setenv(env, "microplane@example.com")
+	}
+	dir := t.TempDir()
+	git := func(dir string, args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		output, err := cmd.CombinedOutput()
+		assert.NoError(t, err, string(output))
+		return strings.TrimSpace(string(output))
+	}
+	remote := filepath.Join(dir, "remote.git")
+	planDir := filepath.Join(dir, "planned")
+	git(dir, "init", "--quiet", "--bare", remote)
+	git(dir, "clone", "--quiet", remote, planDir)
+	git(planDir, "checkout", "--quiet", "-b", "mp-change")
+	git(planDir, "commit", "--quiet", "--allow-empty", "-m", "Earlier change")
+	earlier := git(planDir, "rev-parse", "HEAD")
+	git(planDir, "push", "--quiet", "origin", "mp-change")
+	git(planDir, "commit", "--quiet", "--amend", "--allow-empty", "-m", "Change")
+	sha := git(planDir, "rev-parse", "HEAD")
+
+	input := Input{Repo: lib.Repo{Owner: "clever", Name: "app"}, PlanDir: planDir, BranchName: "mp-change"}
+	for _, policy := range []string{"", BranchExistingOverwrite} {
+		input.ExistingBranch = policy
+		existing, err := existingBranch(context.Background(), input, sha)
+		assert.NoError(t, err)
+		assert.Equal(t, "", existing)
+	}
+
+	input.ExistingBranch = BranchExistingSkip
+	existing, err := existingBranch(context.Background(), input, sha)
+	assert.NoError(t, err)
+	assert.Equal(t, earlier, existing)
+	// the branch is already where it would be pushed, so there's nothing to overwrite
+	existing, err = existingBranch(context.Background(), input, earlier)
+	assert.NoError(t, err)
+	assert.Equal(t, "", existing)
+
+	input.ExistingBranch = BranchExistingFail
+	_, err = existingBranch(context.Background(), input, sha)
+	assert.True(t, errors.Is(err, lib.ErrConflict))
+
+	input.BranchName = "mp-other"
+	existing, err = existingBranch(context.Background(), input, sha)
+	assert.NoError(t, err)
+	assert.Equal(t, "", existing)
+}
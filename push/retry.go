@@ -0,0 +1,64 @@
+package push
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Clever/microplane/lib"
+)
+
+// apiRetries is how many more times a retryable API call is attempted before giving up
+const apiRetries = 3
+
+// apiRetryBackoff is how long to wait before the first retry. It doubles for each retry after.
+var apiRetryBackoff = 2 * time.Second
+
+// APIError is a failed API call, and its category
+type APIError struct {
+	Category lib.ErrorCategory
+	Err      error
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("(%s) %s", e.Category, e.Err.Error())
+}
+
+func (e *APIError) Unwrap() error {
+	return e.Err
+}
+
+// errorCategory is the category of an error from withRetries, or empty if it isn't an APIError
+func errorCategory(err error) lib.ErrorCategory {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Category
+	}
+	return ""
+}
+
+// withRetries calls fn, calling it again if it fails with a retryable error, e.g. a timeout or
+// 5xx. Other errors, e.g. validation or permission errors, are returned right away. The error
+// returned is an APIError, so the caller can tell which it was.
+func withRetries(ctx context.Context, what string, fn func() error) error {
+	backoff := apiRetryBackoff
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		category := lib.ClassifyError(err)
+		if !category.Retryable() || attempt == apiRetries || ctx.Err() != nil {
+			return &APIError{Category: category, Err: err}
+		}
+		log.Printf("failed to %s (%s), retrying in %v (%d/%d): %s", what, category, backoff, attempt+1, apiRetries, err.Error())
+		select {
+		case <-ctx.Done():
+			return &APIError{Category: category, Err: err}
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
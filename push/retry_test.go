@@ -0,0 +1,52 @@
+package push
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Clever/microplane/lib"
+	"github.com/stretchr/testify/assert"
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+func TestWithRetries(t *testing.T) {
+	apiRetryBackoff = 0
+	gitlabErr := func(status int) error {
+		return &gitlab.ErrorResponse{Response: &http.Response{StatusCode: status, Request: httptest.NewRequest("POST", "/", nil)}}
+	}
+
+	// retryable errors are retried until they succeed
+	calls := 0
+	err := withRetries(context.Background(), "open MR", func() error {
+		calls++
+		if calls < 3 {
+			return gitlabErr(http.StatusBadGateway)
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, calls)
+
+	// or until the retries run out
+	calls = 0
+	err = withRetries(context.Background(), "open MR", func() error {
+		calls++
+		return gitlabErr(http.StatusServiceUnavailable)
+	})
+	assert.Equal(t, apiRetries+1, calls)
+	assert.Equal(t, lib.ErrorServer, errorCategory(err))
+
+	// terminal errors aren't retried
+	calls = 0
+	err = withRetries(context.Background(), "open MR", func() error {
+		calls++
+		return gitlabErr(http.StatusForbidden)
+	})
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, lib.ErrorPermission, errorCategory(err))
+	var gitlabErrResp *gitlab.ErrorResponse
+	assert.True(t, errors.As(err, &gitlabErrResp))
+}
@@ -0,0 +1,108 @@
+package push
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"text/template"
+
+	"github.com/Clever/microplane/lib"
+)
+
+// What to do when a tag already exists on the remote, on a different commit
+const (
+	TagExistingFail      = "fail"
+	TagExistingSkip      = "skip"
+	TagExistingOverwrite = "overwrite"
+)
+
+// TagVars are the variables available to Tag templates
+type TagVars struct {
+	Owner  string
+	Name   string
+	Branch string
+	// Metadata is whatever was attached to the repo, e.g. its new version
+	Metadata map[string]string
+}
+
+// ParseTagTemplate parses a Tag template
+func ParseTagTemplate(text string) (*template.Template, error) {
+	return template.New("tag").Option("missingkey=error").Parse(text)
+}
+
+// renderTag renders the Tag template for the repo, and checks the result is a valid tag name
+func renderTag(input Input) (string, error) {
+	tmpl, err := ParseTagTemplate(input.Tag)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, TagVars{
+		Owner:    input.Repo.Owner,
+		Name:     input.Repo.Name,
+		Branch:   input.BranchName,
+		Metadata: input.Metadata,
+	}); err != nil {
+		return "", fmt.Errorf("failed to render tag: %w", err)
+	}
+	tag := strings.TrimSpace(buf.String())
+	if err := lib.ValidateBranchName(tag); err != nil {
+		return "", fmt.Errorf("tag: %w", err)
+	}
+	return tag, nil
+}
+
+// pushTag creates an annotated tag on the pushed commit, and pushes it. It returns the tag, and
+// whether it was skipped because it already exists on another commit.
+func pushTag(ctx context.Context, input Input, sha string) (string, bool, error) {
+	tag, err := renderTag(input)
+	if err != nil {
+		return "", false, err
+	}
+	ref := "refs/tags/" + tag
+
+	// the remote lists annotated tags twice, the peeled ref (^{}) being the commit it's on
+	remote, err := gitOutput(ctx, input.PlanDir, "ls-remote", "--tags", "origin", ref, ref+"^{}")
+	if err != nil {
+		return "", false, err
+	}
+	force := false
+	if remote != "" {
+		existing := ""
+		for _, line := range strings.Split(remote, "\n") {
+			if fields := strings.Fields(line); len(fields) == 2 && (existing == "" || fields[1] == ref+"^{}") {
+				existing = fields[0]
+			}
+		}
+		if existing == sha {
+			return tag, false, nil
+		}
+		switch input.ExistingTag {
+		case TagExistingSkip:
+			log.Printf("%s/%s - tag %s already exists on %s, skipping it", input.Repo.Owner, input.Repo.Name, tag, existing)
+			return tag, true, nil
+		case TagExistingOverwrite:
+			force = true
+		default:
+			return "", false, lib.WithKind(lib.ErrConflict, fmt.Errorf("tag %s already exists on commit %s. Use --existing-tag=skip or --existing-tag=overwrite to push anyway", tag, existing))
+		}
+	}
+
+	message := input.TagMessage
+	if message == "" {
+		message, _ = GetTitleBody(input)
+	}
+	if _, err := gitOutput(ctx, input.PlanDir, "tag", "--force", "--annotate", "--message", message, tag, sha); err != nil {
+		return "", false, fmt.Errorf("could not create tag %s: %s", tag, err.Error())
+	}
+	args := []string{"push", "origin", ref}
+	if force {
+		args = []string{"push", "--force", "origin", ref}
+	}
+	if _, err := gitOutput(ctx, input.PlanDir, args...); err != nil {
+		return "", false, lib.WithKind(lib.ErrGitPush, fmt.Errorf("could not push tag %s: %s", tag, err.Error()))
+	}
+	return tag, false, nil
+}
@@ -0,0 +1,127 @@
+// Package ready marks draft PRs as ready for review.
+package ready
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Clever/microplane/lib"
+	"github.com/Clever/microplane/merge"
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+// Input to Ready()
+type Input struct {
+	// Repo is the git Repo
+	Repo lib.Repo
+	// PRNumber of the PR opened by push. It's the IID for Gitlab.
+	PRNumber int
+}
+
+// Output from Ready()
+type Output struct {
+	Success bool
+	// WasDraft is set if the PR was a draft, and so was marked ready
+	WasDraft bool
+	// NotOpen is set if the PR was already merged or closed, so was left alone
+	NotOpen bool
+}
+
+// Ready marks a PR as ready for review, if it's an open draft.
+// A nil limiter means no rate limiting.
+func Ready(ctx context.Context, input Input, repoLimiter *time.Ticker) (Output, error) {
+	switch {
+	case input.Repo.IsGithub():
+		return GithubReady(ctx, input, repoLimiter)
+	case input.Repo.IsGitlab():
+		return GitlabReady(ctx, input, repoLimiter)
+	}
+	return Output{}, fmt.Errorf("unsupported provider: %s", input.Repo.ProviderConfig.Backend)
+}
+
+// githubMarkReady is the GraphQL mutation that marks a PR ready, which the REST API can't do
+const githubMarkReady = `mutation($id: ID!) { markPullRequestReadyForReview(input: {pullRequestId: $id}) { pullRequest { isDraft } } }`
+
+// GithubReady marks a draft PR in Github as ready for review
+func GithubReady(ctx context.Context, input Input, repoLimiter *time.Ticker) (Output, error) {
+	p := lib.NewProviderFromConfig(input.Repo.ProviderConfig)
+	client, err := p.GithubClient(ctx)
+	if err != nil {
+		return Output{}, err
+	}
+
+	lib.Wait(repoLimiter)
+	pr, _, err := client.PullRequests.Get(ctx, input.Repo.Owner, input.Repo.Name, input.PRNumber)
+	if err != nil {
+		return Output{Success: false}, err
+	}
+	if pr.GetState() != "open" {
+		return Output{Success: true, NotOpen: true}, nil
+	}
+	if !pr.GetDraft() {
+		return Output{Success: true}, nil
+	}
+
+	// the GraphQL endpoint is next to the REST API's, e.g. /api/graphql for /api/v3/ in enterprise
+	req, err := client.NewRequest("POST", "../graphql", map[string]interface{}{
+		"query":     githubMarkReady,
+		"variables": map[string]string{"id": pr.GetNodeID()},
+	})
+	if err != nil {
+		return Output{Success: false}, err
+	}
+	var result struct {
+		Errors []struct {
+			Message string
+		}
+	}
+	lib.Wait(repoLimiter)
+	if _, err := client.Do(ctx, req, &result); err != nil {
+		return Output{Success: false}, fmt.Errorf("failed to mark PR as ready: %w", err)
+	}
+	if len(result.Errors) > 0 {
+		messages := []string{}
+		for _, e := range result.Errors {
+			messages = append(messages, e.Message)
+		}
+		return Output{Success: false}, fmt.Errorf("failed to mark PR as ready: %s", strings.Join(messages, "; "))
+	}
+	return Output{Success: true, WasDraft: true}, nil
+}
+
+// GitlabReady marks a draft MR in Gitlab as ready, by removing the draft prefix from its title
+func GitlabReady(ctx context.Context, input Input, repoLimiter *time.Ticker) (Output, error) {
+	p := lib.NewProviderFromConfig(input.Repo.ProviderConfig)
+	client, err := p.GitlabClient()
+	if err != nil {
+		return Output{}, err
+	}
+	ctxFunc := gitlab.WithContext(ctx)
+	pid := fmt.Sprintf("%s/%s", input.Repo.Owner, input.Repo.Name)
+
+	lib.Wait(repoLimiter)
+	mr, _, err := client.MergeRequests.GetMergeRequest(pid, input.PRNumber, &gitlab.GetMergeRequestsOptions{}, ctxFunc)
+	if err != nil {
+		return Output{Success: false}, err
+	}
+	if mr.State != "opened" {
+		return Output{Success: true, NotOpen: true}, nil
+	}
+	if !merge.GitlabIsDraft(mr) {
+		return Output{Success: true}, nil
+	}
+
+	title := merge.GitlabUndraftTitle(mr.Title)
+	lib.Wait(repoLimiter)
+	updated, _, err := client.MergeRequests.UpdateMergeRequest(pid, input.PRNumber, &gitlab.UpdateMergeRequestOptions{Title: &title}, ctxFunc)
+	if err != nil {
+		return Output{Success: false}, fmt.Errorf("failed to mark MR as ready: %w", err)
+	}
+	if merge.GitlabIsDraft(updated) {
+		return Output{Success: false}, errors.New("failed to mark MR as ready: it's still a draft after removing the draft prefix from its title")
+	}
+	return Output{Success: true, WasDraft: true}, nil
+}
@@ -0,0 +1,51 @@
+package ready
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Clever/microplane/lib"
+	"github.com/google/go-github/v35/github"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGithubReady(t *testing.T) {
+	t.Setenv("GITHUB_API_TOKEN", "test")
+	pr := github.PullRequest{Number: github.Int(7), State: github.String("open"), Draft: github.Bool(true), NodeID: github.String("PR_7")}
+	var mutation struct {
+		Query     string
+		Variables map[string]string
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/api/v3/repos/clever/app/pulls/7":
+			json.NewEncoder(w).Encode(pr)
+		case r.Method == http.MethodPost && r.URL.Path == "/api/graphql":
+			json.NewDecoder(r.Body).Decode(&mutation)
+			w.Write([]byte(`{"data": {"markPullRequestReadyForReview": {"pullRequest": {"isDraft": false}}}}`))
+		default:
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	input := Input{
+		Repo:     lib.Repo{Owner: "clever", Name: "app", ProviderConfig: lib.ProviderConfig{Backend: "github", BackendURL: server.URL}},
+		PRNumber: 7,
+	}
+
+	output, err := Ready(context.Background(), input, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, Output{Success: true, WasDraft: true}, output)
+	assert.Equal(t, githubMarkReady, mutation.Query)
+	assert.Equal(t, map[string]string{"id": "PR_7"}, mutation.Variables)
+
+	// already ready, so there's nothing to do
+	pr.Draft = github.Bool(false)
+	output, err = Ready(context.Background(), input, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, Output{Success: true}, output)
+}
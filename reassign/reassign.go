@@ -0,0 +1,179 @@
+package reassign
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Clever/microplane/lib"
+	"github.com/Clever/microplane/push"
+	"github.com/google/go-github/v35/github"
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+// Input to Reassign()
+type Input struct {
+	// Repo is the git Repo
+	Repo lib.Repo
+	// PRNumber of the PR opened by push
+	PRNumber int
+	// Assignees replace the PR's current assignees
+	Assignees []string
+	// Reviewers replace the PR's currently requested reviewers
+	Reviewers []string
+	// TeamReviewers replace the PR's currently requested team reviewers, by slug. A slug may
+	// include the org, e.g. "clever/infra", which must be the repo's owner. Only supported for Github.
+	TeamReviewers []string
+}
+
+// Output from Reassign()
+type Output struct {
+	Success   bool
+	Assignees []string
+	Reviewers []string
+	// TeamReviewers are the requested team reviewers' slugs, without the org
+	TeamReviewers []string `json:",omitempty"`
+}
+
+// GithubReassign replaces the assignees and requested reviewers of an open PR in Github
+// - repoLimiter rate limits the # of calls to Github
+// A nil limiter means no rate limiting.
+func GithubReassign(ctx context.Context, input Input, repoLimiter *time.Ticker) (Output, error) {
+	p := lib.NewProviderFromConfig(input.Repo.ProviderConfig)
+	client, err := p.GithubClient(ctx)
+	if err != nil {
+		return Output{}, err
+	}
+
+	if len(input.Assignees) > 0 {
+		lib.Wait(repoLimiter)
+		_, _, err := client.Issues.Edit(ctx, input.Repo.Owner, input.Repo.Name, input.PRNumber, &github.IssueRequest{
+			Assignees: &input.Assignees,
+		})
+		if err != nil {
+			return Output{Success: false}, err
+		}
+	}
+
+	teams, err := githubTeamSlugs(ctx, client, input.Repo.Owner, input.TeamReviewers, repoLimiter)
+	if err != nil {
+		return Output{Success: false}, err
+	}
+
+	if len(input.Reviewers) > 0 || len(teams) > 0 {
+		lib.Wait(repoLimiter)
+		current, _, err := client.PullRequests.ListReviewers(ctx, input.Repo.Owner, input.Repo.Name, input.PRNumber, nil)
+		if err != nil {
+			return Output{Success: false}, err
+		}
+		stale := github.ReviewersRequest{}
+		if len(input.Reviewers) > 0 {
+			for _, u := range current.Users {
+				if !contains(input.Reviewers, u.GetLogin()) {
+					stale.Reviewers = append(stale.Reviewers, u.GetLogin())
+				}
+			}
+		}
+		if len(teams) > 0 {
+			for _, t := range current.Teams {
+				if !contains(teams, t.GetSlug()) {
+					stale.TeamReviewers = append(stale.TeamReviewers, t.GetSlug())
+				}
+			}
+		}
+		if len(stale.Reviewers) > 0 || len(stale.TeamReviewers) > 0 {
+			lib.Wait(repoLimiter)
+			_, err := client.PullRequests.RemoveReviewers(ctx, input.Repo.Owner, input.Repo.Name, input.PRNumber, stale)
+			if err != nil {
+				return Output{Success: false}, err
+			}
+		}
+
+		lib.Wait(repoLimiter)
+		_, _, err = client.PullRequests.RequestReviewers(ctx, input.Repo.Owner, input.Repo.Name, input.PRNumber, github.ReviewersRequest{
+			Reviewers:     input.Reviewers,
+			TeamReviewers: teams,
+		})
+		if err != nil {
+			return Output{Success: false}, err
+		}
+	}
+
+	return Output{Success: true, Assignees: input.Assignees, Reviewers: input.Reviewers, TeamReviewers: teams}, nil
+}
+
+// githubTeamSlugs checks that each team exists in the org and can be seen with the token,
+// and returns their slugs without the org
+func githubTeamSlugs(ctx context.Context, client *github.Client, org string, teams []string, repoLimiter *time.Ticker) ([]string, error) {
+	slugs := []string{}
+	for _, team := range teams {
+		slug := team
+		if i := strings.Index(team, "/"); i >= 0 {
+			if !strings.EqualFold(team[:i], org) {
+				return nil, fmt.Errorf("team '%s' isn't in the repo's org '%s'", team, org)
+			}
+			slug = team[i+1:]
+		}
+		lib.Wait(repoLimiter)
+		_, resp, err := client.Teams.GetTeamBySlug(ctx, org, slug)
+		if resp != nil && resp.StatusCode == http.StatusNotFound {
+			return nil, fmt.Errorf("team '%s/%s' wasn't found. Check the slug, and that the token can see the team (it needs the read:org scope)", org, slug)
+		} else if err != nil {
+			return nil, err
+		}
+		slugs = append(slugs, slug)
+	}
+	return slugs, nil
+}
+
+// GitlabReassign replaces the assignees and reviewers of an open MR in Gitlab
+// - repoLimiter rate limits the # of calls to Gitlab
+// A nil limiter means no rate limiting.
+func GitlabReassign(ctx context.Context, input Input, repoLimiter *time.Ticker) (Output, error) {
+	p := lib.NewProviderFromConfig(input.Repo.ProviderConfig)
+	client, err := p.GitlabClient()
+	if err != nil {
+		return Output{}, err
+	}
+	ctxFunc := gitlab.WithContext(ctx)
+
+	if len(input.TeamReviewers) > 0 {
+		return Output{Success: false}, errors.New("team reviewers are only supported for github")
+	}
+
+	opts := &gitlab.UpdateMergeRequestOptions{}
+	if len(input.Assignees) > 0 {
+		ids, err := push.GitlabUserIDs(ctx, client, input.Assignees, repoLimiter)
+		if err != nil {
+			return Output{Success: false}, err
+		}
+		opts.AssigneeIDs = &ids
+	}
+	if len(input.Reviewers) > 0 {
+		ids, err := push.GitlabUserIDs(ctx, client, input.Reviewers, repoLimiter)
+		if err != nil {
+			return Output{Success: false}, err
+		}
+		opts.ReviewerIDs = &ids
+	}
+
+	lib.Wait(repoLimiter)
+	pid := fmt.Sprintf("%s/%s", input.Repo.Owner, input.Repo.Name)
+	if _, _, err := client.MergeRequests.UpdateMergeRequest(pid, input.PRNumber, opts, ctxFunc); err != nil {
+		return Output{Success: false}, err
+	}
+
+	return Output{Success: true, Assignees: input.Assignees, Reviewers: input.Reviewers}, nil
+}
+
+func contains(list []string, item string) bool {
+	for _, each := range list {
+		if strings.EqualFold(each, item) {
+			return true
+		}
+	}
+	return false
+}
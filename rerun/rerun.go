@@ -0,0 +1,118 @@
+package rerun
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Clever/microplane/lib"
+	"github.com/google/go-github/v35/github"
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+// Input to Rerun()
+type Input struct {
+	// Repo is the git Repo
+	Repo lib.Repo
+	// PRNumber of the PR opened by push
+	PRNumber int
+	// PipelineVariables are set on the pipelines that are started. Only supported for Gitlab.
+	PipelineVariables map[string]string
+}
+
+// Output from Rerun()
+type Output struct {
+	Success bool
+	// RunURLs link to the workflow runs or pipelines that were started
+	RunURLs []string
+}
+
+// GithubRerun re-runs the workflow runs that didn't succeed on an open PR's head commit in Github
+// - repoLimiter rate limits the # of calls to Github
+// A nil limiter means no rate limiting.
+func GithubRerun(ctx context.Context, input Input, repoLimiter *time.Ticker) (Output, error) {
+	p := lib.NewProviderFromConfig(input.Repo.ProviderConfig)
+	client, err := p.GithubClient(ctx)
+	if err != nil {
+		return Output{}, err
+	}
+
+	lib.Wait(repoLimiter)
+	pr, _, err := client.PullRequests.Get(ctx, input.Repo.Owner, input.Repo.Name, input.PRNumber)
+	if err != nil {
+		return Output{Success: false}, err
+	}
+
+	urls := []string{}
+	opts := &github.ListWorkflowRunsOptions{Branch: pr.GetHead().GetRef(), ListOptions: github.ListOptions{PerPage: 100}}
+	for {
+		lib.Wait(repoLimiter)
+		runs, resp, err := client.Actions.ListRepositoryWorkflowRuns(ctx, input.Repo.Owner, input.Repo.Name, opts)
+		if err != nil {
+			return Output{Success: false}, err
+		}
+		for _, run := range runs.WorkflowRuns {
+			if run.GetHeadSHA() != pr.GetHead().GetSHA() || !rerunnable(run) {
+				continue
+			}
+			lib.Wait(repoLimiter)
+			if _, err := client.Actions.RerunWorkflowByID(ctx, input.Repo.Owner, input.Repo.Name, run.GetID()); err != nil {
+				return Output{Success: false, RunURLs: urls}, fmt.Errorf("failed to re-run %s: %w", run.GetHTMLURL(), err)
+			}
+			urls = append(urls, run.GetHTMLURL())
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+
+	return Output{Success: true, RunURLs: urls}, nil
+}
+
+// rerunnable determines if a workflow run finished without succeeding, e.g. because it flaked
+func rerunnable(run *github.WorkflowRun) bool {
+	if run.GetStatus() != "completed" {
+		return false
+	}
+	switch run.GetConclusion() {
+	case "success", "neutral", "skipped":
+		return false
+	}
+	return true
+}
+
+// GitlabRerun starts a new pipeline on the source branch of an open MR in Gitlab
+// - repoLimiter rate limits the # of calls to Gitlab
+// A nil limiter means no rate limiting.
+func GitlabRerun(ctx context.Context, input Input, repoLimiter *time.Ticker) (Output, error) {
+	p := lib.NewProviderFromConfig(input.Repo.ProviderConfig)
+	client, err := p.GitlabClient()
+	if err != nil {
+		return Output{}, err
+	}
+	ctxFunc := gitlab.WithContext(ctx)
+	pid := fmt.Sprintf("%s/%s", input.Repo.Owner, input.Repo.Name)
+
+	lib.Wait(repoLimiter)
+	mr, _, err := client.MergeRequests.GetMergeRequest(pid, input.PRNumber, nil, ctxFunc)
+	if err != nil {
+		return Output{Success: false}, err
+	}
+
+	opts := &gitlab.CreatePipelineOptions{Ref: &mr.SourceBranch}
+	if len(input.PipelineVariables) > 0 {
+		variables := []*gitlab.PipelineVariableOptions{}
+		for key, value := range input.PipelineVariables {
+			variables = append(variables, &gitlab.PipelineVariableOptions{Key: gitlab.String(key), Value: gitlab.String(value)})
+		}
+		opts.Variables = &variables
+	}
+	lib.Wait(repoLimiter)
+	pipeline, _, err := client.Pipelines.CreatePipeline(pid, opts, ctxFunc)
+	if err != nil {
+		return Output{Success: false}, err
+	}
+
+	return Output{Success: true, RunURLs: []string{pipeline.WebURL}}, nil
+}
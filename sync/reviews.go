@@ -0,0 +1,99 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Clever/microplane/lib"
+	"github.com/google/go-github/v35/github"
+	"github.com/xanzy/go-gitlab"
+)
+
+// Review decisions, summarizing where a PR's review stands
+const (
+	ReviewApproved         = "approved"
+	ReviewChangesRequested = "changes_requested"
+	ReviewRequired         = "review_required"
+)
+
+// Reviews is the review state of a PR
+type Reviews struct {
+	// Approvals is how many reviewers currently approve of the PR
+	Approvals int
+	// Decision is one of the Review* constants
+	Decision string
+}
+
+// GithubSyncReviews fetches the review state of a PR in Github. Each reviewer's latest review
+// counts, and a request for changes outweighs any approvals.
+func GithubSyncReviews(ctx context.Context, r lib.Repo, prNumber int, repoLimiter *time.Ticker) (Reviews, error) {
+	p := lib.NewProviderFromConfig(r.ProviderConfig)
+	client, err := p.GithubClient(ctx)
+	if err != nil {
+		return Reviews{}, err
+	}
+
+	latest := map[string]string{}
+	opts := &github.ListOptions{PerPage: 100}
+	for {
+		lib.Wait(repoLimiter)
+		reviews, resp, err := client.PullRequests.ListReviews(ctx, r.Owner, r.Name, prNumber, opts)
+		if err != nil {
+			return Reviews{}, err
+		}
+		for _, review := range reviews {
+			// comments don't change a reviewer's approval or request for changes
+			if state := review.GetState(); state != "COMMENTED" && state != "PENDING" {
+				latest[review.GetUser().GetLogin()] = state
+			}
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+	return githubReviews(latest), nil
+}
+
+// githubReviews summarizes the latest review state of each reviewer
+func githubReviews(latest map[string]string) Reviews {
+	reviews := Reviews{Decision: ReviewRequired}
+	changesRequested := false
+	for _, state := range latest {
+		switch strings.ToUpper(state) {
+		case "APPROVED":
+			reviews.Approvals++
+		case "CHANGES_REQUESTED":
+			changesRequested = true
+		}
+	}
+	if changesRequested {
+		reviews.Decision = ReviewChangesRequested
+	} else if reviews.Approvals > 0 {
+		reviews.Decision = ReviewApproved
+	}
+	return reviews
+}
+
+// GitlabSyncReviews fetches the approval state of an MR in Gitlab
+func GitlabSyncReviews(ctx context.Context, r lib.Repo, mrNumber int, repoLimiter *time.Ticker) (Reviews, error) {
+	p := lib.NewProviderFromConfig(r.ProviderConfig)
+	client, err := p.GitlabClient()
+	if err != nil {
+		return Reviews{}, err
+	}
+	pid := fmt.Sprintf("%s/%s", r.Owner, r.Name)
+
+	lib.Wait(repoLimiter)
+	approvals, _, err := client.MergeRequestApprovals.GetConfiguration(pid, mrNumber, gitlab.WithContext(ctx))
+	if err != nil {
+		return Reviews{}, err
+	}
+	reviews := Reviews{Approvals: len(approvals.ApprovedBy), Decision: ReviewRequired}
+	if approvals.ApprovalsLeft == 0 && reviews.Approvals > 0 {
+		reviews.Decision = ReviewApproved
+	}
+	return reviews, nil
+}
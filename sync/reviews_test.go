@@ -0,0 +1,13 @@
+package sync
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGithubReviews(t *testing.T) {
+	assert.Equal(t, Reviews{Decision: ReviewRequired}, githubReviews(map[string]string{}))
+	assert.Equal(t, Reviews{Approvals: 2, Decision: ReviewApproved}, githubReviews(map[string]string{"a": "APPROVED", "b": "APPROVED", "c": "DISMISSED"}))
+	assert.Equal(t, Reviews{Approvals: 1, Decision: ReviewChangesRequested}, githubReviews(map[string]string{"a": "APPROVED", "b": "CHANGES_REQUESTED"}))
+}
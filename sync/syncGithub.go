@@ -2,17 +2,22 @@ package sync
 
 import (
 	"context"
+	"fmt"
 	"time"
 
 	"github.com/Clever/microplane/lib"
 	"github.com/Clever/microplane/push"
+	"github.com/google/go-github/v35/github"
 )
 
 type Output struct {
 	CommitSHA                 string
+	PullRequestNumber         int
 	PullRequestCombinedStatus string
 	MergeCommitSHA            string
 	Merged                    bool
+	// Closed is set if the PR was closed without being merged
+	Closed bool
 }
 
 func GithubSyncPush(ctx context.Context, r lib.Repo, po push.Output, repoLimiter *time.Ticker) (Output, error) {
@@ -23,21 +28,39 @@ func GithubSyncPush(ctx context.Context, r lib.Repo, po push.Output, repoLimiter
 		return Output{}, err
 	}
 
-	pr, _, err := client.PullRequests.Get(ctx, r.Owner, r.Name, po.PullRequestNumber)
-	if err != nil {
-		return Output{}, err
+	var pr *github.PullRequest
+	lib.Wait(repoLimiter)
+	if po.PullRequestNumber != 0 {
+		pr, _, err = client.PullRequests.Get(ctx, r.Owner, r.Name, po.PullRequestNumber)
+		if err != nil {
+			return Output{}, err
+		}
+	} else {
+		// older outputs may not have the PR number, so find the PR by its branch
+		prs, _, err := client.PullRequests.List(ctx, r.Owner, r.Name, &github.PullRequestListOptions{
+			Head:  fmt.Sprintf("%s:%s", r.Owner, po.BranchName),
+			State: "all",
+		})
+		if err != nil {
+			return Output{}, err
+		} else if len(prs) == 0 {
+			return Output{}, fmt.Errorf("no PR found for branch '%s'", po.BranchName)
+		}
+		pr = prs[0]
 	}
 
-	<-repoLimiter.C
-	cs, _, err := client.Repositories.GetCombinedStatus(ctx, r.Owner, r.Name, *pr.Head.SHA, nil)
+	lib.Wait(repoLimiter)
+	cs, _, err := client.Repositories.GetCombinedStatus(ctx, r.Owner, r.Name, pr.GetHead().GetSHA(), nil)
 	if err != nil {
 		return Output{}, err
 	}
 
 	return Output{
-		CommitSHA:                 *pr.Head.SHA,
-		PullRequestCombinedStatus: *cs.State,
-		MergeCommitSHA:            *pr.MergeCommitSHA,
-		Merged:                    *pr.Merged,
+		CommitSHA:                 pr.GetHead().GetSHA(),
+		PullRequestNumber:         pr.GetNumber(),
+		PullRequestCombinedStatus: lib.NormalizeCIStatus(cs.GetState()),
+		MergeCommitSHA:            pr.GetMergeCommitSHA(),
+		Merged:                    pr.GetMerged(),
+		Closed:                    pr.GetState() == "closed" && !pr.GetMerged(),
 	}, nil
 }
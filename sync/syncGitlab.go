@@ -17,11 +17,30 @@ func GitlabSyncPush(ctx context.Context, r lib.Repo, po push.Output, repoLimiter
 	if err != nil {
 		return Output{}, err
 	}
+	ctxFunc := gitlab.WithContext(ctx)
 	pid := fmt.Sprintf("%s/%s", r.Owner, r.Name)
-	mr, _, err := client.MergeRequests.GetMergeRequest(pid, po.PullRequestNumber, nil)
-	if err != nil {
-		return Output{}, err
+
+	var mr *gitlab.MergeRequest
+	lib.Wait(repoLimiter)
+	if po.PullRequestNumber != 0 {
+		mr, _, err = client.MergeRequests.GetMergeRequest(pid, po.PullRequestNumber, nil, ctxFunc)
+		if err != nil {
+			return Output{}, err
+		}
+	} else {
+		// older outputs may not have the MR number, so find the MR by its source branch
+		mrs, _, err := client.MergeRequests.ListProjectMergeRequests(pid, &gitlab.ListProjectMergeRequestsOptions{
+			SourceBranch: &po.BranchName,
+		}, ctxFunc)
+		if err != nil {
+			return Output{}, err
+		} else if len(mrs) == 0 {
+			return Output{}, fmt.Errorf("no MR found for branch '%s'", po.BranchName)
+		}
+		mr = mrs[0]
 	}
+
+	lib.Wait(repoLimiter)
 	pipelineStatus, err := push.GetPipelineStatus(client, r.Owner, r.Name, &gitlab.ListProjectPipelinesOptions{SHA: &mr.SHA})
 	if err != nil {
 		return Output{}, err
@@ -29,8 +48,10 @@ func GitlabSyncPush(ctx context.Context, r lib.Repo, po push.Output, repoLimiter
 
 	return Output{
 		CommitSHA:                 mr.SHA,
-		PullRequestCombinedStatus: pipelineStatus,
+		PullRequestNumber:         mr.IID,
+		PullRequestCombinedStatus: lib.NormalizeCIStatus(pipelineStatus),
 		MergeCommitSHA:            mr.MergeCommitSHA,
-		Merged:                    mr.MergeStatus == "merged",
+		Merged:                    mr.State == "merged",
+		Closed:                    mr.State == "closed",
 	}, nil
 }
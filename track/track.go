@@ -0,0 +1,102 @@
+// Package track keeps a campaign's tracking issue up to date with a report of its progress.
+package track
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Clever/microplane/lib"
+	"github.com/google/go-github/v35/github"
+)
+
+// Input for Track
+type Input struct {
+	// Repo is where the tracking issue lives
+	Repo lib.Repo
+	// Title identifies the tracking issue, when Number isn't known
+	Title string
+	// Body is the report, which replaces the issue's body
+	Body string
+	// Number is the tracking issue from a previous run, if any. It's the IID for Gitlab.
+	Number int
+	// DryRun finds the issue without creating or updating it
+	DryRun bool
+}
+
+// Output from Track
+type Output struct {
+	Number int
+	URL    string
+	// Created is set when there was no tracking issue yet
+	Created bool
+}
+
+// Track creates or updates the tracking issue. The issue is the one numbered Input.Number if
+// it's set, otherwise an open issue titled Input.Title, so re-running updates rather than
+// duplicates it. A nil limiter means no rate limiting.
+func Track(ctx context.Context, input Input, repoLimiter *time.Ticker) (Output, error) {
+	switch {
+	case input.Repo.IsGithub():
+		return GithubTrack(ctx, input, repoLimiter)
+	case input.Repo.IsGitlab():
+		return GitlabTrack(ctx, input, repoLimiter)
+	}
+	return Output{}, fmt.Errorf("unsupported provider: %s", input.Repo.ProviderConfig.Backend)
+}
+
+// GithubTrack creates or updates a tracking issue in Github
+func GithubTrack(ctx context.Context, input Input, repoLimiter *time.Ticker) (Output, error) {
+	p := lib.NewProviderFromConfig(input.Repo.ProviderConfig)
+	client, err := p.GithubClient(ctx)
+	if err != nil {
+		return Output{}, err
+	}
+	owner, name := input.Repo.Owner, input.Repo.Name
+
+	number := input.Number
+	if number == 0 {
+		if number, err = githubFindIssue(ctx, client, owner, name, input.Title, repoLimiter); err != nil {
+			return Output{}, err
+		}
+	}
+	if input.DryRun {
+		return Output{Number: number, Created: number == 0}, nil
+	}
+
+	lib.Wait(repoLimiter)
+	if number == 0 {
+		issue, _, err := client.Issues.Create(ctx, owner, name, &github.IssueRequest{Title: &input.Title, Body: &input.Body})
+		if err != nil {
+			return Output{}, fmt.Errorf("failed to create tracking issue: %w", err)
+		}
+		return Output{Number: issue.GetNumber(), URL: issue.GetHTMLURL(), Created: true}, nil
+	}
+	issue, _, err := client.Issues.Edit(ctx, owner, name, number, &github.IssueRequest{Body: &input.Body})
+	if err != nil {
+		return Output{}, fmt.Errorf("failed to update tracking issue #%d: %w", number, err)
+	}
+	return Output{Number: issue.GetNumber(), URL: issue.GetHTMLURL()}, nil
+}
+
+// githubFindIssue finds the number of the open issue with a title, or 0 if there isn't one
+func githubFindIssue(ctx context.Context, client *github.Client, owner, name, title string, repoLimiter *time.Ticker) (int, error) {
+	opts := &github.IssueListByRepoOptions{State: "open", ListOptions: github.ListOptions{PerPage: 100}}
+	for {
+		lib.Wait(repoLimiter)
+		issues, resp, err := client.Issues.ListByRepo(ctx, owner, name, opts)
+		if err != nil {
+			return 0, fmt.Errorf("failed to find tracking issue: %w", err)
+		}
+		for _, issue := range issues {
+			// the issues API includes PRs
+			if !issue.IsPullRequest() && issue.GetTitle() == title {
+				return issue.GetNumber(), nil
+			}
+		}
+		if resp.NextPage == 0 {
+			return 0, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
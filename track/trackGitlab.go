@@ -0,0 +1,68 @@
+package track
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Clever/microplane/lib"
+	gitlab "github.com/xanzy/go-gitlab"
+)
+
+// GitlabTrack creates or updates a tracking issue in Gitlab
+func GitlabTrack(ctx context.Context, input Input, repoLimiter *time.Ticker) (Output, error) {
+	p := lib.NewProviderFromConfig(input.Repo.ProviderConfig)
+	client, err := p.GitlabClient()
+	if err != nil {
+		return Output{}, err
+	}
+	ctxFunc := gitlab.WithContext(ctx)
+	pid := fmt.Sprintf("%s/%s", input.Repo.Owner, input.Repo.Name)
+
+	iid := input.Number
+	if iid == 0 {
+		if iid, err = gitlabFindIssue(ctx, client, pid, input.Title, repoLimiter); err != nil {
+			return Output{}, err
+		}
+	}
+	if input.DryRun {
+		return Output{Number: iid, Created: iid == 0}, nil
+	}
+
+	lib.Wait(repoLimiter)
+	if iid == 0 {
+		issue, _, err := client.Issues.CreateIssue(pid, &gitlab.CreateIssueOptions{Title: &input.Title, Description: &input.Body}, ctxFunc)
+		if err != nil {
+			return Output{}, fmt.Errorf("failed to create tracking issue: %w", err)
+		}
+		return Output{Number: issue.IID, URL: issue.WebURL, Created: true}, nil
+	}
+	issue, _, err := client.Issues.UpdateIssue(pid, iid, &gitlab.UpdateIssueOptions{Description: &input.Body}, ctxFunc)
+	if err != nil {
+		return Output{}, fmt.Errorf("failed to update tracking issue #%d: %w", iid, err)
+	}
+	return Output{Number: issue.IID, URL: issue.WebURL}, nil
+}
+
+// gitlabFindIssue finds the IID of the open issue with a title, or 0 if there isn't one
+func gitlabFindIssue(ctx context.Context, client *gitlab.Client, pid, title string, repoLimiter *time.Ticker) (int, error) {
+	state, in := "opened", "title"
+	opts := &gitlab.ListProjectIssuesOptions{State: &state, Search: &title, In: &in, ListOptions: gitlab.ListOptions{PerPage: 100}}
+	for {
+		lib.Wait(repoLimiter)
+		issues, resp, err := client.Issues.ListProjectIssues(pid, opts, gitlab.WithContext(ctx))
+		if err != nil {
+			return 0, fmt.Errorf("failed to find tracking issue: %w", err)
+		}
+		// the search matches titles containing it, so check for an exact match
+		for _, issue := range issues {
+			if issue.Title == title {
+				return issue.IID, nil
+			}
+		}
+		if resp.NextPage == 0 {
+			return 0, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
@@ -0,0 +1,64 @@
+package track
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Clever/microplane/lib"
+	"github.com/google/go-github/v35/github"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGithubTrack(t *testing.T) {
+	t.Setenv("GITHUB_API_TOKEN", "test")
+	issues := []github.Issue{
+		{Number: github.Int(3), Title: github.String("Microplane: bump"), PullRequestLinks: &github.PullRequestLinks{}},
+	}
+	var edited, created map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/api/v3/repos/clever/tracking/issues":
+			assert.Equal(t, "open", r.URL.Query().Get("state"))
+			json.NewEncoder(w).Encode(issues)
+		case r.Method == http.MethodPatch && r.URL.Path == "/api/v3/repos/clever/tracking/issues/4":
+			json.NewDecoder(r.Body).Decode(&edited)
+			json.NewEncoder(w).Encode(github.Issue{Number: github.Int(4), HTMLURL: github.String("https://example.com/4")})
+		case r.Method == http.MethodPost && r.URL.Path == "/api/v3/repos/clever/tracking/issues":
+			json.NewDecoder(r.Body).Decode(&created)
+			json.NewEncoder(w).Encode(github.Issue{Number: github.Int(5), HTMLURL: github.String("https://example.com/5")})
+		default:
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	input := Input{
+		Repo:  lib.Repo{Owner: "clever", Name: "tracking", ProviderConfig: lib.ProviderConfig{Backend: "github", BackendURL: server.URL}},
+		Title: "Microplane: bump",
+		Body:  "report",
+	}
+
+	// only a PR has the title, so the issue is created
+	output, err := Track(context.Background(), input, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, Output{Number: 5, URL: "https://example.com/5", Created: true}, output)
+	assert.Equal(t, map[string]interface{}{"title": "Microplane: bump", "body": "report"}, created)
+
+	// an open issue with the title is updated
+	issues = append(issues, github.Issue{Number: github.Int(4), Title: github.String("Microplane: bump")})
+	output, err = Track(context.Background(), input, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, Output{Number: 4, URL: "https://example.com/4"}, output)
+	assert.Equal(t, map[string]interface{}{"body": "report"}, edited)
+
+	// as is a recorded issue, without searching for it
+	issues = nil
+	edited = nil
+	input.Number = 4
+	_, err = Track(context.Background(), input, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"body": "report"}, edited)
+}